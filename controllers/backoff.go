@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// initialConfigurationBackoff is the duration an instance is not configured for after its first failed configuration
+// attempt. The duration doubles with each consecutive failure.
+const initialConfigurationBackoff = 10 * time.Second
+
+// configurationBackoff tracks the failed configuration attempts of each instance, so that an instance which repeatedly
+// fails to be configured is retried less aggressively, without delaying the configuration of the other instances. It is
+// safe for concurrent use.
+type configurationBackoff struct {
+	// initial is the backoff after the first failure of an instance
+	initial time.Duration
+	// max is the maximum backoff of an instance
+	max time.Duration
+	// hosts holds the backoff state of each instance which failed to be configured, keyed by address
+	hosts map[string]*hostBackoff
+	lock  sync.Mutex
+}
+
+// hostBackoff is the backoff state of an instance
+type hostBackoff struct {
+	// failures is the number of consecutive failed configuration attempts
+	failures int
+	// retryAt is the time the instance can be configured again at
+	retryAt time.Time
+}
+
+// newConfigurationBackoff returns a configurationBackoff with the given initial and maximum backoff
+func newConfigurationBackoff(initial, max time.Duration) *configurationBackoff {
+	return &configurationBackoff{initial: initial, max: max, hosts: make(map[string]*hostBackoff)}
+}
+
+// failed records a failed attempt to configure the instance with the given address at the given time, returning the
+// duration until the instance can be configured again
+func (b *configurationBackoff) failed(address string, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	host, present := b.hosts[address]
+	if !present {
+		host = &hostBackoff{}
+		b.hosts[address] = host
+	}
+	host.failures++
+	delay := b.initial
+	for i := 1; i < host.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	host.retryAt = now.Add(delay)
+	return delay
+}
+
+// succeeded clears the backoff of the instance with the given address
+func (b *configurationBackoff) succeeded(address string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.hosts, address)
+}
+
+// remaining returns the duration until the instance with the given address can be configured again, which is zero if
+// it can be configured at the given time
+func (b *configurationBackoff) remaining(address string, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	host, present := b.hosts[address]
+	if !present || !now.Before(host.retryAt) {
+		return 0
+	}
+	return host.retryAt.Sub(now)
+}
+
+// next returns the duration until the earliest time an instance which is backed off can be configured again, which is
+// zero if no instance is backed off at the given time
+func (b *configurationBackoff) next(now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var next time.Duration
+	for _, host := range b.hosts {
+		if wait := host.retryAt.Sub(now); wait > 0 && (next == 0 || wait < next) {
+			next = wait
+		}
+	}
+	return next
+}
+
+// prune clears the backoff of all instances other than the ones with the given addresses
+func (b *configurationBackoff) prune(addresses []string) {
+	current := make(map[string]struct{}, len(addresses))
+	for _, address := range addresses {
+		current[address] = struct{}{}
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for address := range b.hosts {
+		if _, present := current[address]; !present {
+			delete(b.hosts, address)
+		}
+	}
+}
+
+// retryAfterError is returned when instances failed to be configured, are backed off, or nodes are pending removal or
+// not Ready, indicating the duration after which the ConfigMap should be reconciled again
+type retryAfterError struct {
+	after time.Duration
+	err   error
+}
+
+func (e *retryAfterError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("instances are backed off, or nodes are pending removal or not Ready, retrying after %s",
+			e.after)
+	}
+	return fmt.Sprintf("retrying after %s: %v", e.after, e.err)
+}
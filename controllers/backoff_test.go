@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// TestConfigurationBackoff tests that consecutive failures of an instance result in increasing delays, up to the maximum
+// backoff, and that the backoff is cleared once the instance is configured
+func TestConfigurationBackoff(t *testing.T) {
+	b := newConfigurationBackoff(10*time.Second, time.Minute)
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), b.remaining("127.0.0.1", now))
+	assert.Equal(t, time.Duration(0), b.next(now))
+
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, b.failed("127.0.0.1", now))
+	}
+	assert.Equal(t, []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute},
+		delays)
+	assert.Equal(t, time.Minute, b.remaining("127.0.0.1", now))
+	assert.Equal(t, 30*time.Second, b.remaining("127.0.0.1", now.Add(30*time.Second)))
+	assert.Equal(t, time.Duration(0), b.remaining("127.0.0.1", now.Add(time.Minute)))
+
+	// Other instances are not delayed by a failing instance
+	assert.Equal(t, time.Duration(0), b.remaining("127.0.0.2", now))
+	b.failed("127.0.0.2", now)
+	assert.Equal(t, 10*time.Second, b.next(now))
+	assert.Equal(t, 50*time.Second, b.next(now.Add(10*time.Second)))
+
+	b.succeeded("127.0.0.1")
+	assert.Equal(t, time.Duration(0), b.remaining("127.0.0.1", now))
+	// The backoff starts over after a success
+	assert.Equal(t, 10*time.Second, b.failed("127.0.0.1", now))
+
+	// Instances which are no longer specified are no longer backed off
+	b.prune([]string{"127.0.0.2"})
+	assert.Equal(t, time.Duration(0), b.remaining("127.0.0.1", now))
+	assert.Equal(t, 10*time.Second, b.remaining("127.0.0.2", now))
+}
+
+// TestRetryAfterResult tests that a reconcile with backed off instances is retried once the earliest backoff expires
+func TestRetryAfterResult(t *testing.T) {
+	result, err := requeueResult(&retryAfterError{after: 20 * time.Second, err: errors.New("connection refused")})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: 20 * time.Second}, result)
+}
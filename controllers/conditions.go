@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// WindowsConfiguredCondition is the node condition reflecting the phase of the configuration of the Windows
+	// instance associated with a BYOH node
+	WindowsConfiguredCondition core.NodeConditionType = "WindowsConfigured"
+)
+
+// configurationPhase is the reason of the WindowsConfigured node condition
+type configurationPhase string
+
+const (
+	// phaseConfiguring indicates that the instance is being configured
+	phaseConfiguring configurationPhase = "Configuring"
+	// phaseConfigured indicates that the instance has been fully configured
+	phaseConfigured configurationPhase = "Configured"
+	// phaseFailed indicates that the last configuration attempt failed
+	phaseFailed configurationPhase = "Failed"
+	// phaseUpgrading indicates that the instance is being configured with a newer operator version
+	phaseUpgrading configurationPhase = "Upgrading"
+)
+
+// phaseMessages holds the human readable messages of the WindowsConfigured condition for each phase
+var phaseMessages = map[configurationPhase]string{
+	phaseConfiguring: "Windows instance is being configured",
+	phaseConfigured:  "Windows instance has been configured",
+	phaseFailed:      "Windows instance configuration failed",
+	phaseUpgrading:   "Windows instance is being upgraded",
+}
+
+// setConfigurationPhase sets the WindowsConfigured condition of the given node to reflect the given phase
+func (r *instanceReconciler) setConfigurationPhase(ctx context.Context, node *core.Node,
+	phase configurationPhase) error {
+	patchBase := client.StrategicMergeFrom(node.DeepCopy())
+	node.Status.Conditions = setConfiguredCondition(node.Status.Conditions, phase, meta.Now())
+	if err := r.client.Status().Patch(ctx, node, patchBase); err != nil {
+		return errors.Wrapf(err, "unable to set %s condition of node %s", WindowsConfiguredCondition,
+			node.GetName())
+	}
+	return nil
+}
+
+// setConfiguredCondition returns the given conditions with the WindowsConfigured condition set to reflect the given
+// phase. The transition time is only changed if the status of the condition changes.
+func setConfiguredCondition(conditions []core.NodeCondition, phase configurationPhase,
+	now meta.Time) []core.NodeCondition {
+	status := core.ConditionFalse
+	if phase == phaseConfigured {
+		status = core.ConditionTrue
+	}
+	condition := core.NodeCondition{
+		Type:               WindowsConfiguredCondition,
+		Status:             status,
+		LastHeartbeatTime:  now,
+		LastTransitionTime: now,
+		Reason:             string(phase),
+		Message:            phaseMessages[phase],
+	}
+	for i, existing := range conditions {
+		if existing.Type != WindowsConfiguredCondition {
+			continue
+		}
+		if existing.Status == status {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		conditions[i] = condition
+		return conditions
+	}
+	return append(conditions, condition)
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestSetConfiguredCondition tests the transitions of the WindowsConfigured condition through configuration cycles
+func TestSetConfiguredCondition(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	readyCondition := core.NodeCondition{Type: core.NodeReady, Status: core.ConditionTrue}
+
+	testCases := []struct {
+		name   string
+		phases []configurationPhase
+		// expectedStatus is the expected status of the condition after each phase
+		expectedStatus []core.ConditionStatus
+		// expectedTransition is the index of the phase at which the condition was expected to last transition
+		expectedTransition []int
+	}{
+		{
+			name:               "full configure cycle",
+			phases:             []configurationPhase{phaseConfiguring, phaseConfigured},
+			expectedStatus:     []core.ConditionStatus{core.ConditionFalse, core.ConditionTrue},
+			expectedTransition: []int{0, 1},
+		},
+		{
+			name:   "failed configure cycle followed by a successful one",
+			phases: []configurationPhase{phaseConfiguring, phaseFailed, phaseConfiguring, phaseConfigured},
+			expectedStatus: []core.ConditionStatus{core.ConditionFalse, core.ConditionFalse, core.ConditionFalse,
+				core.ConditionTrue},
+			expectedTransition: []int{0, 0, 0, 3},
+		},
+		{
+			name:   "reconfiguration and upgrade",
+			phases: []configurationPhase{phaseConfigured, phaseConfiguring, phaseConfigured, phaseUpgrading},
+			expectedStatus: []core.ConditionStatus{core.ConditionTrue, core.ConditionFalse, core.ConditionTrue,
+				core.ConditionFalse},
+			expectedTransition: []int{0, 1, 2, 3},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			conditions := []core.NodeCondition{readyCondition}
+			for i, phase := range test.phases {
+				now := meta.NewTime(start.Add(time.Duration(i) * time.Minute))
+				conditions = setConfiguredCondition(conditions, phase, now)
+
+				require.Len(t, conditions, 2)
+				assert.Equal(t, readyCondition, conditions[0])
+				condition := conditions[1]
+				assert.Equal(t, WindowsConfiguredCondition, condition.Type)
+				assert.Equal(t, test.expectedStatus[i], condition.Status)
+				assert.Equal(t, string(phase), condition.Reason)
+				assert.Equal(t, now, condition.LastHeartbeatTime)
+				assert.Equal(t, meta.NewTime(start.Add(time.Duration(test.expectedTransition[i])*time.Minute)),
+					condition.LastTransitionTime)
+			}
+		})
+	}
+}
@@ -18,17 +18,28 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
+	"golang.org/x/mod/semver"
 	core "k8s.io/api/core/v1"
 	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeTypes "k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
@@ -40,13 +51,18 @@ import (
 	"github.com/openshift/windows-machine-config-operator/pkg/instances"
 	"github.com/openshift/windows-machine-config-operator/pkg/metrics"
 	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/notify"
 	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
 	"github.com/openshift/windows-machine-config-operator/pkg/signer"
+	"github.com/openshift/windows-machine-config-operator/pkg/tracing"
+	"github.com/openshift/windows-machine-config-operator/pkg/windows"
+	"github.com/openshift/windows-machine-config-operator/version"
 )
 
 //+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups="",resources=configmaps/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups="",resources=configmaps/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=nodes/status,verbs=get;update;patch
 
 const (
 	// BYOHAnnotation is an an anotation that should be applied to all Windows nodes not associated with a Machine.
@@ -56,15 +72,197 @@ const (
 	// InstanceConfigMap is the name of the ConfigMap where VMs to be configured should be described.
 	// TODO: Possibly make this a singleton that WMCO creates https://issues.redhat.com/browse/WINC-612
 	InstanceConfigMap = "windows-instances"
+	// InstancesLabel is a ConfigMap label which, when set to "true", causes the ConfigMap to describe instances in the
+	// same way as the windows-instances ConfigMap. The instances of all such ConfigMaps are configured together, and an
+	// address can only be described by one of them.
+	InstancesLabel = "windowsmachineconfig.openshift.io/instances"
+	// SSHPortAnnotation is a node annotation that contains the port used to SSH into the Windows instance
+	SSHPortAnnotation = "windowsmachineconfig.openshift.io/ssh-port"
+	// AuthSecretAnnotation is a node annotation that contains the name of the secret holding the password used to log
+	// into the Windows instance. It is empty if only key based authentication is used.
+	AuthSecretAnnotation = "windowsmachineconfig.openshift.io/auth-secret"
+	// SkipDNSValidationAnnotation is an annotation of the windows-instances ConfigMap which, when set to "true", causes
+	// DNS names in the ConfigMap to be accepted without being looked up, for environments in which the operator can
+	// reach instances which are not resolvable through DNS
+	SkipDNSValidationAnnotation = "windowsmachineconfig.openshift.io/skip-dns-validation"
+	// MachineAnnotation is the annotation applied by the Machine API to nodes backed by a Machine
+	MachineAnnotation = "machine.openshift.io/machine"
+	// DefaultIgnoreLabel is the default node label which, when set to "true", exempts a BYOH node from being managed
+	DefaultIgnoreLabel = "windowsmachineconfig.openshift.io/ignore"
+	// InstanceConfigMapFinalizer is the finalizer of the windows-instances ConfigMap, which prevents it from being
+	// deleted until all BYOH nodes have been removed from the cluster
+	InstanceConfigMapFinalizer = "windowsmachineconfig.openshift.io/byoh-cleanup"
+	// PendingRemovalAnnotation is a node annotation that contains the time, in RFC 3339 format, at which the instance
+	// associated with the BYOH node was found to be missing from the instance ConfigMaps. The node is removed once the
+	// removal grace period has elapsed since then, unless the instance is described again before.
+	PendingRemovalAnnotation = "windowsmachineconfig.openshift.io/pending-removal"
+	// BastionAnnotation is a node annotation that contains the <address>:<port> of the bastion SSH connections to the
+	// Windows instance are tunneled through. It is empty if the instance is connected to directly.
+	BastionAnnotation = "windowsmachineconfig.openshift.io/bastion"
+	// ZoneAnnotation is a node annotation that contains the zone of the IPv6 link-local address the Windows instance is
+	// reached at, such as eth0 for fe80::1%eth0, as the node addresses do not include it. It is empty if the address
+	// does not have a zone.
+	ZoneAnnotation = "windowsmachineconfig.openshift.io/zone"
+	// ForceReconfigureAnnotation is a node annotation which, when set to "true", causes the instance associated with
+	// the BYOH node to be deconfigured and configured again, even if it is up to date. The annotation is removed once
+	// the instance has been configured again.
+	ForceReconfigureAnnotation = "windowsmachineconfig.openshift.io/force-reconfigure"
+	// SkipDeconfigureAnnotation is a node annotation which, when set to "true", causes the BYOH node to be deleted
+	// without draining it or deconfiguring its instance once the instance is removed from the ConfigMap, for instances
+	// which are decommissioned separately
+	SkipDeconfigureAnnotation = "windowsmachineconfig.openshift.io/skip-deconfigure"
+	// ServiceCIDRAnnotation is a node annotation that contains the service CIDR the CNI configuration of the BYOH node
+	// was generated with, so that the node is configured again when the cluster service CIDR changes
+	ServiceCIDRAnnotation = "windowsmachineconfig.openshift.io/service-cidr"
 )
 
+const (
+	// usernameKey is the key within an instance entry of the ConfigMap that holds the username
+	usernameKey = "username"
+	// sshPortKey is the key within an instance entry of the ConfigMap that holds the port the SSH server of the
+	// instance listens on
+	sshPortKey = "sshPort"
+	// shutdownGracePeriodKey is the key within an instance entry of the ConfigMap that overrides the kubelet shutdown
+	// grace period
+	shutdownGracePeriodKey = "shutdownGracePeriod"
+	// shutdownGracePeriodCriticalPodsKey is the key within an instance entry of the ConfigMap that overrides the
+	// kubelet shutdown grace period for critical pods
+	shutdownGracePeriodCriticalPodsKey = "shutdownGracePeriodCriticalPods"
+	// featureGatesKey is the key within an instance entry of the ConfigMap that holds additional kubelet feature gates
+	// as a semicolon separated list of <name>=<bool> pairs
+	featureGatesKey = "featureGates"
+	// imageGCHighThresholdPercentKey is the key within an instance entry of the ConfigMap that overrides the kubelet
+	// image garbage collection high threshold
+	imageGCHighThresholdPercentKey = "imageGCHighThresholdPercent"
+	// imageGCLowThresholdPercentKey is the key within an instance entry of the ConfigMap that overrides the kubelet
+	// image garbage collection low threshold
+	imageGCLowThresholdPercentKey = "imageGCLowThresholdPercent"
+	// dnsSearchDomainsKey is the key within an instance entry of the ConfigMap that holds the DNS search domains as a
+	// semicolon separated list
+	dnsSearchDomainsKey = "dnsSearchDomains"
+	// bootstrapKubeconfigSecretKey is the key within an instance entry of the ConfigMap that holds the name of the
+	// secret containing the kubeconfig the instance should bootstrap the kubelet with
+	bootstrapKubeconfigSecretKey = "bootstrapKubeconfigSecret"
+	// topologyLabelsKey is the key within an instance entry of the ConfigMap that holds the topology labels of the
+	// node as a semicolon separated list of <label>=<value> pairs
+	topologyLabelsKey = "topologyLabels"
+	// labelsKey is the key within an instance entry of the ConfigMap that holds the custom labels of the node as a
+	// semicolon separated list of <label>:<value> pairs
+	labelsKey = "labels"
+	// taintsKey is the key within an instance entry of the ConfigMap that holds the taints of the node as a semicolon
+	// separated list of <key>=<value>:<effect> entries, where the value is optional
+	taintsKey = "taints"
+	// authSecretKey is the key within an instance entry of the ConfigMap that holds the name of the secret containing
+	// the password used to authenticate against the instance
+	authSecretKey = "authSecret"
+	// credentialSecretKey is the key within an instance entry of the ConfigMap that holds the name of the secret
+	// containing the private key used to authenticate against the instance, instead of the private key secret
+	credentialSecretKey = "credentialSecret"
+	// bastionKey is the key within an instance entry of the ConfigMap that holds the <address>[:<port>] of the bastion
+	// SSH connections to the instance are tunneled through, instead of the bastion set through the operator flags
+	bastionKey = "bastion"
+	// serviceCIDRKey is the key within an instance entry of the ConfigMap that holds the CIDR used as the service CIDR
+	// in the CNI configuration of the instance, instead of the cluster service CIDR
+	serviceCIDRKey = "serviceCIDR"
+	// natExceptionsKey is the key within an instance entry of the ConfigMap that holds the CIDRs excluded from outbound
+	// NAT on the instance in addition to the service CIDR, as a semicolon separated list
+	natExceptionsKey = "natExceptions"
+)
+
+const (
+	// defaultDNSCacheTTL is the default duration successful DNS lookups of ConfigMap entries are reused for
+	defaultDNSCacheTTL = time.Minute
+	// defaultNotReadyGracePeriod is the default duration a configured node can be NotReady for before its instance is
+	// configured again
+	defaultNotReadyGracePeriod = 5 * time.Minute
+	// privateKeyMissingRequeueInterval is the interval the ConfigMap is reconciled at while instances are waiting for
+	// the private key secret to be created. The creation of the secret also triggers a reconcile.
+	privateKeyMissingRequeueInterval = 5 * time.Minute
+	// nodeReadinessRequeueInterval is the interval the ConfigMap is reconciled at while configured instances do not have
+	// a Ready node, so that their nodes are added to the Prometheus endpoints once they become Ready
+	nodeReadinessRequeueInterval = 30 * time.Second
+	// reachabilityTimeout is the duration the SSH port of an instance is probed for before the instance is considered
+	// unreachable
+	reachabilityTimeout = 5 * time.Second
+)
+
+// errPrivateKeyMissing is returned by reconcileNodes when the only reason for instances not being configured is that
+// the private key secret does not exist
+var errPrivateKeyMissing = errors.New("private key secret does not exist")
+
 // ConfigMapReconciler reconciles a ConfigMap object
 type ConfigMapReconciler struct {
 	instanceReconciler
+	// strictNodeCount causes a reconcile to fail when the number of Ready BYOH nodes does not match the number of
+	// configured instances. Otherwise the mismatch is only reported.
+	strictNodeCount bool
+	// removeUnresolvableHosts causes ConfigMap entries with a DNS name which no longer resolves to be treated as
+	// removed, instead of failing the reconcile
+	removeUnresolvableHosts bool
+	// allowedCIDRs are the networks the addresses of instances must be within. All addresses are allowed if empty.
+	allowedCIDRs []*net.IPNet
+	// deniedCIDRs are the networks the addresses of instances cannot be within
+	deniedCIDRs []*net.IPNet
+	// instanceConfigMap is the name of the ConfigMap describing instances, in addition to the labeled ConfigMaps
+	instanceConfigMap string
+	// restoreConfigMap causes the windows-instances ConfigMap to be recreated from the existing BYOH nodes if it is
+	// deleted
+	restoreConfigMap bool
+	// dryRun causes the actions which would be taken on instances and nodes to be reported instead of being taken
+	dryRun bool
+	// ignoreLabel is the node label which, when set to "true", causes a BYOH node to be neither configured nor removed
+	ignoreLabel string
+	// allowDowngrade permits nodes configured by a newer operator version to be configured again
+	allowDowngrade bool
+	// maxUnavailable is the maximum number of BYOH nodes which can be unavailable at once while nodes are upgraded,
+	// unless overridden by the ConfigMap
+	maxUnavailable int
+	// configurationWorkers is the number of instances which are configured concurrently
+	configurationWorkers int
+	// checkReachability causes the SSH port of an instance to be probed before the instance is configured
+	checkReachability bool
+	// resyncInterval is the interval the ConfigMap is reconciled at in the absence of events. 0 disables the periodic
+	// reconcile.
+	resyncInterval time.Duration
+	// minOSVersion is the minimum version of Windows instances must be running to be configured. The version is not
+	// checked if it is empty.
+	minOSVersion string
+	// removalGracePeriod is the duration a BYOH node whose instance is missing from the instance ConfigMaps is kept for
+	// before it is removed. Nodes are removed as soon as their instance is missing if it is 0.
+	removalGracePeriod time.Duration
+	// removalDeadline is the earliest time the grace period of a node pending removal elapses at, which is zero if no
+	// node is pending removal. It is set by each reconcile of the instances.
+	removalDeadline time.Time
+	// status holds the instanceStatus of the ConfigMap describing each instance during a reconcile, keyed by address
+	status map[string]*instanceStatus
+	// backoff delays the configuration of instances which repeatedly fail to be configured
+	backoff *configurationBackoff
+	// notReadyGracePeriod is the duration a configured node can be NotReady for before its instance is configured
+	// again. Nodes are never reconfigured for being NotReady if it is 0.
+	notReadyGracePeriod time.Duration
+	// dnsCacheTTL is the duration successful DNS lookups of ConfigMap entries are reused for. Caching is disabled if it
+	// is 0.
+	dnsCacheTTL time.Duration
+	// dnsCache holds the results of successful DNS lookups, keyed by hostname
+	dnsCache map[string]dnsCacheEntry
+	// dnsCacheLock guards dnsCache
+	dnsCacheLock sync.Mutex
+	// signerErr is the error encountered creating the signer from the private key secret. Instances which do not
+	// reference an auth secret cannot be configured while it is set, and are rejected unless the secret does not exist.
+	signerErr error
+}
+
+// dnsCacheEntry is the cached result of a DNS lookup
+type dnsCacheEntry struct {
+	// addresses are the addresses the hostname resolved to
+	addresses []string
+	// expiry is the time after which the entry can no longer be used
+	expiry time.Time
 }
 
 // NewConfigMapReconciler returns a pointer to a ConfigMapReconciler
-func NewConfigMapReconciler(mgr manager.Manager, clusterConfig cluster.Config, watchNamespace string) (*ConfigMapReconciler, error) {
+func NewConfigMapReconciler(mgr manager.Manager, clusterConfig cluster.Config, watchNamespace string,
+	opts Options) (*ConfigMapReconciler, error) {
 	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating kubernetes clientset")
@@ -82,10 +280,40 @@ func NewConfigMapReconciler(mgr manager.Manager, clusterConfig cluster.Config, w
 			clusterServiceCIDR:   clusterConfig.Network().GetServiceCIDR(),
 			log:                  ctrl.Log.WithName("controllers").WithName("ConfigMap"),
 			watchNamespace:       watchNamespace,
-			recorder:             mgr.GetEventRecorderFor("configmap"),
-			vxlanPort:            clusterConfig.Network().VXLANPort(),
+			recorder:             notify.NewRecorder(mgr.GetEventRecorderFor("configmap"), opts.Webhook),
+			vxlanPort:            vxlanPort(clusterConfig, opts),
 			prometheusNodeConfig: pc,
+			kubeletConfig:        opts.KubeletConfig,
+			dnsSearchDomains:     opts.DNSSearchDomains,
+			sshSessionLimit:      opts.SSHSessionLimit,
+			sshDialTimeout:       opts.SSHDialTimeout,
+			sshCommandTimeout:    opts.SSHCommandTimeout,
+			hostLocks:            activeHosts,
+			metadataAnnotations:  opts.HostMetadataAnnotations,
+			bastion:              opts.Bastion,
+			proxy:                clusterConfig.Proxy(),
+			ipFamily:             clusterConfig.Network().IPFamily(),
+			drainTimeout:         opts.DrainTimeout,
 		},
+		strictNodeCount:         opts.StrictNodeCount,
+		removeUnresolvableHosts: opts.RemoveUnresolvableHosts,
+		allowedCIDRs:            opts.AllowedCIDRs,
+		deniedCIDRs:             opts.DeniedCIDRs,
+		instanceConfigMap:       instanceConfigMapName(opts),
+		restoreConfigMap:        opts.RestoreConfigMap,
+		dryRun:                  opts.DryRun,
+		ignoreLabel:             opts.IgnoreLabel,
+		allowDowngrade:          opts.AllowDowngrade,
+		maxUnavailable:          opts.MaxUnavailable,
+		configurationWorkers:    opts.ConfigurationWorkers,
+		checkReachability:       opts.CheckReachability,
+		resyncInterval:          opts.ResyncInterval,
+		removalGracePeriod:      opts.RemovalGracePeriod,
+		minOSVersion:            opts.MinOSVersion,
+		backoff:                 newConfigurationBackoff(initialConfigurationBackoff, opts.MaxConfigurationBackoff),
+		notReadyGracePeriod:     defaultNotReadyGracePeriod,
+		dnsCacheTTL:             defaultDNSCacheTTL,
+		dnsCache:                make(map[string]dnsCacheEntry),
 	}, nil
 }
 
@@ -93,205 +321,2067 @@ func NewConfigMapReconciler(mgr manager.Manager, clusterConfig cluster.Config, w
 // move the current state of the cluster closer to the desired state.
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.7.2/pkg/reconcile
-func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	_ = r.log.WithValues("configmap", req.NamespacedName)
+func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, reterr error) {
+	log := r.log.WithValues("configmap", req.NamespacedName)
+	start := time.Now()
+	// The errors of instances retried with their own backoff are not returned to the controller, but are still
+	// observed as failures of the reconcile
+	var observedErr error
+	defer func() {
+		if reterr != nil {
+			observedErr = reterr
+		}
+		metrics.ObserveConfigMapReconcile(time.Since(start), observedErr)
+	}()
 
-	var err error
-	// Create a new signer using the private key that the instances will be configured with
-	r.signer, err = signer.Create(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+	// Create a new signer using the private key that the instances will be configured with. The private key is not
+	// required when all instances reference an auth or credential secret, which is checked when parsing the ConfigMap.
+	r.signer, r.signerErr = signer.Create(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
 		Name: secrets.PrivateKeySecret}, r.client)
+	if r.signerErr != nil {
+		r.signerErr = errors.Wrap(r.signerErr, "unable to create signer from private key secret")
+		log.Info("private key is unusable, only instances with an auth or credential secret can be configured",
+			"error", r.signerErr)
+	}
+	// Credential secrets are read again on each reconcile, so that changes to them are picked up
+	r.credentialSigners = newSignerCache()
+
+	// All instance ConfigMaps are reconciled together, regardless of which of them the request is for, as the
+	// BYOH nodes which are no longer desired can only be determined from the instances described by all of them
+	configMaps, err := r.getInstanceConfigMaps(ctx)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	// A ConfigMap whose label was removed no longer describes instances, and is finalized in the same way as a
+	// ConfigMap being deleted
+	released, err := r.getReleasedConfigMap(ctx, req.NamespacedName)
 	if err != nil {
-		return ctrl.Result{}, errors.Wrapf(err, "unable to create signer from private key secret")
+		return ctrl.Result{}, err
+	}
+	var live, deleting []*core.ConfigMap
+	if released != nil {
+		deleting = append(deleting, released)
+	}
+	for _, configMap := range configMaps {
+		if configMap.GetDeletionTimestamp().IsZero() {
+			live = append(live, configMap)
+		} else {
+			deleting = append(deleting, configMap)
+		}
+	}
+	if len(live) == 0 {
+		for _, configMap := range deleting {
+			if err := r.finalizeInstanceConfigMap(ctx, configMap); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		if len(deleting) != 0 {
+			return ctrl.Result{}, nil
+		}
+		if r.restoreConfigMap && !r.dryRun {
+			return ctrl.Result{}, r.restoreInstanceConfigMap(ctx,
+				kubeTypes.NamespacedName{Namespace: r.watchNamespace, Name: r.instanceConfigMap})
+		}
+		// No instances are desired once all the ConfigMaps are deleted
+		metrics.SetBYOHInstancesDesired(0)
+		metrics.SetBYOHNodeProgress(nil, 0)
+		metrics.PruneInstanceConfigFailures(nil)
+		metrics.SetConfigMapObservedGeneration(nil)
+		return ctrl.Result{}, nil
+	}
+	for _, configMap := range live {
+		if err := r.ensureFinalizer(ctx, configMap); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	err = r.reconcileNodes(ctx, live, log)
+	// The nodes of the instances described by a ConfigMap being deleted, while other ConfigMaps remain, are removed
+	// by reconciling the remaining ConfigMaps, after which its deletion can complete
+	if err == nil {
+		for _, configMap := range deleting {
+			if err := r.removeFinalizer(ctx, configMap); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 	}
+	observedErr = reconcileFailure(err)
+	result, err := requeueResult(err)
+	return r.withResync(result), err
+}
+
+// getInstanceConfigMaps returns the ConfigMaps in the watch namespace describing instances, which are the
+// windows-instances ConfigMap, or the ConfigMap with the configured name, and the ConfigMaps labeled with
+// InstancesLabel. The named ConfigMap comes first, followed by the labeled ConfigMaps sorted by name.
+func (r *ConfigMapReconciler) getInstanceConfigMaps(ctx context.Context) ([]*core.ConfigMap, error) {
+	var configMaps []*core.ConfigMap
+	configMap := &core.ConfigMap{}
+	err := r.client.Get(ctx, kubeTypes.NamespacedName{Namespace: r.watchNamespace, Name: r.instanceConfigMap},
+		configMap)
+	if err == nil {
+		configMaps = append(configMaps, configMap)
+	} else if !k8sapierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(err, "error getting ConfigMap %s", r.instanceConfigMap)
+	}
+	labeled := &core.ConfigMapList{}
+	if err := r.client.List(ctx, labeled, client.InNamespace(r.watchNamespace),
+		client.MatchingLabels{InstancesLabel: "true"}); err != nil {
+		return nil, errors.Wrap(err, "error listing instance ConfigMaps")
+	}
+	sort.Slice(labeled.Items, func(i, j int) bool { return labeled.Items[i].GetName() < labeled.Items[j].GetName() })
+	for i := range labeled.Items {
+		// Labeled ConfigMaps of other operators watching the namespace are left to them
+		if labeled.Items[i].GetName() != r.instanceConfigMap && r.owns(&labeled.Items[i]) {
+			configMaps = append(configMaps, &labeled.Items[i])
+		}
+	}
+	return configMaps, nil
+}
 
-	// Fetch the ConfigMap. The predicate will have filtered out any ConfigMaps that we should not reconcile
-	// so it is safe to assume that all ConfigMaps being reconciled describe hosts that need to be present in the
-	// cluster.
+// getReleasedConfigMap returns the ConfigMap with the given name if it still has the finalizer, despite no longer
+// describing instances. nil is returned otherwise.
+func (r *ConfigMapReconciler) getReleasedConfigMap(ctx context.Context,
+	name kubeTypes.NamespacedName) (*core.ConfigMap, error) {
+	if name.Namespace != r.watchNamespace || name.Name == r.instanceConfigMap {
+		return nil, nil
+	}
 	configMap := &core.ConfigMap{}
-	if err := r.client.Get(ctx, req.NamespacedName, configMap); err != nil {
+	if err := r.client.Get(ctx, name, configMap); err != nil {
 		if k8sapierrors.IsNotFound(err) {
-			// Request object not found, could have been deleted after reconcile request.
-			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
-			// Return and don't requeue
-			return ctrl.Result{}, nil
+			return nil, nil
 		}
-		// Error reading the object - requeue the request.
-		return ctrl.Result{}, err
+		return nil, errors.Wrapf(err, "error getting ConfigMap %s", name)
+	}
+	if r.isInstanceConfigMap(configMap) ||
+		!controllerutil.ContainsFinalizer(configMap, InstanceConfigMapFinalizer) {
+		return nil, nil
 	}
+	return configMap, nil
+}
 
-	return ctrl.Result{}, r.reconcileNodes(ctx, configMap)
+// isInstanceConfigMap returns true if the given object is a ConfigMap in the watch namespace describing instances
+// managed by this operator
+func (r *ConfigMapReconciler) isInstanceConfigMap(object client.Object) bool {
+	return object.GetNamespace() == r.watchNamespace && (object.GetName() == r.instanceConfigMap ||
+		(object.GetLabels()[InstancesLabel] == "true" && r.owns(object)))
 }
 
-// parseHosts gets the lists of hosts specified in the configmap's data
-func (r *ConfigMapReconciler) parseHosts(configMapData map[string]string) ([]*instances.InstanceInfo, error) {
-	hosts := make([]*instances.InstanceInfo, 0)
-	// Get information about the hosts from each entry. The expected key/value format for each entry is:
-	// <address>: username=<username>
-	for address, data := range configMapData {
-		if err := validateAddress(address); err != nil {
-			return nil, errors.Wrapf(err, "invalid address %s", address)
-		}
-		splitData := strings.SplitN(data, "=", 2)
-		if len(splitData) == 0 || splitData[0] != "username" {
-			return hosts, errors.Errorf("data for entry %s has an incorrect format", address)
+// owns returns true if the given node or labeled ConfigMap is managed by this operator, rather than by another operator
+// watching the same namespace with a distinct instance ConfigMap, as recorded by its OperatorLabel. Objects without
+// the label are managed by the operator using the windows-instances ConfigMap.
+func (r *ConfigMapReconciler) owns(object client.Object) bool {
+	operator, present := object.GetLabels()[OperatorLabel]
+	if !present {
+		return r.instanceConfigMap == InstanceConfigMap
+	}
+	return operator == r.instanceConfigMap
+}
+
+// listNodes lists the Windows nodes into the given list, leaving out the nodes managed by other operators watching the
+// same namespace, so that they are neither configured nor removed by this operator
+func (r *ConfigMapReconciler) listNodes(ctx context.Context, nodes *core.NodeList) error {
+	if err := r.client.List(ctx, nodes, windowsNodeLabels); err != nil {
+		return err
+	}
+	owned := nodes.Items[:0]
+	for _, node := range nodes.Items {
+		if r.owns(&node) {
+			owned = append(owned, node)
 		}
+	}
+	nodes.Items = owned
+	return nil
+}
 
-		hosts = append(hosts, instances.NewInstanceInfo(address, splitData[1], ""))
+// ensureFinalizer adds the finalizer to the given ConfigMap, so that all BYOH nodes are removed before it is deleted.
+// The finalizer is not added if the ConfigMap is restored on deletion, as the BYOH nodes are kept in that case.
+func (r *ConfigMapReconciler) ensureFinalizer(ctx context.Context, configMap *core.ConfigMap) error {
+	if r.restoreConfigMap || r.dryRun || controllerutil.ContainsFinalizer(configMap, InstanceConfigMapFinalizer) {
+		return nil
 	}
-	return hosts, nil
+	patchBase := client.MergeFrom(configMap.DeepCopy())
+	controllerutil.AddFinalizer(configMap, InstanceConfigMapFinalizer)
+	return errors.Wrapf(r.client.Patch(ctx, configMap, patchBase), "unable to add finalizer to ConfigMap %s",
+		configMap.GetName())
 }
 
-// validateAddress checks that the given address is either an ipv4 address, or resolves to any ip address
-func validateAddress(address string) error {
-	// first check if address is an IP address
-	if parsedAddr := net.ParseIP(address); parsedAddr != nil {
-		if parsedAddr.To4() != nil {
-			return nil
+// finalizeInstanceConfigMap removes all BYOH nodes from the cluster, as no instances are desired once the given
+// ConfigMap, which is the last remaining instance ConfigMap, is deleted, and then removes the finalizer from it,
+// allowing the deletion to complete. If the ConfigMap is restored on deletion, the nodes are kept.
+func (r *ConfigMapReconciler) finalizeInstanceConfigMap(ctx context.Context, configMap *core.ConfigMap) error {
+	if !controllerutil.ContainsFinalizer(configMap, InstanceConfigMapFinalizer) {
+		return nil
+	}
+	metrics.SetBYOHInstancesDesired(0)
+	metrics.SetBYOHNodeProgress(nil, 0)
+	metrics.PruneInstanceConfigFailures(nil)
+	metrics.SetConfigMapObservedGeneration(nil)
+	if !r.restoreConfigMap {
+		nodes := &core.NodeList{}
+		if err := r.listNodes(ctx, nodes); err != nil {
+			return errors.Wrap(err, "error listing nodes")
+		}
+		if err := r.deconfigureInstances(ctx, configMap, nil, nodes); err != nil {
+			return errors.Wrap(err, "error removing BYOH nodes from cluster")
+		}
+		if !r.dryRun {
+			r.log.Info("removed all BYOH nodes from the cluster as the ConfigMap is being deleted")
 		}
-		// if the address parses into an IP but is not ipv4 it must be ipv6
-		return errors.Errorf("ipv6 is not supported")
 	}
-	// Do a check that the DNS provided is valid
-	addressList, err := net.LookupHost(address)
-	if err != nil {
-		return errors.Wrapf(err, "error looking up DNS")
+	return r.removeFinalizer(ctx, configMap)
+}
+
+// removeFinalizer removes the finalizer from the given ConfigMap, allowing its deletion to complete. The finalizer is
+// kept in dry-run mode, as the nodes it protects have not been removed.
+func (r *ConfigMapReconciler) removeFinalizer(ctx context.Context, configMap *core.ConfigMap) error {
+	if r.dryRun || !controllerutil.ContainsFinalizer(configMap, InstanceConfigMapFinalizer) {
+		return nil
 	}
-	if len(addressList) == 0 {
-		return errors.Errorf("DNS did not resolve to an address")
+	patchBase := client.MergeFrom(configMap.DeepCopy())
+	controllerutil.RemoveFinalizer(configMap, InstanceConfigMapFinalizer)
+	return errors.Wrapf(r.client.Patch(ctx, configMap, patchBase), "unable to remove finalizer from ConfigMap %s",
+		configMap.GetName())
+}
+
+// requeueResult returns the result of a reconcile which failed with the given error. Waiting for the private key
+// secret to be created is not treated as a failure, as it requires action from the cluster administrator, and the
+// reconcile is instead retried at a fixed interval, rather than with a backoff which quickly retries it.
+func requeueResult(err error) (ctrl.Result, error) {
+	if err == errPrivateKeyMissing {
+		return ctrl.Result{RequeueAfter: privateKeyMissingRequeueInterval}, nil
 	}
-	return nil
+	// Instances which failed to be configured are retried with their own backoff
+	var raErr *retryAfterError
+	if errors.As(err, &raErr) {
+		return ctrl.Result{RequeueAfter: raErr.after}, nil
+	}
+	return ctrl.Result{}, err
 }
 
-// reconcileNodes corrects the discrepancy between the "expected" hosts slice, and the "actual" nodelist
-func (r *ConfigMapReconciler) reconcileNodes(ctx context.Context, instances *core.ConfigMap) error {
-	// Get the list of instances that are expected to be Nodes
-	hosts, err := r.parseHosts(instances.Data)
-	if err != nil {
-		return errors.Wrapf(err, "unable to parse hosts from configmap")
+// reconcileFailure returns the error a reconcile which ended with the given error failed with, nil if it did not fail.
+// The errors of instances retried with their own backoff are failures, even though requeueResult does not return
+// them, while waiting for the private key secret to be created is not.
+func reconcileFailure(err error) error {
+	var raErr *retryAfterError
+	if errors.As(err, &raErr) {
+		err = raErr.err
+	}
+	if err == errPrivateKeyMissing {
+		return nil
 	}
+	return err
+}
+
+// withResync returns the given result, requeued after the resync interval if it is not requeued any sooner. Only a
+// single requeue of the ConfigMap is pending at any time, as the work queue keeps the earliest of the requeues of an
+// object, so reconciles triggered by events do not result in additional periodic reconciles.
+func (r *ConfigMapReconciler) withResync(result ctrl.Result) ctrl.Result {
+	if r.resyncInterval <= 0 || result.Requeue {
+		return result
+	}
+	if result.RequeueAfter == 0 || result.RequeueAfter > r.resyncInterval {
+		result.RequeueAfter = r.resyncInterval
+	}
+	return result
+}
 
+// restoreInstanceConfigMap recreates the ConfigMap with the given name, describing the instances associated with the
+// existing BYOH nodes. Nothing is done if there are no BYOH nodes.
+func (r *ConfigMapReconciler) restoreInstanceConfigMap(ctx context.Context, name kubeTypes.NamespacedName) error {
 	nodes := &core.NodeList{}
-	if err := r.client.List(ctx, nodes); err != nil {
+	if err := r.listNodes(ctx, nodes); err != nil {
 		return errors.Wrap(err, "error listing nodes")
 	}
+	data := configMapDataFromNodes(nodes, r.ipFamily)
+	if len(data) == 0 {
+		return nil
+	}
+	configMap := &core.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{Name: name.Name, Namespace: name.Namespace},
+		Data:       data,
+	}
+	if err := r.client.Create(ctx, configMap); err != nil {
+		return errors.Wrapf(err, "unable to restore ConfigMap %s", name)
+	}
+	r.log.Info("restored ConfigMap from existing nodes", "configmap", name, "instances", len(data))
+	r.recorder.Eventf(configMap, core.EventTypeWarning, "ConfigMapRestored",
+		"ConfigMap was deleted while BYOH nodes existed, restored %d instances from the existing nodes", len(data))
+	return nil
+}
 
-	// For each host, ensure that it is configured into a node. On error of any host joining, return error and requeue.
-	// It is better to return early like this, instead of trying to configure as many nodes as possible in a single
-	// reconcile call, as it simplifies error collection. The order the map is read from is psuedo-random, so the
-	// configuration effort for configurable hosts will not be blocked by a specific host that has issues with
-	// configuration.
-	for _, host := range hosts {
-		err := r.ensureInstanceIsConfigured(host, nodes)
+// configMapDataFromNodes returns ConfigMap data describing the instances associated with the BYOH nodes in the given
+// list, using an address supported by the given cluster IP family and the username of each node. Only the username, SSH
+// port, auth secret, credential secret, bastion and address zone are restored for each instance.
+func configMapDataFromNodes(nodes *core.NodeList, ipFamily cluster.IPFamily) map[string]string {
+	data := make(map[string]string)
+	for _, node := range nodes.Items {
+		if !isBYOHNode(&node) || node.Annotations[UsernameAnnotation] == "" {
+			continue
+		}
+		address, err := getAddress(node.Status.Addresses, ipFamily)
 		if err != nil {
-			r.recorder.Eventf(instances, core.EventTypeWarning, "InstanceSetupFailure",
-				"unable to join instance with address %s to the cluster", host.Address)
-			return errors.Wrapf(err, "error configuring host with address %s", host.Address)
+			continue
+		}
+		address = withZone(address, node.Annotations[ZoneAnnotation])
+		data[address] = usernameKey + "=" + node.Annotations[UsernameAnnotation]
+		if port := node.Annotations[SSHPortAnnotation]; port != "" && port != strconv.Itoa(windows.DefaultSSHPort) {
+			data[address] += "," + sshPortKey + "=" + port
+		}
+		if authSecret := node.Annotations[AuthSecretAnnotation]; authSecret != "" {
+			data[address] += "," + authSecretKey + "=" + authSecret
+		}
+		if credentialSecret := node.Annotations[CredentialSecretAnnotation]; credentialSecret != "" {
+			data[address] += "," + credentialSecretKey + "=" + credentialSecret
+		}
+		if bastion := node.Annotations[BastionAnnotation]; bastion != "" {
+			data[address] += "," + bastionKey + "=" + bastion
 		}
 	}
+	return data
+}
 
-	// Ensure that only instances currently specified by the ConfigMap are joined to the cluster as nodes
-	if err = r.deconfigureInstances(hosts, nodes); err != nil {
-		return errors.Wrap(err, "error removing undesired nodes from cluster")
+// parseHosts gets the lists of hosts specified in the configmap's data. If removeUnresolvableHosts is set, entries with
+// a DNS name which no longer resolves are left out of the returned hosts, and their addresses are returned separately.
+// If skipDNSValidation is set, DNS names are accepted without being looked up. Whitespace surrounding the address of
+// an entry is ignored, and entries with an address starting with # are skipped as comments. If any entry is invalid,
+// an aggregate of the errors of all invalid entries is returned.
+func (r *ConfigMapReconciler) parseHosts(configMapData map[string]string,
+	skipDNSValidation bool) ([]*instances.InstanceInfo, []string, error) {
+	hosts := make([]*instances.InstanceInfo, 0)
+	var unresolvable []string
+	// All invalid entries are reported at once, in a consistent order
+	addresses := make([]string, 0, len(configMapData))
+	// data holds the data of each entry by trimmed address
+	data := make(map[string]string, len(configMapData))
+	var errs []error
+	for key, value := range configMapData {
+		address := strings.TrimSpace(key)
+		if strings.HasPrefix(address, "#") {
+			continue
+		}
+		if _, present := data[address]; present {
+			errs = append(errs, &ParseError{Address: address, Reason: ParseErrorDuplicateAddress,
+				Err: errors.Errorf("address %s is specified by multiple entries", address)})
+			continue
+		}
+		addresses = append(addresses, address)
+		data[address] = value
+	}
+	sort.Strings(addresses)
+	// resolvedBy holds the entry each ip address was resolved from, so that entries resolving to the same instance,
+	// such as a hostname and its ip address, are rejected instead of the instance being configured twice
+	resolvedBy := make(map[string]string)
+	// Get information about the hosts from each entry. The expected key/value format for each entry is:
+	// <address>: username=<username>[,<key>=<value>...]
+	for _, address := range addresses {
+		host, err := r.parseHostData(address, data[address])
+		if err != nil {
+			errs = append(errs, asParseError(err, address))
+			continue
+		}
+		// An instance reached through a bastion is on a private network, and may not be resolvable by the operator
+		ips, err := r.validateAddress(address, skipDNSValidation || host.Bastion != nil)
+		if err != nil {
+			var dnsErr *net.DNSError
+			if r.removeUnresolvableHosts && errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+				unresolvable = append(unresolvable, address)
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+		// The addresses a DNS name resolves to are kept, so that its node is found by any of them
+		if ip, _, _ := instances.ParseScopedIP(address); ip == nil {
+			host.ResolvedIPs = ips
+		}
+		if conflict, ip := findResolvedConflict(resolvedBy, address, ips); conflict != "" {
+			errs = append(errs, &ParseError{Address: address, Reason: ParseErrorConflictingAddress,
+				Err: errors.Errorf("entries %s and %s both resolve to %s", conflict, address, ip)})
+			continue
+		}
+		hosts = append(hosts, host)
 	}
+	if len(errs) != 0 {
+		return nil, nil, kerrors.NewAggregate(errs)
+	}
+	return hosts, unresolvable, nil
+}
 
-	// Once all the proper Nodes are in the cluster, configure the prometheus endpoints.
-	if err := r.prometheusNodeConfig.Configure(); err != nil {
-		return errors.Wrap(err, "unable to configure Prometheus")
+// ParseErrorReason is the reason an entry of the windows-instances ConfigMap is invalid
+type ParseErrorReason string
+
+const (
+	// ParseErrorDuplicateAddress is the reason of an entry whose address is also specified by another entry
+	ParseErrorDuplicateAddress ParseErrorReason = "DuplicateAddress"
+	// ParseErrorInvalidData is the reason of an entry whose data is not a valid list of <key>=<value> pairs
+	ParseErrorInvalidData ParseErrorReason = "InvalidData"
+	// ParseErrorInvalidAddress is the reason of an entry whose address is invalid, does not resolve, or is not allowed
+	ParseErrorInvalidAddress ParseErrorReason = "InvalidAddress"
+	// ParseErrorConflictingAddress is the reason of an entry which resolves to the same ip address as another entry
+	ParseErrorConflictingAddress ParseErrorReason = "ConflictingAddress"
+)
+
+// ParseError is returned for an invalid entry of the windows-instances ConfigMap, allowing the entry, and the key of
+// its data which is invalid, to be presented separately from the reason
+type ParseError struct {
+	// Address is the address of the invalid entry, with surrounding whitespace removed
+	Address string
+	// Key is the key of the entry data with an invalid value. It is empty if the error does not concern a single key.
+	Key string
+	// Reason is the reason the entry is invalid
+	Reason ParseErrorReason
+	// Err describes why the entry is invalid
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	switch e.Reason {
+	case ParseErrorInvalidData:
+		if e.Key != "" {
+			return fmt.Sprintf("data for entry %s has an incorrect format: invalid value for %s: %v", e.Address, e.Key,
+				e.Err)
+		}
+		return fmt.Sprintf("data for entry %s has an incorrect format: %v", e.Address, e.Err)
+	case ParseErrorInvalidAddress:
+		return fmt.Sprintf("invalid address %s: %v", e.Address, e.Err)
 	}
-	return nil
+	return e.Err.Error()
 }
 
-// ensureInstanceIsConfigured ensures that the given instance has an associated Node
-func (r *ConfigMapReconciler) ensureInstanceIsConfigured(instance *instances.InstanceInfo, nodes *core.NodeList) error {
-	node, found := findNode(instance.Address, nodes)
-	if found {
-		// Version annotation being present means that the node has been fully configured
-		if _, present := node.Annotations[nodeconfig.VersionAnnotation]; present {
-			// TODO: Check version for upgrade case https://issues.redhat.com/browse/WINC-580 and remove and re-add the node
-			//       if needed. Possibly also do this if the node is not in the `Ready` state.
-			return nil
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ParseErrors returns the ParseErrors held by the given error returned when parsing the windows-instances ConfigMap,
+// one for each invalid entry
+func ParseErrors(err error) []*ParseError {
+	errs := []error{err}
+	if aggregate, ok := err.(kerrors.Aggregate); ok {
+		errs = aggregate.Errors()
+	}
+	var parseErrs []*ParseError
+	for _, err := range errs {
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			parseErrs = append(parseErrs, parseErr)
+		}
+	}
+	return parseErrs
+}
+
+// asParseError returns the given error describing why the data of the entry with the given address is invalid as a
+// ParseError of that entry
+func asParseError(err error, address string) *ParseError {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		parseErr.Address = address
+		return parseErr
+	}
+	return &ParseError{Address: address, Reason: ParseErrorInvalidData, Err: err}
+}
+
+// findResolvedConflict records the given ip addresses as resolved from the given entry in resolvedBy. If any of them
+// was already resolved from another entry, nothing is recorded, and that entry and the ip address are returned.
+func findResolvedConflict(resolvedBy map[string]string, address string, ips []net.IP) (string, string) {
+	for _, ip := range ips {
+		if entry, present := resolvedBy[ip.String()]; present {
+			return entry, ip.String()
+		}
+	}
+	for _, ip := range ips {
+		resolvedBy[ip.String()] = address
+	}
+	return "", ""
+}
+
+// parseHostData returns an instance object for the host with the given address, constructed from the comma separated
+// list of <key>=<value> pairs in the given data. The username key is required, all other keys are optional.
+func (r *ConfigMapReconciler) parseHostData(address, data string) (*instances.InstanceInfo, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(strings.TrimSpace(data), ",") {
+		splitPair := strings.SplitN(pair, "=", 2)
+		if len(splitPair) != 2 {
+			return nil, errors.Errorf("expected <key>=<value> but got %s", pair)
+		}
+		// Whitespace surrounding keys and values is ignored, allowing for entries such as "username = core"
+		key, value := strings.TrimSpace(splitPair[0]), strings.TrimSpace(splitPair[1])
+		if _, present := values[key]; present {
+			return nil, errors.Errorf("duplicate key %s", key)
 		}
+		values[key] = value
+	}
+	if values[usernameKey] == "" {
+		return nil, errors.Errorf("missing %s", usernameKey)
+	}
+	if err := instances.ValidateUsername(values[usernameKey]); err != nil {
+		return nil, errors.Wrapf(err, "invalid value for %s", usernameKey)
 	}
 
-	if err := r.configureInstance(instance, map[string]string{BYOHAnnotation: "true",
-		UsernameAnnotation: instance.Username}); err != nil {
-		return errors.Wrap(err, "error configuring node")
+	host := instances.NewInstanceInfo(address, values[usernameKey], "")
+	// Start with the operator level kubelet settings, allowing them to be overridden by the host specific settings
+	host.KubeletConfig = r.kubeletConfig
+	host.DNSSearchDomains = r.dnsSearchDomains
+	host.SSHSessionLimit = r.sshSessionLimit
+	host.SSHDialTimeout = r.sshDialTimeout
+	host.SSHCommandTimeout = r.sshCommandTimeout
+	host.MetadataAnnotations = r.metadataAnnotations
+	host.MinOSVersion = r.minOSVersion
+	if r.bastion != nil && r.bastion.Address != "" {
+		bastion := *r.bastion
+		host.Bastion = &bastion
+	}
+	for key, value := range values {
+		var err error
+		switch key {
+		case usernameKey:
+		case sshPortKey:
+			host.SSHPort, err = parsePort(value)
+			if err == nil {
+				err = r.validateSSHPort(host.SSHPort)
+			}
+		case shutdownGracePeriodKey:
+			host.KubeletConfig.ShutdownGracePeriod, err = parseDuration(value)
+		case shutdownGracePeriodCriticalPodsKey:
+			host.KubeletConfig.ShutdownGracePeriodCriticalPods, err = parseDuration(value)
+		case featureGatesKey:
+			host.KubeletConfig.FeatureGates, err = parseFeatureGates(value)
+		case imageGCHighThresholdPercentKey:
+			host.KubeletConfig.ImageGCHighThresholdPercent, err = parsePercent(value)
+		case imageGCLowThresholdPercentKey:
+			host.KubeletConfig.ImageGCLowThresholdPercent, err = parsePercent(value)
+		case dnsSearchDomainsKey:
+			host.DNSSearchDomains = strings.Split(value, ";")
+			err = instances.ValidateDNSSearchDomains(host.DNSSearchDomains)
+		case bootstrapKubeconfigSecretKey:
+			if errs := validation.IsDNS1123Subdomain(value); len(errs) != 0 {
+				err = errors.New(strings.Join(errs, ", "))
+			}
+			host.BootstrapKubeconfigSecret = value
+		case authSecretKey:
+			if errs := validation.IsDNS1123Subdomain(value); len(errs) != 0 {
+				err = errors.New(strings.Join(errs, ", "))
+			}
+			host.AuthSecret = value
+		case credentialSecretKey:
+			if errs := validation.IsDNS1123Subdomain(value); len(errs) != 0 {
+				err = errors.New(strings.Join(errs, ", "))
+			}
+			host.CredentialSecret = value
+		case topologyLabelsKey:
+			if host.TopologyLabels, err = parseLabels(value, "="); err == nil {
+				err = instances.ValidateTopologyLabels(host.TopologyLabels)
+			}
+		case labelsKey:
+			if host.Labels, err = parseLabels(value, ":"); err == nil {
+				err = instances.ValidateLabels(host.Labels)
+			}
+		case taintsKey:
+			if host.Taints, err = parseTaints(value); err == nil {
+				err = instances.ValidateTaints(host.Taints)
+			}
+		case bastionKey:
+			if r.bastion == nil {
+				err = errors.New("a bastion username must be set through the bastionUsername operator flag")
+				break
+			}
+			host.Bastion, err = r.bastion.WithAddress(value)
+		case serviceCIDRKey:
+			err = validateCIDRs([]string{value}, r.ipFamily)
+			host.ServiceCIDR = value
+		case natExceptionsKey:
+			host.NATExceptions = strings.Split(value, ";")
+			err = validateCIDRs(host.NATExceptions, r.ipFamily)
+		default:
+			return nil, errors.Errorf("unknown key %s", key)
+		}
+		if err != nil {
+			return nil, &ParseError{Key: key, Reason: ParseErrorInvalidData, Err: err}
+		}
 	}
+	if err := host.KubeletConfig.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid kubelet configuration")
+	}
+	if host.AuthSecret != "" && host.CredentialSecret != "" {
+		return nil, errors.Errorf("only one of %s and %s can be set", authSecretKey, credentialSecretKey)
+	}
+	// The proxy is used to reach the bastion if there is one, as the instance is reached from it
+	var err error
+	if host.SSHProxy, err = r.proxy.URLFor(sshHost(host)); err != nil {
+		return nil, err
+	}
+	// Instances are authenticated against with the private key unless they reference an auth or credential secret. If
+	// the private key secret does not exist, the instance is left to be configured once the secret is created.
+	if !usesOwnCredentials(host) && r.signerErr != nil && !k8sapierrors.IsNotFound(errors.Cause(r.signerErr)) {
+		return nil, errors.Wrapf(r.signerErr, "%s or %s must be set when the private key is unusable", authSecretKey,
+			credentialSecretKey)
+	}
+	return host, nil
+}
 
+// validateCIDRs returns an error if any of the given CIDRs is invalid, or is not of an IP family used by the cluster
+// network
+func validateCIDRs(cidrs []string, ipFamily cluster.IPFamily) error {
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid CIDR %q", cidr)
+		}
+		if !supportsIP(ipFamily, ip) {
+			return errors.Errorf("CIDR %s is not of an IP family used by the cluster network", cidr)
+		}
+	}
 	return nil
 }
 
-// deconfigureInstances removes all BYOH nodes that are not specified in the given instances slice, and
-// deconfigures the instances associated with them.
-func (r *ConfigMapReconciler) deconfigureInstances(instances []*instances.InstanceInfo, nodes *core.NodeList) error {
-	for _, node := range nodes.Items {
-		// Only looking at BYOH nodes
-		if _, present := node.Annotations[BYOHAnnotation]; !present {
-			continue
+// parseFeatureGates returns the feature gates described by the given semicolon separated list of <name>=<bool> pairs
+func parseFeatureGates(value string) (map[string]bool, error) {
+	featureGates := make(map[string]bool)
+	for _, pair := range strings.Split(value, ";") {
+		splitPair := strings.SplitN(pair, "=", 2)
+		if len(splitPair) != 2 {
+			return nil, errors.Errorf("expected <name>=<bool> but got %s", pair)
 		}
-		// Check for instances associated with this node
-		if hasEntry := hasAssociatedInstance(&node, instances); hasEntry {
-			continue
+		if _, present := featureGates[splitPair[0]]; present {
+			return nil, errors.Errorf("duplicate feature gate %s", splitPair[0])
+		}
+		enabled, err := strconv.ParseBool(splitPair[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid value for feature gate %s", splitPair[0])
+		}
+		featureGates[splitPair[0]] = enabled
+	}
+	return featureGates, nil
+}
+
+// parseLabels returns the labels described by the given semicolon separated list of <label><separator><value> pairs
+func parseLabels(value, separator string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, pair := range strings.Split(value, ";") {
+		splitPair := strings.SplitN(pair, separator, 2)
+		if len(splitPair) != 2 {
+			return nil, errors.Errorf("expected <label>%s<value> but got %s", separator, pair)
+		}
+		if _, present := labels[splitPair[0]]; present {
+			return nil, errors.Errorf("duplicate label %s", splitPair[0])
+		}
+		labels[splitPair[0]] = splitPair[1]
+	}
+	return labels, nil
+}
+
+// parseTaints returns the taints described by the given semicolon separated list of <key>=<value>:<effect> entries. The
+// value is optional, allowing for <key>:<effect> entries.
+func parseTaints(value string) ([]core.Taint, error) {
+	var taints []core.Taint
+	for _, entry := range strings.Split(value, ";") {
+		separator := strings.LastIndex(entry, ":")
+		if separator == -1 {
+			return nil, errors.Errorf("expected <key>=<value>:<effect> but got %s", entry)
 		}
-		// no instance found in the provided list, remove the node from the cluster
-		if err := r.deconfigureInstance(&node); err != nil {
-			return errors.Wrapf(err, "unable to deconfigure instance with node %s", node.GetName())
+		taint := core.Taint{Effect: core.TaintEffect(entry[separator+1:])}
+		splitKey := strings.SplitN(entry[:separator], "=", 2)
+		taint.Key = splitKey[0]
+		if len(splitKey) == 2 {
+			taint.Value = splitKey[1]
 		}
+		taints = append(taints, taint)
+	}
+	return taints, nil
+}
+
+// parsePort returns the port number held by the given value
+func parsePort(value string) (int, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if errs := validation.IsValidPortNum(port); len(errs) != 0 {
+		return 0, errors.New(strings.Join(errs, ", "))
+	}
+	return port, nil
+}
+
+// validateSSHPort returns an error if the given SSH port of an instance is the VXLAN port used by Windows nodes, which
+// would leave the instance unreachable or its pod network broken once it is configured
+func (r *ConfigMapReconciler) validateSSHPort(port int) error {
+	vxlanPort := defaultVXLANPort
+	if value, err := strconv.Atoi(r.vxlanPort); err == nil {
+		vxlanPort = value
+	}
+	if port == vxlanPort {
+		return errors.Errorf("SSH port %d conflicts with the VXLAN port used by Windows nodes", port)
 	}
 	return nil
 }
 
-// findNode returns a pointer to the node with an address matching the given address and a bool indicating if the node
-// was found or not.
-func findNode(address string, nodes *core.NodeList) (*core.Node, bool) {
-	for _, node := range nodes.Items {
-		for _, nodeAddress := range node.Status.Addresses {
-			if address == nodeAddress.Address {
-				return &node, true
-			}
+// parseDuration returns the duration held by the given value. A pointer is returned so that a zero duration is
+// distinguished from one which is not set.
+func parseDuration(value string) (*time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// parsePercent returns the percentage held by the given value
+func parsePercent(value string) (int32, error) {
+	percent, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return int32(percent), nil
+}
+
+// validateAddress checks that the given address is either an ip address supported by the IP family of the cluster
+// network, or resolves to such an ip address. The supported ip addresses the address resolves to are returned. If
+// skipDNSValidation is set, a DNS name is only checked to be syntactically valid, and no ip addresses are returned.
+func (r *ConfigMapReconciler) validateAddress(address string, skipDNSValidation bool) ([]net.IP, error) {
+	ips, err := r.resolveAddress(address, skipDNSValidation)
+	if err != nil {
+		return nil, &ParseError{Address: address, Reason: ParseErrorInvalidAddress, Err: err}
+	}
+	return ips, nil
+}
+
+// resolveAddress returns the ip addresses the given address refers to, or an error if it cannot be used as the address
+// of an instance. See validateAddress.
+func (r *ConfigMapReconciler) resolveAddress(address string, skipDNSValidation bool) ([]net.IP, error) {
+	// first check if address is an IP address, which may be followed by a zone
+	parsedAddr, _, err := instances.ParseScopedIP(address)
+	if err != nil {
+		return nil, err
+	}
+	if parsedAddr != nil {
+		if supportsIP(r.ipFamily, parsedAddr) {
+			return []net.IP{parsedAddr}, r.checkAddressRestrictions([]net.IP{parsedAddr})
+		}
+		if parsedAddr.To4() != nil {
+			return nil, errors.Errorf("ipv4 is not supported by the IPv6 single-stack cluster network")
 		}
+		return nil, errors.Errorf("ipv6 is not supported by the IPv4 single-stack cluster network")
 	}
-	return nil, false
+	if skipDNSValidation {
+		// The resolved addresses are needed to enforce the address restrictions
+		if len(r.allowedCIDRs) != 0 || len(r.deniedCIDRs) != 0 {
+			return nil, errors.Errorf("DNS validation cannot be skipped while instance addresses are restricted")
+		}
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(address)); len(errs) != 0 {
+			return nil, errors.Errorf("invalid DNS name: %s", strings.Join(errs, ", "))
+		}
+		return nil, nil
+	}
+	// Do a check that the DNS provided is valid
+	addressList, err := r.lookupHost(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error looking up DNS")
+	}
+	var ips []net.IP
+	for _, resolved := range addressList {
+		if ip := net.ParseIP(resolved); ip != nil && supportsIP(r.ipFamily, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.Errorf("DNS did not resolve to an address supported by the cluster network")
+	}
+	return ips, r.checkAddressRestrictions(ips)
 }
 
-// hasAssociatedInstance returns true if the given node is associated with an instance in the given slice
-func hasAssociatedInstance(node *core.Node, instances []*instances.InstanceInfo) bool {
-	for _, instance := range instances {
-		for _, nodeAddress := range node.Status.Addresses {
-			if instance.Address == nodeAddress.Address {
-				return true
+// checkAddressRestrictions returns an error if any of the given ip addresses is within deniedCIDRs, or is not within
+// allowedCIDRs when it is set
+func (r *ConfigMapReconciler) checkAddressRestrictions(ips []net.IP) error {
+	for _, ip := range ips {
+		for _, network := range r.deniedCIDRs {
+			if network.Contains(ip) {
+				return errors.Errorf("%s is within the denied CIDR %s", ip, network)
+			}
+		}
+		if len(r.allowedCIDRs) == 0 {
+			continue
+		}
+		allowed := false
+		for _, network := range r.allowedCIDRs {
+			if network.Contains(ip) {
+				allowed = true
+				break
 			}
 		}
+		if !allowed {
+			return errors.Errorf("%s is not within any of the allowed CIDRs", ip)
+		}
 	}
-	return false
+	return nil
 }
 
-// mapToConfigMap fulfills the MapFn type, while always returning a request to the windows-instance ConfigMap
-func (r *ConfigMapReconciler) mapToConfigMap(_ client.Object) []reconcile.Request {
-	return []reconcile.Request{{
-		NamespacedName: kubeTypes.NamespacedName{Namespace: r.watchNamespace, Name: InstanceConfigMap},
-	}}
+// lookupHost returns the addresses the given hostname resolves to. Successful lookups are cached for dnsCacheTTL, while
+// failed lookups are not cached, so that transient DNS failures are retried on the next reconcile.
+func (r *ConfigMapReconciler) lookupHost(host string) ([]string, error) {
+	if r.dnsCacheTTL <= 0 {
+		return net.LookupHost(host)
+	}
+	r.dnsCacheLock.Lock()
+	defer r.dnsCacheLock.Unlock()
+	if entry, present := r.dnsCache[host]; present && time.Now().Before(entry.expiry) {
+		return entry.addresses, nil
+	}
+	addresses, err := net.LookupHost(host)
+	if err != nil {
+		delete(r.dnsCache, host)
+		return nil, err
+	}
+	if r.dnsCache == nil {
+		r.dnsCache = make(map[string]dnsCacheEntry)
+	}
+	r.dnsCache[host] = dnsCacheEntry{addresses: addresses, expiry: time.Now().Add(r.dnsCacheTTL)}
+	return addresses, nil
 }
 
-// SetupWithManager sets up the controller with the Manager.
-func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	configMapPredicate := predicate.Funcs{
-		CreateFunc: func(e event.CreateEvent) bool {
-			if e.Object.GetNamespace() == r.watchNamespace && e.Object.GetName() == InstanceConfigMap {
-				return true
+// parseInstanceConfigMaps returns the hosts described by the given ConfigMaps, along with the addresses of the entries
+// which no longer resolve, the ConfigMap describing each of these addresses, and the names of the ConfigMaps which were
+// skipped. A ConfigMap with an invalid entry is skipped as a whole, and an address described by more than one of the
+// ConfigMaps is only kept for the first of them, so that a mistake in one ConfigMap does not prevent the instances of
+// the others from being reconciled. Each skipped ConfigMap and address is reported through an event on its ConfigMap,
+// and an aggregate of the reasons is returned along with the usable hosts.
+func (r *ConfigMapReconciler) parseInstanceConfigMaps(configMaps []*core.ConfigMap) ([]*instances.InstanceInfo,
+	[]string, map[string]*core.ConfigMap, map[string]bool, error) {
+	var hosts []*instances.InstanceInfo
+	var unresolvable []string
+	owners := make(map[string]*core.ConfigMap)
+	skipped := make(map[string]bool)
+	var errs []error
+	for _, configMap := range configMaps {
+		configMapHosts, configMapUnresolvable, err := r.parseHosts(configMap.Data,
+			configMap.Annotations[SkipDNSValidationAnnotation] == "true")
+		if err != nil {
+			r.recorder.Eventf(configMap, core.EventTypeWarning, "InstanceSetupFailure",
+				"unable to parse hosts from ConfigMap, its instances are left as they are until it is fixed: %v", err)
+			errs = append(errs, errors.Wrapf(err, "unable to parse hosts from ConfigMap %s", configMap.GetName()))
+			skipped[configMap.GetName()] = true
+			continue
+		}
+		// described returns true if the given address is already described by a previous ConfigMap, which keeps it
+		described := func(address string) bool {
+			for existing, owner := range owners {
+				if owner != configMap && sameAddress(address, existing) {
+					r.recorder.Eventf(configMap, core.EventTypeWarning, "InstanceSetupFailure",
+						"host %s is already described by ConfigMap %s, ignoring its entry", address, owner.GetName())
+					errs = append(errs, errors.Errorf("host %s is described by both ConfigMap %s and ConfigMap %s",
+						address, owner.GetName(), configMap.GetName()))
+					return true
+				}
 			}
 			return false
-		},
-		UpdateFunc: func(e event.UpdateEvent) bool {
-			if e.ObjectNew.GetNamespace() == r.watchNamespace && e.ObjectNew.GetName() == InstanceConfigMap {
-				return true
+		}
+		for _, host := range configMapHosts {
+			if !described(host.Address) {
+				hosts = append(hosts, host)
+				owners[host.Address] = configMap
+			}
+		}
+		for _, address := range configMapUnresolvable {
+			if !described(address) {
+				unresolvable = append(unresolvable, address)
+				owners[address] = configMap
 			}
+		}
+	}
+	return hosts, unresolvable, owners, skipped, kerrors.NewAggregate(errs)
+}
+
+// describedBySkipped returns true if the given node may be associated with an instance of one of the given skipped
+// ConfigMaps, as referenced by its ConfigMapLabel. A node without the label could belong to any of them.
+func describedBySkipped(node *core.Node, skipped map[string]bool) bool {
+	if len(skipped) == 0 {
+		return false
+	}
+	configMap, present := node.Labels[ConfigMapLabel]
+	return !present || skipped[configMap]
+}
+
+// reconcileNodes corrects the discrepancy between the "expected" hosts slice, described by the given ConfigMaps, and
+// the "actual" nodelist. Events about a specific host are recorded on the ConfigMap describing it, and other events on
+// the first of the ConfigMaps. Messages are logged with the given logger, and messages about a specific host with a
+// logger further scoped to its address.
+func (r *ConfigMapReconciler) reconcileNodes(ctx context.Context, configMaps []*core.ConfigMap,
+	log logr.Logger) error {
+	// Get the list of instances that are expected to be Nodes
+	_, span := tracing.StartSpan(ctx, "ParseHosts")
+	hosts, unresolvable, owners, skipped, parseErr := r.parseInstanceConfigMaps(configMaps)
+	tracing.EndSpan(span, parseErr)
+	instances := configMaps[0]
+	metrics.SetBYOHInstancesDesired(len(hosts))
+	addresses := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		addresses = append(addresses, host.Address)
+	}
+	metrics.PruneInstanceConfigFailures(addresses)
+	r.backoff.prune(addresses)
+	r.removalDeadline = time.Time{}
+	// The instance states are not reported in dry-run mode, as the ConfigMaps are not changed
+	r.status = make(map[string]*instanceStatus, len(hosts))
+	reported := configMaps
+	if r.dryRun {
+		reported = nil
+	}
+	for _, configMap := range reported {
+		// The states reported on a skipped ConfigMap are kept until it can be parsed again
+		if skipped[configMap.GetName()] {
+			continue
+		}
+		var owned []string
+		for _, address := range addresses {
+			if owners[address] == configMap {
+				owned = append(owned, address)
+			}
+		}
+		status := newInstanceStatus(r.client, configMap, owned)
+		if err := status.report(ctx); err != nil {
+			log.Error(err, "unable to report instance states", "configmap", configMap.GetName())
+		}
+		for _, address := range owned {
+			r.status[address] = status
+		}
+	}
+	// Entries which no longer resolve are treated as removed, resulting in their nodes being deconfigured below
+	for _, address := range unresolvable {
+		log.Info("DNS entry no longer resolves, removing host", "address", address)
+		r.recorder.Eventf(owners[address], core.EventTypeWarning, "InstanceRemovalInferred",
+			"DNS entry for %s no longer resolves, removing the associated node from the cluster", address)
+	}
+
+	nodes := &core.NodeList{}
+	if err := r.listNodes(ctx, nodes); err != nil {
+		return errors.Wrap(err, "error listing nodes")
+	}
+	metrics.SetBYOHNodes(countBYOHNodes(nodes))
+	reportNodeProgress(hosts, nodes)
+
+	maxUnavailable, err := r.getMaxUnavailable(instances)
+	if err != nil {
+		r.recorder.Eventf(instances, core.EventTypeWarning, "InstanceSetupFailure", "%v", err)
+		return err
+	}
+	budget := r.newUpgradeBudget(maxUnavailable, nodes)
+
+	// For each host, ensure that it is configured into a node. The hosts are configured by a pool of
+	// configurationWorkers workers, and the errors of all hosts are collected. On error of any host joining, an
+	// aggregate of the errors is returned once all hosts have been processed, to be requeued, before undesired nodes
+	// are removed. Hosts with an invalid bootstrap kubeconfig secret, unreachable hosts, hosts which time out accepting
+	// SSH connections or running commands, hosts whose upgrade is deferred, and hosts another operation is in progress
+	// on, are the exception, as they are skipped, and an error is returned once the other hosts have been reconciled. A
+	// host which fails to be configured is backed off, and is not configured again until its backoff expires, with the
+	// ConfigMap being reconciled again at that point. Hosts rejecting their credentials or running an unsupported
+	// version of Windows are skipped without being retried, as they have to be fixed first. Hosts whose upgrade is
+	// deferred are processed again in batches as the upgrades in progress complete, so that a fleet of outdated nodes
+	// is upgraded within a single reconcile, and are only skipped once no more progress can be made.
+	var skippedErrs, hostErrs []error
+	if parseErr != nil {
+		skippedErrs = append(skippedErrs, parseErr)
+	}
+	// keyless is the number of hosts which could not be configured as the private key secret does not exist
+	keyless := 0
+	var errsLock sync.Mutex
+	// The nodes are indexed once, rather than being searched for the node of each host
+	indexedNodes := newNodeIndex(nodes)
+	outdated := r.outdatedHosts(hosts, indexedNodes)
+	// upgraded is the number of outdated hosts which have been configured by the current operator version
+	upgraded := 0
+	// deferredErrs holds the errors of the hosts whose upgrade was deferred the last time they were processed
+	deferredErrs := make(map[int]error)
+	workers := r.configurationWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	// configure configures the hosts with the given indexes, returning the indexes of the hosts whose upgrade was
+	// deferred
+	configure := func(batch []int) []int {
+		var deferred []int
+		var wg sync.WaitGroup
+		// The queue holds the indexes of the hosts yet to be configured
+		queue := make(chan int)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for index := range queue {
+					host := hosts[index]
+					hostLog := log.WithValues("address", host.Address)
+					if !usesOwnCredentials(host) && r.signer == nil {
+						r.setInstanceState(host.Address, statePending)
+						errsLock.Lock()
+						keyless++
+						errsLock.Unlock()
+						continue
+					}
+					// A host which recently failed to be configured is retried once its backoff expires
+					if remaining := r.backoff.remaining(host.Address, time.Now()); remaining > 0 {
+						hostLog.V(1).Info("backing off configuration", "remaining", remaining)
+						continue
+					}
+					hostCtx, span := tracing.StartSpan(ctx, "ConfigureInstance", tracing.Address(host.Address))
+					err := r.ensureInstanceIsConfigured(hostCtx, owners[host.Address], host, indexedNodes, budget,
+						hostLog)
+					tracing.EndSpan(span, err)
+					if err == nil {
+						r.backoff.succeeded(host.Address)
+						r.setInstanceState(host.Address, stateReady)
+						if _, present := outdated[index]; present {
+							errsLock.Lock()
+							upgraded++
+							errsLock.Unlock()
+						}
+						continue
+					}
+					r.recordHostFailure(host.Address, err)
+					skipped, err := r.handleHostError(owners[host.Address], host.Address, err)
+					if err == nil {
+						continue
+					}
+					var udErr *upgradeDeferredError
+					errsLock.Lock()
+					switch {
+					case errors.As(err, &udErr):
+						deferred = append(deferred, index)
+						deferredErrs[index] = err
+					case skipped:
+						skippedErrs = append(skippedErrs, err)
+					default:
+						hostErrs = append(hostErrs, err)
+					}
+					errsLock.Unlock()
+				}
+			}()
+		}
+		for _, index := range batch {
+			queue <- index
+		}
+		close(queue)
+		wg.Wait()
+		sort.Ints(deferred)
+		return deferred
+	}
+	// The upgrade progress is reported after each batch, as long as any of the hosts are outdated
+	reportProgress := func() {
+		if r.dryRun || len(outdated) == 0 {
+			return
+		}
+		r.recorder.Eventf(instances, core.EventTypeNormal, "UpgradeProgress",
+			"upgraded %d of %d BYOH nodes to operator version %s", upgraded, len(outdated), version.Get())
+	}
+	indexes := make([]int, len(hosts))
+	for index := range hosts {
+		indexes[index] = index
+	}
+	for _, index := range rollingUpgrade(indexes, budget, configure, reportProgress) {
+		skippedErrs = append(skippedErrs, deferredErrs[index])
+	}
+	if keyless != 0 {
+		r.recorder.Eventf(instances, core.EventTypeWarning, "PrivateKeySecretMissing",
+			"%d instances cannot be configured as secret %s/%s does not exist: create it with the private key "+
+				"authorized on the instances, or reference an auth secret from their entries", keyless,
+			r.watchNamespace, secrets.PrivateKeySecret)
+	}
+	if len(hostErrs) != 0 {
+		return r.withRetry(kerrors.NewAggregate(append(hostErrs, skippedErrs...)))
+	}
+
+	// Ensure that only instances currently specified by the ConfigMap are joined to the cluster as nodes, once the
+	// removal grace period of the nodes of the missing instances has elapsed. The nodes of the instances of skipped
+	// ConfigMaps are kept, as it is unknown whether their instances are still described.
+	candidates := &core.NodeList{}
+	for _, node := range nodes.Items {
+		if !isBYOHNode(&node) || !describedBySkipped(&node, skipped) {
+			candidates.Items = append(candidates.Items, node)
+		}
+	}
+	removable, err := r.deferRemovals(ctx, hosts, candidates, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "error deferring the removal of nodes")
+	}
+	if err = r.deconfigureInstances(ctx, instances, hosts, removable); err != nil {
+		return errors.Wrap(err, "error removing undesired nodes from cluster")
+	}
+	// Nothing has been changed in dry-run mode, so the nodes are not checked, and no keys are rotated
+	if r.dryRun {
+		return r.withRetry(kerrors.NewAggregate(skippedErrs))
+	}
+
+	// Check that the configured instances are present as Ready nodes before monitoring is set up for them. The node
+	// list is refreshed, as nodes are created and updated while configuring the instances.
+	if err := r.listNodes(ctx, nodes); err != nil {
+		return errors.Wrap(err, "error listing nodes")
+	}
+	metrics.SetBYOHNodes(countBYOHNodes(nodes))
+	reportNodeProgress(hosts, nodes)
+	if err := r.checkNodeCount(instances, nodes, len(hosts)); err != nil {
+		return err
+	}
+
+	// Once all the proper Nodes are in the cluster, configure the prometheus endpoints. Only Ready nodes are included.
+	if err := r.configurePrometheus(); err != nil {
+		return err
+	}
+
+	// Rotate the authorized key on the configured instances, if a rotation has been requested
+	if err := r.reconcileKeyRotation(ctx, instances, nodes); err != nil {
+		return errors.Wrap(err, "error rotating authorized keys")
+	}
+	if keyless != 0 {
+		if len(skippedErrs) == 0 {
+			return r.withRetry(errPrivateKeyMissing)
+		}
+		skippedErrs = append(skippedErrs, errPrivateKeyMissing)
+	}
+	// The latest edit of the ConfigMaps has been processed once none of their hosts were skipped
+	if len(skippedErrs) == 0 {
+		metrics.SetConfigMapObservedGeneration(configMaps)
+	}
+	return r.withReadinessRetry(r.withRetry(kerrors.NewAggregate(skippedErrs)), nodes, len(hosts))
+}
+
+// withReadinessRetry returns the given result of a reconcile, or a retryAfterError if it succeeded while fewer than
+// the given expected number of BYOH nodes are Ready. Node readiness changes do not trigger a reconcile, so the
+// ConfigMap is reconciled again until the nodes are Ready and have been added to the Prometheus endpoints.
+func (r *ConfigMapReconciler) withReadinessRetry(err error, nodes *core.NodeList, expected int) error {
+	if err != nil {
+		return err
+	}
+	notReady := expected - countReadyBYOHNodes(nodes)
+	if notReady <= 0 {
+		return nil
+	}
+	r.log.Info("waiting for nodes to become Ready before monitoring them", "notReady", notReady,
+		"retryAfter", nodeReadinessRequeueInterval)
+	return &retryAfterError{after: nodeReadinessRequeueInterval}
+}
+
+// withRetry returns the given error of a reconcile wrapped in a retryAfterError if instances are backed off, so that
+// the ConfigMap is reconciled again once the earliest backoff expires, instead of the reconcile being retried with the
+// backoff of the controller, which would delay the configuration of all instances
+func (r *ConfigMapReconciler) withRetry(err error) error {
+	now := time.Now()
+	after := r.backoff.next(now)
+	// Nodes pending removal are removed once their grace period elapses, without waiting for another event
+	if !r.removalDeadline.IsZero() {
+		if untilRemoval := r.removalDeadline.Sub(now); untilRemoval > 0 && (after == 0 || untilRemoval < after) {
+			after = untilRemoval
+		}
+	}
+	if after == 0 {
+		return err
+	}
+	if err != nil {
+		r.log.Error(err, "unable to reconcile all instances", "retryAfter", after)
+	}
+	return &retryAfterError{after: after, err: err}
+}
+
+// setInstanceState reports the state of the instance with the given address. A failure to do so is only logged, as the
+// reported states are informational.
+func (r *ConfigMapReconciler) setInstanceState(address string, state instanceState) {
+	if err := r.status[address].set(context.TODO(), address, state); err != nil {
+		r.log.Error(err, "unable to report instance state", "address", address, "state", state)
+	}
+}
+
+// recordHostFailure records the given error which occurred while configuring the host with the given address, setting
+// the state of the host and backing it off. A host whose upgrade is deferred, or which another operation is in progress
+// on, is still waiting to be configured, and has not failed. A host rejecting its credentials or running an
+// unsupported version of Windows is not backed off, as it is not retried until it is reconciled again.
+func (r *ConfigMapReconciler) recordHostFailure(address string, err error) {
+	var udErr *upgradeDeferredError
+	var busyErr *hostBusyError
+	var authErr *windows.AuthErr
+	var osErr *nodeconfig.UnsupportedOSVersionError
+	switch {
+	case errors.As(err, &udErr), errors.As(err, &busyErr):
+		r.setInstanceState(address, statePending)
+	case errors.As(err, &authErr), errors.As(err, &osErr):
+		r.setInstanceState(address, stateFailed)
+	default:
+		r.backoff.failed(address, time.Now())
+		r.setInstanceState(address, stateFailed)
+	}
+}
+
+// handleHostError reports the given error which occurred while configuring the host with the given address, returning
+// the error to be collected, and true if the host was skipped, in which case the other hosts are still reconciled. A
+// deferred upgrade, or a host which another operation is in progress on, is not counted as a failed configuration
+// attempt. No error is returned for a host rejecting its
+// credentials or running an unsupported version of Windows, so that the reconcile is not retried for it, as the host
+// has to be fixed first.
+func (r *ConfigMapReconciler) handleHostError(configMap *core.ConfigMap, address string, err error) (bool, error) {
+	var udErr *upgradeDeferredError
+	if errors.As(err, &udErr) {
+		r.log.Info("deferring upgrade", "node", udErr.node, "unavailable", udErr.unavailable)
+		return true, err
+	}
+	var busyErr *hostBusyError
+	if errors.As(err, &busyErr) {
+		r.log.Info("deferring configuration, instance is busy", "address", address)
+		return true, err
+	}
+	metrics.IncInstanceConfigFailures(address)
+	var bkErr *bootstrapKubeconfigError
+	if errors.As(err, &bkErr) {
+		r.recorder.Eventf(configMap, core.EventTypeWarning, "InvalidBootstrapKubeconfig",
+			"unable to configure instance with address %s: %v", address, err)
+		return true, errors.Wrapf(err, "error configuring host with address %s", address)
+	}
+	var uErr *unreachableError
+	if errors.As(err, &uErr) {
+		r.recorder.Eventf(configMap, core.EventTypeWarning, "InstanceUnreachable", "%v", err)
+		return true, err
+	}
+	var authErr *windows.AuthErr
+	if errors.As(err, &authErr) {
+		r.log.Info("instance rejected its credentials, not retrying", "address", address, "error", authErr)
+		r.recorder.Eventf(configMap, core.EventTypeWarning, "InstanceAuthenticationFailure",
+			"instance with address %s rejected its credentials, it is configured once its username, private key or "+
+				"auth secret is fixed: %v", address, authErr)
+		return true, nil
+	}
+	var osErr *nodeconfig.UnsupportedOSVersionError
+	if errors.As(err, &osErr) {
+		r.log.Info("instance runs an unsupported version of Windows, not retrying", "address", address, "error",
+			osErr)
+		r.recorder.Eventf(configMap, core.EventTypeWarning, "UnsupportedOSVersion",
+			"instance with address %s cannot be configured: %v", address, osErr)
+		return true, nil
+	}
+	var timeoutErr *windows.TimeoutErr
+	if errors.As(err, &timeoutErr) {
+		r.recorder.Eventf(configMap, core.EventTypeWarning, "InstanceConnectionTimeout",
+			"instance with address %s did not accept an SSH connection, retrying: %v", address, timeoutErr)
+		return true, errors.Wrapf(err, "error configuring host with address %s", address)
+	}
+	var commandErr *windows.CommandTimeoutErr
+	if errors.As(err, &commandErr) {
+		r.recorder.Eventf(configMap, core.EventTypeWarning, "InstanceCommandTimeout",
+			"instance with address %s did not respond in time, retrying: %v", address, commandErr)
+		return true, errors.Wrapf(err, "error configuring host with address %s", address)
+	}
+	r.recorder.Eventf(configMap, core.EventTypeWarning, "InstanceSetupFailure",
+		"unable to join instance with address %s to the cluster", address)
+	return false, errors.Wrapf(err, "error configuring host with address %s", address)
+}
+
+// checkNodeCount compares the number of Ready BYOH nodes in the given list against the expected number of configured
+// instances. A mismatch is reported through a warning event, and results in an error only if strictNodeCount is set.
+func (r *ConfigMapReconciler) checkNodeCount(configMap *core.ConfigMap, nodes *core.NodeList, expected int) error {
+	ready := countReadyBYOHNodes(nodes)
+	if ready == expected {
+		return nil
+	}
+	r.log.Info("BYOH node count mismatch", "expected", expected, "ready", ready)
+	r.recorder.Eventf(configMap, core.EventTypeWarning, "NodeCountMismatch",
+		"expected %d Ready BYOH nodes, found %d", expected, ready)
+	if r.strictNodeCount {
+		return errors.Errorf("expected %d Ready BYOH nodes, found %d", expected, ready)
+	}
+	return nil
+}
+
+// countBYOHNodes returns the number of BYOH nodes within the given list
+func countBYOHNodes(nodes *core.NodeList) int {
+	count := 0
+	for _, node := range nodes.Items {
+		if isBYOHNode(&node) {
+			count++
+		}
+	}
+	return count
+}
+
+// countReadyBYOHNodes returns the number of BYOH nodes within the given list with a Ready condition of True
+func countReadyBYOHNodes(nodes *core.NodeList) int {
+	count := 0
+	for _, node := range nodes.Items {
+		if isBYOHNode(&node) && isNodeReady(&node) {
+			count++
+		}
+	}
+	return count
+}
+
+// reportNodeProgress reports the number of the BYOH nodes within the given list which are associated with the given
+// instances and are configured and Ready, and the number of instances without such a node
+func reportNodeProgress(hosts []*instances.InstanceInfo, nodes *core.NodeList) {
+	var associated []core.Node
+	index := newInstanceIndex(hosts)
+	for _, node := range nodes.Items {
+		if isBYOHNode(&node) && index.hasAssociatedInstance(&node) {
+			associated = append(associated, node)
+		}
+	}
+	metrics.SetBYOHNodeProgress(associated, len(hosts))
+}
+
+// isNodeReady returns true if the given node has a Ready condition of True
+func isNodeReady(node *core.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == core.NodeReady {
+			return condition.Status == core.ConditionTrue
+		}
+	}
+	return false
+}
+
+// repairBYOHAnnotations restores the BYOH and username annotations of the given configured node, associated with the
+// given instance, if they were removed, so that the node is managed again instead of being orphaned. The node must not
+// be backed by a Machine. Nodes which are not configured yet are annotated when their instance is configured.
+func (r *ConfigMapReconciler) repairBYOHAnnotations(ctx context.Context, node *core.Node,
+	instance *instances.InstanceInfo, log logr.Logger) error {
+	if _, configured := node.Annotations[nodeconfig.VersionAnnotation]; !configured {
+		return nil
+	}
+	if isBYOHNode(node) && node.Annotations[UsernameAnnotation] != "" {
+		return nil
+	}
+	if r.dryRun {
+		log.Info("dry run: would restore missing BYOH annotations", "node", node.GetName())
+		return nil
+	}
+	patchBase := client.MergeFrom(node.DeepCopy())
+	node.Annotations[BYOHAnnotation] = "true"
+	if node.Annotations[UsernameAnnotation] == "" {
+		node.Annotations[UsernameAnnotation] = instance.Username
+	}
+	if err := r.client.Patch(ctx, node, patchBase); err != nil {
+		return errors.Wrapf(err, "unable to repair annotations of node %s", node.GetName())
+	}
+	log.Info("restored missing BYOH annotations", "node", node.GetName())
+	r.recorder.Eventf(node, core.EventTypeWarning, "AnnotationsRepaired",
+		"restored the BYOH annotations of node %s associated with instance %s", node.GetName(), instance.Address)
+	return nil
+}
+
+// ensureInstanceIsConfigured ensures that the given instance has an associated Node, which is looked up within the
+// given index of nodes. A success event is emitted on the
+// given ConfigMap once an instance which was not configured becomes fully configured. An upgrade of the node is only
+// started if the given budget allows for it. A hostBusyError is returned without waiting if another operation is in
+// progress on the instance. The spans of the configuration steps are started as children of the span of the given
+// context. Messages are logged with the given logger, which is scoped to the instance.
+func (r *ConfigMapReconciler) ensureInstanceIsConfigured(ctx context.Context, configMap *core.ConfigMap,
+	instance *instances.InstanceInfo, nodes *nodeIndex, budget *upgradeBudget, log logr.Logger) error {
+	lockedAddresses := instanceAddressKeys(instance)
+	if !r.hostLocks.tryLock(lockedAddresses...) {
+		return &hostBusyError{address: instance.Address}
+	}
+	defer r.hostLocks.unlock(lockedAddresses...)
+	configHash, err := instance.ConfigHash()
+	if err != nil {
+		return err
+	}
+	node, found := nodes.find(instance)
+	if found && r.isIgnored(node) {
+		log.V(1).Info("ignoring node", "node", node.GetName(), "label", r.ignoreLabel)
+		return nil
+	}
+	// Configuring the instance would result in the node being managed by both controllers
+	if found {
+		if machine, present := node.Annotations[MachineAnnotation]; present {
+			return errors.Errorf("node %s is backed by Machine %s", node.GetName(), machine)
+		}
+		if err := r.repairBYOHAnnotations(ctx, node, instance, log); err != nil {
+			return err
+		}
+	}
+	// Version annotation being present means that the node has been fully configured
+	nodeVersion, configured := "", false
+	if found {
+		nodeVersion, configured = node.Annotations[nodeconfig.VersionAnnotation]
+	}
+	force := found && node.Annotations[ForceReconfigureAnnotation] == "true"
+	serviceCIDR := r.serviceCIDRFor(instance)
+	if configured {
+		cidrChanged := serviceCIDRChanged(node, serviceCIDR)
+		if cidrChanged {
+			log.Info("service CIDR changed, reconfiguring", "node", node.GetName(),
+				"configuredServiceCIDR", node.Annotations[ServiceCIDRAnnotation], "serviceCIDR", serviceCIDR)
+		}
+		// If the instance specific configuration, the service CIDR or the operator version have changed since, the
+		// node has been NotReady for too long, or reconfiguration is forced, the instance needs to be configured again
+		if node.Annotations[nodeconfig.ConfigHashAnnotation] == configHash && nodeVersion == version.Get() && !force &&
+			!cidrChanged {
+			if !notReadyTooLong(node, r.notReadyGracePeriod, time.Now()) {
+				if r.dryRun {
+					return nil
+				}
+				return r.syncLabelsAndTaints(ctx, node, instance, configMap.GetName())
+			}
+			log.Info("node has been NotReady for too long, reconfiguring", "node", node.GetName(),
+				"gracePeriod", r.notReadyGracePeriod)
+		}
+		// Configuring the instance with an older operator version could leave it in a broken state
+		if !r.allowDowngrade && isDowngrade(nodeVersion, version.Get()) {
+			log.Info("refusing to downgrade node", "node", node.GetName(), "nodeVersion", nodeVersion,
+				"operatorVersion", version.Get())
+			r.recorder.Eventf(node, core.EventTypeWarning, "DowngradeBlocked",
+				"node was configured by operator version %s, refusing to configure it with older version %s",
+				nodeVersion, version.Get())
+			return nil
+		}
+	}
+	if r.dryRun {
+		action := "configure"
+		if configured && nodeVersion != version.Get() {
+			action = "upgrade"
+		} else if configured {
+			action = "reconfigure"
+		}
+		log.Info("dry run: would configure instance", "action", action)
+		r.recorder.Eventf(configMap, core.EventTypeNormal, "DryRunConfigure", "dry run: would %s instance %s", action,
+			instance.Address)
+		return nil
+	}
+	sshPort := instance.SSHPort
+	if sshPort == 0 {
+		sshPort = windows.DefaultSSHPort
+	}
+	// An instance which cannot be reached is reported as such, instead of failing while it is being configured. Instances
+	// reached through the proxy or a bastion cannot be probed directly.
+	if r.checkReachability && instance.SSHProxy == nil && instance.Bastion == nil {
+		if err := probePort(instance.Address, sshPort, reachabilityTimeout); err != nil {
+			return &unreachableError{address: instance.Address, port: sshPort, err: err}
+		}
+	}
+	if instance.BootstrapKubeconfigSecret != "" {
+		instance.BootstrapKubeconfig, err = secrets.GetBootstrapKubeconfig(kubeTypes.NamespacedName{
+			Namespace: r.watchNamespace, Name: instance.BootstrapKubeconfigSecret}, r.client)
+		if err != nil {
+			return &bootstrapKubeconfigError{err: err}
+		}
+	}
+	if instance.AuthSecret != "" {
+		instance.Password, err = secrets.GetPassword(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+			Name: instance.AuthSecret}, r.client)
+		if err != nil {
+			return errors.Wrapf(err, "unable to get password from secret %s", instance.AuthSecret)
+		}
+	}
+	if _, err := r.signerFor(instance); err != nil {
+		return err
+	}
+	// A node configured by a different operator version is removed and configured again from scratch. An upgrade is
+	// only started if the number of unavailable BYOH nodes, including the upgraded node, stays within the budget, so
+	// that capacity is only reduced by a bounded number of nodes at a time. The node counts as unavailable until it
+	// has been configured again, as configuring an instance waits for its node to become Ready. A node whose
+	// reconfiguration is forced is removed and configured again in the same way. The budget is only taken up once the
+	// secrets the instance is configured with have been read, as the node is left untouched when they cannot be.
+	upgrade := configured && nodeVersion != version.Get()
+	rebuild := upgrade || (configured && force)
+	upgradingNode := ""
+	if rebuild {
+		upgradingNode = node.GetName()
+		if acquired, unavailable := budget.acquire(upgradingNode); !acquired {
+			return &upgradeDeferredError{node: upgradingNode, unavailable: unavailable}
+		}
+	}
+
+	r.setInstanceState(instance.Address, stateConfiguring)
+	// The configuration phase can only be reported once the node exists
+	if found {
+		phase := phaseConfiguring
+		if upgrade {
+			phase = phaseUpgrading
+		}
+		if err := r.setConfigurationPhase(ctx, node, phase); err != nil {
+			log.Error(err, "unable to report configuration phase")
+		}
+	}
+	if rebuild {
+		if upgrade {
+			log.Info("upgrading node", "node", node.GetName(), "nodeVersion", nodeVersion,
+				"operatorVersion", version.Get())
+		} else {
+			log.Info("forcing reconfiguration of node", "node", node.GetName(), "annotation",
+				ForceReconfigureAnnotation)
+		}
+		if err := r.deconfigureHeldInstance(ctx, configMap, node, lockedAddresses, log); err != nil {
+			if err := r.setConfigurationPhase(ctx, node, phaseFailed); err != nil {
+				log.Error(err, "unable to report configuration phase")
+			}
+			return errors.Wrapf(err, "unable to deconfigure node %s to configure it again", node.GetName())
+		}
+		// The node has been removed, and is created again when the instance is configured
+		found, node = false, nil
+	}
+
+	_, zone := instances.SplitZone(instance.Address)
+	annotations := map[string]string{BYOHAnnotation: "true", UsernameAnnotation: instance.Username,
+		SSHPortAnnotation: strconv.Itoa(sshPort), AuthSecretAnnotation: instance.AuthSecret,
+		CredentialSecretAnnotation: instance.CredentialSecret, BastionAnnotation: "", ZoneAnnotation: zone,
+		ServiceCIDRAnnotation: serviceCIDR}
+	if instance.Bastion != nil {
+		annotations[BastionAnnotation] = instance.Bastion.HostPort()
+	}
+	// Custom labels are applied as soon as the node is created, and are tracked so that they are kept in sync
+	if keys := trackedLabelKeys(node, LabelsAnnotation, instance.Labels); keys != "" {
+		annotations[LabelsAnnotation] = keys
+	}
+	// Taints are handled in the same way, so that no workloads are scheduled on the node before they are applied
+	if keys := trackedTaintKeys(node, instance.Taints); keys != "" {
+		annotations[TaintsAnnotation] = keys
+	}
+	configErr := r.configureInstance(ctx, instance, annotations,
+		nodeLabels(instance, configMap.GetName(), r.instanceConfigMap), log)
+	phase := phaseConfigured
+	if configErr != nil {
+		phase = phaseFailed
+	} else if rebuild {
+		budget.release(upgradingNode)
+	}
+	// Look up the node if it did not exist before, as it is created when a new instance is configured
+	if !found {
+		if node, err = r.findInstanceNode(ctx, instance); err != nil {
+			log.Error(err, "unable to find node to report configuration phase")
+		}
+	}
+	if node != nil {
+		if err := r.setConfigurationPhase(ctx, node, phase); err != nil {
+			log.Error(err, "unable to report configuration phase")
+		}
+	}
+	if configErr != nil {
+		return errors.Wrap(configErr, "error configuring node")
+	}
+	if node == nil {
+		return errors.Errorf("unable to find node with address %s to apply labels and taints to", instance.Address)
+	}
+	r.recorder.Eventf(configMap, core.EventTypeNormal, "InstanceSetupSuccess",
+		"instance with address %s joined the cluster as node %s", instance.Address, node.GetName())
+	// A node which was removed to be configured again is created without the annotation, but a node which had not been
+	// fully configured yet is kept
+	if force && !rebuild {
+		if err := r.clearForceReconfigure(ctx, node); err != nil {
+			return err
+		}
+	}
+	return r.syncLabelsAndTaints(ctx, node, instance, configMap.GetName())
+}
+
+// clearForceReconfigure removes the ForceReconfigureAnnotation from the given node, once its instance has been
+// configured again
+func (r *ConfigMapReconciler) clearForceReconfigure(ctx context.Context, node *core.Node) error {
+	if _, present := node.Annotations[ForceReconfigureAnnotation]; !present {
+		return nil
+	}
+	patchBase := client.MergeFrom(node.DeepCopy())
+	delete(node.Annotations, ForceReconfigureAnnotation)
+	if err := r.client.Patch(ctx, node, patchBase); err != nil {
+		return errors.Wrapf(err, "unable to remove %s annotation from node %s", ForceReconfigureAnnotation,
+			node.GetName())
+	}
+	return nil
+}
+
+// isDowngrade returns true if configuring a node which was configured by the given node version with the given
+// operator version would downgrade it. Versions which are not valid semantic versions cannot be compared, and are
+// never considered a downgrade.
+func isDowngrade(nodeVersion, operatorVersion string) bool {
+	nodeSemver, operatorSemver := "v"+nodeVersion, "v"+operatorVersion
+	if !semver.IsValid(nodeSemver) || !semver.IsValid(operatorSemver) {
+		return false
+	}
+	return semver.Compare(operatorSemver, nodeSemver) < 0
+}
+
+// outdatedHosts returns the indexes of the given hosts whose nodes, found in the given index, were configured by
+// another operator version and are to be upgraded. As the hosts are determined from the version annotations of the
+// nodes, an upgrade interrupted by a restart of the operator is resumed with the hosts which are still outdated.
+func (r *ConfigMapReconciler) outdatedHosts(hosts []*instances.InstanceInfo, nodes *nodeIndex) map[int]struct{} {
+	outdated := make(map[int]struct{})
+	for index, host := range hosts {
+		node, found := nodes.find(host)
+		if !found || r.isIgnored(node) {
+			continue
+		}
+		nodeVersion, configured := node.Annotations[nodeconfig.VersionAnnotation]
+		if !configured || nodeVersion == version.Get() {
+			continue
+		}
+		// A node which would have to be downgraded is left as it is
+		if r.allowDowngrade || !isDowngrade(nodeVersion, version.Get()) {
+			outdated[index] = struct{}{}
+		}
+	}
+	return outdated
+}
+
+// notReadyTooLong returns true if the Ready condition of the given node has not been True for longer than the given
+// grace period. A grace period of 0 disables the check.
+func notReadyTooLong(node *core.Node, gracePeriod time.Duration, now time.Time) bool {
+	if gracePeriod <= 0 {
+		return false
+	}
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == core.NodeReady {
+			return condition.Status != core.ConditionTrue && now.Sub(condition.LastTransitionTime.Time) > gracePeriod
+		}
+	}
+	return false
+}
+
+// serviceCIDRFor returns the service CIDR the CNI configuration of the given instance is generated with
+func (r *instanceReconciler) serviceCIDRFor(instance *instances.InstanceInfo) string {
+	if instance.ServiceCIDR != "" {
+		return instance.ServiceCIDR
+	}
+	return r.clusterServiceCIDR
+}
+
+// serviceCIDRChanged returns true if the given node was configured with a service CIDR other than the given one. Nodes
+// configured before the service CIDR was recorded are not considered changed, and are annotated when they are next
+// configured.
+func serviceCIDRChanged(node *core.Node, serviceCIDR string) bool {
+	configured, present := node.Annotations[ServiceCIDRAnnotation]
+	return present && configured != serviceCIDR
+}
+
+// bootstrapKubeconfigError occurs when the bootstrap kubeconfig secret referenced by an instance cannot be used
+type bootstrapKubeconfigError struct {
+	err error
+}
+
+func (e *bootstrapKubeconfigError) Error() string {
+	return fmt.Sprintf("invalid bootstrap kubeconfig: %v", e.err)
+}
+
+// probePort returns an error if a TCP connection cannot be established to the given port of the given address within
+// the given timeout
+func probePort(address string, port int, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(address, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// unreachableError is returned when the SSH port of an instance cannot be connected to. The instance is skipped, and
+// the other instances are still reconciled.
+type unreachableError struct {
+	address string
+	port    int
+	err     error
+}
+
+func (e *unreachableError) Error() string {
+	return fmt.Sprintf("host %s unreachable on port %d: %v", e.address, e.port, e.err)
+}
+
+// findInstanceNode returns the node associated with the given instance, or nil if there is none
+func (r *ConfigMapReconciler) findInstanceNode(ctx context.Context, instance *instances.InstanceInfo) (*core.Node,
+	error) {
+	nodes := &core.NodeList{}
+	if err := r.listNodes(ctx, nodes); err != nil {
+		return nil, errors.Wrap(err, "error listing nodes")
+	}
+	node, _ := findNode(instance, nodes)
+	return node, nil
+}
+
+// deconfigureInstances removes all BYOH nodes that are not specified in the given instances slice, and
+// deconfigures the instances associated with them. The nodes are removed concurrently by a pool of
+// configurationWorkers workers, and the removed nodes are dropped from the given list, even if other nodes could not
+// be removed. The removal of each node is reported on the given ConfigMap. No more nodes are removed once the given
+// context is done. An aggregate of the errors of all nodes which could not be removed is returned, along with the
+// error of the context if it is done.
+func (r *ConfigMapReconciler) deconfigureInstances(ctx context.Context, configMap *core.ConfigMap,
+	instances []*instances.InstanceInfo, nodes *core.NodeList) error {
+	var undesired []*core.Node
+	index := newInstanceIndex(instances)
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		// Only looking at BYOH nodes
+		if !isBYOHNode(node) || r.isIgnored(node) {
+			continue
+		}
+		// A node backed by a Machine which gained the BYOH annotation out of band is managed by the Machine
+		// controller, and must not be removed
+		if _, present := node.Annotations[MachineAnnotation]; present {
+			r.log.Info("ignoring BYOH annotated node backed by a Machine", "node", node.GetName())
+			continue
+		}
+		// Check for instances associated with this node
+		if hasEntry := index.hasAssociatedInstance(node); hasEntry {
+			continue
+		}
+		// no instance found in the provided list, the node is removed from the cluster
+		undesired = append(undesired, node)
+	}
+	if r.dryRun {
+		for _, node := range undesired {
+			r.log.Info("dry run: would remove node", "node", node.GetName())
+			if skipsDeconfigure(node) {
+				r.recorder.Eventf(node, core.EventTypeNormal, "DryRunRemove",
+					"dry run: would remove node %s without deconfiguring its instance", node.GetName())
+				continue
+			}
+			r.recorder.Eventf(node, core.EventTypeNormal, "DryRunRemove", "dry run: would drain and remove node %s",
+				node.GetName())
+		}
+		return nil
+	}
+	if len(undesired) == 0 {
+		return nil
+	}
+
+	workers := r.configurationWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	var errs []error
+	removed := make(map[string]bool)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan *core.Node)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for node := range queue {
+				// Nodes which are already queued are skipped once the context is done
+				if ctx.Err() != nil {
+					continue
+				}
+				var err error
+				if skipsDeconfigure(node) {
+					err = r.deleteNode(ctx, node)
+				} else {
+					err = r.deconfigureInstance(ctx, configMap, node, r.log)
+				}
+				if err == nil {
+					r.recordDeconfigured(configMap, node)
+				}
+				lock.Lock()
+				if err != nil {
+					errs = append(errs, errors.Wrapf(err, "unable to deconfigure instance with node %s",
+						node.GetName()))
+				} else {
+					removed[node.GetName()] = true
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+dispatch:
+	for _, node := range undesired {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case queue <- node:
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	remaining := nodes.Items[:0]
+	for _, node := range nodes.Items {
+		if !removed[node.GetName()] {
+			remaining = append(remaining, node)
+		}
+	}
+	nodes.Items = remaining
+	if ctx.Err() != nil {
+		errs = append(errs, errors.Wrap(ctx.Err(), "stopped removing nodes"))
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// skipsDeconfigure returns true if the given node should be removed without deconfiguring its instance
+func skipsDeconfigure(node *core.Node) bool {
+	return node.Annotations[SkipDeconfigureAnnotation] == "true"
+}
+
+// deleteNode deletes the given node without draining it or connecting to its instance, leaving the instance as it is
+func (r *ConfigMapReconciler) deleteNode(ctx context.Context, node *core.Node) error {
+	if err := r.client.Delete(ctx, node); err != nil && !k8sapierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "error deleting node %s", node.GetName())
+	}
+	r.log.Info("removed node without deconfiguring its instance", "node", node.GetName())
+	return nil
+}
+
+// recordDeconfigured reports the removal of the given node, whose instance is no longer specified by the given
+// ConfigMap, through an event on the ConfigMap and the count of deconfigured BYOH nodes
+func (r *ConfigMapReconciler) recordDeconfigured(configMap *core.ConfigMap, node *core.Node) {
+	metrics.IncBYOHNodesDeconfigured()
+	address, err := getAddress(node.Status.Addresses, r.ipFamily)
+	if err != nil {
+		address = "unknown"
+	}
+	r.recorder.Eventf(configMap, core.EventTypeNormal, "InstanceDeconfigured",
+		"removed node %s of instance with address %s, as it is no longer specified", node.GetName(), address)
+}
+
+// deferRemovals returns the given node list without the BYOH nodes which are not associated with any of the given
+// instances, and whose removal grace period has not elapsed at the given time. Such nodes are annotated with the time
+// their instance was first found to be missing, and the annotation is removed from nodes whose instance is described
+// again. All nodes are returned if removalGracePeriod is 0.
+func (r *ConfigMapReconciler) deferRemovals(ctx context.Context, instances []*instances.InstanceInfo,
+	nodes *core.NodeList, now time.Time) (*core.NodeList, error) {
+	removable := &core.NodeList{}
+	index := newInstanceIndex(instances)
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if _, backed := node.Annotations[MachineAnnotation]; !isBYOHNode(node) || r.isIgnored(node) || backed {
+			removable.Items = append(removable.Items, *node)
+			continue
+		}
+		markedAt, pending := node.Annotations[PendingRemovalAnnotation]
+		if index.hasAssociatedInstance(node) {
+			if pending {
+				if err := r.cancelRemoval(ctx, node); err != nil {
+					return nil, err
+				}
+			}
+			removable.Items = append(removable.Items, *node)
+			continue
+		}
+		if r.removalGracePeriod <= 0 {
+			removable.Items = append(removable.Items, *node)
+			continue
+		}
+		marked, err := time.Parse(time.RFC3339, markedAt)
+		if !pending || err != nil {
+			if err := r.markForRemoval(ctx, node, now); err != nil {
+				return nil, err
+			}
+			marked = now
+		}
+		deadline := marked.Add(r.removalGracePeriod)
+		if !now.Before(deadline) {
+			removable.Items = append(removable.Items, *node)
+			continue
+		}
+		r.log.V(1).Info("deferring node removal", "node", node.GetName(), "remaining", deadline.Sub(now))
+		if r.removalDeadline.IsZero() || deadline.Before(r.removalDeadline) {
+			r.removalDeadline = deadline
+		}
+	}
+	return removable, nil
+}
+
+// markForRemoval annotates the given node as pending removal since the given time
+func (r *ConfigMapReconciler) markForRemoval(ctx context.Context, node *core.Node, now time.Time) error {
+	if r.dryRun {
+		r.log.Info("dry run: would mark node for removal", "node", node.GetName())
+		return nil
+	}
+	patchBase := client.MergeFrom(node.DeepCopy())
+	if node.Annotations == nil {
+		node.Annotations = make(map[string]string)
+	}
+	node.Annotations[PendingRemovalAnnotation] = now.UTC().Format(time.RFC3339)
+	if err := r.client.Patch(ctx, node, patchBase); err != nil {
+		return errors.Wrapf(err, "unable to mark node %s for removal", node.GetName())
+	}
+	r.log.Info("marked node for removal", "node", node.GetName(), "gracePeriod", r.removalGracePeriod)
+	r.recorder.Eventf(node, core.EventTypeNormal, "RemovalPending",
+		"instance of node %s is no longer described, the node will be removed in %s unless it is added back",
+		node.GetName(), r.removalGracePeriod)
+	return nil
+}
+
+// cancelRemoval removes the pending removal annotation from the given node, as its instance is described again
+func (r *ConfigMapReconciler) cancelRemoval(ctx context.Context, node *core.Node) error {
+	if r.dryRun {
+		r.log.Info("dry run: would cancel pending node removal", "node", node.GetName())
+		return nil
+	}
+	patchBase := client.MergeFrom(node.DeepCopy())
+	delete(node.Annotations, PendingRemovalAnnotation)
+	if err := r.client.Patch(ctx, node, patchBase); err != nil {
+		return errors.Wrapf(err, "unable to cancel the removal of node %s", node.GetName())
+	}
+	r.log.Info("cancelled pending node removal", "node", node.GetName())
+	r.recorder.Eventf(node, core.EventTypeNormal, "RemovalCancelled",
+		"instance of node %s is described again, the node is no longer removed", node.GetName())
+	return nil
+}
+
+// isIgnored returns true if the given node is exempt from being managed by the operator
+func (r *ConfigMapReconciler) isIgnored(node *core.Node) bool {
+	return r.ignoreLabel != "" && node.Labels[r.ignoreLabel] == "true"
+}
+
+// findNode returns a pointer to the node with an address matching the address of the given instance, or any of the
+// addresses its DNS name resolved to, and a bool indicating if the node was found or not.
+func findNode(instance *instances.InstanceInfo, nodes *core.NodeList) (*core.Node, bool) {
+	for _, node := range nodes.Items {
+		if isInstanceNode(instance, &node) {
+			return &node, true
+		}
+	}
+	return nil, false
+}
+
+// hasAssociatedInstance returns true if the given node is associated with an instance in the given slice
+func hasAssociatedInstance(node *core.Node, instances []*instances.InstanceInfo) bool {
+	for _, instance := range instances {
+		if isInstanceNode(instance, node) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeIndex indexes a node list by the addresses of the nodes, so that the node associated with each of many instances
+// is found without comparing every instance against every node
+type nodeIndex struct {
+	nodes *core.NodeList
+	// byAddress holds the position within nodes of the first node with each address, keyed by addressKey
+	byAddress map[string]int
+}
+
+// newNodeIndex returns an index of the given node list, which must not be changed while the index is used
+func newNodeIndex(nodes *core.NodeList) *nodeIndex {
+	index := &nodeIndex{nodes: nodes, byAddress: make(map[string]int)}
+	for i, node := range nodes.Items {
+		for _, nodeAddress := range node.Status.Addresses {
+			key := addressKey(nodeAddress.Address)
+			if _, present := index.byAddress[key]; !present {
+				index.byAddress[key] = i
+			}
+		}
+	}
+	return index
+}
+
+// find returns a copy of the node associated with the given instance, with the same result as findNode. A copy is
+// returned so that concurrent callers can update the node they are given.
+func (index *nodeIndex) find(instance *instances.InstanceInfo) (*core.Node, bool) {
+	first := -1
+	for _, key := range instanceAddressKeys(instance) {
+		if i, present := index.byAddress[key]; present && (first == -1 || i < first) {
+			first = i
+		}
+	}
+	if first == -1 {
+		return nil, false
+	}
+	return index.nodes.Items[first].DeepCopy(), true
+}
+
+// instanceIndex indexes instances by their addresses, so that checking whether each of many nodes is associated with
+// an instance does not compare every node against every instance
+type instanceIndex map[string]struct{}
+
+// newInstanceIndex returns an index of the given instances
+func newInstanceIndex(instances []*instances.InstanceInfo) instanceIndex {
+	index := make(instanceIndex)
+	for _, instance := range instances {
+		for _, key := range instanceAddressKeys(instance) {
+			index[key] = struct{}{}
+		}
+	}
+	return index
+}
+
+// hasAssociatedInstance returns true if the given node is associated with an indexed instance, with the same result as
+// the hasAssociatedInstance function
+func (index instanceIndex) hasAssociatedInstance(node *core.Node) bool {
+	for _, nodeAddress := range node.Status.Addresses {
+		if _, present := index[addressKey(nodeAddress.Address)]; present {
+			return true
+		}
+	}
+	return false
+}
+
+// instanceAddressKeys returns the keys of the address of the given instance, and of the addresses its DNS name
+// resolved to, which the addresses of its node are matched against
+func instanceAddressKeys(instance *instances.InstanceInfo) []string {
+	keys := []string{addressKey(instance.Address)}
+	for _, resolved := range instance.ResolvedIPs {
+		keys = append(keys, resolved.String())
+	}
+	return keys
+}
+
+// addressKey returns the key the given address is indexed by. The keys of two addresses are equal if sameAddress
+// returns true for them, as the zone is removed and ip addresses are keyed by their canonical representation.
+func addressKey(address string) string {
+	address, _ = instances.SplitZone(address)
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
+
+// isInstanceNode returns true if any of the addresses of the given node matches the address of the given instance, or
+// any of the addresses its DNS name resolved to
+func isInstanceNode(instance *instances.InstanceInfo, node *core.Node) bool {
+	for _, nodeAddress := range node.Status.Addresses {
+		if sameAddress(instance.Address, nodeAddress.Address) {
+			return true
+		}
+		ip := net.ParseIP(nodeAddress.Address)
+		if ip == nil {
+			continue
+		}
+		for _, resolved := range instance.ResolvedIPs {
+			if resolved.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mapToConfigMap fulfills the MapFn type, while always returning a request to the named instance ConfigMap. As all
+// instance ConfigMaps are reconciled together, the request results in the instances of all of them being reconciled.
+func (r *ConfigMapReconciler) mapToConfigMap(_ client.Object) []reconcile.Request {
+	return []reconcile.Request{{
+		NamespacedName: kubeTypes.NamespacedName{Namespace: r.watchNamespace, Name: r.instanceConfigMap},
+	}}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	configMapPredicate := predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return r.isInstanceConfigMap(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			// A ConfigMap whose label was removed is reconciled, so that the instances it described are removed.
+			// Reporting the instance states must not result in the ConfigMap being reconciled again.
+			if r.isInstanceConfigMap(e.ObjectOld) || r.isInstanceConfigMap(e.ObjectNew) {
+				return !onlyStatusChanged(e.ObjectOld, e.ObjectNew)
+			}
+			return false
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return r.isInstanceConfigMap(e.Object)
+		},
+	}
+	rotationSecretPredicate := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.GetNamespace() == r.watchNamespace && object.GetName() == secrets.PrivateKeyRotationSecret
+	})
+	// Instances waiting for the private key secret are configured as soon as it is created
+	privateKeyCreatedPredicate := predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return isPrivateKeySecret(e.Object, r.watchNamespace)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return false
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
 			return false
 		},
 	}
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&core.ConfigMap{}, builder.WithPredicates(configMapPredicate)).
 		Watches(&source.Kind{Type: &core.Node{}}, handler.EnqueueRequestsFromMapFunc(r.mapToConfigMap),
-			builder.WithPredicates(windowsNodePredicate(true))).
-		Complete(r)
+			builder.WithPredicates(windowsNodePredicate(true), predicate.NewPredicateFuncs(r.owns))).
+		Watches(&source.Kind{Type: &core.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.mapToConfigMap),
+			builder.WithPredicates(rotationSecretPredicate)).
+		Watches(&source.Kind{Type: &core.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.mapToConfigMap),
+			builder.WithPredicates(privateKeyCreatedPredicate)).
+		Complete(tracing.Reconciler("ReconcileConfigMap", r))
 }
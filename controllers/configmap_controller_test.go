@@ -1,12 +1,43 @@
 package controllers
 
 import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	core "k8s.io/api/core/v1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/openshift/windows-machine-config-operator/pkg/cluster"
 	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+	"github.com/openshift/windows-machine-config-operator/pkg/metrics"
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
+	"github.com/openshift/windows-machine-config-operator/pkg/windows"
+	"github.com/openshift/windows-machine-config-operator/version"
 )
 
 func TestParseHosts(t *testing.T) {
@@ -24,6 +55,48 @@ func TestParseHosts(t *testing.T) {
 			expectedOut: nil,
 			expectedErr: true,
 		},
+		{
+			name:        "empty username",
+			input:       map[string]string{"localhost": "username="},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "username with invalid character",
+			input:       map[string]string{"localhost": "username=core*"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "username with control character",
+			input:       map[string]string{"localhost": "username=co\tre"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "username of only periods",
+			input:       map[string]string{"localhost": "username=.."},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "username with empty domain",
+			input:       map[string]string{"localhost": "username=\\core"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "domain username with spaces",
+			input:       map[string]string{"localhost": "username=CORP\\Windows Admin"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "CORP\\Windows Admin"}},
+			expectedErr: false,
+		},
+		{
+			name:        "UPN username",
+			input:       map[string]string{"localhost": "username=admin@corp.example.com"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "admin@corp.example.com"}},
+			expectedErr: false,
+		},
 		{
 			name:        "invalid DNS address",
 			input:       map[string]string{"notlocalhost": "username=core"},
@@ -54,22 +127,2361 @@ func TestParseHosts(t *testing.T) {
 			expectedOut: []*instances.InstanceInfo{{Address: "127.0.0.1", Username: "core"}},
 			expectedErr: false,
 		},
+		{
+			name:        "unknown key",
+			input:       map[string]string{"localhost": "username=core,unknown=value"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "duplicate key",
+			input:       map[string]string{"localhost": "username=core,username=Admin"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid shutdown grace period",
+			input:       map[string]string{"localhost": "username=core,shutdownGracePeriod=30"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "critical pods shutdown grace period greater than shutdown grace period",
+			input: map[string]string{"localhost": "username=core,shutdownGracePeriod=30s," +
+				"shutdownGracePeriodCriticalPods=1m"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "valid shutdown grace periods",
+			input: map[string]string{"localhost": "username=core,shutdownGracePeriod=30s," +
+				"shutdownGracePeriodCriticalPods=10s"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				KubeletConfig: instances.KubeletConfig{ShutdownGracePeriod: duration(30 * time.Second),
+					ShutdownGracePeriodCriticalPods: duration(10 * time.Second)}}},
+			expectedErr: false,
+		},
+		{
+			name:        "invalid feature gate value",
+			input:       map[string]string{"localhost": "username=core,featureGates=GracefulNodeShutdown=yes"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid feature gate name",
+			input:       map[string]string{"localhost": "username=core,featureGates=graceful-node-shutdown=true"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "duplicate feature gate",
+			input: map[string]string{"localhost": "username=core," +
+				"featureGates=GracefulNodeShutdown=true;GracefulNodeShutdown=false"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "conflicting required feature gate",
+			input:       map[string]string{"localhost": "username=core,featureGates=RotateKubeletServerCertificate=false"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "valid feature gates",
+			input: map[string]string{"localhost": "username=core," +
+				"featureGates=GracefulNodeShutdown=true;RotateKubeletServerCertificate=true"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				KubeletConfig: instances.KubeletConfig{FeatureGates: map[string]bool{"GracefulNodeShutdown": true,
+					"RotateKubeletServerCertificate": true}}}},
+			expectedErr: false,
+		},
+		{
+			name:        "invalid DNS search domain",
+			input:       map[string]string{"localhost": "username=core,dnsSearchDomains=example.com;-invalid"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:  "valid DNS search domains",
+			input: map[string]string{"localhost": "username=core,dnsSearchDomains=example.com;corp.example.com"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				DNSSearchDomains: []string{"example.com", "corp.example.com"}}},
+			expectedErr: false,
+		},
+		{
+			name: "service CIDR override and NAT exceptions",
+			input: map[string]string{"localhost": "username=core,serviceCIDR=10.96.0.0/16," +
+				"natExceptions=172.30.0.0/16;192.168.1.0/24"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core", ServiceCIDR: "10.96.0.0/16",
+				NATExceptions: []string{"172.30.0.0/16", "192.168.1.0/24"}}},
+			expectedErr: false,
+		},
+		{
+			name:        "invalid service CIDR",
+			input:       map[string]string{"localhost": "username=core,serviceCIDR=10.96.0.0"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "service CIDR of an IP family not used by the cluster",
+			input:       map[string]string{"localhost": "username=core,serviceCIDR=fd02::/112"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid NAT exception",
+			input:       map[string]string{"localhost": "username=core,natExceptions=172.30.0.0/16;192.168.1.0/33"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "empty NAT exception",
+			input:       map[string]string{"localhost": "username=core,natExceptions=172.30.0.0/16;"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid bootstrap kubeconfig secret name",
+			input:       map[string]string{"localhost": "username=core,bootstrapKubeconfigSecret=Invalid_Name"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:  "valid bootstrap kubeconfig secret name",
+			input: map[string]string{"localhost": "username=core,bootstrapKubeconfigSecret=host-bootstrap"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				BootstrapKubeconfigSecret: "host-bootstrap"}},
+			expectedErr: false,
+		},
+		{
+			name:        "invalid image GC threshold",
+			input:       map[string]string{"localhost": "username=core,imageGCHighThresholdPercent=90%"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "image GC threshold out of range",
+			input:       map[string]string{"localhost": "username=core,imageGCHighThresholdPercent=101"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "image GC high threshold not greater than low threshold",
+			input: map[string]string{"localhost": "username=core,imageGCHighThresholdPercent=70," +
+				"imageGCLowThresholdPercent=70"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "image GC high threshold not greater than default low threshold",
+			input:       map[string]string{"localhost": "username=core,imageGCHighThresholdPercent=75"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "valid ssh port",
+			input:       map[string]string{"localhost": "username=Admin,sshPort=2222"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "Admin", SSHPort: 2222}},
+			expectedErr: false,
+		},
+		{
+			name:        "non-numeric ssh port",
+			input:       map[string]string{"localhost": "username=Admin,sshPort=ssh"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "out of range ssh port",
+			input:       map[string]string{"localhost": "username=Admin,sshPort=65536"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "zero ssh port",
+			input:       map[string]string{"localhost": "username=Admin,sshPort=0"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "ssh port conflicting with the default VXLAN port",
+			input:       map[string]string{"localhost": "username=Admin,sshPort=4789"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "non topology label",
+			input:       map[string]string{"localhost": "username=core,topologyLabels=kubernetes.io/os=windows"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid topology label value",
+			input:       map[string]string{"localhost": "username=core,topologyLabels=topology.kubernetes.io/zone=a b"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "malformed topology labels",
+			input:       map[string]string{"localhost": "username=core,topologyLabels=topology.kubernetes.io/zone"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "valid topology labels",
+			input: map[string]string{"localhost": "username=core,topologyLabels=topology.kubernetes.io/zone=us-east-1a;" +
+				"topology.kubernetes.io/region=us-east-1"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				TopologyLabels: map[string]string{core.LabelTopologyZone: "us-east-1a",
+					core.LabelTopologyRegion: "us-east-1"}}},
+			expectedErr: false,
+		},
+		{
+			name:  "valid labels",
+			input: map[string]string{"localhost": "username=core,labels=gpu:true;example.com/tier:gold"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				Labels: map[string]string{"gpu": "true", "example.com/tier": "gold"}}},
+			expectedErr: false,
+		},
+		{
+			name:        "invalid label key",
+			input:       map[string]string{"localhost": "username=core,labels=-gpu:true"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid label value",
+			input:       map[string]string{"localhost": "username=core,labels=gpu:a b"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "reserved label key",
+			input:       map[string]string{"localhost": "username=core,labels=node-role.kubernetes.io/worker:"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "topology label set as custom label",
+			input:       map[string]string{"localhost": "username=core,labels=topology.kubernetes.io/zone:a"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "malformed labels",
+			input:       map[string]string{"localhost": "username=core,labels=gpu=true"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "valid taints",
+			input: map[string]string{"localhost": "username=core," +
+				"taints=dedicated=winapp:NoSchedule;example.com/gpu:NoExecute"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				Taints: []core.Taint{{Key: "dedicated", Value: "winapp", Effect: core.TaintEffectNoSchedule},
+					{Key: "example.com/gpu", Effect: core.TaintEffectNoExecute}}}},
+			expectedErr: false,
+		},
+		{
+			name:        "invalid taint effect",
+			input:       map[string]string{"localhost": "username=core,taints=dedicated=winapp:NoRun"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "taint without effect",
+			input:       map[string]string{"localhost": "username=core,taints=dedicated=winapp"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid taint key",
+			input:       map[string]string{"localhost": "username=core,taints=-dedicated:NoSchedule"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "duplicate taint",
+			input: map[string]string{"localhost": "username=core," +
+				"taints=dedicated=a:NoSchedule;dedicated=b:NoSchedule"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name: "valid image GC thresholds",
+			input: map[string]string{"localhost": "username=core,imageGCHighThresholdPercent=75," +
+				"imageGCLowThresholdPercent=50"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+				KubeletConfig: instances.KubeletConfig{ImageGCHighThresholdPercent: 75,
+					ImageGCLowThresholdPercent: 50}}},
+			expectedErr: false,
+		},
 		{
 			name:        "valid dns and ip addresses",
-			input:       map[string]string{"localhost": "username=core", "127.0.0.1": "username=Admin"},
-			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core"}, {Address: "127.0.0.1", Username: "Admin"}},
+			input:       map[string]string{"localhost": "username=core", "127.0.0.2": "username=Admin"},
+			expectedOut: []*instances.InstanceInfo{{Address: "localhost", Username: "core"}, {Address: "127.0.0.2", Username: "Admin"}},
 			expectedErr: false,
 		},
+		{
+			name:        "hostname and its ip address",
+			input:       map[string]string{"localhost": "username=core", "127.0.0.1": "username=Admin"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
+		{
+			name:        "equivalent ip addresses",
+			input:       map[string]string{"127.0.0.2": "username=core", "::ffff:127.0.0.2": "username=Admin"},
+			expectedOut: nil,
+			expectedErr: true,
+		},
 	}
 	for _, test := range testCases {
 		t.Run(test.name, func(t *testing.T) {
-			out, err := r.parseHosts(test.input)
+			out, _, err := r.parseHosts(test.input, false)
 			if test.expectedErr {
 				assert.Error(t, err)
 				return
 			}
 			require.NoError(t, err)
-			assert.ElementsMatch(t, test.expectedOut, out)
+			assert.ElementsMatch(t, test.expectedOut, withoutResolvedIPs(out))
+		})
+	}
+}
+
+// TestParseHostsKubeletConfigDefaults tests that the operator level kubelet settings are applied to hosts, and can be
+// overridden by the host specific settings
+// TestValidateSSHPort tests that the SSH port of an instance is rejected if it is the VXLAN port used by Windows nodes,
+// whether it is the default port or a custom one
+func TestValidateSSHPort(t *testing.T) {
+	testCases := []struct {
+		name        string
+		vxlanPort   string
+		sshPort     int
+		expectedErr bool
+	}{
+		{"default VXLAN port", "", 2222, false},
+		{"conflicting with the default VXLAN port", "", 4789, true},
+		{"custom VXLAN port", "9898", 2222, false},
+		{"conflicting with a custom VXLAN port", "9898", 9898, true},
+		{"default VXLAN port with a custom VXLAN port", "9898", 4789, false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r := ConfigMapReconciler{instanceReconciler: instanceReconciler{vxlanPort: test.vxlanPort}}
+			err := r.validateSSHPort(test.sshPort)
+			if !test.expectedErr {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "conflicts with the VXLAN port")
+
+			// The conflict is reported as an invalid sshPort entry
+			_, _, err = r.parseHosts(map[string]string{"localhost": fmt.Sprintf("username=core,sshPort=%d",
+				test.sshPort)}, false)
+			parseErrs := ParseErrors(err)
+			require.Len(t, parseErrs, 1)
+			assert.Equal(t, sshPortKey, parseErrs[0].Key)
 		})
 	}
 }
+
+func TestParseHostsKubeletConfigDefaults(t *testing.T) {
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{
+		kubeletConfig: instances.KubeletConfig{ShutdownGracePeriod: duration(time.Minute),
+			ShutdownGracePeriodCriticalPods: duration(20 * time.Second)}}}
+
+	out, _, err := r.parseHosts(map[string]string{
+		"localhost": "username=core",
+		"127.0.0.2": "username=Admin,shutdownGracePeriodCriticalPods=30s",
+		// Graceful node shutdown can be disabled on an instance despite the operator level grace periods
+		"127.0.0.3": "username=core,shutdownGracePeriod=0s,shutdownGracePeriodCriticalPods=0s",
+	}, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*instances.InstanceInfo{
+		{Address: "localhost", Username: "core", KubeletConfig: instances.KubeletConfig{
+			ShutdownGracePeriod: duration(time.Minute), ShutdownGracePeriodCriticalPods: duration(20 * time.Second)}},
+		{Address: "127.0.0.2", Username: "Admin", KubeletConfig: instances.KubeletConfig{
+			ShutdownGracePeriod: duration(time.Minute), ShutdownGracePeriodCriticalPods: duration(30 * time.Second)}},
+		{Address: "127.0.0.3", Username: "core", KubeletConfig: instances.KubeletConfig{
+			ShutdownGracePeriod: duration(0), ShutdownGracePeriodCriticalPods: duration(0)}},
+	}, withoutResolvedIPs(out))
+	for _, host := range out {
+		if host.Address == "127.0.0.3" {
+			assert.Equal(t, map[string]interface{}{"shutdownGracePeriod": "0s",
+				"shutdownGracePeriodCriticalPods": "0s"}, host.KubeletConfig.Overrides())
+		}
+	}
+}
+
+// duration returns a pointer to the given duration
+func duration(d time.Duration) *time.Duration {
+	return &d
+}
+
+// TestParseHostsRemoveUnresolvableHosts tests that entries with a DNS name which does not resolve are only left out of
+// the parsed hosts when removeUnresolvableHosts is set
+func TestParseHostsRemoveUnresolvableHosts(t *testing.T) {
+	input := map[string]string{"localhost": "username=core", "notlocalhost": "username=core"}
+
+	r := ConfigMapReconciler{}
+	_, _, err := r.parseHosts(input, false)
+	assert.Error(t, err)
+
+	r.removeUnresolvableHosts = true
+	out, unresolvable, err := r.parseHosts(input, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*instances.InstanceInfo{{Address: "localhost", Username: "core"}},
+		withoutResolvedIPs(out))
+	assert.ElementsMatch(t, []string{"notlocalhost"}, unresolvable)
+
+	// Invalid addresses are still rejected
+	_, _, err = r.parseHosts(map[string]string{"::1": "username=core"}, false)
+	assert.Error(t, err)
+}
+
+// withoutResolvedIPs returns copies of the given instances without the addresses their DNS names resolved to, which
+// depend on the resolver of the host running the tests
+func withoutResolvedIPs(hosts []*instances.InstanceInfo) []*instances.InstanceInfo {
+	var result []*instances.InstanceInfo
+	for _, host := range hosts {
+		withoutIPs := *host
+		withoutIPs.ResolvedIPs = nil
+		result = append(result, &withoutIPs)
+	}
+	return result
+}
+
+// TestParseHostsDuplicateAddresses tests that entries resolving to the same ip address are reported by name
+func TestParseHostsDuplicateAddresses(t *testing.T) {
+	r := ConfigMapReconciler{dnsCacheTTL: time.Minute,
+		dnsCache: map[string]dnsCacheEntry{"windows.example.com": {addresses: []string{"10.0.0.1", "10.0.0.2"},
+			expiry: time.Now().Add(time.Minute)}}}
+	_, _, err := r.parseHosts(map[string]string{"windows.example.com": "username=core", "10.0.0.2": "username=core",
+		"10.0.0.3": "username=core"}, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "entries 10.0.0.2 and windows.example.com both resolve to 10.0.0.2")
+
+	out, _, err := r.parseHosts(map[string]string{"windows.example.com": "username=core", "10.0.0.3": "username=core"},
+		false)
+	require.NoError(t, err)
+	assert.Len(t, out, 2)
+}
+
+// TestParseInstanceConfigMaps tests that the hosts of all instance ConfigMaps are merged, and that an address described
+// by more than one of them is rejected
+func TestParseInstanceConfigMaps(t *testing.T) {
+	recorder := record.NewFakeRecorder(2)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+		recorder: recorder}}
+	first := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap},
+		Data: map[string]string{"127.0.0.1": "username=core"}}
+	second := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "more-instances"},
+		Data: map[string]string{"127.0.0.2": "username=core"}}
+
+	hosts, _, owners, skipped, err := r.parseInstanceConfigMaps([]*core.ConfigMap{first, second})
+	require.NoError(t, err)
+	assert.Len(t, hosts, 2)
+	assert.Equal(t, first, owners["127.0.0.1"])
+	assert.Equal(t, second, owners["127.0.0.2"])
+	assert.Empty(t, skipped)
+	assert.Empty(t, recorder.Events)
+
+	// A duplicated address is kept by the first ConfigMap, and only the duplicate entry is ignored
+	second.Data["127.0.0.1"] = "username=core"
+	hosts, _, owners, skipped, err = r.parseInstanceConfigMaps([]*core.ConfigMap{first, second})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "host 127.0.0.1 is described by both ConfigMap windows-instances and ConfigMap "+
+		"more-instances")
+	assert.Len(t, hosts, 2)
+	assert.Equal(t, first, owners["127.0.0.1"])
+	assert.Equal(t, second, owners["127.0.0.2"])
+	assert.Empty(t, skipped)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "already described by ConfigMap windows-instances")
+
+	// A ConfigMap with an invalid entry is skipped, while the instances of the others are kept
+	delete(second.Data, "127.0.0.1")
+	first.Data["127.0.0.3"] = "sshPort=22"
+	hosts, _, owners, skipped, err = r.parseInstanceConfigMaps([]*core.ConfigMap{first, second})
+	require.Error(t, err)
+	require.Len(t, hosts, 1)
+	assert.Equal(t, "127.0.0.2", hosts[0].Address)
+	assert.Equal(t, second, owners["127.0.0.2"])
+	assert.Equal(t, map[string]bool{InstanceConfigMap: true}, skipped)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "unable to parse hosts from ConfigMap")
+}
+
+// TestSkippedConfigMapNodesKept tests that the instances of valid ConfigMaps are reconciled while another ConfigMap is
+// invalid, without the nodes of the invalid ConfigMap being removed
+func TestSkippedConfigMapNodesKept(t *testing.T) {
+	newNode := func(name, address, configMap string) core.Node {
+		return core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: name,
+				Labels: map[string]string{core.LabelOSStable: "windows", ConfigMapLabel: configMap},
+				Annotations: map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+					nodeconfig.VersionAnnotation: version.Get()}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}},
+		}
+	}
+	c := &mutationRecordingClient{nodeListClient: nodeListClient{nodes: []core.Node{
+		newNode("broken", "127.0.0.1", "team-a"), newNode("removed", "127.0.0.2", "team-b")}}}
+	recorder := record.NewFakeRecorder(10)
+	privateKeySigner, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+		recorder: recorder, signer: privateKeySigner}, configurationWorkers: 1, maxUnavailable: 1,
+		backoff: newConfigurationBackoff(time.Second, time.Minute), dryRun: true, instanceConfigMap: InstanceConfigMap}
+	teamA := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "team-a", Namespace: "wmco"},
+		Data: map[string]string{"127.0.0.1": "username=core", "127.0.0.4": "sshPort=22"}}
+	teamB := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "team-b", Namespace: "wmco"},
+		Data: map[string]string{"127.0.0.3": "username=core"}}
+
+	err = r.reconcileNodes(context.Background(), []*core.ConfigMap{teamA, teamB}, r.log)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to parse hosts from ConfigMap team-a")
+	var events []string
+	for len(recorder.Events) != 0 {
+		events = append(events, <-recorder.Events)
+	}
+	require.Len(t, events, 3)
+	assert.Contains(t, events[0], "Warning InstanceSetupFailure unable to parse hosts from ConfigMap")
+	assert.ElementsMatch(t, []string{"Normal DryRunConfigure dry run: would configure instance 127.0.0.3",
+		"Normal DryRunRemove dry run: would drain and remove node removed"}, events[1:])
+	assert.Empty(t, c.mutated)
+
+	// An unlabeled node could be described by the skipped ConfigMap, and is kept as well
+	c.nodes = []core.Node{newNode("unlabeled", "127.0.0.5", "")}
+	delete(c.nodes[0].Labels, ConfigMapLabel)
+	require.Error(t, r.reconcileNodes(context.Background(), []*core.ConfigMap{teamA, teamB}, r.log))
+	for len(recorder.Events) != 0 {
+		assert.NotContains(t, <-recorder.Events, "DryRunRemove")
+	}
+}
+
+// TestIsInstanceConfigMap tests that the windows-instances ConfigMap and labeled ConfigMaps in the watch namespace
+// describe instances
+func TestIsInstanceConfigMap(t *testing.T) {
+	testCases := []struct {
+		name      string
+		configMap *core.ConfigMap
+		expected  bool
+	}{
+		{
+			name:      "windows-instances ConfigMap",
+			configMap: &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Namespace: "wmco"}},
+			expected:  true,
+		},
+		{
+			name: "labeled ConfigMap",
+			configMap: &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "other", Namespace: "wmco",
+				Labels: map[string]string{InstancesLabel: "true"}}},
+			expected: true,
+		},
+		{
+			name: "ConfigMap with a false label",
+			configMap: &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "other", Namespace: "wmco",
+				Labels: map[string]string{InstancesLabel: "false"}}},
+			expected: false,
+		},
+		{
+			name: "labeled ConfigMap in another namespace",
+			configMap: &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "other", Namespace: "default",
+				Labels: map[string]string{InstancesLabel: "true"}}},
+			expected: false,
+		},
+	}
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{watchNamespace: "wmco"},
+		instanceConfigMap: InstanceConfigMap}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, r.isInstanceConfigMap(test.configMap))
+		})
+	}
+}
+
+// configMapClient is a client which serves the given ConfigMaps, filtered by the label selector of list requests. All
+// other requests are unimplemented.
+type configMapClient struct {
+	client.Client
+	configMaps []core.ConfigMap
+}
+
+func (c *configMapClient) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	for _, configMap := range c.configMaps {
+		if configMap.GetNamespace() == key.Namespace && configMap.GetName() == key.Name {
+			configMap.DeepCopyInto(obj.(*core.ConfigMap))
+			return nil
+		}
+	}
+	return k8sapierrors.NewNotFound(core.Resource("configmaps"), key.Name)
+}
+
+func (c *configMapClient) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+	configMapList := list.(*core.ConfigMapList)
+	for _, configMap := range c.configMaps {
+		if configMap.GetNamespace() == listOpts.Namespace &&
+			(listOpts.LabelSelector == nil || listOpts.LabelSelector.Matches(labels.Set(configMap.GetLabels()))) {
+			configMapList.Items = append(configMapList.Items, configMap)
+		}
+	}
+	return nil
+}
+
+// TestCustomInstanceConfigMap tests that a reconciler configured with a custom ConfigMap name reconciles the ConfigMap
+// with that name, and ignores the windows-instances ConfigMap
+func TestCustomInstanceConfigMap(t *testing.T) {
+	newConfigMap := func(name string, labels map[string]string) core.ConfigMap {
+		return core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: name, Namespace: "wmco", Labels: labels}}
+	}
+	defaultConfigMap := newConfigMap(InstanceConfigMap, nil)
+	customConfigMap := newConfigMap("tenant-a-instances", nil)
+	labeledConfigMap := newConfigMap("more-instances", map[string]string{InstancesLabel: "true",
+		OperatorLabel: "tenant-a-instances"})
+	// Labeled ConfigMaps without the operator label belong to the operator using the default name
+	otherConfigMap := newConfigMap("default-instances", map[string]string{InstancesLabel: "true"})
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{watchNamespace: "wmco",
+		client: &configMapClient{configMaps: []core.ConfigMap{defaultConfigMap, customConfigMap, labeledConfigMap,
+			otherConfigMap}}},
+		instanceConfigMap: instanceConfigMapName(Options{InstanceConfigMap: "tenant-a-instances"})}
+
+	assert.False(t, r.isInstanceConfigMap(&defaultConfigMap))
+	assert.True(t, r.isInstanceConfigMap(&customConfigMap))
+	assert.True(t, r.isInstanceConfigMap(&labeledConfigMap))
+	assert.False(t, r.isInstanceConfigMap(&otherConfigMap))
+
+	configMaps, err := r.getInstanceConfigMaps(context.Background())
+	require.NoError(t, err)
+	var names []string
+	for _, configMap := range configMaps {
+		names = append(names, configMap.GetName())
+	}
+	assert.Equal(t, []string{"tenant-a-instances", "more-instances"}, names)
+
+	// Node and secret events are mapped to the custom ConfigMap
+	assert.Equal(t, []reconcile.Request{{NamespacedName: kubeTypes.NamespacedName{Namespace: "wmco",
+		Name: "tenant-a-instances"}}}, r.mapToConfigMap(&core.Node{}))
+	// The default ConfigMap is not considered released, as it never described instances for this reconciler
+	released, err := r.getReleasedConfigMap(context.Background(),
+		kubeTypes.NamespacedName{Namespace: "wmco", Name: InstanceConfigMap})
+	require.NoError(t, err)
+	assert.Nil(t, released)
+
+	assert.Equal(t, InstanceConfigMap, instanceConfigMapName(Options{}))
+}
+
+// namespaceClient is a client which serves ConfigMaps like configMapClient, and node lists like
+// mutationRecordingClient, so that several reconcilers can share the objects of a namespace
+type namespaceClient struct {
+	mutationRecordingClient
+	configMaps configMapClient
+}
+
+func (c *namespaceClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*core.ConfigMapList); ok {
+		return c.configMaps.List(ctx, list, opts...)
+	}
+	return c.mutationRecordingClient.List(ctx, list, opts...)
+}
+
+func (c *namespaceClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	return c.configMaps.Get(ctx, key, obj)
+}
+
+// TestOperatorsSharingNamespace tests that operators watching the same namespace with distinct instance ConfigMaps
+// only read their own labeled ConfigMaps, and never remove the nodes of each other
+func TestOperatorsSharingNamespace(t *testing.T) {
+	newNode := func(name, address, operator string) core.Node {
+		return core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: name,
+				Labels: map[string]string{core.LabelOSStable: "windows", OperatorLabel: operator},
+				Annotations: map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+					nodeconfig.VersionAnnotation: version.Get()}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}},
+		}
+	}
+	newConfigMap := func(name string, labels, data map[string]string) core.ConfigMap {
+		return core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: name, Namespace: "wmco", Labels: labels}, Data: data}
+	}
+	c := &namespaceClient{
+		mutationRecordingClient: mutationRecordingClient{nodeListClient: nodeListClient{nodes: []core.Node{
+			newNode("a", "127.0.0.1", "tenant-a-instances"), newNode("b", "127.0.0.2", "tenant-b-instances")}}},
+		configMaps: configMapClient{configMaps: []core.ConfigMap{
+			newConfigMap("tenant-a-instances", nil, map[string]string{"127.0.0.1": "username=core"}),
+			newConfigMap("tenant-b-instances", nil, nil),
+			newConfigMap("team-b", map[string]string{InstancesLabel: "true", OperatorLabel: "tenant-b-instances"},
+				map[string]string{"127.0.0.2": "username=core"}),
+		}},
+	}
+	privateKeySigner, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	newReconciler := func(name string) (*ConfigMapReconciler, *record.FakeRecorder) {
+		recorder := record.NewFakeRecorder(10)
+		return &ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName(name),
+			recorder: recorder, signer: privateKeySigner, watchNamespace: "wmco"}, configurationWorkers: 1,
+			maxUnavailable: 1, backoff: newConfigurationBackoff(time.Second, time.Minute), dryRun: true,
+			instanceConfigMap: name}, recorder
+	}
+	a, aRecorder := newReconciler("tenant-a-instances")
+	b, bRecorder := newReconciler("tenant-b-instances")
+	reconcile := func(r *ConfigMapReconciler) {
+		configMaps, err := r.getInstanceConfigMaps(context.Background())
+		require.NoError(t, err)
+		require.NoError(t, r.reconcileNodes(context.Background(), configMaps, r.log))
+	}
+
+	// Each operator finds its own node up to date, and leaves the node of the other operator alone
+	reconcile(a)
+	reconcile(b)
+	assert.Empty(t, aRecorder.Events)
+	assert.Empty(t, bRecorder.Events)
+
+	// Once the instance of operator A is removed, only its own node is removed
+	c.configMaps.configMaps[0].Data = nil
+	reconcile(a)
+	reconcile(b)
+	require.Len(t, aRecorder.Events, 1)
+	assert.Equal(t, "Normal DryRunRemove dry run: would drain and remove node a", <-aRecorder.Events)
+	assert.Empty(t, bRecorder.Events)
+	assert.Empty(t, c.mutated)
+}
+
+// TestParseHostsWhitespaceAndComments tests that whitespace surrounding addresses, keys and values is ignored, and that
+// entries with an address starting with # are skipped
+func TestParseHostsWhitespaceAndComments(t *testing.T) {
+	r := ConfigMapReconciler{}
+	out, _, err := r.parseHosts(map[string]string{
+		" 127.0.0.2 ":      " username = core , sshPort= 2222\n",
+		"\t127.0.0.3":      "username =core,shutdownGracePeriod =1m ",
+		"# decommissioned": "username=core",
+		"#127.0.0.4":       "not a valid entry",
+	}, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*instances.InstanceInfo{
+		{Address: "127.0.0.2", Username: "core", SSHPort: 2222},
+		{Address: "127.0.0.3", Username: "core",
+			KubeletConfig: instances.KubeletConfig{ShutdownGracePeriod: duration(time.Minute)}},
+	}, withoutResolvedIPs(out))
+
+	// Entries which only differ by whitespace specify the same address
+	_, _, err = r.parseHosts(map[string]string{"127.0.0.2": "username=core", "127.0.0.2 ": "username=core"}, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "address 127.0.0.2 is specified by multiple entries")
+}
+
+// TestParseHostsSkipDNSValidation tests that DNS names are accepted without being looked up when DNS validation is
+// skipped, while ip addresses are still validated
+func TestParseHostsSkipDNSValidation(t *testing.T) {
+	r := ConfigMapReconciler{}
+	data := map[string]string{"windows.invalid": "username=core", "WIN-HOST.internal": "username=core"}
+	_, _, err := r.parseHosts(data, false)
+	assert.Error(t, err)
+
+	out, _, err := r.parseHosts(data, true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*instances.InstanceInfo{{Address: "windows.invalid", Username: "core"},
+		{Address: "WIN-HOST.internal", Username: "core"}}, withoutResolvedIPs(out))
+
+	for _, address := range []string{"win_host", "::1", "-windows"} {
+		_, _, err = r.parseHosts(map[string]string{address: "username=core"}, true)
+		assert.Error(t, err, address)
+	}
+}
+
+// TestParseHostsAuthSecret tests that instances must reference an auth secret when the private key is unusable
+func TestParseHostsAuthSecret(t *testing.T) {
+	r := ConfigMapReconciler{}
+	out, _, err := r.parseHosts(map[string]string{"localhost": "username=core,authSecret=host-creds"}, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+		AuthSecret: "host-creds"}}, withoutResolvedIPs(out))
+	_, _, err = r.parseHosts(map[string]string{"localhost": "username=core,authSecret=Host_Creds"}, false)
+	assert.Error(t, err)
+
+	r.signerErr = errors.New("secret not found")
+	_, _, err = r.parseHosts(map[string]string{"localhost": "username=core"}, false)
+	assert.Error(t, err)
+	out, _, err = r.parseHosts(map[string]string{"localhost": "username=core,authSecret=host-creds"}, false)
+	require.NoError(t, err)
+	assert.Len(t, out, 1)
+
+	// Instances are left to be configured once the private key secret is created, if it does not exist
+	r.signerErr = errors.Wrap(k8sapierrors.NewNotFound(core.Resource("secrets"), secrets.PrivateKeySecret),
+		"unable to create signer from private key secret")
+	out, _, err = r.parseHosts(map[string]string{"localhost": "username=core"}, false)
+	require.NoError(t, err)
+	assert.Len(t, out, 1)
+}
+
+// TestParseHostsCredentialSecret tests that instances can reference a credential secret instead of the private key
+// secret, and that an instance cannot reference both an auth secret and a credential secret
+func TestParseHostsCredentialSecret(t *testing.T) {
+	r := ConfigMapReconciler{}
+	out, _, err := r.parseHosts(map[string]string{"localhost": "username=core,credentialSecret=team-a-key"}, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*instances.InstanceInfo{{Address: "localhost", Username: "core",
+		CredentialSecret: "team-a-key"}}, withoutResolvedIPs(out))
+	_, _, err = r.parseHosts(map[string]string{"localhost": "username=core,credentialSecret=Team_A"}, false)
+	assert.Error(t, err)
+	_, _, err = r.parseHosts(map[string]string{
+		"localhost": "username=core,credentialSecret=team-a-key,authSecret=host-creds"}, false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "only one of authSecret and credentialSecret can be set")
+
+	// The private key secret is not needed by instances referencing a credential secret
+	r.signerErr = errors.New("invalid private key")
+	_, _, err = r.parseHosts(map[string]string{"localhost": "username=core,credentialSecret=team-a-key"}, false)
+	assert.NoError(t, err)
+}
+
+// TestRequeueResult tests that a missing private key secret results in the reconcile being retried at a fixed interval
+func TestRequeueResult(t *testing.T) {
+	result, err := requeueResult(errPrivateKeyMissing)
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: privateKeyMissingRequeueInterval}, result)
+
+	aggregate := kerrors.NewAggregate([]error{errors.New("invalid bootstrap kubeconfig"), errPrivateKeyMissing})
+	result, err = requeueResult(aggregate)
+	assert.Equal(t, aggregate, err)
+	assert.Equal(t, ctrl.Result{}, result)
+
+	result, err = requeueResult(nil)
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+}
+
+// TestWithResync tests that the ConfigMap is requeued after the resync interval, unless it is requeued sooner
+func TestWithResync(t *testing.T) {
+	r := &ConfigMapReconciler{resyncInterval: 10 * time.Minute}
+	assert.Equal(t, ctrl.Result{RequeueAfter: 10 * time.Minute}, r.withResync(ctrl.Result{}))
+	assert.Equal(t, ctrl.Result{RequeueAfter: time.Minute}, r.withResync(ctrl.Result{RequeueAfter: time.Minute}))
+	assert.Equal(t, ctrl.Result{RequeueAfter: 10 * time.Minute},
+		r.withResync(ctrl.Result{RequeueAfter: time.Hour}))
+	assert.Equal(t, ctrl.Result{Requeue: true}, r.withResync(ctrl.Result{Requeue: true}))
+
+	// The periodic reconcile can be disabled
+	r.resyncInterval = 0
+	assert.Equal(t, ctrl.Result{}, r.withResync(ctrl.Result{}))
+}
+
+// TestParseHostsReportsAllErrors tests that all invalid entries are reported in the returned error
+func TestParseHostsReportsAllErrors(t *testing.T) {
+	r := ConfigMapReconciler{}
+	_, _, err := r.parseHosts(map[string]string{
+		"localhost": "username=core",
+		"127.0.0.1": "username=core,sshPort=ssh",
+		"127.0.0.2": "shutdownGracePeriod=1m",
+		"127.0.0.3": "username=core,unknownKey=value",
+		"::1":       "username=core",
+	}, false)
+	require.Error(t, err)
+	var aggregate kerrors.Aggregate
+	require.True(t, errors.As(err, &aggregate))
+	assert.Len(t, aggregate.Errors(), 4)
+	for _, expected := range []string{"entry 127.0.0.1", "entry 127.0.0.2", "entry 127.0.0.3", "invalid address ::1"} {
+		assert.Contains(t, err.Error(), expected)
+	}
+	assert.NotContains(t, err.Error(), "localhost")
+}
+
+// TestParseErrors tests that each invalid entry is reported through a ParseError holding the entry, the invalid key and
+// the reason, while keeping the messages of the errors
+func TestParseErrors(t *testing.T) {
+	r := ConfigMapReconciler{}
+	_, _, err := r.parseHosts(map[string]string{
+		"127.0.0.1":   "username=core,sshPort=ssh",
+		"127.0.0.2":   "shutdownGracePeriod=1m",
+		"::1":         "username=core",
+		"127.0.0.4":   "username=core",
+		" 127.0.0.4 ": "username=Admin",
+		"127.0.0.5":   "username=core",
+	}, false)
+	require.Error(t, err)
+	parseErrs := ParseErrors(err)
+	require.Len(t, parseErrs, 4)
+	byAddress := make(map[string]*ParseError)
+	for _, parseErr := range parseErrs {
+		byAddress[parseErr.Address] = parseErr
+	}
+
+	require.Contains(t, byAddress, "127.0.0.1")
+	assert.Equal(t, ParseErrorInvalidData, byAddress["127.0.0.1"].Reason)
+	assert.Equal(t, sshPortKey, byAddress["127.0.0.1"].Key)
+	assert.True(t, strings.HasPrefix(byAddress["127.0.0.1"].Error(),
+		"data for entry 127.0.0.1 has an incorrect format: invalid value for sshPort: "))
+
+	require.Contains(t, byAddress, "127.0.0.2")
+	assert.Equal(t, ParseErrorInvalidData, byAddress["127.0.0.2"].Reason)
+	assert.Empty(t, byAddress["127.0.0.2"].Key)
+	assert.Equal(t, "data for entry 127.0.0.2 has an incorrect format: missing username",
+		byAddress["127.0.0.2"].Error())
+
+	require.Contains(t, byAddress, "::1")
+	assert.Equal(t, ParseErrorInvalidAddress, byAddress["::1"].Reason)
+	assert.True(t, strings.HasPrefix(byAddress["::1"].Error(), "invalid address ::1: "))
+
+	require.Contains(t, byAddress, "127.0.0.4")
+	assert.Equal(t, ParseErrorDuplicateAddress, byAddress["127.0.0.4"].Reason)
+	assert.Equal(t, "address 127.0.0.4 is specified by multiple entries", byAddress["127.0.0.4"].Error())
+	assert.NotContains(t, byAddress, "127.0.0.5")
+
+	// Entries resolving to the same instance are reported as conflicting
+	_, _, err = r.parseHosts(map[string]string{"127.0.0.7": "username=core", "::ffff:127.0.0.7": "username=Admin"},
+		false)
+	require.Error(t, err)
+	parseErrs = ParseErrors(err)
+	require.Len(t, parseErrs, 1)
+	assert.Equal(t, ParseErrorConflictingAddress, parseErrs[0].Reason)
+	assert.Contains(t, parseErrs[0].Error(), "both resolve to 127.0.0.7")
+
+	assert.Empty(t, ParseErrors(errors.New("unrelated")))
+}
+
+// TestLookupHostCache tests that successful DNS lookups are cached until they expire, and failed lookups are not
+func TestLookupHostCache(t *testing.T) {
+	r := ConfigMapReconciler{dnsCacheTTL: time.Minute}
+	addresses, err := r.lookupHost("localhost")
+	require.NoError(t, err)
+	require.Contains(t, r.dnsCache, "localhost")
+	assert.Equal(t, addresses, r.dnsCache["localhost"].addresses)
+
+	// A cached entry is used until it expires
+	r.dnsCache["cached.example.com"] = dnsCacheEntry{addresses: []string{"10.0.0.1"},
+		expiry: time.Now().Add(time.Minute)}
+	addresses, err = r.lookupHost("cached.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, addresses)
+	ips, err := r.validateAddress("cached.example.com", false)
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1")}, ips)
+
+	// An expired entry is looked up again, and removed if the lookup fails
+	r.dnsCache["notlocalhost"] = dnsCacheEntry{addresses: []string{"10.0.0.1"}, expiry: time.Now().Add(-time.Second)}
+	_, err = r.lookupHost("notlocalhost")
+	assert.Error(t, err)
+	assert.NotContains(t, r.dnsCache, "notlocalhost")
+
+	// Nothing is cached when caching is disabled
+	r = ConfigMapReconciler{}
+	_, err = r.lookupHost("localhost")
+	require.NoError(t, err)
+	assert.Empty(t, r.dnsCache)
+}
+
+// TestValidateAddressRestrictions tests that addresses, and the addresses DNS names resolve to, are checked against the
+// allowed and denied CIDRs
+func TestValidateAddressRestrictions(t *testing.T) {
+	allowed, err := instances.ParseCIDRs([]string{"10.0.0.0/16", "192.168.1.0/24"})
+	require.NoError(t, err)
+	denied, err := instances.ParseCIDRs([]string{"10.0.1.0/24"})
+	require.NoError(t, err)
+	r := ConfigMapReconciler{allowedCIDRs: allowed, deniedCIDRs: denied, dnsCacheTTL: time.Minute,
+		dnsCache: map[string]dnsCacheEntry{
+			"allowed.example.com": {addresses: []string{"10.0.0.5"}, expiry: time.Now().Add(time.Minute)},
+			"denied.example.com":  {addresses: []string{"10.0.0.6", "10.0.1.6"}, expiry: time.Now().Add(time.Minute)},
+			"outside.example.com": {addresses: []string{"172.16.0.1"}, expiry: time.Now().Add(time.Minute)},
+		}}
+
+	testCases := []struct {
+		address       string
+		skipDNS       bool
+		expectedError string
+	}{
+		{address: "10.0.0.1"},
+		{address: "192.168.1.10"},
+		{address: "allowed.example.com"},
+		{address: "10.0.1.1", expectedError: "10.0.1.1 is within the denied CIDR 10.0.1.0/24"},
+		{address: "denied.example.com", expectedError: "10.0.1.6 is within the denied CIDR 10.0.1.0/24"},
+		{address: "192.168.2.1", expectedError: "192.168.2.1 is not within any of the allowed CIDRs"},
+		{address: "outside.example.com", expectedError: "172.16.0.1 is not within any of the allowed CIDRs"},
+		{address: "allowed.example.com", skipDNS: true, expectedError: "DNS validation cannot be skipped"},
+	}
+	for _, test := range testCases {
+		t.Run(test.address, func(t *testing.T) {
+			_, err := r.validateAddress(test.address, test.skipDNS)
+			if test.expectedError == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), test.expectedError)
+		})
+	}
+
+	// Only the denied CIDRs are checked when no allowed CIDRs are set
+	r.allowedCIDRs = nil
+	_, err = r.validateAddress("172.16.0.1", false)
+	assert.NoError(t, err)
+	_, err = r.validateAddress("10.0.1.1", false)
+	assert.Error(t, err)
+}
+
+func TestConfigMapDataFromNodes(t *testing.T) {
+	nodes := &core.NodeList{Items: []core.Node{
+		{
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true",
+				UsernameAnnotation: "core"}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true",
+				UsernameAnnotation: "Administrator"}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "::1"},
+				{Type: core.NodeInternalDNS, Address: "instance.dns.com"}}},
+		},
+		{
+			// Machine backed node
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{UsernameAnnotation: "core"}},
+			Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.2"}}},
+		},
+		{
+			// BYOH node missing the username annotation
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true"}},
+			Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.3"}}},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true",
+				UsernameAnnotation: "core", SSHPortAnnotation: "2222"}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.4"}}},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true",
+				UsernameAnnotation: "core", SSHPortAnnotation: "22", AuthSecretAnnotation: ""}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.5"}}},
+		},
+		{
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true",
+				UsernameAnnotation: "core", AuthSecretAnnotation: "host-creds"}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.6"}}},
+		},
+	}}
+
+	assert.Equal(t, map[string]string{"10.0.0.1": "username=core", "instance.dns.com": "username=Administrator",
+		"10.0.0.4": "username=core,sshPort=2222", "10.0.0.5": "username=core",
+		"10.0.0.6": "username=core,authSecret=host-creds"},
+		configMapDataFromNodes(nodes, cluster.IPv4))
+	assert.Equal(t, map[string]string{"::1": "username=Administrator"}, configMapDataFromNodes(nodes, cluster.IPv6))
+}
+
+// TestScopedAddress tests that the node of an instance with a scoped IPv6 link-local address is found by the address
+// without its zone, and that the zone is restored from the node
+func TestScopedAddress(t *testing.T) {
+	node := &core.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "winhost", Annotations: map[string]string{BYOHAnnotation: "true",
+			UsernameAnnotation: "core", ZoneAnnotation: "eth0"}},
+		Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "fe80::1"}}},
+	}
+	assert.True(t, isInstanceNode(&instances.InstanceInfo{Address: "fe80::1%eth0"}, node))
+	assert.True(t, isInstanceNode(&instances.InstanceInfo{Address: "fe80:0:0:0:0:0:0:1%eth0"}, node))
+	assert.False(t, isInstanceNode(&instances.InstanceInfo{Address: "fe80::2%eth0"}, node))
+
+	r := instanceReconciler{ipFamily: cluster.IPv6}
+	instance, err := r.instanceFromNode(node)
+	require.NoError(t, err)
+	assert.Equal(t, "fe80::1%eth0", instance.Address)
+	assert.Equal(t, map[string]string{"fe80::1%eth0": "username=core"},
+		configMapDataFromNodes(&core.NodeList{Items: []core.Node{*node}}, cluster.IPv6))
+
+	// The zone is only added to link-local addresses
+	assert.Equal(t, "fe80::1", withZone("fe80::1", ""))
+	assert.Equal(t, "2001:db8::1", withZone("2001:db8::1", "eth0"))
+	assert.Equal(t, "10.0.0.1", withZone("10.0.0.1", "eth0"))
+}
+
+// TestParseHostsIPFamily tests that only addresses supported by the IP family of the cluster network are accepted
+func TestParseHostsIPFamily(t *testing.T) {
+	testCases := []struct {
+		name        string
+		ipFamily    cluster.IPFamily
+		address     string
+		expectedErr string
+	}{
+		{"ipv4 on ipv4 cluster", cluster.IPv4, "127.0.0.1", ""},
+		{"ipv6 on ipv4 cluster", cluster.IPv4, "::1", "ipv6 is not supported"},
+		{"ipv4 on ipv6 cluster", cluster.IPv6, "127.0.0.1", "ipv4 is not supported"},
+		{"ipv6 on ipv6 cluster", cluster.IPv6, "::1", ""},
+		{"ipv4 on dual-stack cluster", cluster.DualStack, "127.0.0.1", ""},
+		{"compressed ipv6 on dual-stack cluster", cluster.DualStack, "fd00:10:20::5", ""},
+		{"expanded ipv6 on dual-stack cluster", cluster.DualStack, "fd00:10:20:0:0:0:0:5", ""},
+		{"scoped link-local ipv6 on ipv6 cluster", cluster.IPv6, "fe80::1%eth0", ""},
+		{"link-local ipv6 with interface index", cluster.DualStack, "fe80::1%2", ""},
+		{"scoped link-local ipv6 on ipv4 cluster", cluster.IPv4, "fe80::1%eth0", "ipv6 is not supported"},
+		{"scoped ipv4", cluster.DualStack, "10.0.0.1%eth0", "only be given for an IPv6 link-local address"},
+		{"scoped global ipv6", cluster.DualStack, "2001:db8::1%eth0", "only be given for an IPv6 link-local address"},
+		{"empty zone", cluster.IPv6, "fe80::1%", "invalid zone"},
+		{"scoped DNS name", cluster.DualStack, "winhost%eth0", "only be given for an IP address"},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			r := ConfigMapReconciler{instanceReconciler: instanceReconciler{ipFamily: test.ipFamily}}
+			out, _, err := r.parseHosts(map[string]string{test.address: "username=core"}, false)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []*instances.InstanceInfo{{Address: test.address, Username: "core"}},
+				withoutResolvedIPs(out))
+		})
+	}
+}
+
+// TestFindNodeResolvedIPs tests that the node of an entry with a DNS name is found by any of the addresses the name
+// resolved to, not only the first one
+func TestFindNodeResolvedIPs(t *testing.T) {
+	r := ConfigMapReconciler{dnsCacheTTL: time.Minute,
+		dnsCache: map[string]dnsCacheEntry{"windows.example.com": {addresses: []string{"10.0.0.1", "10.0.0.2"},
+			expiry: time.Now().Add(time.Minute)}}}
+	out, _, err := r.parseHosts(map[string]string{"windows.example.com": "username=core", "10.0.0.3": "username=core"},
+		false)
+	require.NoError(t, err)
+	require.Len(t, out, 2)
+	hostsByAddress := map[string]*instances.InstanceInfo{out[0].Address: out[0], out[1].Address: out[1]}
+	named := hostsByAddress["windows.example.com"]
+	require.NotNil(t, named)
+	assert.Equal(t, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, named.ResolvedIPs)
+	assert.Empty(t, hostsByAddress["10.0.0.3"].ResolvedIPs)
+
+	newNode := func(name, address string) core.Node {
+		return core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: name},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address},
+				{Type: core.NodeHostName, Address: name}}},
+		}
+	}
+	nodes := &core.NodeList{Items: []core.Node{newNode("other", "10.0.0.4"), newNode("secondary", "10.0.0.2")}}
+	node, found := findNode(named, nodes)
+	require.True(t, found)
+	assert.Equal(t, "secondary", node.GetName())
+	assert.True(t, hasAssociatedInstance(&nodes.Items[1], out))
+	assert.False(t, hasAssociatedInstance(&nodes.Items[0], out))
+}
+
+// TestFindNodeIPv6 tests that ipv6 addresses are matched regardless of their representation
+func TestFindNodeIPv6(t *testing.T) {
+	nodes := &core.NodeList{Items: []core.Node{{
+		ObjectMeta: meta.ObjectMeta{Name: "node"},
+		Status: core.NodeStatus{Addresses: []core.NodeAddress{
+			{Type: core.NodeInternalIP, Address: "10.0.0.5"},
+			{Type: core.NodeInternalIP, Address: "fd00:10:20::5"}}},
+	}}}
+	for _, address := range []string{"fd00:10:20::5", "fd00:10:20:0:0:0:0:5", "FD00:0010:0020::0005", "10.0.0.5"} {
+		node, found := findNode(&instances.InstanceInfo{Address: address}, nodes)
+		require.True(t, found, address)
+		assert.Equal(t, "node", node.GetName())
+		assert.True(t, hasAssociatedInstance(node, []*instances.InstanceInfo{{Address: address}}), address)
+	}
+
+	_, found := findNode(&instances.InstanceInfo{Address: "fd00:10:20::6"}, nodes)
+	assert.False(t, found)
+	assert.False(t, hasAssociatedInstance(&nodes.Items[0], []*instances.InstanceInfo{{Address: "fd00:10:20:0::6"}}))
+}
+
+// TestNodeIndex tests that looking up nodes and instances through the indexes gives the same results as comparing each
+// instance with each node
+func TestNodeIndex(t *testing.T) {
+	newNode := func(name string, addresses ...string) core.Node {
+		node := core.Node{ObjectMeta: meta.ObjectMeta{Name: name}}
+		for _, address := range addresses {
+			node.Status.Addresses = append(node.Status.Addresses,
+				core.NodeAddress{Type: core.NodeInternalIP, Address: address})
+		}
+		return node
+	}
+	nodes := &core.NodeList{Items: []core.Node{
+		newNode("ipv4", "10.0.0.1", "ipv4"),
+		newNode("ipv6", "fd00:10:20::5"),
+		newNode("link-local", "fe80::1"),
+		newNode("resolved", "10.0.0.2"),
+		// A second node with the same address, which is never found as the first node takes precedence
+		newNode("duplicate", "10.0.0.2"),
+	}}
+	instanceList := []*instances.InstanceInfo{
+		{Address: "10.0.0.1"},
+		{Address: "::ffff:10.0.0.1"},
+		{Address: "FD00:0010:0020::0005"},
+		{Address: "fe80::1%eth0"},
+		{Address: "ipv4"},
+		{Address: "windows.example.com", ResolvedIPs: []net.IP{net.ParseIP("10.0.0.9"), net.ParseIP("10.0.0.2")}},
+		// Resolving to the addresses of several nodes finds the first of them in the list
+		{Address: "multi.example.com", ResolvedIPs: []net.IP{net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")}},
+		{Address: "10.0.0.3"},
+		{Address: "unknown.example.com"},
+	}
+
+	index := newNodeIndex(nodes)
+	for _, instance := range instanceList {
+		expected, expectedFound := findNode(instance, nodes)
+		node, found := index.find(instance)
+		require.Equal(t, expectedFound, found, instance.Address)
+		assert.Equal(t, expected, node, instance.Address)
+	}
+	// The indexed node is a copy, which can be changed without affecting the list
+	node, _ := index.find(instanceList[0])
+	node.Labels = map[string]string{"changed": "true"}
+	assert.Empty(t, nodes.Items[0].Labels)
+
+	for i := range instanceList {
+		subset := instanceList[i : i+1]
+		indexed := newInstanceIndex(subset)
+		for _, node := range nodes.Items {
+			assert.Equal(t, hasAssociatedInstance(&node, subset), indexed.hasAssociatedInstance(&node),
+				"%s and %s", instanceList[i].Address, node.GetName())
+		}
+	}
+}
+
+// BenchmarkFindNode compares finding the node of each of 500 instances by comparing it with each node, against
+// finding it through a node index
+func BenchmarkFindNode(b *testing.B) {
+	const count = 500
+	nodes := &core.NodeList{}
+	var instanceList []*instances.InstanceInfo
+	for i := 0; i < count; i++ {
+		address := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		nodes.Items = append(nodes.Items, core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: fmt.Sprintf("node-%d", i)},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address},
+				{Type: core.NodeHostName, Address: fmt.Sprintf("node-%d", i)}}},
+		})
+		instanceList = append(instanceList, &instances.InstanceInfo{Address: address})
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			for _, instance := range instanceList {
+				findNode(instance, nodes)
+			}
+			for i := range nodes.Items {
+				hasAssociatedInstance(&nodes.Items[i], instanceList)
+			}
+		}
+	})
+	b.Run("index", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			index := newNodeIndex(nodes)
+			for _, instance := range instanceList {
+				index.find(instance)
+			}
+			indexed := newInstanceIndex(instanceList)
+			for i := range nodes.Items {
+				indexed.hasAssociatedInstance(&nodes.Items[i])
+			}
+		}
+	})
+}
+
+// TestIgnoredNodes tests that nodes with the ignore label are neither configured nor removed
+func TestIgnoredNodes(t *testing.T) {
+	r := ConfigMapReconciler{ignoreLabel: DefaultIgnoreLabel}
+	r.log = ctrl.Log.WithName("test")
+	newNode := func(address string, ignored bool) core.Node {
+		node := core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: address, Labels: map[string]string{},
+				Annotations: map[string]string{BYOHAnnotation: "true"}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}},
+		}
+		if ignored {
+			node.Labels[DefaultIgnoreLabel] = "true"
+		}
+		return node
+	}
+
+	t.Run("add path", func(t *testing.T) {
+		// The node is not annotated as configured, so it would be configured if it was not ignored
+		nodes := &core.NodeList{Items: []core.Node{newNode("127.0.0.1", true)}}
+		expected := nodes.DeepCopy()
+		require.NoError(t, r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{},
+			&instances.InstanceInfo{Address: "127.0.0.1", Username: "core"}, newNodeIndex(nodes),
+			r.newUpgradeBudget(1, nodes), r.log))
+		assert.Equal(t, expected, nodes)
+	})
+
+	t.Run("remove path", func(t *testing.T) {
+		// None of the nodes are associated with an instance, so they would be removed if they were not ignored. The
+		// nodes are missing the username annotation, so removing them results in an error.
+		nodes := &core.NodeList{Items: []core.Node{newNode("127.0.0.1", true), newNode("127.0.0.2", true)}}
+		expected := nodes.DeepCopy()
+		require.NoError(t, r.deconfigureInstances(context.Background(), &core.ConfigMap{}, nil, nodes))
+		assert.Equal(t, expected, nodes)
+
+		nodes.Items = append(nodes.Items, newNode("127.0.0.3", false))
+		assert.Error(t, r.deconfigureInstances(context.Background(), &core.ConfigMap{}, nil, nodes))
+	})
+
+	t.Run("custom label", func(t *testing.T) {
+		r := ConfigMapReconciler{ignoreLabel: "example.com/unmanaged"}
+		node := newNode("127.0.0.1", true)
+		assert.False(t, r.isIgnored(&node))
+		node.Labels["example.com/unmanaged"] = "true"
+		assert.True(t, r.isIgnored(&node))
+	})
+}
+
+func TestIsDowngrade(t *testing.T) {
+	testCases := []struct {
+		name            string
+		nodeVersion     string
+		operatorVersion string
+		expected        bool
+	}{
+		{"same version", "3.0.0+abc1234", "3.0.0+abc1234", false},
+		{"upgrade", "3.0.0+abc1234", "3.1.0+def5678", false},
+		{"downgrade", "3.1.0+def5678", "3.0.0+abc1234", true},
+		{"downgrade of dirty build", "3.1.0+def5678-dirty", "3.0.0+abc1234", true},
+		{"unversioned node", "", "3.0.0+abc1234", false},
+		{"invalid operator version", "3.1.0", "dev", false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, isDowngrade(test.nodeVersion, test.operatorVersion))
+		})
+	}
+}
+
+// TestDowngradeBlocked tests that a node configured by a newer operator version is not configured again
+func TestDowngradeBlocked(t *testing.T) {
+	operatorVersion := version.Version
+	version.Version = "3.0.0+abc1234"
+	defer func() { version.Version = operatorVersion }()
+
+	recorder := record.NewFakeRecorder(1)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+		recorder: recorder}}
+	// The instance configuration differs from the one the node was configured with, so the instance would be
+	// configured again if the downgrade was not blocked
+	instance := &instances.InstanceInfo{Address: "127.0.0.1", Username: "core",
+		KubeletConfig: instances.KubeletConfig{ShutdownGracePeriod: duration(time.Minute)}}
+	nodes := &core.NodeList{Items: []core.Node{{
+		ObjectMeta: meta.ObjectMeta{Name: "node", Annotations: map[string]string{BYOHAnnotation: "true",
+			UsernameAnnotation: "core", nodeconfig.VersionAnnotation: "3.1.0+def5678"}},
+		Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "127.0.0.1"}}},
+	}}}
+
+	require.NoError(t, r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{}, instance,
+		newNodeIndex(nodes), r.newUpgradeBudget(1, nodes), r.log))
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "DowngradeBlocked")
+}
+
+// nodePatchRecordingClient is a client which records the nodes it is asked to patch. All other requests are
+// unimplemented.
+type nodePatchRecordingClient struct {
+	client.Client
+	patched []*core.Node
+}
+
+func (c *nodePatchRecordingClient) Patch(_ context.Context, obj client.Object, _ client.Patch,
+	_ ...client.PatchOption) error {
+	c.patched = append(c.patched, obj.(*core.Node).DeepCopy())
+	return nil
+}
+
+// TestRepairBYOHAnnotations tests that the BYOH and username annotations removed from a configured node are restored,
+// and that nodes backed by a Machine are never annotated
+func TestRepairBYOHAnnotations(t *testing.T) {
+	instance := &instances.InstanceInfo{Address: "127.0.0.1", Username: "core"}
+	newNode := func(annotations map[string]string) *core.Node {
+		return &core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: "node", Annotations: annotations},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP,
+				Address: "127.0.0.1"}}},
+		}
+	}
+
+	testCases := []struct {
+		name                string
+		node                *core.Node
+		expectedAnnotations map[string]string
+	}{
+		{
+			name: "annotations removed",
+			node: newNode(map[string]string{nodeconfig.VersionAnnotation: "3.1.0"}),
+			expectedAnnotations: map[string]string{nodeconfig.VersionAnnotation: "3.1.0", BYOHAnnotation: "true",
+				UsernameAnnotation: "core"},
+		},
+		{
+			name: "BYOH annotation changed",
+			node: newNode(map[string]string{nodeconfig.VersionAnnotation: "3.1.0", BYOHAnnotation: "false",
+				UsernameAnnotation: "administrator"}),
+			expectedAnnotations: map[string]string{nodeconfig.VersionAnnotation: "3.1.0", BYOHAnnotation: "true",
+				UsernameAnnotation: "administrator"},
+		},
+		{
+			name: "username annotation removed",
+			node: newNode(map[string]string{nodeconfig.VersionAnnotation: "3.1.0", BYOHAnnotation: "true"}),
+			expectedAnnotations: map[string]string{nodeconfig.VersionAnnotation: "3.1.0", BYOHAnnotation: "true",
+				UsernameAnnotation: "core"},
+		},
+		{
+			name: "annotations present",
+			node: newNode(map[string]string{nodeconfig.VersionAnnotation: "3.1.0", BYOHAnnotation: "true",
+				UsernameAnnotation: "core"}),
+		},
+		{
+			name: "node not configured",
+			node: newNode(map[string]string{}),
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			c := &nodePatchRecordingClient{}
+			recorder := record.NewFakeRecorder(1)
+			r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c,
+				log: ctrl.Log.WithName("test"), recorder: recorder}}
+			require.NoError(t, r.repairBYOHAnnotations(context.Background(), test.node, instance, r.log))
+			if test.expectedAnnotations == nil {
+				assert.Empty(t, c.patched)
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			require.Len(t, c.patched, 1)
+			assert.Equal(t, test.expectedAnnotations, c.patched[0].Annotations)
+			require.Len(t, recorder.Events, 1)
+			assert.Contains(t, <-recorder.Events, "AnnotationsRepaired")
+		})
+	}
+
+	t.Run("node backed by a Machine", func(t *testing.T) {
+		c := &nodePatchRecordingClient{}
+		r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test")}}
+		nodes := &core.NodeList{Items: []core.Node{*newNode(map[string]string{nodeconfig.VersionAnnotation: "3.1.0",
+			MachineAnnotation: "openshift-machine-api/winworker-abcde"})}}
+		assert.Error(t, r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{}, instance,
+			newNodeIndex(nodes), r.newUpgradeBudget(1, nodes), r.log))
+		assert.Empty(t, c.patched)
+	})
+}
+
+// TestHandleHostError tests that only hosts with an invalid bootstrap kubeconfig, a deferred upgrade, connection
+// failures, rejected credentials or an unsupported Windows version are skipped, and that no error is returned for
+// rejected credentials or an unsupported Windows version
+func TestHandleHostError(t *testing.T) {
+	tests := []struct {
+		name            string
+		err             error
+		expectedSkipped bool
+		expectedNoError bool
+		expectedEvent   string
+	}{
+		{
+			name:            "invalid bootstrap kubeconfig",
+			err:             &bootstrapKubeconfigError{err: errors.New("secret not found")},
+			expectedSkipped: true,
+			expectedEvent:   "InvalidBootstrapKubeconfig",
+		},
+		{
+			name:            "upgrade deferred",
+			err:             errors.Wrap(&upgradeDeferredError{node: "node"}, "error upgrading"),
+			expectedSkipped: true,
+		},
+		{
+			name:            "busy host",
+			err:             &hostBusyError{address: "127.0.0.1"},
+			expectedSkipped: true,
+		},
+		{
+			name: "unreachable host",
+			err: &unreachableError{address: "127.0.0.1", port: 22,
+				err: errors.New("connection refused")},
+			expectedSkipped: true,
+			expectedEvent:   "InstanceUnreachable",
+		},
+		{
+			name:            "SSH connection timeout",
+			err:             errors.Wrap(&windows.TimeoutErr{}, "unable to connect to Windows VM 127.0.0.1"),
+			expectedSkipped: true,
+			expectedEvent:   "InstanceConnectionTimeout",
+		},
+		{
+			name:            "SSH command timeout",
+			err:             errors.Wrap(&windows.CommandTimeoutErr{}, "error running hostname"),
+			expectedSkipped: true,
+			expectedEvent:   "InstanceCommandTimeout",
+		},
+		{
+			name:            "SSH authentication failure",
+			err:             errors.Wrap(&windows.AuthErr{}, "unable to connect to Windows VM 127.0.0.1"),
+			expectedSkipped: true,
+			expectedNoError: true,
+			expectedEvent:   "InstanceAuthenticationFailure",
+		},
+		{
+			name:            "unsupported Windows version",
+			err:             errors.Wrap(&nodeconfig.UnsupportedOSVersionError{}, "failed to configure instance"),
+			expectedSkipped: true,
+			expectedNoError: true,
+			expectedEvent:   "UnsupportedOSVersion",
+		},
+		{
+			name:            "configuration failure",
+			err:             errors.New("connection refused"),
+			expectedSkipped: false,
+			expectedEvent:   "InstanceSetupFailure",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(1)
+			r := ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+				recorder: recorder}}
+			skipped, err := r.handleHostError(&core.ConfigMap{}, "127.0.0.1", test.err)
+			assert.Equal(t, test.expectedSkipped, skipped)
+			if test.expectedNoError {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, test.err))
+			}
+			if test.expectedEvent == "" {
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			require.Len(t, recorder.Events, 1)
+			assert.Contains(t, <-recorder.Events, test.expectedEvent)
+		})
+	}
+}
+
+// TestConnectionFailureRequeue tests that a host timing out accepting SSH connections is backed off and requeued, while
+// a host rejecting its credentials or running an unsupported version of Windows is not retried
+func TestConnectionFailureRequeue(t *testing.T) {
+	newReconciler := func() *ConfigMapReconciler {
+		return &ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+			recorder: record.NewFakeRecorder(1)}, backoff: newConfigurationBackoff(time.Minute, time.Hour)}
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		r := newReconciler()
+		err := errors.Wrap(&windows.TimeoutErr{}, "unable to connect to Windows VM 127.0.0.1")
+		r.recordHostFailure("127.0.0.1", err)
+		assert.True(t, r.backoff.remaining("127.0.0.1", time.Now()) > 0)
+		_, err = r.handleHostError(&core.ConfigMap{}, "127.0.0.1", err)
+		result, err := requeueResult(r.withRetry(err))
+		require.NoError(t, err)
+		assert.True(t, result.RequeueAfter > 0 && result.RequeueAfter <= time.Minute)
+	})
+
+	t.Run("authentication failure", func(t *testing.T) {
+		r := newReconciler()
+		err := errors.Wrap(&windows.AuthErr{}, "unable to connect to Windows VM 127.0.0.1")
+		r.recordHostFailure("127.0.0.1", err)
+		assert.Equal(t, time.Duration(0), r.backoff.remaining("127.0.0.1", time.Now()))
+		_, err = r.handleHostError(&core.ConfigMap{}, "127.0.0.1", err)
+		require.NoError(t, err)
+		result, err := requeueResult(r.withRetry(err))
+		require.NoError(t, err)
+		assert.Equal(t, ctrl.Result{}, result)
+	})
+
+	t.Run("unsupported Windows version", func(t *testing.T) {
+		r := newReconciler()
+		r.recordHostFailure("127.0.0.1", errors.Wrap(&nodeconfig.UnsupportedOSVersionError{}, "failed"))
+		assert.Equal(t, time.Duration(0), r.backoff.remaining("127.0.0.1", time.Now()))
+	})
+}
+
+// TestBackedOffReconcileFailure tests that a reconcile in which an instance failed to be configured is observed as a
+// failure, and eventually fails the readiness check, even though it is requeued without returning the error
+func TestBackedOffReconcileFailure(t *testing.T) {
+	reconcileErrors := func() uint64 {
+		families, err := crmetrics.Registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() != "wmco_configmap_reconcile_seconds" {
+				continue
+			}
+			for _, metric := range family.GetMetric() {
+				if metric.GetLabel()[0].GetValue() == "error" {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+		return 0
+	}
+	// The auth secret of the instance is missing, so that configuring it fails before it is connected to
+	c := &namespaceClient{configMaps: configMapClient{configMaps: []core.ConfigMap{{
+		ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Namespace: "wmco"},
+		Data:       map[string]string{"127.0.0.1": "username=core,authSecret=host-creds"},
+	}}}}
+	// The API server holds no Windows nodes to be scraped by Prometheus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/api/v1/nodes":
+			fmt.Fprint(w, `{"kind":"NodeList","apiVersion":"v1","items":[]}`)
+		case "/api/v1/namespaces/wmco/endpoints/" + metrics.WindowsMetricsResource:
+			fmt.Fprint(w, `{"kind":"Endpoints","apiVersion":"v1","metadata":{"name":"windows-exporter"}}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+	pc, err := metrics.NewPrometheusNodeConfig(clientset, "wmco")
+	require.NoError(t, err)
+	r := &ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+		recorder: record.NewFakeRecorder(10), watchNamespace: "wmco", prometheusNodeConfig: pc},
+		configurationWorkers: 1, backoff: newConfigurationBackoff(100*time.Millisecond, 100*time.Millisecond),
+		instanceConfigMap: InstanceConfigMap}
+	const threshold = 3
+	check := metrics.ConfigMapReconcileCheck(threshold)
+	// Start from a successful reconcile, as the failures of other tests are counted as well
+	metrics.ObserveConfigMapReconcile(0, nil)
+	before := reconcileErrors()
+
+	req := ctrl.Request{NamespacedName: kubeTypes.NamespacedName{Namespace: "wmco", Name: InstanceConfigMap}}
+	for i := 0; i < threshold; i++ {
+		require.NoError(t, check(nil))
+		result, err := r.Reconcile(context.Background(), req)
+		require.NoError(t, err)
+		assert.True(t, result.RequeueAfter > 0)
+		// The instance is retried once its backoff expires, as it is when the reconcile is requeued
+		time.Sleep(r.backoff.remaining("127.0.0.1", time.Now()))
+	}
+	assert.Error(t, check(nil))
+	assert.Equal(t, before+threshold, reconcileErrors())
+}
+
+// TestUnreachableInstance tests that an instance is only configured if its SSH port can be connected to, when
+// reachability checks are enabled
+func TestUnreachableInstance(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+	assert.NoError(t, probePort("127.0.0.1", port, time.Second))
+	require.NoError(t, listener.Close())
+	assert.Error(t, probePort("127.0.0.1", port, time.Second))
+
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test")},
+		checkReachability: true}
+	instance := &instances.InstanceInfo{Address: "127.0.0.1", Username: "core", SSHPort: port}
+	nodes := &core.NodeList{}
+	err = r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{}, instance, newNodeIndex(nodes),
+		r.newUpgradeBudget(1, nodes), r.log)
+	var uErr *unreachableError
+	require.True(t, errors.As(err, &uErr))
+	assert.Contains(t, err.Error(), fmt.Sprintf("host 127.0.0.1 unreachable on port %d", port))
+}
+
+// TestUpgradeDeferred tests that a node configured by a different operator version is only upgraded while all other
+// BYOH nodes are Ready
+func TestUpgradeDeferred(t *testing.T) {
+	operatorVersion := version.Version
+	version.Version = "3.1.0+def5678"
+	defer func() { version.Version = operatorVersion }()
+
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test")}}
+	newNode := func(name, address, nodeVersion string, ready core.ConditionStatus) core.Node {
+		return core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: name, Annotations: map[string]string{BYOHAnnotation: "true",
+				UsernameAnnotation: "core", nodeconfig.VersionAnnotation: nodeVersion}},
+			Status: core.NodeStatus{
+				Addresses:  []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}},
+				Conditions: []core.NodeCondition{{Type: core.NodeReady, Status: ready}},
+			},
+		}
+	}
+	instance := &instances.InstanceInfo{Address: "127.0.0.1", Username: "core"}
+
+	// The node is up to date, so nothing is done
+	nodes := &core.NodeList{Items: []core.Node{newNode("upgraded", "127.0.0.1", "3.1.0+def5678", core.ConditionTrue),
+		newNode("not-ready", "127.0.0.2", "3.1.0+def5678", core.ConditionFalse)}}
+	require.NoError(t, r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{}, instance,
+		newNodeIndex(nodes), r.newUpgradeBudget(1, nodes), r.log))
+
+	// The node is outdated, but another node is not Ready
+	nodes.Items[0] = newNode("outdated", "127.0.0.1", "3.0.0+abc1234", core.ConditionTrue)
+	err := r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{}, instance, newNodeIndex(nodes),
+		r.newUpgradeBudget(1, nodes), r.log)
+	var udErr *upgradeDeferredError
+	require.True(t, errors.As(err, &udErr))
+	assert.Equal(t, "outdated", udErr.node)
+	assert.Equal(t, []string{"not-ready"}, udErr.unavailable)
+
+	// Nodes which are not managed do not block upgrades
+	nodes.Items[1].Labels = map[string]string{DefaultIgnoreLabel: "true"}
+	r.ignoreLabel = DefaultIgnoreLabel
+	acquired, _ := r.newUpgradeBudget(1, nodes).acquire("outdated")
+	assert.True(t, acquired)
+}
+
+func TestNotReadyTooLong(t *testing.T) {
+	now := time.Date(2021, 1, 1, 0, 10, 0, 0, time.UTC)
+	newNode := func(status core.ConditionStatus, since time.Duration) *core.Node {
+		return &core.Node{Status: core.NodeStatus{Conditions: []core.NodeCondition{{Type: core.NodeReady,
+			Status: status, LastTransitionTime: meta.NewTime(now.Add(-since))}}}}
+	}
+	testCases := []struct {
+		name        string
+		node        *core.Node
+		gracePeriod time.Duration
+		expected    bool
+	}{
+		{"ready", newNode(core.ConditionTrue, time.Hour), 5 * time.Minute, false},
+		{"recently not ready", newNode(core.ConditionFalse, time.Minute), 5 * time.Minute, false},
+		{"long not ready", newNode(core.ConditionFalse, 10*time.Minute), 5 * time.Minute, true},
+		{"long unknown", newNode(core.ConditionUnknown, 10*time.Minute), 5 * time.Minute, true},
+		{"long not ready with check disabled", newNode(core.ConditionFalse, 10*time.Minute), 0, false},
+		{"no ready condition", &core.Node{}, 5 * time.Minute, false},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, notReadyTooLong(test.node, test.gracePeriod, now))
+		})
+	}
+}
+
+func TestCountBYOHNodes(t *testing.T) {
+	newNode := func(byoh bool, ready core.ConditionStatus) core.Node {
+		node := core.Node{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{}}}
+		if byoh {
+			node.Annotations[BYOHAnnotation] = "true"
+		}
+		if ready != "" {
+			node.Status.Conditions = []core.NodeCondition{{Type: core.NodeReady, Status: ready}}
+		}
+		return node
+	}
+
+	testCases := []struct {
+		name          string
+		nodes         []core.Node
+		expectedTotal int
+		expectedReady int
+	}{
+		{
+			name:          "no nodes",
+			nodes:         nil,
+			expectedTotal: 0,
+			expectedReady: 0,
+		},
+		{
+			name:          "ready BYOH nodes",
+			nodes:         []core.Node{newNode(true, core.ConditionTrue), newNode(true, core.ConditionTrue)},
+			expectedTotal: 2,
+			expectedReady: 2,
+		},
+		{
+			name: "not ready BYOH nodes are not counted as ready",
+			nodes: []core.Node{newNode(true, core.ConditionTrue), newNode(true, core.ConditionFalse),
+				newNode(true, core.ConditionUnknown), newNode(true, "")},
+			expectedTotal: 4,
+			expectedReady: 1,
+		},
+		{
+			name:          "Machine backed nodes are not counted",
+			nodes:         []core.Node{newNode(false, core.ConditionTrue), newNode(true, core.ConditionTrue)},
+			expectedTotal: 1,
+			expectedReady: 1,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			nodes := &core.NodeList{Items: test.nodes}
+			assert.Equal(t, test.expectedTotal, countBYOHNodes(nodes))
+			assert.Equal(t, test.expectedReady, countReadyBYOHNodes(nodes))
+		})
+	}
+}
+
+// TestWithReadinessRetry tests that a successful reconcile is retried while configured instances do not have a Ready
+// node, so that the nodes are added to the Prometheus endpoints once they become Ready
+func TestWithReadinessRetry(t *testing.T) {
+	newNode := func(ready core.ConditionStatus) core.Node {
+		return core.Node{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true"}},
+			Status: core.NodeStatus{Conditions: []core.NodeCondition{{Type: core.NodeReady, Status: ready}}}}
+	}
+	r := ConfigMapReconciler{}
+	r.log = ctrl.Log.WithName("test")
+	nodes := &core.NodeList{Items: []core.Node{newNode(core.ConditionTrue), newNode(core.ConditionFalse)}}
+
+	assert.NoError(t, r.withReadinessRetry(nil, nodes, 1))
+	err := r.withReadinessRetry(nil, nodes, 2)
+	var raErr *retryAfterError
+	require.True(t, errors.As(err, &raErr))
+	assert.Equal(t, nodeReadinessRequeueInterval, raErr.after)
+	result, err := requeueResult(err)
+	require.NoError(t, err)
+	assert.Equal(t, nodeReadinessRequeueInterval, result.RequeueAfter)
+
+	// A reconcile which already failed or is retried is left as is
+	failure := errors.New("connection refused")
+	assert.Equal(t, failure, r.withReadinessRetry(failure, nodes, 2))
+}
+
+// TestManagementModelTransitions tests the handling of nodes whose BYOH annotation changed out of band
+func TestManagementModelTransitions(t *testing.T) {
+	r := ConfigMapReconciler{}
+	r.log = ctrl.Log.WithName("test")
+	newNode := func(address string, annotations map[string]string) core.Node {
+		return core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: address, Labels: map[string]string{core.LabelOSStable: "windows"},
+				Annotations: annotations},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}},
+		}
+	}
+
+	t.Run("node losing the BYOH annotation", func(t *testing.T) {
+		// None of the nodes are associated with an instance, and are missing the username annotation, so considering
+		// any of them for removal results in an error
+		nodes := &core.NodeList{Items: []core.Node{
+			newNode("127.0.0.1", map[string]string{}),
+			newNode("127.0.0.2", map[string]string{BYOHAnnotation: "false"}),
+		}}
+		assert.NoError(t, r.deconfigureInstances(context.Background(), &core.ConfigMap{}, nil, nodes))
+
+		old := newNode("127.0.0.1", map[string]string{BYOHAnnotation: "true"})
+		updated := newNode("127.0.0.1", map[string]string{})
+		updateEvent := event.UpdateEvent{ObjectOld: &old, ObjectNew: &updated}
+		assert.True(t, windowsNodePredicate(false).Update(updateEvent))
+		assert.True(t, windowsNodePredicate(true).Update(updateEvent))
+	})
+
+	t.Run("node gaining the BYOH annotation", func(t *testing.T) {
+		machineNode := newNode("127.0.0.1", map[string]string{BYOHAnnotation: "true",
+			MachineAnnotation: "openshift-machine-api/winworker-abcde"})
+		nodes := &core.NodeList{Items: []core.Node{machineNode}}
+		// The node is backed by a Machine, so it is neither removed nor configured
+		assert.NoError(t, r.deconfigureInstances(context.Background(), &core.ConfigMap{}, nil, nodes))
+		assert.Error(t, r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{},
+			&instances.InstanceInfo{Address: "127.0.0.1", Username: "core"}, newNodeIndex(nodes),
+			r.newUpgradeBudget(1, nodes), r.log))
+
+		old := newNode("127.0.0.1", map[string]string{MachineAnnotation: "openshift-machine-api/winworker-abcde"})
+		updateEvent := event.UpdateEvent{ObjectOld: &old, ObjectNew: &machineNode}
+		assert.True(t, windowsNodePredicate(true).Update(updateEvent))
+		assert.True(t, windowsNodePredicate(false).Update(updateEvent))
+	})
+}
+
+// nodeListClient is a client which serves node lists from the given nodes, filtered by the label selector of the
+// request as the API server would. All other requests are unimplemented.
+type nodeListClient struct {
+	client.Client
+	nodes []core.Node
+}
+
+func (c *nodeListClient) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	nodeList := list.(*core.NodeList)
+	nodeList.Items = nil
+	for _, node := range c.nodes {
+		if listOpts.LabelSelector == nil || listOpts.LabelSelector.Matches(labels.Set(node.Labels)) {
+			nodeList.Items = append(nodeList.Items, node)
+		}
+	}
+	return nil
+}
+
+// mutationRecordingClient is a client which serves node lists like nodeListClient, and records the objects it is asked
+// to create, update, patch or delete, including their status, without changing them
+type mutationRecordingClient struct {
+	nodeListClient
+	mutated []string
+}
+
+func (c *mutationRecordingClient) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	c.mutated = append(c.mutated, "create "+obj.GetName())
+	return nil
+}
+
+func (c *mutationRecordingClient) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	c.mutated = append(c.mutated, "update "+obj.GetName())
+	return nil
+}
+
+func (c *mutationRecordingClient) Patch(_ context.Context, obj client.Object, _ client.Patch,
+	_ ...client.PatchOption) error {
+	c.mutated = append(c.mutated, "patch "+obj.GetName())
+	return nil
+}
+
+func (c *mutationRecordingClient) Delete(_ context.Context, obj client.Object, _ ...client.DeleteOption) error {
+	c.mutated = append(c.mutated, "delete "+obj.GetName())
+	return nil
+}
+
+func (c *mutationRecordingClient) Status() client.StatusWriter {
+	return &statusRecordingWriter{c}
+}
+
+// statusRecordingWriter records the status updates and patches it is asked to make in the mutations of the client it
+// belongs to, without changing the objects
+type statusRecordingWriter struct {
+	c *mutationRecordingClient
+}
+
+func (w *statusRecordingWriter) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	w.c.mutated = append(w.c.mutated, "update status "+obj.GetName())
+	return nil
+}
+
+func (w *statusRecordingWriter) Patch(_ context.Context, obj client.Object, _ client.Patch,
+	_ ...client.PatchOption) error {
+	w.c.mutated = append(w.c.mutated, "patch status "+obj.GetName())
+	return nil
+}
+
+// TestDryRun tests that in dry-run mode, the instances which would be configured and the nodes which would be removed
+// are reported through events, without any object being changed
+func TestDryRun(t *testing.T) {
+	operatorVersion := version.Version
+	version.Version = "3.1.0+def5678"
+	defer func() { version.Version = operatorVersion }()
+
+	newNode := func(name, address string, annotations map[string]string) core.Node {
+		return core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: name, Labels: map[string]string{core.LabelOSStable: "windows"},
+				Annotations: annotations},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}},
+		}
+	}
+	overriddenHash, err := (&instances.InstanceInfo{ServiceCIDR: "10.96.0.0/12"}).ConfigHash()
+	require.NoError(t, err)
+	c := &mutationRecordingClient{nodeListClient: nodeListClient{nodes: []core.Node{
+		// The node of an instance configured by an older operator version, which would be upgraded
+		newNode("outdated", "127.0.0.2", map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+			nodeconfig.VersionAnnotation: "3.0.0+abc1234"}),
+		// The node of an instance no longer in the ConfigMap, which would be removed
+		newNode("removed", "127.0.0.3", map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+			nodeconfig.VersionAnnotation: "3.1.0+def5678"}),
+		// The node of an instance whose BYOH annotation was removed, which would be restored
+		newNode("unannotated", "127.0.0.4", map[string]string{nodeconfig.VersionAnnotation: "3.1.0+def5678"}),
+		// The node of an up to date instance whose reconfiguration is forced, which would be configured again
+		newNode("forced", "127.0.0.5", map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+			nodeconfig.VersionAnnotation: "3.1.0+def5678", ForceReconfigureAnnotation: "true"}),
+		// The node of an up to date instance configured with a previous service CIDR, which would be configured again
+		newNode("renumbered", "127.0.0.6", map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+			nodeconfig.VersionAnnotation: "3.1.0+def5678", ServiceCIDRAnnotation: "10.96.0.0/12"}),
+		// The nodes of up to date instances configured with their current service CIDR, which are left as they are
+		newNode("current", "127.0.0.7", map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+			nodeconfig.VersionAnnotation: "3.1.0+def5678", ServiceCIDRAnnotation: "172.30.0.0/16"}),
+		newNode("overridden", "127.0.0.8", map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+			nodeconfig.VersionAnnotation: "3.1.0+def5678", ServiceCIDRAnnotation: "10.96.0.0/12",
+			nodeconfig.ConfigHashAnnotation: overriddenHash}),
+	}}}
+	recorder := record.NewFakeRecorder(10)
+	privateKeySigner, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+		recorder: recorder, signer: privateKeySigner, clusterServiceCIDR: "172.30.0.0/16"}, configurationWorkers: 2,
+		maxUnavailable: 1, backoff: newConfigurationBackoff(time.Second, time.Minute), dryRun: true,
+		instanceConfigMap: InstanceConfigMap}
+	configMap := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Namespace: "wmco"},
+		Data: map[string]string{"127.0.0.1": "username=core", "127.0.0.2": "username=core",
+			"127.0.0.4": "username=core", "127.0.0.5": "username=core", "127.0.0.6": "username=core",
+			"127.0.0.7": "username=core", "127.0.0.8": "username=core,serviceCIDR=10.96.0.0/12"}}
+
+	require.NoError(t, r.reconcileNodes(context.Background(), []*core.ConfigMap{configMap}, r.log))
+	assert.Empty(t, c.mutated)
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.ElementsMatch(t, []string{
+		"Normal DryRunConfigure dry run: would configure instance 127.0.0.1",
+		"Normal DryRunConfigure dry run: would upgrade instance 127.0.0.2",
+		"Normal DryRunConfigure dry run: would reconfigure instance 127.0.0.5",
+		"Normal DryRunConfigure dry run: would reconfigure instance 127.0.0.6",
+		"Normal DryRunRemove dry run: would drain and remove node removed",
+	}, events)
+
+	// The finalizer is neither added nor removed
+	require.NoError(t, r.ensureFinalizer(context.Background(), configMap))
+	configMap.Finalizers = []string{InstanceConfigMapFinalizer}
+	require.NoError(t, r.removeFinalizer(context.Background(), configMap))
+	assert.Empty(t, c.mutated)
+}
+
+// TestForceReconfigure tests that setting the force reconfigure annotation on a BYOH node triggers a reconciliation,
+// and that the annotation is cleared once the instance has been configured again
+func TestForceReconfigure(t *testing.T) {
+	newNode := func(annotations map[string]string) *core.Node {
+		return &core.Node{ObjectMeta: meta.ObjectMeta{Name: "forced",
+			Labels: map[string]string{core.LabelOSStable: "windows"}, Annotations: annotations}}
+	}
+	old := newNode(map[string]string{BYOHAnnotation: "true", nodeconfig.VersionAnnotation: version.Get()})
+	forced := newNode(map[string]string{BYOHAnnotation: "true", nodeconfig.VersionAnnotation: version.Get(),
+		ForceReconfigureAnnotation: "true"})
+	assert.True(t, windowsNodePredicate(true).Update(event.UpdateEvent{ObjectOld: old, ObjectNew: forced}))
+	// The annotation is only honored for BYOH nodes, and setting it again is not a change
+	assert.False(t, windowsNodePredicate(false).Update(event.UpdateEvent{ObjectOld: old, ObjectNew: forced}))
+	assert.False(t, windowsNodePredicate(true).Update(event.UpdateEvent{ObjectOld: forced, ObjectNew: forced}))
+
+	c := &mutationRecordingClient{}
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c}}
+	require.NoError(t, r.clearForceReconfigure(context.Background(), forced))
+	assert.Equal(t, []string{"patch forced"}, c.mutated)
+	assert.NotContains(t, forced.Annotations, ForceReconfigureAnnotation)
+	// A node without the annotation is left untouched
+	require.NoError(t, r.clearForceReconfigure(context.Background(), forced))
+	assert.Equal(t, []string{"patch forced"}, c.mutated)
+}
+
+// TestNodeDeletion tests that deleting the node of an instance which is still described by the ConfigMap triggers a
+// reconciliation, which configures the instance again
+func TestNodeDeletion(t *testing.T) {
+	newNode := func(labels, annotations map[string]string) *core.Node {
+		return &core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: "deleted", Labels: labels, Annotations: annotations},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP,
+				Address: "127.0.0.1"}}},
+		}
+	}
+	windowsLabels := map[string]string{core.LabelOSStable: "windows"}
+	node := newNode(windowsLabels, map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core",
+		nodeconfig.VersionAnnotation: version.Get()})
+	assert.True(t, windowsNodePredicate(true).Delete(event.DeleteEvent{Object: node}))
+	// The nodes of Machines, and nodes which are not Windows nodes, are left to other controllers
+	assert.False(t, windowsNodePredicate(false).Delete(event.DeleteEvent{Object: node}))
+	assert.False(t, windowsNodePredicate(true).Delete(event.DeleteEvent{Object: newNode(windowsLabels, nil)}))
+	assert.False(t, windowsNodePredicate(true).Delete(event.DeleteEvent{Object: newNode(
+		map[string]string{core.LabelOSStable: "linux"}, map[string]string{BYOHAnnotation: "true"})}))
+
+	c := &mutationRecordingClient{nodeListClient: nodeListClient{nodes: []core.Node{*node}}}
+	recorder := record.NewFakeRecorder(10)
+	privateKeySigner, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+		recorder: recorder, signer: privateKeySigner}, configurationWorkers: 1, maxUnavailable: 1,
+		backoff: newConfigurationBackoff(time.Second, time.Minute), dryRun: true, instanceConfigMap: InstanceConfigMap}
+	configMap := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Namespace: "wmco"},
+		Data: map[string]string{"127.0.0.1": "username=core"}}
+
+	// The instance is up to date while its node exists
+	require.NoError(t, r.reconcileNodes(context.Background(), []*core.ConfigMap{configMap}, r.log))
+	assert.Empty(t, recorder.Events)
+
+	// Once the node is deleted, the instance is configured again
+	c.nodes = nil
+	require.NoError(t, r.reconcileNodes(context.Background(), []*core.ConfigMap{configMap}, r.log))
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Normal DryRunConfigure dry run: would configure instance 127.0.0.1", <-recorder.Events)
+	assert.Empty(t, c.mutated)
+}
+
+// TestDefaultConfigurationWorkers tests that instances are configured by a reconciler which does not set the number of
+// configuration workers, instead of the reconcile waiting for a worker forever
+func TestDefaultConfigurationWorkers(t *testing.T) {
+	c := &mutationRecordingClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+		recorder: recorder, signer: newTestSigner(t, 1)}, maxUnavailable: 1,
+		backoff: newConfigurationBackoff(time.Second, time.Minute), dryRun: true, instanceConfigMap: InstanceConfigMap}
+	configMap := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Namespace: "wmco"},
+		Data: map[string]string{"127.0.0.1": "username=core"}}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.reconcileNodes(context.Background(), []*core.ConfigMap{configMap}, r.log)
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the instance was not configured")
+	}
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Normal DryRunConfigure dry run: would configure instance 127.0.0.1", <-recorder.Events)
+}
+
+// TestSkipDeconfigure tests that a node annotated to skip deconfiguration is deleted without its instance being
+// connected to once the instance is removed from the ConfigMap
+func TestSkipDeconfigure(t *testing.T) {
+	// The node has no username annotation, so its instance could not be connected to
+	node := core.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "wiped", Labels: map[string]string{core.LabelOSStable: "windows"},
+			Annotations: map[string]string{BYOHAnnotation: "true", SkipDeconfigureAnnotation: "true"}},
+		Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+	c := &mutationRecordingClient{}
+	recorder := record.NewFakeRecorder(10)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+		recorder: recorder}, configurationWorkers: 1, dryRun: true}
+	nodes := &core.NodeList{Items: []core.Node{node}}
+
+	require.NoError(t, r.deconfigureInstances(context.Background(), &core.ConfigMap{}, nil, nodes))
+	assert.Empty(t, c.mutated)
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Normal DryRunRemove dry run: would remove node wiped without deconfiguring its instance",
+		<-recorder.Events)
+
+	r.dryRun = false
+	require.NoError(t, r.deconfigureInstances(context.Background(), &core.ConfigMap{}, nil, nodes))
+	assert.Equal(t, []string{"delete wiped"}, c.mutated)
+	assert.Empty(t, nodes.Items)
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Normal InstanceDeconfigured removed node wiped")
+
+	// Without the annotation, the instance is deconfigured, which fails as it cannot be described
+	node.Annotations[SkipDeconfigureAnnotation] = "false"
+	nodes.Items = []core.Node{node}
+	assert.Error(t, r.deconfigureInstances(context.Background(), &core.ConfigMap{}, nil, nodes))
+	assert.Equal(t, []string{"delete wiped"}, c.mutated)
+	assert.Len(t, nodes.Items, 1)
+}
+
+// TestDeferRemovals tests that the nodes of instances missing from the ConfigMap are only removed once the removal
+// grace period has elapsed, and that their pending removal is cancelled if the instances are described again before
+func TestDeferRemovals(t *testing.T) {
+	now := time.Now()
+	newNode := func(name, address string, pendingSince time.Duration) core.Node {
+		node := core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: name, Labels: map[string]string{core.LabelOSStable: "windows"},
+				Annotations: map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core"}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}},
+		}
+		if pendingSince != 0 {
+			node.Annotations[PendingRemovalAnnotation] = now.Add(-pendingSince).Format(time.RFC3339)
+		}
+		return node
+	}
+	newReconciler := func(gracePeriod time.Duration) (*ConfigMapReconciler, *mutationRecordingClient,
+		*record.FakeRecorder) {
+		c := &mutationRecordingClient{}
+		recorder := record.NewFakeRecorder(10)
+		return &ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+			recorder: recorder}, removalGracePeriod: gracePeriod,
+			backoff: newConfigurationBackoff(time.Second, time.Minute)}, c, recorder
+	}
+	nodeNames := func(nodes *core.NodeList) []string {
+		var names []string
+		for _, node := range nodes.Items {
+			names = append(names, node.GetName())
+		}
+		return names
+	}
+	described := []*instances.InstanceInfo{{Address: "127.0.0.1", Username: "core"}}
+
+	t.Run("removal deferred within window", func(t *testing.T) {
+		r, c, recorder := newReconciler(10 * time.Minute)
+		nodes := &core.NodeList{Items: []core.Node{newNode("kept", "127.0.0.1", 0), newNode("missing", "127.0.0.2", 0),
+			newNode("pending", "127.0.0.3", 5*time.Minute)}}
+		removable, err := r.deferRemovals(context.Background(), described, nodes, now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"kept"}, nodeNames(removable))
+		// Only the node newly missing its instance is marked, with the time its removal was deferred at
+		assert.Equal(t, []string{"patch missing"}, c.mutated)
+		assert.Equal(t, now.UTC().Format(time.RFC3339), nodes.Items[1].Annotations[PendingRemovalAnnotation])
+		require.Len(t, recorder.Events, 1)
+		assert.Contains(t, <-recorder.Events, "RemovalPending")
+		// The reconcile is retried once the grace period of the node marked earliest elapses
+		assert.True(t, now.Add(5*time.Minute).Truncate(time.Second).Equal(r.removalDeadline))
+		var raErr *retryAfterError
+		require.True(t, errors.As(r.withRetry(nil), &raErr))
+		assert.True(t, raErr.after > 0 && raErr.after <= 5*time.Minute)
+	})
+
+	t.Run("cancel within window", func(t *testing.T) {
+		r, c, recorder := newReconciler(10 * time.Minute)
+		nodes := &core.NodeList{Items: []core.Node{newNode("readded", "127.0.0.1", 5*time.Minute)}}
+		removable, err := r.deferRemovals(context.Background(), described, nodes, now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"readded"}, nodeNames(removable))
+		assert.Equal(t, []string{"patch readded"}, c.mutated)
+		assert.NotContains(t, nodes.Items[0].Annotations, PendingRemovalAnnotation)
+		require.Len(t, recorder.Events, 1)
+		assert.Contains(t, <-recorder.Events, "RemovalCancelled")
+		assert.True(t, r.removalDeadline.IsZero())
+	})
+
+	t.Run("expire past window", func(t *testing.T) {
+		r, c, _ := newReconciler(10 * time.Minute)
+		nodes := &core.NodeList{Items: []core.Node{newNode("kept", "127.0.0.1", 0),
+			newNode("expired", "127.0.0.2", 15*time.Minute)}}
+		removable, err := r.deferRemovals(context.Background(), described, nodes, now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"kept", "expired"}, nodeNames(removable))
+		assert.Empty(t, c.mutated)
+		assert.True(t, r.removalDeadline.IsZero())
+	})
+
+	t.Run("grace period disabled", func(t *testing.T) {
+		r, c, _ := newReconciler(0)
+		nodes := &core.NodeList{Items: []core.Node{newNode("missing", "127.0.0.2", 0)}}
+		removable, err := r.deferRemovals(context.Background(), described, nodes, now)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"missing"}, nodeNames(removable))
+		assert.Empty(t, c.mutated)
+	})
+}
+
+// TestLinuxNodesNotConsidered tests that Linux nodes are never considered to be associated with an instance, even when
+// they are annotated as BYOH nodes
+func TestLinuxNodesNotConsidered(t *testing.T) {
+	newNode := func(name, os string) core.Node {
+		return core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: name, Labels: map[string]string{core.LabelOSStable: os},
+				Annotations: map[string]string{BYOHAnnotation: "true"}},
+			Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "127.0.0.1"}}},
+		}
+	}
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{
+		client: &nodeListClient{nodes: []core.Node{newNode("linux", "linux"), newNode("windows", "windows")}}},
+		instanceConfigMap: InstanceConfigMap}
+	node, err := r.findInstanceNode(context.Background(), &instances.InstanceInfo{Address: "127.0.0.1"})
+	require.NoError(t, err)
+	require.NotNil(t, node)
+	assert.Equal(t, "windows", node.GetName())
+
+	r.client = &nodeListClient{nodes: []core.Node{newNode("linux", "linux")}}
+	node, err = r.findInstanceNode(context.Background(), &instances.InstanceInfo{Address: "127.0.0.1"})
+	require.NoError(t, err)
+	assert.Nil(t, node)
+}
+
+// TestSampleInstanceConfigMap tests that the sample ConfigMap is valid once its placeholders are replaced
+func TestSampleInstanceConfigMap(t *testing.T) {
+	sample := SampleInstanceConfigMap(InstanceConfigMap, "openshift-windows-machine-config-operator")
+	for _, key := range sampleKeys {
+		assert.Contains(t, sample, key.key+"=")
+	}
+	filled := strings.NewReplacer(SampleAddressPlaceholder, "10.1.42.1",
+		SampleSSHPortAddressPlaceholder, "10.1.42.2", SampleUsernamePlaceholder, "Administrator").Replace(sample)
+	configMap := &core.ConfigMap{}
+	require.NoError(t, yaml.NewYAMLOrJSONDecoder(strings.NewReader(filled), len(filled)).Decode(configMap))
+	assert.Equal(t, InstanceConfigMap, configMap.GetName())
+	assert.Equal(t, "openshift-windows-machine-config-operator", configMap.GetNamespace())
+
+	r := ConfigMapReconciler{}
+	out, _, err := r.parseHosts(configMap.Data, false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []*instances.InstanceInfo{{Address: "10.1.42.1", Username: "Administrator"},
+		{Address: "10.1.42.2", Username: "Administrator", SSHPort: 2222}}, withoutResolvedIPs(out))
+
+	// The placeholders cannot be used as they are
+	configMap = &core.ConfigMap{}
+	require.NoError(t, yaml.NewYAMLOrJSONDecoder(strings.NewReader(sample), len(sample)).Decode(configMap))
+	_, _, err = r.parseHosts(configMap.Data, false)
+	assert.Error(t, err)
+}
+
+// TestRecordDeconfigured tests that the removal of a BYOH node is reported through an event on the ConfigMap and the
+// count of deconfigured BYOH nodes
+func TestRecordDeconfigured(t *testing.T) {
+	deconfigured := func() float64 {
+		families, err := crmetrics.Registry.Gather()
+		require.NoError(t, err)
+		for _, family := range families {
+			if family.GetName() == "wmco_byoh_nodes_deconfigured_total" {
+				return family.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+		t.Fatal("wmco_byoh_nodes_deconfigured_total is not registered")
+		return 0
+	}
+	recorder := record.NewFakeRecorder(1)
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+		recorder: recorder}}
+	node := &core.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "winhost"},
+		Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+
+	before := deconfigured()
+	r.recordDeconfigured(&core.ConfigMap{}, node)
+	assert.Equal(t, before+1, deconfigured())
+	require.Len(t, recorder.Events, 1)
+	event := <-recorder.Events
+	assert.Contains(t, event, "Normal InstanceDeconfigured")
+	assert.Contains(t, event, "node winhost")
+	assert.Contains(t, event, "address 10.0.0.1")
+}
+
+// TestBastion tests which instances SSH connections are tunneled through a bastion for, and that the proxy is used to
+// reach the bastion rather than the instance
+func TestBastion(t *testing.T) {
+	proxy := cluster.Proxy{HTTPSProxy: "http://proxy.example.com:3128"}
+	newReconciler := func(bastion *instances.Bastion) *ConfigMapReconciler {
+		return &ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+			proxy: proxy, bastion: bastion}}
+	}
+
+	t.Run("no bastion", func(t *testing.T) {
+		r := newReconciler(nil)
+		host, err := r.parseHostData("10.0.0.1", "username=core")
+		require.NoError(t, err)
+		assert.Nil(t, host.Bastion)
+		assert.Nil(t, host.SSHProxy)
+		// A bastion cannot be named without the credentials to log into it
+		_, err = r.parseHostData("10.0.0.1", "username=core,bastion=bastion.example.com")
+		assert.Error(t, err)
+		// DNS names are looked up
+		_, _, err = r.parseHosts(map[string]string{"notlocalhost": "username=core"}, false)
+		assert.Error(t, err)
+	})
+
+	t.Run("bastion set by the operator", func(t *testing.T) {
+		r := newReconciler(&instances.Bastion{Address: "bastion.example.com", Username: "jump"})
+		host, err := r.parseHostData("10.0.0.1", "username=core")
+		require.NoError(t, err)
+		require.NotNil(t, host.Bastion)
+		assert.Equal(t, "bastion.example.com:22", host.Bastion.HostPort())
+		assert.Equal(t, "jump", host.Bastion.Username)
+		// The instance is on a private network, but the bastion is reached through the proxy
+		require.NotNil(t, host.SSHProxy)
+		assert.Equal(t, "proxy.example.com:3128", host.SSHProxy.Host)
+		// Each instance has its own copy of the bastion, as the signer is set on it while connecting
+		assert.False(t, host.Bastion == r.bastion)
+
+		// An entry can name a different bastion, which is logged into with the same credentials
+		host, err = r.parseHostData("10.0.0.1", "username=core,bastion=10.1.0.1:2222")
+		require.NoError(t, err)
+		assert.Equal(t, "10.1.0.1:2222", host.Bastion.HostPort())
+		assert.Equal(t, "jump", host.Bastion.Username)
+		assert.Nil(t, host.SSHProxy)
+		assert.Equal(t, "bastion.example.com", r.bastion.Address)
+
+		_, err = r.parseHostData("10.0.0.1", "username=core,bastion=bastion.example.com:ssh")
+		assert.Error(t, err)
+
+		// Instances reached through the bastion do not have to be resolvable by the operator
+		out, _, err := r.parseHosts(map[string]string{"notlocalhost": "username=core"}, false)
+		require.NoError(t, err)
+		require.Len(t, out, 1)
+		assert.Equal(t, "notlocalhost", out[0].Address)
+	})
+
+	t.Run("bastion only set by entries", func(t *testing.T) {
+		r := newReconciler(&instances.Bastion{Username: "jump"})
+		host, err := r.parseHostData("10.0.0.1", "username=core")
+		require.NoError(t, err)
+		assert.Nil(t, host.Bastion)
+		host, err = r.parseHostData("10.0.0.1", "username=core,bastion=bastion.example.com:2222")
+		require.NoError(t, err)
+		assert.Equal(t, "bastion.example.com:2222", host.Bastion.HostPort())
+	})
+
+	t.Run("instance from node", func(t *testing.T) {
+		r := newReconciler(&instances.Bastion{Address: "bastion.example.com", Username: "jump"})
+		node := &core.Node{
+			ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{UsernameAnnotation: "core"}},
+			Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+		}
+		// Nodes configured before the bastion was annotated are reached through the bastion set by the operator
+		instance, err := r.instanceFromNode(node)
+		require.NoError(t, err)
+		assert.Equal(t, "bastion.example.com:22", instance.Bastion.HostPort())
+
+		node.Annotations[BastionAnnotation] = "10.1.0.1:2222"
+		instance, err = r.instanceFromNode(node)
+		require.NoError(t, err)
+		assert.Equal(t, "10.1.0.1:2222", instance.Bastion.HostPort())
+
+		node.Annotations[BastionAnnotation] = ""
+		instance, err = r.instanceFromNode(node)
+		require.NoError(t, err)
+		assert.Nil(t, instance.Bastion)
+
+		r.bastion = nil
+		node.Annotations[BastionAnnotation] = "10.1.0.1:2222"
+		_, err = r.instanceFromNode(node)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// SampleAddressPlaceholder is the placeholder for the address of the first instance of the sample ConfigMap
+	SampleAddressPlaceholder = "<address>"
+	// SampleSSHPortAddressPlaceholder is the placeholder for the address of the second instance of the sample
+	// ConfigMap, whose SSH server listens on a custom port
+	SampleSSHPortAddressPlaceholder = "<ssh-port-address>"
+	// SampleUsernamePlaceholder is the placeholder for the usernames of the instances of the sample ConfigMap
+	SampleUsernamePlaceholder = "<username>"
+)
+
+// sampleKeys are the optional keys of an instance entry described in the sample ConfigMap, with an example value
+var sampleKeys = []struct {
+	key     string
+	example string
+}{
+	{sshPortKey, "2222"},
+	{shutdownGracePeriodKey, "30s"},
+	{shutdownGracePeriodCriticalPodsKey, "10s"},
+	{featureGatesKey, "GracefulNodeShutdown=true;ExpandCSIVolumes=false"},
+	{imageGCHighThresholdPercentKey, "85"},
+	{imageGCLowThresholdPercentKey, "80"},
+	{dnsSearchDomainsKey, "corp.example.com;example.com"},
+	{bootstrapKubeconfigSecretKey, "windows-bootstrap-kubeconfig"},
+	{authSecretKey, "windows-password"},
+	{credentialSecretKey, "windows-private-key"},
+	{bastionKey, "bastion.example.com:22"},
+	{topologyLabelsKey, "topology.kubernetes.io/zone=us-east-1a"},
+	{labelsKey, "example.com/tier:gold"},
+	{taintsKey, "dedicated=winapp:NoSchedule"},
+}
+
+// SampleInstanceConfigMap returns a sample instance ConfigMap with the given name and namespace as YAML, with comments
+// describing the format of its entries. The ConfigMap is only valid once SampleAddressPlaceholder,
+// SampleSSHPortAddressPlaceholder and SampleUsernamePlaceholder are replaced with the addresses and usernames of
+// actual instances.
+func SampleInstanceConfigMap(name, namespace string) string {
+	var b strings.Builder
+	b.WriteString(`# The windows-instances ConfigMap describes the Windows instances which are configured into nodes.
+# Each entry has the address of an instance as its key, either an IP address or a DNS name which resolves to one, and
+# a value with the format username=<username>. The username is the Windows account used to SSH into the instance, and
+# can be given as <domain>\<user> or <user>@<domain> for domain accounts.
+#
+# Additional settings are appended to the username as comma separated <key>=<value> pairs, for example
+# username=core,sshPort=2222. Lists within a value are semicolon separated. The supported keys are:
+`)
+	for _, sample := range sampleKeys {
+		fmt.Fprintf(&b, "#   %s=%s\n", sample.key, sample.example)
+	}
+	fmt.Fprintf(&b, `#
+# Replace %s, %s and %s with the details of your instances before creating the ConfigMap.
+kind: ConfigMap
+apiVersion: v1
+metadata:
+  name: %s
+  namespace: %s
+data:
+  # An instance whose SSH server listens on the default port 22
+  %s: |-
+    %s=%s
+  # An instance whose SSH server listens on a custom port
+  %s: |-
+    %s=%s,%s=2222
+`, SampleAddressPlaceholder, SampleSSHPortAddressPlaceholder, SampleUsernamePlaceholder, name,
+		namespace, SampleAddressPlaceholder, usernameKey, SampleUsernamePlaceholder, SampleSSHPortAddressPlaceholder,
+		usernameKey, SampleUsernamePlaceholder, sshPortKey)
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"github.com/pkg/errors"
+	admissionv1 "k8s.io/api/admission/v1"
+	core "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/cluster"
+)
+
+// ConfigMapValidatorPath is the path the webhook validating the windows-instances ConfigMap is served at
+const ConfigMapValidatorPath = "/validate-windows-instances"
+
+//+kubebuilder:webhook:path=/validate-windows-instances,mutating=false,failurePolicy=ignore,sideEffects=None,groups="",resources=configmaps,verbs=create;update,versions=v1,name=vwindowsinstances.windowsmachineconfig.openshift.io,admissionReviewVersions=v1
+
+// ConfigMapValidator is a validating admission webhook rejecting an instance ConfigMap with invalid entries, so
+// that such errors are reported when the ConfigMap is applied rather than when it is reconciled
+type ConfigMapValidator struct {
+	// parser parses the ConfigMap entries in the same way as the ConfigMap controller. It is not shared with the
+	// ConfigMapReconciler, as the reconciler state it would read is updated while reconciling.
+	parser *ConfigMapReconciler
+	// watchNamespace is the namespace the windows-instances ConfigMap is validated in
+	watchNamespace string
+	decoder        *admission.Decoder
+}
+
+// NewConfigMapValidator returns a pointer to a ConfigMapValidator validating the windows-instances ConfigMap as it is
+// parsed by a ConfigMapReconciler created with the same options
+func NewConfigMapValidator(clusterConfig cluster.Config, watchNamespace string, opts Options) *ConfigMapValidator {
+	return &ConfigMapValidator{
+		parser: &ConfigMapReconciler{
+			instanceReconciler: instanceReconciler{
+				log:              ctrl.Log.WithName("webhooks").WithName("ConfigMap"),
+				watchNamespace:   watchNamespace,
+				kubeletConfig:    opts.KubeletConfig,
+				dnsSearchDomains: opts.DNSSearchDomains,
+				sshSessionLimit:  opts.SSHSessionLimit,
+				bastion:          opts.Bastion,
+				proxy:            clusterConfig.Proxy(),
+				ipFamily:         clusterConfig.Network().IPFamily(),
+				vxlanPort:        vxlanPort(clusterConfig, opts),
+			},
+			removeUnresolvableHosts: opts.RemoveUnresolvableHosts,
+			allowedCIDRs:            opts.AllowedCIDRs,
+			deniedCIDRs:             opts.DeniedCIDRs,
+			instanceConfigMap:       instanceConfigMapName(opts),
+		},
+		watchNamespace: watchNamespace,
+	}
+}
+
+// SetupWithManager registers the webhook with the webhook server of the Manager
+func (v *ConfigMapValidator) SetupWithManager(mgr ctrl.Manager) {
+	mgr.GetWebhookServer().Register(ConfigMapValidatorPath, &webhook.Admission{Handler: v})
+}
+
+// InjectDecoder implements admission.DecoderInjector
+func (v *ConfigMapValidator) InjectDecoder(decoder *admission.Decoder) error {
+	v.decoder = decoder
+	return nil
+}
+
+// Handle rejects an instance ConfigMap in the watch namespace, which is either the ConfigMap with the configured name
+// or a ConfigMap labeled with InstancesLabel, if any of its entries is invalid. All other ConfigMaps are allowed.
+// Updates which do not change how the entries are parsed, such as the ones made by the operator to report the state of
+// the instances, are allowed so that an invalid ConfigMap can still be finalized. Addresses described by more than one
+// ConfigMap are reported by the ConfigMap controller instead.
+func (v *ConfigMapValidator) Handle(_ context.Context, req admission.Request) admission.Response {
+	if req.Namespace != v.watchNamespace {
+		return admission.Allowed("")
+	}
+	configMap := &core.ConfigMap{}
+	if err := v.decoder.Decode(req, configMap); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if !v.parser.isInstanceConfigMap(configMap) {
+		return admission.Allowed("")
+	}
+	if req.Operation == admissionv1.Update {
+		oldConfigMap := &core.ConfigMap{}
+		if err := v.decoder.DecodeRaw(req.OldObject, oldConfigMap); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if v.parser.isInstanceConfigMap(oldConfigMap) && !parsingChanged(oldConfigMap, configMap) {
+			return admission.Allowed("")
+		}
+	}
+	if _, _, err := v.parser.parseHosts(configMap.Data,
+		configMap.Annotations[SkipDNSValidationAnnotation] == "true"); err != nil {
+		return admission.Denied(errors.Wrapf(err, "invalid instance ConfigMap %s", configMap.GetName()).Error())
+	}
+	return admission.Allowed("")
+}
+
+// parsingChanged returns true if the entries of the given ConfigMaps, or the annotations affecting how they are parsed,
+// differ
+func parsingChanged(oldConfigMap, newConfigMap *core.ConfigMap) bool {
+	return !reflect.DeepEqual(oldConfigMap.Data, newConfigMap.Data) ||
+		oldConfigMap.Annotations[SkipDNSValidationAnnotation] != newConfigMap.Annotations[SkipDNSValidationAnnotation]
+}
@@ -0,0 +1,133 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// admissionRequest returns an admission request for the given operation on the given ConfigMap
+func admissionRequest(t *testing.T, operation admissionv1.Operation, configMap,
+	oldConfigMap *core.ConfigMap) admission.Request {
+	req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: operation,
+		Name:      configMap.GetName(),
+		Namespace: configMap.GetNamespace(),
+	}}
+	raw, err := json.Marshal(configMap)
+	require.NoError(t, err)
+	req.Object = runtime.RawExtension{Raw: raw}
+	if oldConfigMap != nil {
+		raw, err = json.Marshal(oldConfigMap)
+		require.NoError(t, err)
+		req.OldObject = runtime.RawExtension{Raw: raw}
+	}
+	return req
+}
+
+// TestConfigMapValidator tests that only an invalid instance ConfigMap in the watch namespace is rejected
+func TestConfigMapValidator(t *testing.T) {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	require.NoError(t, err)
+	v := &ConfigMapValidator{
+		parser: &ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+			watchNamespace: "wmco"}, instanceConfigMap: InstanceConfigMap},
+		watchNamespace: "wmco",
+	}
+	require.NoError(t, v.InjectDecoder(decoder))
+
+	valid := &core.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Namespace: "wmco"},
+		Data:       map[string]string{"127.0.0.1": "username=core"},
+	}
+	invalid := valid.DeepCopy()
+	invalid.Data["127.0.0.2"] = "username=core,sshPort=abc"
+	otherNamespace := invalid.DeepCopy()
+	otherNamespace.Namespace = "default"
+	otherName := invalid.DeepCopy()
+	otherName.Name = "other"
+	labeled := otherName.DeepCopy()
+	labeled.Labels = map[string]string{InstancesLabel: "true"}
+	invalidStatusUpdate := invalid.DeepCopy()
+	invalidStatusUpdate.Annotations = map[string]string{InstanceStatusAnnotation: `{"127.0.0.1":"Ready"}`}
+
+	testCases := []struct {
+		name         string
+		operation    admissionv1.Operation
+		configMap    *core.ConfigMap
+		oldConfigMap *core.ConfigMap
+		allowed      bool
+	}{
+		{
+			name:      "valid ConfigMap created",
+			operation: admissionv1.Create,
+			configMap: valid,
+			allowed:   true,
+		},
+		{
+			name:      "invalid ConfigMap created",
+			operation: admissionv1.Create,
+			configMap: invalid,
+			allowed:   false,
+		},
+		{
+			name:         "ConfigMap updated with an invalid entry",
+			operation:    admissionv1.Update,
+			configMap:    invalid,
+			oldConfigMap: valid,
+			allowed:      false,
+		},
+		{
+			name:         "invalid ConfigMap updated without changing its entries",
+			operation:    admissionv1.Update,
+			configMap:    invalidStatusUpdate,
+			oldConfigMap: invalid,
+			allowed:      true,
+		},
+		{
+			name:      "ConfigMap in another namespace",
+			operation: admissionv1.Create,
+			configMap: otherNamespace,
+			allowed:   true,
+		},
+		{
+			name:      "ConfigMap with another name",
+			operation: admissionv1.Create,
+			configMap: otherName,
+			allowed:   true,
+		},
+		{
+			name:      "invalid labeled ConfigMap created",
+			operation: admissionv1.Create,
+			configMap: labeled,
+			allowed:   false,
+		},
+		{
+			name:         "invalid ConfigMap labeled without changing its entries",
+			operation:    admissionv1.Update,
+			configMap:    labeled,
+			oldConfigMap: otherName,
+			allowed:      false,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			resp := v.Handle(context.Background(), admissionRequest(t, test.operation, test.configMap,
+				test.oldConfigMap))
+			assert.Equal(t, test.allowed, resp.Allowed)
+			if !test.allowed {
+				assert.Contains(t, string(resp.Result.Reason), "127.0.0.2")
+			}
+		})
+	}
+}
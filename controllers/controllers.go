@@ -1,24 +1,122 @@
 package controllers
 
 import (
+	"context"
 	"net"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	core "k8s.io/api/core/v1"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
+	"github.com/openshift/windows-machine-config-operator/pkg/cluster"
 	"github.com/openshift/windows-machine-config-operator/pkg/instances"
 	"github.com/openshift/windows-machine-config-operator/pkg/metrics"
 	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/notify"
+	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
+	"github.com/openshift/windows-machine-config-operator/pkg/tracing"
 	"github.com/openshift/windows-machine-config-operator/version"
 )
 
+// Options holds the operator level settings used by the controllers
+type Options struct {
+	// KubeletConfig holds the kubelet settings that are applied to all Windows instances by default
+	KubeletConfig instances.KubeletConfig
+	// DNSSearchDomains are the DNS search domains that are set on all Windows instances by default
+	DNSSearchDomains []string
+	// SSHSessionLimit is the maximum number of concurrent SSH sessions to a single Windows instance
+	SSHSessionLimit int
+	// SSHDialTimeout is the maximum duration of a single attempt to connect to the SSH server of a Windows instance
+	SSHDialTimeout time.Duration
+	// SSHCommandTimeout is the maximum duration of a command run on a Windows instance, or of a file transfer to it
+	SSHCommandTimeout time.Duration
+	// Bastion is the jump host SSH connections to BYOH instances are tunneled through. Its address is unset if
+	// instances are connected to directly unless their entry names a bastion, in which case its credentials are used.
+	// Instances are always connected to directly if it is nil.
+	Bastion *instances.Bastion
+	// HostMetadataAnnotations are the node annotations whose values are sourced from commands run on all Windows
+	// instances
+	HostMetadataAnnotations []instances.MetadataAnnotation
+	// StrictNodeCount causes the ConfigMap reconciler to fail when the number of Ready BYOH nodes does not match the
+	// number of configured instances, instead of only reporting the mismatch
+	StrictNodeCount bool
+	// RemoveUnresolvableHosts causes BYOH instances with a DNS name which no longer resolves to be removed from the
+	// cluster, instead of the ConfigMap being rejected
+	RemoveUnresolvableHosts bool
+	// AllowedCIDRs are the networks the addresses of BYOH instances must be within. All addresses are allowed if empty.
+	AllowedCIDRs []*net.IPNet
+	// DeniedCIDRs are the networks the addresses of BYOH instances cannot be within
+	DeniedCIDRs []*net.IPNet
+	// InstanceConfigMap is the name of the ConfigMap describing the BYOH instances, allowing several operators to watch
+	// the same namespace with distinct ConfigMaps. InstanceConfigMap is used if it is empty.
+	InstanceConfigMap string
+	// RestoreConfigMap causes the windows-instances ConfigMap to be recreated from the existing BYOH nodes if it is
+	// deleted, instead of all BYOH nodes being removed from the cluster
+	RestoreConfigMap bool
+	// DryRun causes the BYOH instances which would be configured and the BYOH nodes which would be removed to be
+	// reported through logs and events, without the instances, nodes or ConfigMaps being changed
+	DryRun bool
+	// IgnoreLabel is the node label which, when set to "true", exempts a BYOH node from being configured or removed by
+	// the operator
+	IgnoreLabel string
+	// AllowDowngrade permits BYOH nodes configured by a newer operator version to be configured again by the running
+	// operator version
+	AllowDowngrade bool
+	// Webhook is notified of the events emitted by the controllers, if it is not nil
+	Webhook *notify.Webhook
+	// DrainTimeout bounds how long a BYOH node is drained for before it is removed. 0 waits until the node is drained.
+	DrainTimeout time.Duration
+	// MaxUnavailable is the maximum number of BYOH nodes which can be unavailable at once while nodes are upgraded. It
+	// can be overridden through the MaxUnavailableAnnotation of the windows-instances ConfigMap.
+	MaxUnavailable int
+	// ConfigurationWorkers is the number of BYOH instances which are configured concurrently
+	ConfigurationWorkers int
+	// MaxConfigurationBackoff is the maximum duration a BYOH instance which repeatedly fails to be configured is not
+	// retried for
+	MaxConfigurationBackoff time.Duration
+	// CheckReachability causes the SSH port of a BYOH instance to be probed before the instance is configured, so that
+	// an unreachable instance is reported as such
+	CheckReachability bool
+	// ResyncInterval is the interval the windows-instances ConfigMap is reconciled at in the absence of events, so that
+	// BYOH nodes which were changed without an event being observed are corrected. 0 disables the periodic reconcile.
+	ResyncInterval time.Duration
+	// VXLANPort is the VXLAN port configured on Windows nodes, overriding the port of the cluster network if it is set
+	VXLANPort string
+	// MinOSVersion is the minimum version of Windows, such as 10.0.17763, BYOH instances must be running to be
+	// configured. The version is not checked if it is empty.
+	MinOSVersion string
+	// RemovalGracePeriod is the duration a BYOH node whose instance is removed from the windows-instances ConfigMap is
+	// kept for before it is removed, so that an instance added back within it is not configured again. 0 removes nodes
+	// as soon as their instance is removed.
+	RemovalGracePeriod time.Duration
+}
+
+const (
+	// DefaultDrainTimeout is the default duration a BYOH node is drained for before it is removed
+	DefaultDrainTimeout = 5 * time.Minute
+	// DefaultMinOSVersion is the default minimum version of Windows BYOH instances must be running, which is Windows
+	// Server 2019
+	DefaultMinOSVersion = "10.0.17763"
+	// DefaultMaxUnavailable is the default maximum number of BYOH nodes which can be unavailable at once
+	DefaultMaxUnavailable = 1
+	// DefaultConfigurationWorkers is the default number of BYOH instances which are configured concurrently
+	DefaultConfigurationWorkers = 5
+	// DefaultMaxConfigurationBackoff is the default maximum duration a BYOH instance which repeatedly fails to be
+	// configured is not retried for
+	DefaultMaxConfigurationBackoff = 5 * time.Minute
+	// DefaultResyncInterval is the default interval the windows-instances ConfigMap is reconciled at in the absence of
+	// events
+	DefaultResyncInterval = 10 * time.Minute
+)
+
 // instanceReconciler contains everything needed to perform actions on a Windows instance
 type instanceReconciler struct {
 	// Client is the cache client
@@ -34,24 +132,91 @@ type instanceReconciler struct {
 	vxlanPort string
 	// signer is a signer created from the user's private key
 	signer ssh.Signer
+	// credentialSigners caches the signers created from the credential secrets of instances
+	credentialSigners *signerCache
+	// hostLocks ensures that only one operation is in progress on an instance at a time
+	hostLocks *hostLocks
 	// prometheusNodeConfig stores information required to configure Prometheus
 	prometheusNodeConfig *metrics.PrometheusNodeConfig
 	// recorder to generate events
 	recorder record.EventRecorder
+	// kubeletConfig holds the kubelet settings that are applied to all Windows instances by default
+	kubeletConfig instances.KubeletConfig
+	// dnsSearchDomains are the DNS search domains that are set on all Windows instances by default
+	dnsSearchDomains []string
+	// sshSessionLimit is the maximum number of concurrent SSH sessions to a single Windows instance
+	sshSessionLimit int
+	// sshDialTimeout is the maximum duration of a single attempt to connect to the SSH server of a Windows instance
+	sshDialTimeout time.Duration
+	// sshCommandTimeout is the maximum duration of a command run on a Windows instance, or of a file transfer to it
+	sshCommandTimeout time.Duration
+	// bastion is the jump host SSH connections to BYOH instances are tunneled through
+	bastion *instances.Bastion
+	// metadataAnnotations are the node annotations whose values are sourced from commands run on all Windows instances
+	metadataAnnotations []instances.MetadataAnnotation
+	// proxy holds the cluster-wide proxy settings, which determine whether SSH connections to Windows instances are
+	// tunneled through a proxy
+	proxy cluster.Proxy
+	// drainTimeout bounds how long a node is drained for before it is deconfigured. 0 waits until the node is drained.
+	drainTimeout time.Duration
+	// ipFamily is the IP family of the cluster network, which determines the families of the addresses Windows
+	// instances can be reached with
+	ipFamily cluster.IPFamily
+	// connect overrides how instances are connected to outside of their configuration, connectInstance is used if it
+	// is nil
+	connect func(instance *instances.InstanceInfo, signer ssh.Signer) (instanceConnection, error)
+}
+
+// instanceConnection holds the operations performed on a connected instance apart from configuring it
+type instanceConnection interface {
+	// Drain cordons the node of the instance and evicts its pods until the given context is done
+	Drain(context.Context) error
+	// Deconfigure reverts the configuration of the instance and removes its node
+	Deconfigure() error
+	// AuthorizeKey ensures the given public key is an authorized SSH key on the instance
+	AuthorizeKey(ssh.PublicKey) error
+	// UnauthorizeKey ensures the given public key is not an authorized SSH key on the instance
+	UnauthorizeKey(ssh.PublicKey) error
+}
+
+// connectInstance connects to the given instance, authenticating with the given signer
+func (r *instanceReconciler) connectInstance(instance *instances.InstanceInfo,
+	signer ssh.Signer) (instanceConnection, error) {
+	if r.connect != nil {
+		return r.connect(instance, signer)
+	}
+	nc, err := nodeconfig.NewNodeConfig(r.k8sclientset, r.clusterServiceCIDR, r.vxlanPort, instance, signer, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return nc, nil
 }
 
 // configureInstance adds the specified instance to the cluster. if hostname is not empty, the instance's hostname will be
 // changed to the passed in value. If annotations is not nil, the node will have the specified annotations applied to
-// it.
-func (r *instanceReconciler) configureInstance(instance *instances.InstanceInfo, annotations map[string]string) error {
-	nc, err := nodeconfig.NewNodeConfig(r.k8sclientset, r.clusterServiceCIDR, r.vxlanPort, instance, r.signer,
-		annotations)
+// it. The spans of the configuration steps are started as children of the span of the given context. Messages are
+// logged with the given logger, which is scoped to the instance.
+func (r *instanceReconciler) configureInstance(ctx context.Context, instance *instances.InstanceInfo, annotations,
+	labels map[string]string, log logr.Logger) error {
+	log.V(1).Info("configuring instance")
+	instanceSigner, err := r.signerFor(instance)
+	if err != nil {
+		return err
+	}
+	if err := r.setBastionSigner(instance); err != nil {
+		return err
+	}
+	_, span := tracing.StartSpan(ctx, "Connect", tracing.Address(instance.Address))
+	nc, err := nodeconfig.NewNodeConfig(r.k8sclientset, r.clusterServiceCIDR, r.vxlanPort, instance, instanceSigner,
+		annotations, labels)
+	tracing.EndSpan(span, err)
 	if err != nil {
 		return errors.Wrap(err, "failed to create new nodeconfig")
 	}
-	if err := nc.Configure(); err != nil {
+	if err := nc.Configure(ctx); err != nil {
 		return errors.Wrap(err, "failed to configure Windows instance")
 	}
+	log.V(1).Info("instance configured")
 	return nil
 }
 
@@ -61,20 +226,70 @@ func (r *instanceReconciler) instanceFromNode(node *core.Node) (*instances.Insta
 	if node.Annotations[UsernameAnnotation] == "" {
 		return nil, errors.New("node is missing valid username annotation")
 	}
-	addr, err := GetAddress(node.Status.Addresses)
+	addr, err := getAddress(node.Status.Addresses, r.ipFamily)
 	if err != nil {
 		return nil, err
 	}
-	return instances.NewInstanceInfo(addr, node.Annotations[UsernameAnnotation], ""), nil
+	addr = withZone(addr, node.Annotations[ZoneAnnotation])
+	instance := instances.NewInstanceInfo(addr, node.Annotations[UsernameAnnotation], "")
+	// Nodes configured before the SSH port was annotated use the default port
+	if port, present := node.Annotations[SSHPortAnnotation]; present {
+		if instance.SSHPort, err = parsePort(port); err != nil {
+			return nil, errors.Wrapf(err, "node has invalid %s annotation", SSHPortAnnotation)
+		}
+	}
+	if authSecret := node.Annotations[AuthSecretAnnotation]; authSecret != "" {
+		instance.AuthSecret = authSecret
+		instance.Password, err = secrets.GetPassword(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+			Name: authSecret}, r.client)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get password from secret %s", authSecret)
+		}
+	}
+	instance.CredentialSecret = node.Annotations[CredentialSecretAnnotation]
+	instance.SSHSessionLimit = r.sshSessionLimit
+	instance.SSHDialTimeout = r.sshDialTimeout
+	instance.SSHCommandTimeout = r.sshCommandTimeout
+	instance.MetadataAnnotations = r.metadataAnnotations
+	// Nodes configured before the bastion was annotated are reached through the bastion set by the operator flags
+	if bastion, present := node.Annotations[BastionAnnotation]; present && bastion != "" {
+		if r.bastion == nil {
+			return nil, errors.Errorf("node is reached through bastion %s, but no bastion username is set", bastion)
+		}
+		if instance.Bastion, err = r.bastion.WithAddress(bastion); err != nil {
+			return nil, errors.Wrapf(err, "node has invalid %s annotation", BastionAnnotation)
+		}
+	} else if !present && r.bastion != nil && r.bastion.Address != "" {
+		bastion := *r.bastion
+		instance.Bastion = &bastion
+	}
+	if instance.SSHProxy, err = r.proxy.URLFor(sshHost(instance)); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// sshHost returns the host SSH connections to the given instance are made to, which is its bastion if it has one
+func sshHost(instance *instances.InstanceInfo) string {
+	if instance.Bastion != nil {
+		return instance.Bastion.Address
+	}
+	return instance.Address
 }
 
 // GetAddress returns a non-ipv6 address that can be used to reach a Windows node. This can be either an ipv4
 // or dns address.
 func GetAddress(addresses []core.NodeAddress) (string, error) {
+	return getAddress(addresses, cluster.IPv4)
+}
+
+// getAddress returns an address that can be used to reach a Windows node. This can be either a dns address, or an ip
+// address supported by the given cluster IP family.
+func getAddress(addresses []core.NodeAddress, ipFamily cluster.IPFamily) (string, error) {
 	for _, addr := range addresses {
 		if addr.Type == core.NodeInternalIP || addr.Type == core.NodeInternalDNS {
-			// filter out ipv6
-			if net.ParseIP(addr.Address) != nil && net.ParseIP(addr.Address).To4() == nil {
+			// filter out ip addresses the cluster network does not support
+			if ip := net.ParseIP(addr.Address); ip != nil && !supportsIP(ipFamily, ip) {
 				continue
 			}
 			return addr.Address, nil
@@ -83,21 +298,153 @@ func GetAddress(addresses []core.NodeAddress) (string, error) {
 	return "", errors.New("no usable address")
 }
 
+// supportsIP returns true if the given ip address can be used on a cluster network of the given IP family
+func supportsIP(ipFamily cluster.IPFamily, ip net.IP) bool {
+	if ip.To4() != nil {
+		return ipFamily.SupportsIPv4()
+	}
+	return ipFamily.SupportsIPv6()
+}
+
+// sameAddress returns true if the given addresses are equal, comparing ip addresses by value so that different
+// representations of the same ipv6 address match. The zone of an address is ignored, as node addresses do not have one.
+func sameAddress(a, b string) bool {
+	a, _ = instances.SplitZone(a)
+	b, _ = instances.SplitZone(b)
+	if ipA, ipB := net.ParseIP(a), net.ParseIP(b); ipA != nil && ipB != nil {
+		return ipA.Equal(ipB)
+	}
+	return a == b
+}
+
+// containsAddress returns true if the given address is the same as any of the given addresses
+func containsAddress(addresses []string, address string) bool {
+	for _, candidate := range addresses {
+		if sameAddress(candidate, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// withZone returns the given node address followed by the given zone, if the address is an IPv6 link-local address and
+// the zone is not empty
+func withZone(address, zone string) string {
+	if ip := net.ParseIP(address); zone == "" || ip == nil || ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return address
+	}
+	return address + "%" + zone
+}
+
 // deconfigureInstance deconfigures the instance associated with the given node, removing the node from the cluster.
-func (r *instanceReconciler) deconfigureInstance(node *core.Node) error {
+// The node is drained first, and removed regardless of any remaining pods if it is not drained within drainTimeout, in
+// which case the pods are reported on the given ConfigMap describing the instance. The drain is stopped once the given
+// context is done. A hostBusyError is returned without waiting if another operation is in progress on the instance.
+// Messages are logged with the given logger, scoped to the node.
+func (r *instanceReconciler) deconfigureInstance(ctx context.Context, configMap *core.ConfigMap, node *core.Node,
+	log logr.Logger) error {
+	return r.deconfigureHeldInstance(ctx, configMap, node, nil, log)
+}
+
+// deconfigureHeldInstance deconfigures the instance associated with the given node as deconfigureInstance does, without
+// locking the instance if it is reached at one of the given addresses, which the caller already holds the lock of
+func (r *instanceReconciler) deconfigureHeldInstance(ctx context.Context, configMap *core.ConfigMap, node *core.Node,
+	held []string, log logr.Logger) error {
+	log = log.WithValues("node", node.GetName())
 	instance, err := r.instanceFromNode(node)
 	if err != nil {
 		return errors.Wrap(err, "unable to create instance object from node")
 	}
+	if !containsAddress(held, instance.Address) {
+		if !r.hostLocks.tryLock(instance.Address) {
+			return &hostBusyError{address: instance.Address}
+		}
+		defer r.hostLocks.unlock(instance.Address)
+	}
+	instanceSigner, err := r.signerFor(instance)
+	if err != nil {
+		return err
+	}
+	if err := r.setBastionSigner(instance); err != nil {
+		return err
+	}
 
-	nc, err := nodeconfig.NewNodeConfig(r.k8sclientset, r.clusterServiceCIDR, r.vxlanPort, instance, r.signer,
-		nil)
+	nc, err := r.connectInstance(instance, instanceSigner)
 	if err != nil {
 		return errors.Wrap(err, "failed to create new nodeconfig")
 	}
+
+	var drainCtx context.Context
+	var cancel context.CancelFunc
+	if r.drainTimeout > 0 {
+		drainCtx, cancel = context.WithTimeout(ctx, r.drainTimeout)
+	} else {
+		drainCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	r.recorder.Eventf(node, core.EventTypeNormal, "DrainStarted", "draining node %s before removing it",
+		node.GetName())
+	if err := nc.Drain(drainCtx); err != nil {
+		if !errors.Is(drainCtx.Err(), context.DeadlineExceeded) {
+			return err
+		}
+		log.Info("drain timed out, removing node", "timeout", r.drainTimeout)
+		r.recorder.Eventf(node, core.EventTypeWarning, "DrainTimeout",
+			"node %s was not drained within %s, removing it along with its remaining pods", node.GetName(),
+			r.drainTimeout)
+		// The node is removed regardless, so failing to report the pods is not fatal
+		if err := r.reportDrainBlockers(configMap, node); err != nil {
+			log.Error(err, "unable to report the pods blocking the drain")
+		}
+	} else {
+		r.recorder.Eventf(node, core.EventTypeNormal, "DrainCompleted", "drained node %s", node.GetName())
+	}
 	return nc.Deconfigure()
 }
 
+// configurePrometheus updates the Prometheus endpoints to reflect the current list of Windows nodes, logging when they
+// are changed
+func (r *instanceReconciler) configurePrometheus() error {
+	changed, err := r.prometheusNodeConfig.Configure()
+	if err != nil {
+		return errors.Wrap(err, "unable to configure Prometheus")
+	}
+	if changed {
+		r.log.Info("Prometheus endpoints updated", "endpoints", metrics.WindowsMetricsResource, "port", metrics.Port)
+	}
+	return nil
+}
+
+// windowsNodeLabels selects the Windows nodes when listing nodes. BYOH nodes are identified by their annotation, which
+// cannot be selected on, so node lists are narrowed down to the Windows nodes instead of including the Linux nodes.
+var windowsNodeLabels = client.MatchingLabels{core.LabelOSStable: "windows"}
+
+// instanceConfigMapName returns the name of the ConfigMap describing the BYOH instances, which is the override in the
+// given options if it is set, and InstanceConfigMap otherwise
+func instanceConfigMapName(opts Options) string {
+	if opts.InstanceConfigMap != "" {
+		return opts.InstanceConfigMap
+	}
+	return InstanceConfigMap
+}
+
+// defaultVXLANPort is the VXLAN port used by hybrid-overlay on Windows nodes when no custom port is configured
+const defaultVXLANPort = 4789
+
+// vxlanPort returns the VXLAN port to be configured on Windows nodes, which is the override in the given options if it
+// is set, and the port of the cluster network otherwise
+func vxlanPort(clusterConfig cluster.Config, opts Options) string {
+	if opts.VXLANPort != "" {
+		return opts.VXLANPort
+	}
+	return clusterConfig.Network().VXLANPort()
+}
+
+// isBYOHNode returns true if the given node is annotated as a BYOH node
+func isBYOHNode(node *core.Node) bool {
+	return node.Annotations[BYOHAnnotation] == "true"
+}
+
 // windowsNodePredicate returns a predicate which filters out all node objects that are not Windows nodes.
 // If BYOH is true, only BYOH nodes will be allowed through, else no BYOH nodes will be allowed.
 func windowsNodePredicate(byoh bool) predicate.Funcs {
@@ -119,6 +466,10 @@ func windowsNodePredicate(byoh bool) predicate.Funcs {
 			if e.ObjectNew.GetLabels()[core.LabelOSStable] != "windows" {
 				return false
 			}
+			// A change in the management model of a node is relevant to both the BYOH and Machine controllers
+			if e.ObjectNew.GetAnnotations()[BYOHAnnotation] != e.ObjectOld.GetAnnotations()[BYOHAnnotation] {
+				return true
+			}
 			if (byoh && e.ObjectNew.GetAnnotations()[BYOHAnnotation] != "true") ||
 				(!byoh && e.ObjectNew.GetAnnotations()[BYOHAnnotation] == "true") {
 				return false
@@ -128,10 +479,18 @@ func windowsNodePredicate(byoh bool) predicate.Funcs {
 					e.ObjectOld.GetAnnotations()[nodeconfig.PubKeyHashAnnotation] {
 				return true
 			}
+			// Only BYOH nodes can have their reconfiguration forced
+			if byoh && e.ObjectNew.GetAnnotations()[ForceReconfigureAnnotation] == "true" &&
+				e.ObjectOld.GetAnnotations()[ForceReconfigureAnnotation] != "true" {
+				return true
+			}
 			return false
 		},
+		// A BYOH node deleted out of band is created again by configuring its instance, if the instance is still
+		// described by the ConfigMap. The nodes of Machines are removed along with their Machine.
 		DeleteFunc: func(e event.DeleteEvent) bool {
-			return false
+			return byoh && e.Object.GetLabels()[core.LabelOSStable] == "windows" &&
+				e.Object.GetAnnotations()[BYOHAnnotation] == "true"
 		},
 	}
 
@@ -1,11 +1,22 @@
 package controllers
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/cluster"
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+	"github.com/openshift/windows-machine-config-operator/pkg/tracing"
 )
 
 func TestGetAddress(t *testing.T) {
@@ -62,3 +73,97 @@ func TestGetAddress(t *testing.T) {
 		})
 	}
 }
+
+func TestGetAddressIPFamily(t *testing.T) {
+	addresses := []core.NodeAddress{
+		{Type: core.NodeInternalIP, Address: "10.0.0.1"},
+		{Type: core.NodeInternalIP, Address: "fd00::1"},
+	}
+	out, err := getAddress(addresses, cluster.IPv6)
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::1", out)
+
+	out, err = getAddress(addresses, cluster.IPv4)
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", out)
+
+	out, err = getAddress([]core.NodeAddress{{Type: core.NodeInternalIP, Address: "fd00::1"}}, cluster.DualStack)
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::1", out)
+
+	_, err = getAddress([]core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}, cluster.IPv6)
+	assert.Error(t, err)
+}
+
+func TestInstanceFromNodeSSHPort(t *testing.T) {
+	r := instanceReconciler{}
+	node := &core.Node{
+		ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{UsernameAnnotation: "core"}},
+		Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+	instance, err := r.instanceFromNode(node)
+	require.NoError(t, err)
+	assert.Equal(t, 0, instance.SSHPort)
+
+	node.Annotations[SSHPortAnnotation] = "2222"
+	instance, err = r.instanceFromNode(node)
+	require.NoError(t, err)
+	assert.Equal(t, 2222, instance.SSHPort)
+
+	node.Annotations[SSHPortAnnotation] = "ssh"
+	_, err = r.instanceFromNode(node)
+	assert.Error(t, err)
+}
+
+// TestDomainUsernameRoundTrip tests that domain qualified usernames are kept as is when an instance is parsed from the
+// ConfigMap, recorded on its node, read back from the node, and restored into the ConfigMap
+func TestDomainUsernameRoundTrip(t *testing.T) {
+	for _, username := range []string{`CORP\svc-wmco`, "svc-wmco@corp.example.com", `CORP\Windows Admin`} {
+		t.Run(username, func(t *testing.T) {
+			r := &ConfigMapReconciler{}
+			hosts, _, err := r.parseHosts(map[string]string{"10.0.0.1": "username=" + username}, false)
+			require.NoError(t, err)
+			require.Len(t, hosts, 1)
+			assert.Equal(t, username, hosts[0].Username)
+
+			node := &core.Node{
+				ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{BYOHAnnotation: "true",
+					UsernameAnnotation: hosts[0].Username}},
+				Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP,
+					Address: "10.0.0.1"}}},
+			}
+			instance, err := r.instanceFromNode(node)
+			require.NoError(t, err)
+			assert.Equal(t, username, instance.Username)
+
+			data := configMapDataFromNodes(&core.NodeList{Items: []core.Node{*node}}, cluster.IPv4)
+			hosts, _, err = r.parseHosts(data, false)
+			require.NoError(t, err)
+			require.Len(t, hosts, 1)
+			assert.Equal(t, username, hosts[0].Username)
+		})
+	}
+}
+
+// TestConfigureInstanceSpans tests that the steps of configuring an instance are traced as children of the span of the
+// context the instance is configured with
+func TestConfigureInstanceSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	r := instanceReconciler{log: ctrl.Log.WithName("test"), signer: newTestSigner(t, 1)}
+
+	// The instance cannot be connected to, as there is no cluster to discover the ignition endpoint of
+	ctx, span := tracing.StartSpan(context.Background(), "ConfigureInstance")
+	err := r.configureInstance(ctx, &instances.InstanceInfo{Address: "10.0.0.1", Username: "core"}, nil, nil, r.log)
+	tracing.EndSpan(span, err)
+	require.Error(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	connect, root := spans[0], spans[1]
+	assert.Equal(t, "Connect", connect.Name())
+	assert.Equal(t, root.SpanContext().SpanID(), connect.Parent().SpanID())
+	assert.Equal(t, codes.Error, connect.Status().Code)
+}
@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+	"github.com/openshift/windows-machine-config-operator/pkg/signer"
+)
+
+// CredentialSecretAnnotation is a node annotation that contains the name of the secret holding the private key used to
+// log into the Windows instance. It is empty if the private key secret is used.
+const CredentialSecretAnnotation = "windowsmachineconfig.openshift.io/credential-secret"
+
+// signerCache holds the signers created from the credential secrets of instances, so that a secret shared by several
+// instances is only read once. It is safe for concurrent use, and a nil signerCache creates a signer on each request.
+type signerCache struct {
+	// signers holds the signer created from each secret, keyed by secret name
+	signers map[string]ssh.Signer
+	// errs holds the error encountered creating a signer from each secret, keyed by secret name
+	errs map[string]error
+	lock sync.Mutex
+}
+
+// newSignerCache returns an empty signerCache
+func newSignerCache() *signerCache {
+	return &signerCache{signers: make(map[string]ssh.Signer), errs: make(map[string]error)}
+}
+
+// get returns the signer created from the private key held by the given secret, which is read with the given client
+func (c *signerCache) get(secret kubeTypes.NamespacedName, cl client.Client) (ssh.Signer, error) {
+	if c == nil {
+		return signer.Create(secret, cl)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s, present := c.signers[secret.Name]; present {
+		return s, nil
+	}
+	if err, present := c.errs[secret.Name]; present {
+		return nil, err
+	}
+	s, err := signer.Create(secret, cl)
+	if err != nil {
+		c.errs[secret.Name] = err
+		return nil, err
+	}
+	c.signers[secret.Name] = s
+	return s, nil
+}
+
+// usesOwnCredentials returns true if the given instance is authenticated against with credentials of its own, rather
+// than with the private key secret shared by all instances
+func usesOwnCredentials(instance *instances.InstanceInfo) bool {
+	return instance.AuthSecret != "" || instance.CredentialSecret != ""
+}
+
+// signerFor returns the signer used to authenticate against the given instance. It is created from the credential
+// secret of the instance if it references one, and is the signer created from the private key secret otherwise.
+func (r *instanceReconciler) signerFor(instance *instances.InstanceInfo) (ssh.Signer, error) {
+	if instance.CredentialSecret == "" {
+		return r.signer, nil
+	}
+	s, err := r.credentialSigners.get(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+		Name: instance.CredentialSecret}, r.client)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create signer from credential secret %s", instance.CredentialSecret)
+	}
+	return s, nil
+}
+
+// setBastionSigner sets the signer used to authenticate against the bastion of the given instance, if it has one. The
+// signer is created from the private key held by the bastion secret, or is the private key signer if it is not set.
+func (r *instanceReconciler) setBastionSigner(instance *instances.InstanceInfo) error {
+	if instance.Bastion == nil {
+		return nil
+	}
+	if instance.Bastion.Secret == "" {
+		if r.signer == nil {
+			return errors.Errorf("unable to authenticate against bastion %s without the private key secret",
+				instance.Bastion.HostPort())
+		}
+		instance.Bastion.Signer = r.signer
+		return nil
+	}
+	s, err := r.credentialSigners.get(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+		Name: instance.Bastion.Secret}, r.client)
+	if err != nil {
+		return errors.Wrapf(err, "unable to create signer from bastion secret %s", instance.Bastion.Secret)
+	}
+	instance.Bastion.Signer = s
+	return nil
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	core "k8s.io/api/core/v1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
+)
+
+// secretClient is a client which serves the given secrets, counting the number of times each secret is read. All other
+// requests are unimplemented.
+type secretClient struct {
+	client.Client
+	secrets map[string]*core.Secret
+	gets    map[string]int
+}
+
+func (c *secretClient) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	c.gets[key.Name]++
+	secret, present := c.secrets[key.Name]
+	if !present {
+		return k8sapierrors.NewNotFound(core.Resource("secrets"), key.Name)
+	}
+	secret.DeepCopyInto(obj.(*core.Secret))
+	return nil
+}
+
+// newPrivateKeySecret returns a secret holding a new Ed25519 private key
+func newPrivateKeySecret(t *testing.T) *core.Secret {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return &core.Secret{Data: map[string][]byte{
+		secrets.PrivateKeySecretKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}),
+	}}
+}
+
+// TestSignerFor tests that instances referencing a credential secret are authenticated against with the key it holds,
+// that each secret is only read once, and that other instances use the private key secret
+func TestSignerFor(t *testing.T) {
+	c := &secretClient{secrets: map[string]*core.Secret{"team-a": newPrivateKeySecret(t),
+		"team-b": newPrivateKeySecret(t)}, gets: make(map[string]int)}
+	globalSigner, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	require.NoError(t, err)
+	r := instanceReconciler{client: c, watchNamespace: "wmco", signer: globalSigner,
+		credentialSigners: newSignerCache()}
+
+	global, err := r.signerFor(&instances.InstanceInfo{Address: "10.0.0.1"})
+	require.NoError(t, err)
+	assert.Equal(t, globalSigner, global)
+
+	teamA, err := r.signerFor(&instances.InstanceInfo{Address: "10.0.0.2", CredentialSecret: "team-a"})
+	require.NoError(t, err)
+	teamAAgain, err := r.signerFor(&instances.InstanceInfo{Address: "10.0.0.3", CredentialSecret: "team-a"})
+	require.NoError(t, err)
+	teamB, err := r.signerFor(&instances.InstanceInfo{Address: "10.0.0.4", CredentialSecret: "team-b"})
+	require.NoError(t, err)
+	assert.Equal(t, teamA, teamAAgain)
+	assert.NotEqual(t, teamA.PublicKey().Marshal(), teamB.PublicKey().Marshal())
+	assert.NotEqual(t, global.PublicKey().Marshal(), teamA.PublicKey().Marshal())
+	assert.Equal(t, map[string]int{"team-a": 1, "team-b": 1}, c.gets)
+
+	// A missing secret is reported for each instance referencing it, and is only read once
+	for i := 0; i < 2; i++ {
+		_, err = r.signerFor(&instances.InstanceInfo{Address: "10.0.0.5", CredentialSecret: "team-c"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "credential secret team-c")
+	}
+	assert.Equal(t, 1, c.gets["team-c"])
+
+	// Signers are created on each request without a cache
+	r.credentialSigners = nil
+	_, err = r.signerFor(&instances.InstanceInfo{Address: "10.0.0.2", CredentialSecret: "team-a"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, c.gets["team-a"])
+}
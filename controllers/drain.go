@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+//+kubebuilder:rbac:groups=policy,resources=poddisruptionbudgets,verbs=list
+
+// maxReportedBlockers is the maximum number of pods named in a DrainBlocked event, keeping the event message within
+// the size limit of events
+const maxReportedBlockers = 10
+
+// reportDrainBlockers emits a DrainBlocked warning event on the given ConfigMap, listing the pods still running on the
+// given node after draining it timed out, along with the PodDisruptionBudgets preventing their eviction
+func (r *instanceReconciler) reportDrainBlockers(configMap *core.ConfigMap, node *core.Node) error {
+	// The context of the drain is done by now, so the pods are listed with a new one
+	pods, err := r.k8sclientset.CoreV1().Pods("").List(context.TODO(),
+		meta.ListOptions{FieldSelector: "spec.nodeName=" + node.GetName()})
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the pods of node %s", node.GetName())
+	}
+	pdbs, err := r.k8sclientset.PolicyV1().PodDisruptionBudgets("").List(context.TODO(), meta.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "unable to list PodDisruptionBudgets")
+	}
+	blockers := drainBlockers(pods.Items, pdbs.Items)
+	if len(blockers) == 0 {
+		return nil
+	}
+	r.recorder.Eventf(configMap, core.EventTypeWarning, "DrainBlocked",
+		"node %s was not drained, pods still running: %s", node.GetName(), summarizeBlockers(blockers))
+	return nil
+}
+
+// drainBlockers returns a description of each of the given pods which draining did not evict, naming the
+// PodDisruptionBudgets among the given ones which cover the pod and their status. DaemonSet pods and pods which have
+// terminated are not evicted by a drain, and are left out.
+func drainBlockers(pods []core.Pod, pdbs []policy.PodDisruptionBudget) []string {
+	var blockers []string
+	for _, pod := range pods {
+		if pod.Status.Phase == core.PodSucceeded || pod.Status.Phase == core.PodFailed || isDaemonSetPod(&pod) {
+			continue
+		}
+		blocker := pod.GetNamespace() + "/" + pod.GetName()
+		var budgets []string
+		for _, pdb := range pdbs {
+			if pdb.GetNamespace() != pod.GetNamespace() || pdb.Spec.Selector == nil {
+				continue
+			}
+			selector, err := meta.LabelSelectorAsSelector(pdb.Spec.Selector)
+			if err != nil || !selector.Matches(labels.Set(pod.GetLabels())) {
+				continue
+			}
+			budgets = append(budgets, fmt.Sprintf("PodDisruptionBudget %s allows %d disruptions, %d of %d healthy",
+				pdb.GetName(), pdb.Status.DisruptionsAllowed, pdb.Status.CurrentHealthy, pdb.Status.DesiredHealthy))
+		}
+		if len(budgets) != 0 {
+			blocker += " (" + strings.Join(budgets, "; ") + ")"
+		}
+		blockers = append(blockers, blocker)
+	}
+	return blockers
+}
+
+// summarizeBlockers joins the given descriptions of the pods blocking a drain, naming at most maxReportedBlockers of
+// them
+func summarizeBlockers(blockers []string) string {
+	if len(blockers) <= maxReportedBlockers {
+		return strings.Join(blockers, ", ")
+	}
+	return fmt.Sprintf("%s, and %d more", strings.Join(blockers[:maxReportedBlockers], ", "),
+		len(blockers)-maxReportedBlockers)
+}
+
+// isDaemonSetPod returns true if the given pod is controlled by a DaemonSet
+func isDaemonSetPod(pod *core.Pod) bool {
+	owner := meta.GetControllerOf(pod)
+	return owner != nil && owner.Kind == "DaemonSet"
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	policy "k8s.io/api/policy/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// TestDrainBlockers tests that the pods left on a node after a drain timed out are reported along with the
+// PodDisruptionBudgets blocking their eviction
+func TestDrainBlockers(t *testing.T) {
+	newPod := func(namespace, name string, labels map[string]string) core.Pod {
+		return core.Pod{ObjectMeta: meta.ObjectMeta{Namespace: namespace, Name: name, Labels: labels},
+			Status: core.PodStatus{Phase: core.PodRunning}}
+	}
+	controller := true
+	daemonSetPod := newPod("kube-system", "exporter-abcde", nil)
+	daemonSetPod.OwnerReferences = []meta.OwnerReference{{Kind: "DaemonSet", Name: "exporter", Controller: &controller}}
+	completedPod := newPod("default", "job-abcde", map[string]string{"app": "web"})
+	completedPod.Status.Phase = core.PodSucceeded
+	pods := []core.Pod{
+		newPod("default", "web-1", map[string]string{"app": "web"}),
+		newPod("default", "cache-1", map[string]string{"app": "cache"}),
+		newPod("other", "web-1", map[string]string{"app": "web"}),
+		daemonSetPod,
+		completedPod,
+	}
+	// A PodDisruptionBudget which does not allow any of the pods it covers to be evicted
+	blocking := policy.PodDisruptionBudget{
+		ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "web-pdb"},
+		Spec: policy.PodDisruptionBudgetSpec{
+			Selector: &meta.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+		Status: policy.PodDisruptionBudgetStatus{DisruptionsAllowed: 0, CurrentHealthy: 2, DesiredHealthy: 2},
+	}
+	noSelector := policy.PodDisruptionBudget{ObjectMeta: meta.ObjectMeta{Namespace: "default", Name: "empty"}}
+
+	assert.Equal(t, []string{
+		"default/web-1 (PodDisruptionBudget web-pdb allows 0 disruptions, 2 of 2 healthy)",
+		"default/cache-1",
+		"other/web-1",
+	}, drainBlockers(pods, []policy.PodDisruptionBudget{blocking, noSelector}))
+	assert.Empty(t, drainBlockers([]core.Pod{daemonSetPod, completedPod}, []policy.PodDisruptionBudget{blocking}))
+}
+
+// TestSummarizeBlockers tests that the number of pods named in a DrainBlocked event is bounded
+func TestSummarizeBlockers(t *testing.T) {
+	var blockers []string
+	for i := 0; i < maxReportedBlockers+3; i++ {
+		blockers = append(blockers, fmt.Sprintf("default/web-%d", i))
+	}
+	assert.Equal(t, "default/web-0, default/web-1", summarizeBlockers(blockers[:2]))
+	summary := summarizeBlockers(blockers)
+	assert.Contains(t, summary, fmt.Sprintf("default/web-%d, and 3 more", maxReportedBlockers-1))
+	assert.NotContains(t, summary, fmt.Sprintf("default/web-%d", maxReportedBlockers))
+}
+
+// TestDeconfigureDrain tests that a node is removed once it is drained or its drain times out, reporting the pods left
+// on it in the latter case, and that it is kept when draining fails otherwise
+func TestDeconfigureDrain(t *testing.T) {
+	// The API server only holds a pod running on the node being removed
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch req.URL.Path {
+		case "/api/v1/pods":
+			fmt.Fprint(w, `{"kind":"PodList","apiVersion":"v1","items":[{"metadata":{"name":"web-1",`+
+				`"namespace":"default"},"status":{"phase":"Running"}}]}`)
+		case "/apis/policy/v1/poddisruptionbudgets":
+			fmt.Fprint(w, `{"kind":"PodDisruptionBudgetList","apiVersion":"policy/v1","items":[]}`)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	require.NoError(t, err)
+
+	// waitForCancel drains until the context of the drain is done, as a drain blocked by a pod does
+	waitForCancel := func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.Wrap(ctx.Err(), "unable to drain node removed")
+	}
+	testCases := []struct {
+		name         string
+		drainTimeout time.Duration
+		drain        func(context.Context) error
+		// expectedEvents are the reasons of the events emitted, in order
+		expectedEvents []string
+		expectedErr    bool
+	}{
+		{
+			name:           "drained",
+			drainTimeout:   time.Minute,
+			expectedEvents: []string{"DrainStarted", "DrainCompleted"},
+		},
+		{
+			name:           "drain timed out",
+			drainTimeout:   10 * time.Millisecond,
+			drain:          waitForCancel,
+			expectedEvents: []string{"DrainStarted", "DrainTimeout", "DrainBlocked"},
+		},
+		{
+			name:         "drain failed",
+			drainTimeout: time.Minute,
+			drain: func(context.Context) error {
+				return errors.New("unable to cordon node removed")
+			},
+			expectedEvents: []string{"DrainStarted"},
+			expectedErr:    true,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			privateKeySigner := newTestSigner(t, 1)
+			instance := &fakeInstance{authorized: sets.NewString(authorizedKeyEntry(privateKeySigner.PublicKey())),
+				drain: test.drain}
+			recorder := record.NewFakeRecorder(10)
+			r := instanceReconciler{log: ctrl.Log.WithName("test"), k8sclientset: clientset, recorder: recorder,
+				signer: privateKeySigner, hostLocks: newHostLocks(), drainTimeout: test.drainTimeout,
+				connect: instance.connect}
+			node := &core.Node{
+				ObjectMeta: meta.ObjectMeta{Name: "removed",
+					Annotations: map[string]string{UsernameAnnotation: "core"}},
+				Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP,
+					Address: "10.0.0.1"}}},
+			}
+
+			err := r.deconfigureInstance(context.Background(), &core.ConfigMap{}, node, r.log)
+			if test.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			// The node is removed unless draining it failed before timing out
+			assert.Equal(t, !test.expectedErr, instance.deconfigured)
+			close(recorder.Events)
+			var reasons []string
+			for event := range recorder.Events {
+				var eventType, reason string
+				_, err := fmt.Sscan(event, &eventType, &reason)
+				require.NoError(t, err)
+				reasons = append(reasons, reason)
+			}
+			assert.Equal(t, test.expectedEvents, reasons)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package controllers
+
+import (
+	"fmt"
+	"sync"
+)
+
+// activeHosts is shared by the controllers, so that an instance is only acted upon by one of them at a time
+var activeHosts = newHostLocks()
+
+// hostLocks tracks the Windows instances an operation is in progress on, keyed by the addresses they are reached at, so
+// that concurrent SSH sessions configuring and deconfiguring the same instance do not conflict. Addresses are keyed by
+// addressKey, so that the same address written differently locks the same instance. It is safe for concurrent use, and
+// a nil hostLocks always grants the lock.
+type hostLocks struct {
+	// held holds the address keys of the instances which are locked
+	held map[string]struct{}
+	lock sync.Mutex
+}
+
+// newHostLocks returns a hostLocks with no instances locked
+func newHostLocks() *hostLocks {
+	return &hostLocks{held: make(map[string]struct{})}
+}
+
+// tryLock locks the instance reached at the given addresses, returning false without waiting if any of them is already
+// locked. An instance described by a DNS name is locked under the addresses it resolved to as well, so that it
+// conflicts with operations on its node, which reach the instance at the address of the node.
+func (l *hostLocks) tryLock(addresses ...string) bool {
+	if l == nil {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, address := range addresses {
+		if _, present := l.held[addressKey(address)]; present {
+			return false
+		}
+	}
+	for _, address := range addresses {
+		l.held[addressKey(address)] = struct{}{}
+	}
+	return true
+}
+
+// unlock unlocks the instance reached at the given addresses, which must be the addresses it was locked with
+func (l *hostLocks) unlock(addresses ...string) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, address := range addresses {
+		delete(l.held, addressKey(address))
+	}
+}
+
+// hostBusyError occurs when an instance cannot be acted upon as another operation is in progress on it
+type hostBusyError struct {
+	address string
+}
+
+func (e *hostBusyError) Error() string {
+	return fmt.Sprintf("another operation is in progress on instance with address %s", e.address)
+}
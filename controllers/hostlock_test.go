@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+)
+
+// TestHostLocksSerializeAccess tests that only one operation at a time is in progress on an instance, while operations
+// on different instances proceed concurrently
+func TestHostLocksSerializeAccess(t *testing.T) {
+	locks := newHostLocks()
+	addresses := []string{"10.0.0.1", "10.0.0.2"}
+	// active and peak count the operations in progress on each instance, and the most which were in progress at once
+	active := make([]int32, len(addresses))
+	peak := make([]int32, len(addresses))
+	completed := make([]int32, len(addresses))
+	var wg sync.WaitGroup
+	for worker := 0; worker < 20; worker++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			address := addresses[index]
+			// Workers retry until they acquire the lock, as a requeued reconcile would
+			for !locks.tryLock(address) {
+				time.Sleep(time.Millisecond)
+			}
+			current := atomic.AddInt32(&active[index], 1)
+			for {
+				highest := atomic.LoadInt32(&peak[index])
+				if current <= highest || atomic.CompareAndSwapInt32(&peak[index], highest, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&active[index], -1)
+			atomic.AddInt32(&completed[index], 1)
+			locks.unlock(address)
+		}(worker % len(addresses))
+	}
+	wg.Wait()
+	for index, address := range addresses {
+		assert.Equal(t, int32(1), peak[index], "concurrent operations on %s", address)
+		assert.Equal(t, int32(10), completed[index], "operations on %s", address)
+	}
+
+	// Locking one instance does not prevent others from being locked
+	require.True(t, locks.tryLock("10.0.0.1"))
+	assert.False(t, locks.tryLock("10.0.0.1"))
+	assert.True(t, locks.tryLock("10.0.0.2"))
+	locks.unlock("10.0.0.1")
+	assert.True(t, locks.tryLock("10.0.0.1"))
+
+	// A nil hostLocks does not serialize access
+	var none *hostLocks
+	assert.True(t, none.tryLock("10.0.0.1"))
+	assert.True(t, none.tryLock("10.0.0.1"))
+}
+
+// TestBusyHost tests that an instance another operation is in progress on is neither configured nor deconfigured,
+// without waiting for the operation to complete
+func TestBusyHost(t *testing.T) {
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{log: ctrl.Log.WithName("test"),
+		hostLocks: newHostLocks()}}
+	require.True(t, r.hostLocks.tryLock("10.0.0.1"))
+
+	instance := &instances.InstanceInfo{Address: "10.0.0.1", Username: "core"}
+	nodes := &core.NodeList{}
+	err := r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{}, instance, newNodeIndex(nodes),
+		r.newUpgradeBudget(1, nodes), r.log)
+	var busyErr *hostBusyError
+	require.True(t, errors.As(err, &busyErr))
+	assert.Equal(t, "10.0.0.1", busyErr.address)
+
+	node := &core.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "node", Annotations: map[string]string{UsernameAnnotation: "core"}},
+		Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+	err = r.deconfigureInstance(context.TODO(), &core.ConfigMap{}, node, r.log)
+	require.True(t, errors.As(err, &busyErr))
+
+	// The lock is still held by the other operation
+	assert.False(t, r.hostLocks.tryLock("10.0.0.1"))
+}
+
+// TestHostLockAddresses tests that an instance is locked under the canonical form of its address, and under the
+// addresses its DNS name resolved to, so that it is locked against operations on its node, which reach it at the
+// address of the node
+func TestHostLockAddresses(t *testing.T) {
+	locks := newHostLocks()
+	require.True(t, locks.tryLock("2001:db8::1"))
+	assert.False(t, locks.tryLock("2001:DB8:0:0::1"))
+	locks.unlock("2001:DB8::1")
+	assert.True(t, locks.tryLock("2001:db8::1"))
+
+	privateKeySigner := newTestSigner(t, 1)
+	instance := &fakeInstance{authorized: sets.NewString(authorizedKeyEntry(privateKeySigner.PublicKey())),
+		rejected: sets.NewString()}
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: &mutationRecordingClient{},
+		log: ctrl.Log.WithName("test"), recorder: record.NewFakeRecorder(10), signer: privateKeySigner,
+		connect: instance.connect, hostLocks: newHostLocks()}}
+	described := &instances.InstanceInfo{Address: "win.example.com", Username: "core",
+		ResolvedIPs: []net.IP{net.ParseIP("10.0.0.1")}}
+	node := &core.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "node", Annotations: map[string]string{UsernameAnnotation: "core"}},
+		Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+
+	// The node of an instance being configured cannot be removed by another operation
+	held := instanceAddressKeys(described)
+	require.True(t, r.hostLocks.tryLock(held...))
+	err := r.deconfigureInstance(context.TODO(), &core.ConfigMap{}, node, r.log)
+	var busyErr *hostBusyError
+	require.True(t, errors.As(err, &busyErr))
+	assert.False(t, instance.deconfigured)
+	// The operation holding the lock removes the node itself when reconfiguring the instance
+	require.NoError(t, r.deconfigureHeldInstance(context.TODO(), &core.ConfigMap{}, node, held, r.log))
+	assert.True(t, instance.deconfigured)
+	r.hostLocks.unlock(held...)
+
+	// An instance cannot be configured while its node is being removed
+	require.True(t, r.hostLocks.tryLock("10.0.0.1"))
+	nodes := &core.NodeList{}
+	err = r.ensureInstanceIsConfigured(context.Background(), &core.ConfigMap{}, described, newNodeIndex(nodes),
+		r.newUpgradeBudget(1, nodes), r.log)
+	require.True(t, errors.As(err, &busyErr))
+	assert.Equal(t, "win.example.com", busyErr.address)
+}
@@ -0,0 +1,186 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	core "k8s.io/api/core/v1"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
+	"github.com/openshift/windows-machine-config-operator/pkg/signer"
+)
+
+const (
+	// KeyRotationAnnotation is a node annotation that tracks the state of the rotation of the authorized SSH key on
+	// the instance associated with a BYOH node
+	KeyRotationAnnotation = "windowsmachineconfig.openshift.io/key-rotation"
+	// keyRotated indicates that the key held by the private key rotation secret has been authorized on the instance
+	keyRotated = "Rotated"
+	// keyRotationFailed indicates that the key held by the private key rotation secret could not be authorized on the
+	// instance
+	keyRotationFailed = "Failed"
+	// KeyRotationKeysAnnotation is a node annotation that holds the public keys authorized on the instance associated
+	// with a BYOH node during a key rotation, in the authorized keys format and separated by keyListSeparator. These
+	// keys, apart from the current one, are removed from the instance once the rotation is complete.
+	KeyRotationKeysAnnotation = "windowsmachineconfig.openshift.io/key-rotation-keys"
+	// keyListSeparator separates the keys held by KeyRotationKeysAnnotation, and cannot appear within a key entry
+	keyListSeparator = ","
+)
+
+// reconcileKeyRotation drives the rotation of the authorized SSH key on the instances associated with the given BYOH
+// nodes. While the private key rotation secret exists, its public key is authorized on each instance alongside the
+// current key. Once the rotation secret is removed, which the user should do after replacing the private key secret
+// with the rotated key, the keys involved in the rotation other than the current key are removed from the instances.
+func (r *ConfigMapReconciler) reconcileKeyRotation(ctx context.Context, configMap *core.ConfigMap,
+	nodes *core.NodeList) error {
+	// Keys can only be rotated while the current private key is usable
+	if r.signer == nil {
+		return nil
+	}
+	rotationSigner, err := signer.Create(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+		Name: secrets.PrivateKeyRotationSecret}, r.client)
+	if err != nil && !k8sapierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "unable to create signer from %s secret", secrets.PrivateKeyRotationSecret)
+	}
+
+	var errs []error
+	for _, node := range nodes.Items {
+		if !isBYOHNode(&node) || r.isIgnored(&node) {
+			continue
+		}
+		// Only fully configured nodes are rotated, the rest will be configured with the current key
+		if _, present := node.Annotations[nodeconfig.VersionAnnotation]; !present {
+			continue
+		}
+		// Nodes authenticated against with their own credential secret do not use the private key secret
+		if node.Annotations[CredentialSecretAnnotation] != "" {
+			continue
+		}
+		if rotationSigner == nil {
+			if _, present := node.Annotations[KeyRotationAnnotation]; present {
+				if err := r.completeKeyRotation(ctx, &node); err != nil {
+					errs = append(errs, errors.Wrapf(err, "unable to complete key rotation of node %s",
+						node.GetName()))
+				}
+			}
+			continue
+		}
+		if node.Annotations[nodeconfig.PubKeyHashAnnotation] ==
+			nodeconfig.CreatePubKeyHashAnnotation(rotationSigner.PublicKey()) {
+			continue
+		}
+		if err := r.rotateKey(ctx, &node, rotationSigner); err != nil {
+			r.recorder.Eventf(configMap, core.EventTypeWarning, "KeyRotationFailure",
+				"unable to rotate the authorized key of node %s: %v", node.GetName(), err)
+			errs = append(errs, errors.Wrapf(err, "unable to rotate key of node %s", node.GetName()))
+			continue
+		}
+		r.recorder.Eventf(configMap, core.EventTypeNormal, "KeyRotated",
+			"rotated the authorized key of node %s", node.GetName())
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// rotateKey authorizes the public key of the given signer on the instance associated with the given node, connecting
+// to it with the current private key. The rotation is verified by connecting to the instance with the given signer,
+// and rolled back if that is not possible, so that the instance remains reachable with the current private key.
+func (r *ConfigMapReconciler) rotateKey(ctx context.Context, node *core.Node, rotationSigner ssh.Signer) error {
+	instance, err := r.instanceFromNode(node)
+	if err != nil {
+		return errors.Wrap(err, "unable to create instance object from node")
+	}
+	nc, err := r.connectInstance(instance, r.signer)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect with the current private key")
+	}
+	// Both keys are recorded before any change is made, so that the key which ends up not being used is removed from
+	// the instance once the rotation is complete or aborted
+	keys := append(rotationKeys(node), authorizedKeyEntry(r.signer.PublicKey()),
+		authorizedKeyEntry(rotationSigner.PublicKey()))
+	if err := nc.AuthorizeKey(rotationSigner.PublicKey()); err != nil {
+		return err
+	}
+
+	// Verify that the instance can be reached using the rotated key
+	if _, err := r.connectInstance(instance, rotationSigner); err != nil {
+		rotationErr := errors.Wrap(err, "unable to connect with the rotated private key")
+		if err := nc.UnauthorizeKey(rotationSigner.PublicKey()); err != nil {
+			r.log.Error(err, "unable to roll back key rotation", "node", node.GetName())
+		}
+		if err := r.setKeyRotationAnnotations(ctx, node, keyRotationFailed,
+			node.Annotations[nodeconfig.PubKeyHashAnnotation], keys); err != nil {
+			r.log.Error(err, "unable to mark key rotation as failed", "node", node.GetName())
+		}
+		return rotationErr
+	}
+
+	return r.setKeyRotationAnnotations(ctx, node, keyRotated,
+		nodeconfig.CreatePubKeyHashAnnotation(rotationSigner.PublicKey()), keys)
+}
+
+// completeKeyRotation removes the keys authorized during the key rotation, other than the current private key, from
+// the instance associated with the given node, and clears the key rotation state from the node. Keys which were
+// authorized on the instance by other means are left as they are.
+func (r *ConfigMapReconciler) completeKeyRotation(ctx context.Context, node *core.Node) error {
+	instance, err := r.instanceFromNode(node)
+	if err != nil {
+		return errors.Wrap(err, "unable to create instance object from node")
+	}
+	nc, err := r.connectInstance(instance, r.signer)
+	if err != nil {
+		return errors.Wrap(err, "unable to connect with the current private key")
+	}
+	current := authorizedKeyEntry(r.signer.PublicKey())
+	for _, entry := range rotationKeys(node) {
+		if entry == current {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry))
+		if err != nil {
+			return errors.Wrapf(err, "unable to parse key held by the %s annotation", KeyRotationKeysAnnotation)
+		}
+		if err := nc.UnauthorizeKey(key); err != nil {
+			return err
+		}
+	}
+	return r.setKeyRotationAnnotations(ctx, node, "", nodeconfig.CreatePubKeyHashAnnotation(r.signer.PublicKey()),
+		nil)
+}
+
+// setKeyRotationAnnotations patches the given node with the given key rotation state, public key hash and the keys
+// authorized during the rotation. An empty state removes the key rotation annotations.
+func (r *ConfigMapReconciler) setKeyRotationAnnotations(ctx context.Context, node *core.Node, state,
+	pubKeyHash string, keys []string) error {
+	patchBase := client.MergeFrom(node.DeepCopy())
+	if state == "" {
+		delete(node.Annotations, KeyRotationAnnotation)
+		delete(node.Annotations, KeyRotationKeysAnnotation)
+	} else {
+		node.Annotations[KeyRotationAnnotation] = state
+		node.Annotations[KeyRotationKeysAnnotation] = strings.Join(sets.NewString(keys...).List(), keyListSeparator)
+	}
+	node.Annotations[nodeconfig.PubKeyHashAnnotation] = pubKeyHash
+	return errors.Wrapf(r.client.Patch(ctx, node, patchBase), "unable to patch node %s", node.GetName())
+}
+
+// rotationKeys returns the authorized keys entries recorded on the given node during a key rotation
+func rotationKeys(node *core.Node) []string {
+	value := node.Annotations[KeyRotationKeysAnnotation]
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, keyListSeparator)
+}
+
+// authorizedKeyEntry returns the given public key in the format used by the authorized keys file
+func authorizedKeyEntry(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
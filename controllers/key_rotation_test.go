@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+)
+
+// fakeInstance is an instance whose authorized keys are tracked in memory. It can be connected to with the signer of
+// any of its authorized keys which it does not reject.
+type fakeInstance struct {
+	authorized   sets.String
+	rejected     sets.String
+	authorizeErr error
+	// drain is called when the instance is drained, Drain returns its result
+	drain        func(context.Context) error
+	deconfigured bool
+}
+
+func (f *fakeInstance) connect(_ *instances.InstanceInfo, signer ssh.Signer) (instanceConnection, error) {
+	entry := authorizedKeyEntry(signer.PublicKey())
+	if !f.authorized.Has(entry) || f.rejected.Has(entry) {
+		return nil, errors.New("ssh: unable to authenticate")
+	}
+	return f, nil
+}
+
+func (f *fakeInstance) Drain(ctx context.Context) error {
+	if f.drain == nil {
+		return nil
+	}
+	return f.drain(ctx)
+}
+
+func (f *fakeInstance) Deconfigure() error {
+	f.deconfigured = true
+	return nil
+}
+
+func (f *fakeInstance) AuthorizeKey(key ssh.PublicKey) error {
+	if f.authorizeErr != nil {
+		return f.authorizeErr
+	}
+	f.authorized.Insert(authorizedKeyEntry(key))
+	return nil
+}
+
+func (f *fakeInstance) UnauthorizeKey(key ssh.PublicKey) error {
+	f.authorized.Delete(authorizedKeyEntry(key))
+	return nil
+}
+
+// newTestSigner returns a signer of an ed25519 key derived from the given seed byte
+func newTestSigner(t *testing.T, seed byte) ssh.Signer {
+	s, err := ssh.NewSignerFromKey(ed25519.NewKeyFromSeed(append(make([]byte, ed25519.SeedSize-1), seed)))
+	require.NoError(t, err)
+	return s
+}
+
+// newRotationNode returns a configured BYOH node with the given annotations in addition to the ones it is configured
+// with
+func newRotationNode(annotations map[string]string) *core.Node {
+	node := &core.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "rotated", Labels: map[string]string{core.LabelOSStable: "windows"},
+			Annotations: map[string]string{BYOHAnnotation: "true", UsernameAnnotation: "core"}},
+		Status: core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: "10.0.0.1"}}},
+	}
+	for key, value := range annotations {
+		node.Annotations[key] = value
+	}
+	return node
+}
+
+// TestRotateKey tests that a rotated key is authorized alongside the current key once it is verified to be usable,
+// and that the rotation is rolled back otherwise
+func TestRotateKey(t *testing.T) {
+	current := newTestSigner(t, 1)
+	rotated := newTestSigner(t, 2)
+	currentEntry := authorizedKeyEntry(current.PublicKey())
+	rotatedEntry := authorizedKeyEntry(rotated.PublicKey())
+	currentHash := nodeconfig.CreatePubKeyHashAnnotation(current.PublicKey())
+	// Both keys are recorded, so that the one left unused is removed once the rotation is complete
+	rotationKeys := strings.Join(sets.NewString(currentEntry, rotatedEntry).List(), keyListSeparator)
+
+	testCases := []struct {
+		name         string
+		rejected     []string
+		authorizeErr error
+		// expectedAuthorized are the keys authorized on the instance after the rotation
+		expectedAuthorized []string
+		// expectedAnnotations are the key rotation annotations of the node after the rotation, nil if it is unchanged
+		expectedAnnotations map[string]string
+		expectedErr         bool
+	}{
+		{
+			name:               "verified",
+			expectedAuthorized: []string{currentEntry, rotatedEntry},
+			expectedAnnotations: map[string]string{KeyRotationAnnotation: keyRotated,
+				nodeconfig.PubKeyHashAnnotation: nodeconfig.CreatePubKeyHashAnnotation(rotated.PublicKey()),
+				KeyRotationKeysAnnotation:       rotationKeys},
+		},
+		{
+			name:               "verification fails",
+			rejected:           []string{rotatedEntry},
+			expectedAuthorized: []string{currentEntry},
+			expectedAnnotations: map[string]string{KeyRotationAnnotation: keyRotationFailed,
+				nodeconfig.PubKeyHashAnnotation: currentHash,
+				KeyRotationKeysAnnotation:       rotationKeys},
+			expectedErr: true,
+		},
+		{
+			name:               "authorization fails",
+			authorizeErr:       errors.New("unable to add authorized key"),
+			expectedAuthorized: []string{currentEntry},
+			expectedErr:        true,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			instance := &fakeInstance{authorized: sets.NewString(currentEntry),
+				rejected: sets.NewString(test.rejected...), authorizeErr: test.authorizeErr}
+			c := &mutationRecordingClient{}
+			r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+				recorder: record.NewFakeRecorder(10), signer: current, connect: instance.connect}}
+			node := newRotationNode(map[string]string{nodeconfig.PubKeyHashAnnotation: currentHash})
+
+			err := r.rotateKey(context.Background(), node, rotated)
+			if test.expectedErr {
+				assert.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.ElementsMatch(t, test.expectedAuthorized, instance.authorized.List())
+			if test.expectedAnnotations == nil {
+				assert.Empty(t, c.mutated)
+				assert.NotContains(t, node.Annotations, KeyRotationAnnotation)
+				assert.Equal(t, currentHash, node.Annotations[nodeconfig.PubKeyHashAnnotation])
+				return
+			}
+			assert.Equal(t, []string{"patch rotated"}, c.mutated)
+			for key, value := range test.expectedAnnotations {
+				assert.Equal(t, value, node.Annotations[key], key)
+			}
+		})
+	}
+}
+
+// TestCompleteKeyRotation tests that once a rotation is complete or aborted, only the keys involved in the rotation
+// other than the current key are removed from the instance, and the rotation state is cleared from the node
+func TestCompleteKeyRotation(t *testing.T) {
+	previous := newTestSigner(t, 1)
+	rotated := newTestSigner(t, 2)
+	previousEntry := authorizedKeyEntry(previous.PublicKey())
+	rotatedEntry := authorizedKeyEntry(rotated.PublicKey())
+	// A key authorized on the instance by an administrator, outside of the operator
+	adminEntry := authorizedKeyEntry(newTestSigner(t, 3).PublicKey())
+	rotationKeys := previousEntry + keyListSeparator + rotatedEntry
+
+	testCases := []struct {
+		name  string
+		state string
+		// signer holds the current private key
+		signer             ssh.Signer
+		authorized         []string
+		expectedAuthorized []string
+	}{
+		{
+			name:               "private key replaced",
+			state:              keyRotated,
+			signer:             rotated,
+			authorized:         []string{previousEntry, rotatedEntry, adminEntry},
+			expectedAuthorized: []string{rotatedEntry, adminEntry},
+		},
+		{
+			name:               "rotation aborted",
+			state:              keyRotated,
+			signer:             previous,
+			authorized:         []string{previousEntry, rotatedEntry, adminEntry},
+			expectedAuthorized: []string{previousEntry, adminEntry},
+		},
+		{
+			name:               "rotation failed",
+			state:              keyRotationFailed,
+			signer:             previous,
+			authorized:         []string{previousEntry, adminEntry},
+			expectedAuthorized: []string{previousEntry, adminEntry},
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			instance := &fakeInstance{authorized: sets.NewString(test.authorized...), rejected: sets.NewString()}
+			c := &mutationRecordingClient{}
+			r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c, log: ctrl.Log.WithName("test"),
+				recorder: record.NewFakeRecorder(10), signer: test.signer, connect: instance.connect}}
+			node := newRotationNode(map[string]string{KeyRotationAnnotation: test.state,
+				KeyRotationKeysAnnotation:       rotationKeys,
+				nodeconfig.PubKeyHashAnnotation: nodeconfig.CreatePubKeyHashAnnotation(rotated.PublicKey())})
+
+			require.NoError(t, r.completeKeyRotation(context.Background(), node))
+			assert.ElementsMatch(t, test.expectedAuthorized, instance.authorized.List())
+			assert.Equal(t, []string{"patch rotated"}, c.mutated)
+			assert.NotContains(t, node.Annotations, KeyRotationAnnotation)
+			assert.NotContains(t, node.Annotations, KeyRotationKeysAnnotation)
+			assert.Equal(t, nodeconfig.CreatePubKeyHashAnnotation(test.signer.PublicKey()),
+				node.Annotations[nodeconfig.PubKeyHashAnnotation])
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+)
+
+const (
+	// TopologyLabelsAnnotation is a node annotation holding the comma separated list of topology labels which were
+	// applied to a BYOH node from its ConfigMap entry. It allows labels removed from the entry to be removed from the
+	// node, without removing topology labels applied by other means.
+	TopologyLabelsAnnotation = "windowsmachineconfig.openshift.io/topology-labels"
+	// LabelsAnnotation is a node annotation holding the comma separated list of custom labels which were applied to a
+	// BYOH node from its ConfigMap entry, serving the same purpose as TopologyLabelsAnnotation
+	LabelsAnnotation = "windowsmachineconfig.openshift.io/labels"
+	// ConfigMapLabel is a node label holding the name of the ConfigMap describing the instance of a BYOH node, in the
+	// namespace of the operator. Nodes are cluster scoped and cannot be owned by a ConfigMap, so the label serves as a
+	// back-reference, allowing the nodes of a ConfigMap to be listed and orphaned nodes to be detected. It is not set
+	// if the name of the ConfigMap is not a valid label value.
+	ConfigMapLabel = "windowsmachineconfig.openshift.io/instance-configmap"
+	// OperatorLabel is a label holding the name of the instance ConfigMap of the operator managing a BYOH node or a
+	// labeled instance ConfigMap, so that operators watching the same namespace with distinct instance ConfigMaps only
+	// act on their own nodes and ConfigMaps. Objects without the label are managed by the operator using the
+	// windows-instances ConfigMap, which is the name used by operator versions which did not set the label.
+	OperatorLabel = "windowsmachineconfig.openshift.io/operator"
+)
+
+// syncLabelsAndTaints patches the given node so that the topology and custom labels, and the taints, applied to it from
+// its ConfigMap entry match the labels and taints of the given instance, and so that it references the ConfigMap with
+// the given name
+func (r *ConfigMapReconciler) syncLabelsAndTaints(ctx context.Context, node *core.Node,
+	instance *instances.InstanceInfo, configMap string) error {
+	patchBase := client.MergeFrom(node.DeepCopy())
+	topologyChanged := setAppliedLabels(node, TopologyLabelsAnnotation, instance.TopologyLabels)
+	labelsChanged := setAppliedLabels(node, LabelsAnnotation, instance.Labels)
+	referenceChanged := setConfigMapLabel(node, configMap)
+	operatorChanged := setOperatorLabel(node, r.instanceConfigMap)
+	if !setAppliedTaints(node, instance.Taints) && !labelsChanged && !topologyChanged && !referenceChanged &&
+		!operatorChanged {
+		return nil
+	}
+	if err := r.client.Patch(ctx, node, patchBase); err != nil {
+		return errors.Wrapf(err, "unable to set labels and taints of node %s", node.GetName())
+	}
+	return nil
+}
+
+// setAppliedLabels sets the given labels on the given node, removing the labels previously applied which are no longer
+// present. The keys of the applied labels are tracked in the given annotation. Returns true if the node was changed.
+func setAppliedLabels(node *core.Node, annotation string, labels map[string]string) bool {
+	changed := false
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	if applied := node.Annotations[annotation]; applied != "" {
+		for _, key := range strings.Split(applied, ",") {
+			if _, present := labels[key]; present {
+				continue
+			}
+			if _, present := node.Labels[key]; present {
+				delete(node.Labels, key)
+				changed = true
+			}
+		}
+	}
+
+	for key, value := range labels {
+		if existing, present := node.Labels[key]; !present || existing != value {
+			node.Labels[key] = value
+			changed = true
+		}
+	}
+	applied := labelKeys(labels)
+	if node.Annotations[annotation] != applied {
+		if applied == "" {
+			delete(node.Annotations, annotation)
+		} else {
+			if node.Annotations == nil {
+				node.Annotations = make(map[string]string)
+			}
+			node.Annotations[annotation] = applied
+		}
+		changed = true
+	}
+	return changed
+}
+
+// setConfigMapLabel sets the ConfigMapLabel of the given node to the given ConfigMap name, or removes it if the name
+// cannot be held by the label, so that the node does not reference a ConfigMap which no longer describes its instance.
+// Returns true if the node was changed.
+func setConfigMapLabel(node *core.Node, configMap string) bool {
+	if !isConfigMapLabelValue(configMap) {
+		if _, present := node.Labels[ConfigMapLabel]; !present {
+			return false
+		}
+		delete(node.Labels, ConfigMapLabel)
+		return true
+	}
+	if existing, present := node.Labels[ConfigMapLabel]; present && existing == configMap {
+		return false
+	}
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	node.Labels[ConfigMapLabel] = configMap
+	return true
+}
+
+// setOperatorLabel sets the OperatorLabel of the given node to the given name of the instance ConfigMap of the operator
+// managing it, so that nodes configured before the label was introduced are labeled. Returns true if the node was
+// changed.
+func setOperatorLabel(node *core.Node, operator string) bool {
+	if !isConfigMapLabelValue(operator) || node.Labels[OperatorLabel] == operator {
+		return false
+	}
+	if node.Labels == nil {
+		node.Labels = make(map[string]string)
+	}
+	node.Labels[OperatorLabel] = operator
+	return true
+}
+
+// isConfigMapLabelValue returns true if the given ConfigMap name can be held by the ConfigMapLabel
+func isConfigMapLabelValue(configMap string) bool {
+	return configMap != "" && len(validation.IsValidLabelValue(configMap)) == 0
+}
+
+// nodeLabels returns the labels to apply to the node of the given instance when it is configured, which are the custom
+// labels of the instance, the ConfigMapLabel referencing the ConfigMap with the given name, and the OperatorLabel
+// holding the given name of the instance ConfigMap of the operator
+func nodeLabels(instance *instances.InstanceInfo, configMap, operator string) map[string]string {
+	labels := make(map[string]string, len(instance.Labels)+2)
+	for key, value := range instance.Labels {
+		labels[key] = value
+	}
+	if isConfigMapLabelValue(configMap) {
+		labels[ConfigMapLabel] = configMap
+	}
+	if isConfigMapLabelValue(operator) {
+		labels[OperatorLabel] = operator
+	}
+	return labels
+}
+
+// trackedLabelKeys returns the value of the given tracking annotation covering both the given labels and the labels
+// which were previously applied to the given node, if any. This allows labels applied when a node is configured to be
+// tracked, without losing track of the previously applied labels which are yet to be removed.
+func trackedLabelKeys(node *core.Node, annotation string, labels map[string]string) string {
+	keys := make(map[string]string, len(labels))
+	for key := range labels {
+		keys[key] = ""
+	}
+	if node != nil && node.Annotations[annotation] != "" {
+		for _, key := range strings.Split(node.Annotations[annotation], ",") {
+			keys[key] = ""
+		}
+	}
+	return labelKeys(keys)
+}
+
+// labelKeys returns the sorted, comma separated keys of the given labels
+func labelKeys(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
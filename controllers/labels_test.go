@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+)
+
+// TestSetAppliedLabels tests that the topology labels of a node are kept in sync with its ConfigMap entry, without
+// removing labels which were not applied from the entry
+func TestSetAppliedLabels(t *testing.T) {
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Labels: map[string]string{core.LabelOSStable: "windows"}}}
+
+	topologyLabels := map[string]string{core.LabelTopologyZone: "us-east-1a", core.LabelTopologyRegion: "us-east-1"}
+
+	// Labels are applied and tracked
+	assert.True(t, setAppliedLabels(node, TopologyLabelsAnnotation, topologyLabels))
+	assert.Equal(t, map[string]string{core.LabelOSStable: "windows", core.LabelTopologyZone: "us-east-1a",
+		core.LabelTopologyRegion: "us-east-1"}, node.Labels)
+	assert.Equal(t, core.LabelTopologyRegion+","+core.LabelTopologyZone, node.Annotations[TopologyLabelsAnnotation])
+
+	// Nothing changes when the labels are already in sync
+	assert.False(t, setAppliedLabels(node, TopologyLabelsAnnotation, topologyLabels))
+
+	// Labels removed from the entry are removed from the node
+	assert.True(t, setAppliedLabels(node, TopologyLabelsAnnotation,
+		map[string]string{core.LabelTopologyZone: "us-east-1b"}))
+	assert.Equal(t, map[string]string{core.LabelOSStable: "windows", core.LabelTopologyZone: "us-east-1b"},
+		node.Labels)
+	assert.Equal(t, core.LabelTopologyZone, node.Annotations[TopologyLabelsAnnotation])
+
+	assert.True(t, setAppliedLabels(node, TopologyLabelsAnnotation, nil))
+	assert.Equal(t, map[string]string{core.LabelOSStable: "windows"}, node.Labels)
+	assert.NotContains(t, node.Annotations, TopologyLabelsAnnotation)
+
+	// Topology labels which were not applied from the entry are left alone
+	node.Labels[core.LabelTopologyZone] = "us-west-1a"
+	assert.False(t, setAppliedLabels(node, TopologyLabelsAnnotation, nil))
+	assert.Equal(t, "us-west-1a", node.Labels[core.LabelTopologyZone])
+
+	// Custom labels are tracked independently of the topology labels
+	assert.True(t, setAppliedLabels(node, LabelsAnnotation, map[string]string{"gpu": "true"}))
+	assert.True(t, setAppliedLabels(node, TopologyLabelsAnnotation,
+		map[string]string{core.LabelTopologyZone: "us-east-1a"}))
+	assert.True(t, setAppliedLabels(node, LabelsAnnotation, nil))
+	assert.Equal(t, map[string]string{core.LabelOSStable: "windows", core.LabelTopologyZone: "us-east-1a"},
+		node.Labels)
+	assert.Equal(t, core.LabelTopologyZone, node.Annotations[TopologyLabelsAnnotation])
+}
+
+func TestTrackedLabelKeys(t *testing.T) {
+	labels := map[string]string{"gpu": "true", "tier": "gold"}
+	assert.Equal(t, "", trackedLabelKeys(nil, LabelsAnnotation, nil))
+	assert.Equal(t, "gpu,tier", trackedLabelKeys(nil, LabelsAnnotation, labels))
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{LabelsAnnotation: "gpu,rack"}}}
+	assert.Equal(t, "gpu,rack,tier", trackedLabelKeys(node, LabelsAnnotation, labels))
+}
+
+// TestConfigMapLabel tests that BYOH nodes reference the ConfigMap describing their instance through a label, which is
+// kept separate from the custom labels of the instance
+func TestConfigMapLabel(t *testing.T) {
+	instance := &instances.InstanceInfo{Labels: map[string]string{"gpu": "true"}}
+	assert.Equal(t, map[string]string{"gpu": "true", ConfigMapLabel: "windows-instances"},
+		nodeLabels(instance, "windows-instances", ""))
+	assert.Equal(t, map[string]string{"gpu": "true"}, instance.Labels)
+	// A name which is not a valid label value is not referenced
+	longName := strings.Repeat("a", 64)
+	assert.Equal(t, map[string]string{"gpu": "true"}, nodeLabels(instance, longName, ""))
+
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Name: "byoh"}}
+	assert.True(t, setConfigMapLabel(node, "windows-instances"))
+	assert.Equal(t, "windows-instances", node.Labels[ConfigMapLabel])
+	assert.False(t, setConfigMapLabel(node, "windows-instances"))
+	// The label follows the instance when it is moved to another ConfigMap
+	assert.True(t, setConfigMapLabel(node, "extra-instances"))
+	assert.Equal(t, "extra-instances", node.Labels[ConfigMapLabel])
+	assert.True(t, setConfigMapLabel(node, longName))
+	assert.NotContains(t, node.Labels, ConfigMapLabel)
+	assert.False(t, setConfigMapLabel(node, ""))
+
+	// Syncing the labels of a node applies the reference, which is not removed along with the custom labels
+	c := &mutationRecordingClient{}
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c}}
+	require.NoError(t, r.syncLabelsAndTaints(context.Background(), node, instance, "windows-instances"))
+	assert.Equal(t, []string{"patch byoh"}, c.mutated)
+	require.NoError(t, r.syncLabelsAndTaints(context.Background(), node, &instances.InstanceInfo{},
+		"windows-instances"))
+	assert.Equal(t, []string{"patch byoh", "patch byoh"}, c.mutated)
+	assert.Equal(t, map[string]string{ConfigMapLabel: "windows-instances"}, node.Labels)
+	require.NoError(t, r.syncLabelsAndTaints(context.Background(), node, &instances.InstanceInfo{},
+		"windows-instances"))
+	assert.Len(t, c.mutated, 2)
+}
+
+// TestOperatorLabel tests that BYOH nodes record the instance ConfigMap of the operator managing them through a label,
+// which is applied to nodes configured before it was introduced
+func TestOperatorLabel(t *testing.T) {
+	instance := &instances.InstanceInfo{Labels: map[string]string{"gpu": "true"}}
+	assert.Equal(t, map[string]string{"gpu": "true", ConfigMapLabel: "team-a", OperatorLabel: "tenant-a-instances"},
+		nodeLabels(instance, "team-a", "tenant-a-instances"))
+
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Name: "byoh"}}
+	assert.True(t, setOperatorLabel(node, InstanceConfigMap))
+	assert.Equal(t, InstanceConfigMap, node.Labels[OperatorLabel])
+	assert.False(t, setOperatorLabel(node, InstanceConfigMap))
+	assert.False(t, setOperatorLabel(node, ""))
+	assert.Equal(t, InstanceConfigMap, node.Labels[OperatorLabel])
+
+	c := &mutationRecordingClient{}
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: c}, instanceConfigMap: InstanceConfigMap}
+	unlabeled := &core.Node{ObjectMeta: meta.ObjectMeta{Name: "byoh", Labels: map[string]string{ConfigMapLabel: "a"}}}
+	require.NoError(t, r.syncLabelsAndTaints(context.Background(), unlabeled, &instances.InstanceInfo{}, "a"))
+	assert.Equal(t, []string{"patch byoh"}, c.mutated)
+	assert.Equal(t, InstanceConfigMap, unlabeled.Labels[OperatorLabel])
+}
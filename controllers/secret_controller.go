@@ -50,7 +50,7 @@ func NewSecretReconciler(mgr manager.Manager, watchNamespace string) *SecretReco
 // SetupWithManager sets up a new Secret controller
 func (r *SecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	// Check that the private key exists, if it doesn't, log a warning
-	_, err := secrets.GetPrivateKey(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
+	_, _, err := secrets.GetPrivateKey(kubeTypes.NamespacedName{Namespace: r.watchNamespace,
 		Name: secrets.PrivateKeySecret}, mgr.GetClient())
 	if err != nil {
 		r.log.Error(err, "Unable to retrieve private key, please ensure it is created")
@@ -64,10 +64,11 @@ func (r *SecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			return isPrivateKeySecret(e.Object, r.watchNamespace)
 		},
 		UpdateFunc: func(e event.UpdateEvent) bool {
-			// get update event only when secret data is changed
+			// get update event only when the private key or its passphrase is changed
 			if isPrivateKeySecret(e.ObjectNew, r.watchNamespace) {
-				if string(e.ObjectOld.(*core.Secret).Data[secrets.PrivateKeySecretKey]) !=
-					string(e.ObjectNew.(*core.Secret).Data[secrets.PrivateKeySecretKey]) {
+				oldData, newData := e.ObjectOld.(*core.Secret).Data, e.ObjectNew.(*core.Secret).Data
+				if string(oldData[secrets.PrivateKeySecretKey]) != string(newData[secrets.PrivateKeySecretKey]) ||
+					string(oldData[secrets.PrivateKeyPassphraseKey]) != string(newData[secrets.PrivateKeyPassphraseKey]) {
 					return true
 				}
 			}
@@ -166,7 +167,7 @@ func (r *SecretReconciler) Reconcile(ctx context.Context, request ctrl.Request)
 		// userdata secret data does not match what is expected
 		// Mark nodes configured with the previous private key for deletion
 		nodes := &core.NodeList{}
-		err = r.client.List(ctx, nodes, client.MatchingLabels{core.LabelOSStable: "windows"})
+		err = r.client.List(ctx, nodes, windowsNodeLabels)
 		if err != nil {
 			return reconcile.Result{}, errors.Wrapf(err, "error getting node list")
 		}
@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// InstanceStatusAnnotation is an annotation of the windows-instances ConfigMap holding the state of each instance
+// specified by it, as a JSON object keyed by instance address
+const InstanceStatusAnnotation = "windowsmachineconfig.openshift.io/instance-status"
+
+// instanceState is the state of an instance reported through the InstanceStatusAnnotation
+type instanceState string
+
+const (
+	// statePending indicates that the instance is waiting to be configured
+	statePending instanceState = "Pending"
+	// stateConfiguring indicates that the instance is being configured
+	stateConfiguring instanceState = "Configuring"
+	// stateReady indicates that the instance has been configured
+	stateReady instanceState = "Ready"
+	// stateFailed indicates that the last attempt to configure the instance failed
+	stateFailed instanceState = "Failed"
+)
+
+// instanceStatus tracks the state of the instances of the windows-instances ConfigMap, and reports it through the
+// InstanceStatusAnnotation of the ConfigMap. It is safe for concurrent use, and a nil instanceStatus reports nothing.
+type instanceStatus struct {
+	client client.Client
+	// configMap is a copy of the ConfigMap the status is reported on
+	configMap *core.ConfigMap
+	// states holds the state of each instance, keyed by address
+	states map[string]instanceState
+	lock   sync.Mutex
+}
+
+// newInstanceStatus returns an instanceStatus reporting on the given ConfigMap, for the instances with the given
+// addresses. The states of the instances reported by the ConfigMap are kept, and other instances are Pending.
+func newInstanceStatus(c client.Client, configMap *core.ConfigMap, addresses []string) *instanceStatus {
+	s := &instanceStatus{client: c, configMap: configMap.DeepCopy(), states: make(map[string]instanceState)}
+	reported := make(map[string]instanceState)
+	// An invalid annotation is overwritten
+	_ = json.Unmarshal([]byte(configMap.Annotations[InstanceStatusAnnotation]), &reported)
+	for _, address := range addresses {
+		state, present := reported[address]
+		if !present {
+			state = statePending
+		}
+		s.states[address] = state
+	}
+	return s
+}
+
+// set sets the state of the instance with the given address, reporting it if it has changed
+func (s *instanceStatus) set(ctx context.Context, address string, state instanceState) error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if current, present := s.states[address]; present && current == state {
+		return nil
+	}
+	s.states[address] = state
+	return s.report(ctx)
+}
+
+// report writes the states of the instances to the ConfigMap, if they differ from the reported ones. It must be called
+// with the lock held, unless the instanceStatus is not shared.
+func (s *instanceStatus) report(ctx context.Context) error {
+	value, err := json.Marshal(s.states)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal instance states")
+	}
+	if s.configMap.Annotations[InstanceStatusAnnotation] == string(value) {
+		return nil
+	}
+	patchBase := client.MergeFrom(s.configMap.DeepCopy())
+	if s.configMap.Annotations == nil {
+		s.configMap.Annotations = make(map[string]string)
+	}
+	s.configMap.Annotations[InstanceStatusAnnotation] = string(value)
+	return errors.Wrapf(s.client.Patch(ctx, s.configMap, patchBase), "unable to report instance states on ConfigMap %s",
+		s.configMap.GetName())
+}
+
+// onlyStatusChanged returns true if the given ConfigMaps only differ by their InstanceStatusAnnotation, so that the
+// updates made to report the status do not result in the ConfigMap being reconciled again
+func onlyStatusChanged(oldObject, newObject client.Object) bool {
+	oldConfigMap, ok := oldObject.(*core.ConfigMap)
+	if !ok {
+		return false
+	}
+	newConfigMap, ok := newObject.(*core.ConfigMap)
+	if !ok {
+		return false
+	}
+	if oldConfigMap.Annotations[InstanceStatusAnnotation] == newConfigMap.Annotations[InstanceStatusAnnotation] {
+		return false
+	}
+	withoutStatus := func(annotations map[string]string) map[string]string {
+		result := make(map[string]string, len(annotations))
+		for key, value := range annotations {
+			if key != InstanceStatusAnnotation {
+				result[key] = value
+			}
+		}
+		return result
+	}
+	return reflect.DeepEqual(oldConfigMap.Data, newConfigMap.Data) &&
+		reflect.DeepEqual(oldConfigMap.BinaryData, newConfigMap.BinaryData) &&
+		reflect.DeepEqual(oldConfigMap.Labels, newConfigMap.Labels) &&
+		reflect.DeepEqual(oldConfigMap.Finalizers, newConfigMap.Finalizers) &&
+		reflect.DeepEqual(oldConfigMap.DeletionTimestamp, newConfigMap.DeletionTimestamp) &&
+		reflect.DeepEqual(withoutStatus(oldConfigMap.Annotations), withoutStatus(newConfigMap.Annotations))
+}
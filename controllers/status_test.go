@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// patchRecordingClient is a client which records the ConfigMaps it is asked to patch. All other requests are
+// unimplemented.
+type patchRecordingClient struct {
+	client.Client
+	patched []*core.ConfigMap
+}
+
+func (c *patchRecordingClient) Patch(_ context.Context, obj client.Object, _ client.Patch,
+	_ ...client.PatchOption) error {
+	c.patched = append(c.patched, obj.(*core.ConfigMap).DeepCopy())
+	return nil
+}
+
+// reportedStates returns the instance states reported on the given ConfigMap
+func reportedStates(t *testing.T, configMap *core.ConfigMap) map[string]instanceState {
+	states := make(map[string]instanceState)
+	require.NoError(t, json.Unmarshal([]byte(configMap.Annotations[InstanceStatusAnnotation]), &states))
+	return states
+}
+
+// TestInstanceStatus tests that instance states are initialized from the ConfigMap, and only reported when they change
+func TestInstanceStatus(t *testing.T) {
+	c := &patchRecordingClient{}
+	configMap := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Annotations: map[string]string{
+		InstanceStatusAnnotation: `{"127.0.0.2":"Ready","127.0.0.3":"Failed"}`}}}
+	s := newInstanceStatus(c, configMap, []string{"127.0.0.1", "127.0.0.2"})
+	assert.Equal(t, map[string]instanceState{"127.0.0.1": statePending, "127.0.0.2": stateReady}, s.states)
+
+	require.NoError(t, s.report(context.Background()))
+	require.Len(t, c.patched, 1)
+	assert.Equal(t, s.states, reportedStates(t, c.patched[0]))
+
+	// Unchanged states are not reported again
+	require.NoError(t, s.set(context.Background(), "127.0.0.2", stateReady))
+	require.NoError(t, s.report(context.Background()))
+	assert.Len(t, c.patched, 1)
+
+	require.NoError(t, s.set(context.Background(), "127.0.0.1", stateConfiguring))
+	require.Len(t, c.patched, 2)
+	assert.Equal(t, map[string]instanceState{"127.0.0.1": stateConfiguring, "127.0.0.2": stateReady},
+		reportedStates(t, c.patched[1]))
+	// The given ConfigMap is not modified, as it is shared with the rest of the reconcile
+	assert.Equal(t, `{"127.0.0.2":"Ready","127.0.0.3":"Failed"}`, configMap.Annotations[InstanceStatusAnnotation])
+
+	// An invalid annotation is overwritten
+	configMap.Annotations[InstanceStatusAnnotation] = "invalid"
+	s = newInstanceStatus(c, configMap, []string{"127.0.0.1"})
+	assert.Equal(t, map[string]instanceState{"127.0.0.1": statePending}, s.states)
+
+	// A nil instanceStatus reports nothing
+	var nilStatus *instanceStatus
+	assert.NoError(t, nilStatus.set(context.Background(), "127.0.0.1", stateReady))
+}
+
+// TestOnlyStatusChanged tests that only updates changing nothing but the reported instance states are detected
+func TestOnlyStatusChanged(t *testing.T) {
+	base := &core.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Annotations: map[string]string{
+			InstanceStatusAnnotation: `{"127.0.0.1":"Pending"}`, SkipDNSValidationAnnotation: "true"}},
+		Data: map[string]string{"127.0.0.1": "username=core"},
+	}
+	tests := []struct {
+		name     string
+		update   func(*core.ConfigMap)
+		expected bool
+	}{
+		{
+			name: "status changed",
+			update: func(c *core.ConfigMap) {
+				c.Annotations[InstanceStatusAnnotation] = `{"127.0.0.1":"Ready"}`
+			},
+			expected: true,
+		},
+		{
+			name:     "nothing changed",
+			update:   func(c *core.ConfigMap) {},
+			expected: false,
+		},
+		{
+			name: "status and data changed",
+			update: func(c *core.ConfigMap) {
+				c.Annotations[InstanceStatusAnnotation] = `{"127.0.0.1":"Ready"}`
+				c.Data["127.0.0.2"] = "username=core"
+			},
+			expected: false,
+		},
+		{
+			name: "status and annotation changed",
+			update: func(c *core.ConfigMap) {
+				c.Annotations[InstanceStatusAnnotation] = `{"127.0.0.1":"Ready"}`
+				delete(c.Annotations, SkipDNSValidationAnnotation)
+			},
+			expected: false,
+		},
+		{
+			name: "status changed and deletion requested",
+			update: func(c *core.ConfigMap) {
+				c.Annotations[InstanceStatusAnnotation] = `{"127.0.0.1":"Ready"}`
+				c.DeletionTimestamp = &meta.Time{}
+			},
+			expected: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updated := base.DeepCopy()
+			test.update(updated)
+			assert.Equal(t, test.expected, onlyStatusChanged(base, updated))
+		})
+	}
+}
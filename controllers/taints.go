@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+)
+
+// TaintsAnnotation is a node annotation holding the comma separated list of taints, identified as <key>:<effect>, which
+// were applied to a BYOH node from its ConfigMap entry. It allows taints removed from the entry to be removed from the
+// node, without removing taints applied by other means.
+const TaintsAnnotation = "windowsmachineconfig.openshift.io/taints"
+
+// setAppliedTaints sets the given taints on the given node, removing the taints previously applied which are no longer
+// present. The applied taints are tracked in TaintsAnnotation. Returns true if the node was changed.
+func setAppliedTaints(node *core.Node, taints []core.Taint) bool {
+	changed := false
+	desired := make(map[string]core.Taint, len(taints))
+	for _, taint := range taints {
+		desired[taintID(taint)] = taint
+	}
+	previouslyApplied := make(map[string]struct{})
+	if applied := node.Annotations[TaintsAnnotation]; applied != "" {
+		for _, id := range strings.Split(applied, ",") {
+			previouslyApplied[id] = struct{}{}
+		}
+	}
+
+	nodeTaints := make([]core.Taint, 0, len(node.Spec.Taints)+len(taints))
+	for _, taint := range node.Spec.Taints {
+		id := taintID(taint)
+		if desiredTaint, present := desired[id]; present {
+			if taint.Value != desiredTaint.Value {
+				taint.Value = desiredTaint.Value
+				changed = true
+			}
+			delete(desired, id)
+		} else if _, present := previouslyApplied[id]; present {
+			changed = true
+			continue
+		}
+		nodeTaints = append(nodeTaints, taint)
+	}
+	// Taints are added in the order they are given in, skipping the ones which were already present on the node
+	for _, taint := range taints {
+		if _, present := desired[taintID(taint)]; present {
+			nodeTaints = append(nodeTaints, taint)
+			changed = true
+		}
+	}
+	if changed {
+		node.Spec.Taints = nodeTaints
+	}
+
+	applied := trackedTaintKeys(nil, taints)
+	if node.Annotations[TaintsAnnotation] != applied {
+		if applied == "" {
+			delete(node.Annotations, TaintsAnnotation)
+		} else {
+			if node.Annotations == nil {
+				node.Annotations = make(map[string]string)
+			}
+			node.Annotations[TaintsAnnotation] = applied
+		}
+		changed = true
+	}
+	return changed
+}
+
+// trackedTaintKeys returns the value of TaintsAnnotation covering both the given taints and the taints which were
+// previously applied to the given node, if any, serving the same purpose as trackedLabelKeys
+func trackedTaintKeys(node *core.Node, taints []core.Taint) string {
+	ids := make(map[string]struct{}, len(taints))
+	for _, taint := range taints {
+		ids[taintID(taint)] = struct{}{}
+	}
+	if node != nil && node.Annotations[TaintsAnnotation] != "" {
+		for _, id := range strings.Split(node.Annotations[TaintsAnnotation], ",") {
+			ids[id] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+// taintID returns the <key>:<effect> identifier of the given taint, as a node cannot have multiple taints with the same
+// key and effect
+func taintID(taint core.Taint) string {
+	return taint.Key + ":" + string(taint.Effect)
+}
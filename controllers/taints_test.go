@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestSetAppliedTaints tests that the taints of a node are kept in sync with its ConfigMap entry, without removing
+// taints which were not applied from the entry
+func TestSetAppliedTaints(t *testing.T) {
+	unreachable := core.Taint{Key: core.TaintNodeUnreachable, Effect: core.TaintEffectNoExecute}
+	node := &core.Node{Spec: core.NodeSpec{Taints: []core.Taint{unreachable}}}
+
+	dedicated := core.Taint{Key: "dedicated", Value: "winapp", Effect: core.TaintEffectNoSchedule}
+	gpu := core.Taint{Key: "example.com/gpu", Effect: core.TaintEffectPreferNoSchedule}
+
+	// Taints are added and tracked
+	assert.True(t, setAppliedTaints(node, []core.Taint{dedicated, gpu}))
+	assert.Equal(t, []core.Taint{unreachable, dedicated, gpu}, node.Spec.Taints)
+	assert.Equal(t, "dedicated:NoSchedule,example.com/gpu:PreferNoSchedule", node.Annotations[TaintsAnnotation])
+
+	// Nothing changes when the taints are already in sync
+	assert.False(t, setAppliedTaints(node, []core.Taint{dedicated, gpu}))
+
+	// The value of a taint is updated in place
+	updated := core.Taint{Key: "dedicated", Value: "batch", Effect: core.TaintEffectNoSchedule}
+	assert.True(t, setAppliedTaints(node, []core.Taint{updated, gpu}))
+	assert.Equal(t, []core.Taint{unreachable, updated, gpu}, node.Spec.Taints)
+
+	// Changing the effect of a taint replaces it
+	noExecute := core.Taint{Key: "dedicated", Value: "batch", Effect: core.TaintEffectNoExecute}
+	assert.True(t, setAppliedTaints(node, []core.Taint{noExecute, gpu}))
+	assert.Equal(t, []core.Taint{unreachable, gpu, noExecute}, node.Spec.Taints)
+	assert.Equal(t, "dedicated:NoExecute,example.com/gpu:PreferNoSchedule", node.Annotations[TaintsAnnotation])
+
+	// Taints removed from the entry are removed from the node
+	assert.True(t, setAppliedTaints(node, []core.Taint{gpu}))
+	assert.Equal(t, []core.Taint{unreachable, gpu}, node.Spec.Taints)
+	assert.True(t, setAppliedTaints(node, nil))
+	assert.Equal(t, []core.Taint{unreachable}, node.Spec.Taints)
+	assert.NotContains(t, node.Annotations, TaintsAnnotation)
+
+	// Taints which were not applied from the entry are left alone
+	assert.False(t, setAppliedTaints(node, nil))
+	assert.Equal(t, []core.Taint{unreachable}, node.Spec.Taints)
+}
+
+func TestTrackedTaintKeys(t *testing.T) {
+	taints := []core.Taint{{Key: "dedicated", Value: "winapp", Effect: core.TaintEffectNoSchedule}}
+	assert.Equal(t, "", trackedTaintKeys(nil, nil))
+	assert.Equal(t, "dedicated:NoSchedule", trackedTaintKeys(nil, taints))
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{
+		TaintsAnnotation: "dedicated:NoSchedule,gpu:NoExecute"}}}
+	assert.Equal(t, "dedicated:NoSchedule,gpu:NoExecute", trackedTaintKeys(node, taints))
+}
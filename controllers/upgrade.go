@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+)
+
+// MaxUnavailableAnnotation is an annotation of the windows-instances ConfigMap which overrides the maximum number of
+// BYOH nodes which can be unavailable at once while nodes are upgraded
+const MaxUnavailableAnnotation = "windowsmachineconfig.openshift.io/max-unavailable"
+
+// upgradeBudget bounds the number of BYOH nodes which are unavailable at once while nodes are upgraded. It is safe for
+// concurrent use.
+type upgradeBudget struct {
+	// maxUnavailable is the maximum number of nodes which can be unavailable at once
+	maxUnavailable int
+	// unavailable holds the names of the nodes which are unavailable, either because they are not Ready or cordoned,
+	// or because they are being upgraded
+	unavailable map[string]struct{}
+	lock        sync.Mutex
+}
+
+// newUpgradeBudget returns an upgradeBudget allowing the given number of nodes to be unavailable at once, with the
+// managed BYOH nodes in the given list which are not Ready or are cordoned counting as unavailable
+func (r *ConfigMapReconciler) newUpgradeBudget(maxUnavailable int, nodes *core.NodeList) *upgradeBudget {
+	b := &upgradeBudget{maxUnavailable: maxUnavailable, unavailable: make(map[string]struct{})}
+	for _, node := range nodes.Items {
+		if !isBYOHNode(&node) || r.isIgnored(&node) {
+			continue
+		}
+		if !isNodeReady(&node) || node.Spec.Unschedulable {
+			b.unavailable[node.GetName()] = struct{}{}
+		}
+	}
+	return b
+}
+
+// acquire marks the given node as unavailable while it is upgraded, if that keeps the number of unavailable nodes
+// within the budget. Otherwise false is returned, along with the sorted names of the nodes which are unavailable.
+func (b *upgradeBudget) acquire(node string) (bool, []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, present := b.unavailable[node]; present || len(b.unavailable) < b.maxUnavailable {
+		b.unavailable[node] = struct{}{}
+		return true, nil
+	}
+	unavailable := make([]string, 0, len(b.unavailable))
+	for name := range b.unavailable {
+		unavailable = append(unavailable, name)
+	}
+	sort.Strings(unavailable)
+	return false, unavailable
+}
+
+// release marks the given node as available once it has been upgraded
+func (b *upgradeBudget) release(node string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.unavailable, node)
+}
+
+// available returns true if another node can be marked as unavailable without exceeding the budget
+func (b *upgradeBudget) available() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.unavailable) < b.maxUnavailable
+}
+
+// rollingUpgrade processes the hosts with the given indexes through the given function, which returns the indexes of
+// the hosts whose upgrade was deferred as the budget was exhausted. The deferred hosts are processed again in batches,
+// as the upgrades of the previous batch complete and free up the budget, until none are left or a batch makes no
+// progress, such as when the budget is taken up by nodes which are not being upgraded. The given progress function is
+// called after each batch. Returns the indexes of the hosts whose upgrade remains deferred.
+func rollingUpgrade(indexes []int, budget *upgradeBudget, process func([]int) []int, progress func()) []int {
+	deferred := process(indexes)
+	progress()
+	for len(deferred) != 0 && budget.available() {
+		next := process(deferred)
+		progress()
+		if len(next) == len(deferred) {
+			return next
+		}
+		deferred = next
+	}
+	return deferred
+}
+
+// getMaxUnavailable returns the maximum number of BYOH nodes which can be unavailable at once, taken from the
+// MaxUnavailableAnnotation of the given ConfigMap if it is present
+func (r *ConfigMapReconciler) getMaxUnavailable(configMap *core.ConfigMap) (int, error) {
+	value, present := configMap.Annotations[MaxUnavailableAnnotation]
+	if !present {
+		return r.maxUnavailable, nil
+	}
+	maxUnavailable, err := strconv.Atoi(value)
+	if err != nil || maxUnavailable <= 0 {
+		return 0, errors.Errorf("invalid %s annotation %s, expected a positive integer", MaxUnavailableAnnotation,
+			value)
+	}
+	return maxUnavailable, nil
+}
+
+// upgradeDeferredError occurs when the upgrade of a node is deferred as the maximum number of BYOH nodes are already
+// unavailable
+type upgradeDeferredError struct {
+	node        string
+	unavailable []string
+}
+
+func (e *upgradeDeferredError) Error() string {
+	return fmt.Sprintf("upgrade of node %s deferred until one of the unavailable nodes %s is available", e.node,
+		strings.Join(e.unavailable, ", "))
+}
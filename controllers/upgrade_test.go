@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/version"
+)
+
+// newBudgetNode returns a BYOH node with the given name, readiness and schedulability
+func newBudgetNode(name string, ready core.ConditionStatus, unschedulable bool) core.Node {
+	return core.Node{
+		ObjectMeta: meta.ObjectMeta{Name: name, Annotations: map[string]string{BYOHAnnotation: "true"}},
+		Spec:       core.NodeSpec{Unschedulable: unschedulable},
+		Status:     core.NodeStatus{Conditions: []core.NodeCondition{{Type: core.NodeReady, Status: ready}}},
+	}
+}
+
+// TestUpgradeBudget tests that nodes which are not Ready or cordoned count against the budget, and that no more nodes
+// than the budget allows are upgraded at once
+func TestUpgradeBudget(t *testing.T) {
+	r := ConfigMapReconciler{}
+	nodes := &core.NodeList{Items: []core.Node{newBudgetNode("a", core.ConditionTrue, false),
+		newBudgetNode("b", core.ConditionTrue, false), newBudgetNode("c", core.ConditionTrue, false),
+		newBudgetNode("not-ready", core.ConditionFalse, false), newBudgetNode("cordoned", core.ConditionTrue, true)}}
+
+	budget := r.newUpgradeBudget(3, nodes)
+	acquired, _ := budget.acquire("a")
+	require.True(t, acquired)
+	acquired, unavailable := budget.acquire("b")
+	require.False(t, acquired)
+	assert.Equal(t, []string{"a", "cordoned", "not-ready"}, unavailable)
+	// An unavailable node does not take up more of the budget when it is upgraded
+	acquired, _ = budget.acquire("not-ready")
+	assert.True(t, acquired)
+
+	budget.release("a")
+	acquired, _ = budget.acquire("b")
+	assert.True(t, acquired)
+	acquired, _ = budget.acquire("c")
+	assert.False(t, acquired)
+}
+
+// TestUpgradeBudgetConcurrency tests that no more than maxUnavailable nodes are unavailable at once when nodes are
+// upgraded concurrently
+func TestUpgradeBudgetConcurrency(t *testing.T) {
+	const maxUnavailable = 3
+	r := ConfigMapReconciler{}
+	nodes := &core.NodeList{}
+	for i := 0; i < 20; i++ {
+		nodes.Items = append(nodes.Items, newBudgetNode(fmt.Sprintf("node-%d", i), core.ConditionTrue, false))
+	}
+	budget := r.newUpgradeBudget(maxUnavailable, nodes)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	unavailable, peak := 0, 0
+	for _, node := range nodes.Items {
+		name := node.GetName()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Retry until the upgrade is allowed, as a deferred upgrade is retried on a later reconcile
+			for {
+				if acquired, _ := budget.acquire(name); acquired {
+					break
+				}
+				runtime.Gosched()
+			}
+			lock.Lock()
+			unavailable++
+			if unavailable > peak {
+				peak = unavailable
+			}
+			lock.Unlock()
+			// Let the other upgrades progress while this node is unavailable
+			runtime.Gosched()
+			lock.Lock()
+			unavailable--
+			lock.Unlock()
+			budget.release(name)
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, peak, maxUnavailable)
+	assert.Empty(t, budget.unavailable)
+}
+
+// TestRollingUpgrade tests that a fleet of outdated nodes is upgraded in batches of at most the budget, with progress
+// being reported after each batch, and that the upgrades which cannot make progress remain deferred
+func TestRollingUpgrade(t *testing.T) {
+	newFleet := func(size int, extra ...core.Node) (*core.NodeList, []int) {
+		nodes := &core.NodeList{Items: extra}
+		indexes := make([]int, size)
+		for i := 0; i < size; i++ {
+			nodes.Items = append(nodes.Items, newBudgetNode(fmt.Sprintf("node-%d", i), core.ConditionTrue, false))
+			indexes[i] = i
+		}
+		return nodes, indexes
+	}
+	// process simulates configuring the hosts concurrently, with the upgrades started in a batch completing once the
+	// whole batch has been processed. The upgrades of the hosts in the given set fail, leaving their nodes unavailable.
+	process := func(budget *upgradeBudget, failing map[int]bool, batches *[][]int) func([]int) []int {
+		return func(indexes []int) []int {
+			var started, deferred []int
+			for _, index := range indexes {
+				if acquired, _ := budget.acquire(fmt.Sprintf("node-%d", index)); !acquired {
+					deferred = append(deferred, index)
+					continue
+				}
+				started = append(started, index)
+			}
+			for _, index := range started {
+				if !failing[index] {
+					budget.release(fmt.Sprintf("node-%d", index))
+				}
+			}
+			*batches = append(*batches, started)
+			return deferred
+		}
+	}
+	r := ConfigMapReconciler{}
+
+	t.Run("batched", func(t *testing.T) {
+		nodes, indexes := newFleet(7)
+		budget := r.newUpgradeBudget(3, nodes)
+		var batches [][]int
+		reports := 0
+		deferred := rollingUpgrade(indexes, budget, process(budget, nil, &batches), func() { reports++ })
+		assert.Empty(t, deferred)
+		assert.Equal(t, [][]int{{0, 1, 2}, {3, 4, 5}, {6}}, batches)
+		assert.Equal(t, 3, reports)
+		assert.Empty(t, budget.unavailable)
+	})
+	t.Run("budget taken by other nodes", func(t *testing.T) {
+		nodes, indexes := newFleet(3, newBudgetNode("not-ready", core.ConditionFalse, false))
+		budget := r.newUpgradeBudget(1, nodes)
+		var batches [][]int
+		reports := 0
+		deferred := rollingUpgrade(indexes, budget, process(budget, nil, &batches), func() { reports++ })
+		assert.Equal(t, []int{0, 1, 2}, deferred)
+		assert.Equal(t, [][]int{nil}, batches)
+		assert.Equal(t, 1, reports)
+	})
+	t.Run("failed upgrade", func(t *testing.T) {
+		nodes, indexes := newFleet(5)
+		budget := r.newUpgradeBudget(2, nodes)
+		var batches [][]int
+		// The failed node stays unavailable, so the remaining upgrades proceed one at a time
+		deferred := rollingUpgrade(indexes, budget, process(budget, map[int]bool{1: true}, &batches), func() {})
+		assert.Empty(t, deferred)
+		assert.Equal(t, [][]int{{0, 1}, {2}, {3}, {4}}, batches)
+		assert.Equal(t, map[string]struct{}{"node-1": {}}, budget.unavailable)
+	})
+}
+
+// TestOutdatedHosts tests that only the hosts whose nodes were configured by another operator version, and which
+// would not be downgraded, are to be upgraded
+func TestOutdatedHosts(t *testing.T) {
+	operatorVersion := version.Version
+	version.Version = "3.1.0+def5678"
+	defer func() { version.Version = operatorVersion }()
+
+	newNode := func(address, nodeVersion string) core.Node {
+		node := core.Node{
+			ObjectMeta: meta.ObjectMeta{Name: address, Annotations: map[string]string{BYOHAnnotation: "true"}},
+			Status:     core.NodeStatus{Addresses: []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}},
+		}
+		if nodeVersion != "" {
+			node.Annotations[nodeconfig.VersionAnnotation] = nodeVersion
+		}
+		return node
+	}
+	nodes := &core.NodeList{Items: []core.Node{newNode("10.0.0.1", "3.1.0+def5678"),
+		newNode("10.0.0.2", "3.0.0+abc1234"), newNode("10.0.0.3", "3.2.0+fed9876"), newNode("10.0.0.4", "")}}
+	var hosts []*instances.InstanceInfo
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5"} {
+		hosts = append(hosts, &instances.InstanceInfo{Address: address})
+	}
+
+	r := ConfigMapReconciler{}
+	assert.Equal(t, map[int]struct{}{1: {}}, r.outdatedHosts(hosts, newNodeIndex(nodes)))
+	r.allowDowngrade = true
+	assert.Equal(t, map[int]struct{}{1: {}, 2: {}}, r.outdatedHosts(hosts, newNodeIndex(nodes)))
+}
+
+func TestGetMaxUnavailable(t *testing.T) {
+	r := ConfigMapReconciler{maxUnavailable: DefaultMaxUnavailable}
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		expected    int
+		expectedErr bool
+	}{
+		{"default", nil, DefaultMaxUnavailable, false},
+		{"annotation", map[string]string{MaxUnavailableAnnotation: "3"}, 3, false},
+		{"zero", map[string]string{MaxUnavailableAnnotation: "0"}, 0, true},
+		{"not a number", map[string]string{MaxUnavailableAnnotation: "all"}, 0, true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			maxUnavailable, err := r.getMaxUnavailable(&core.ConfigMap{ObjectMeta: meta.ObjectMeta{
+				Annotations: test.annotations}})
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, maxUnavailable)
+		})
+	}
+}
+
+// TestUpgradeBudgetSecretFailure tests that an upgrade which fails before its node is touched, as the secrets the
+// instance is configured with cannot be read, does not take up the budget, so that other outdated nodes still upgrade
+func TestUpgradeBudgetSecretFailure(t *testing.T) {
+	operatorVersion := version.Version
+	version.Version = "3.1.0+def5678"
+	defer func() { version.Version = operatorVersion }()
+
+	newNode := func(name, address string) core.Node {
+		node := newBudgetNode(name, core.ConditionTrue, false)
+		node.Annotations[UsernameAnnotation] = "core"
+		node.Annotations[nodeconfig.VersionAnnotation] = "3.0.0+abc1234"
+		node.Status.Addresses = []core.NodeAddress{{Type: core.NodeInternalIP, Address: address}}
+		return node
+	}
+	nodes := &core.NodeList{Items: []core.Node{newNode("a", "10.0.0.1"), newNode("b", "10.0.0.2")}}
+	privateKeySigner := newTestSigner(t, 1)
+	instance := &fakeInstance{authorized: sets.NewString(authorizedKeyEntry(privateKeySigner.PublicKey())),
+		rejected: sets.NewString()}
+	// The auth secret referenced by the first instance does not exist
+	r := ConfigMapReconciler{instanceReconciler: instanceReconciler{client: &namespaceClient{},
+		log: ctrl.Log.WithName("test"), recorder: record.NewFakeRecorder(10), watchNamespace: "wmco",
+		signer: privateKeySigner, connect: instance.connect, hostLocks: newHostLocks()}}
+	budget := r.newUpgradeBudget(1, nodes)
+	index := newNodeIndex(nodes)
+	configMap := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: InstanceConfigMap, Namespace: "wmco"}}
+
+	err := r.ensureInstanceIsConfigured(context.Background(), configMap, &instances.InstanceInfo{Address: "10.0.0.1",
+		Username: "core", AuthSecret: "host-creds"}, index, budget, r.log)
+	require.Error(t, err)
+	assert.Empty(t, budget.unavailable)
+
+	// The second node is removed to be configured again, which then fails as there is no cluster to join
+	err = r.ensureInstanceIsConfigured(context.Background(), configMap, &instances.InstanceInfo{Address: "10.0.0.2",
+		Username: "core"}, index, budget, r.log)
+	require.Error(t, err)
+	var deferredErr *upgradeDeferredError
+	assert.False(t, errors.As(err, &deferredErr))
+	assert.True(t, instance.deconfigured)
+	assert.Equal(t, map[string]struct{}{"b": {}}, budget.unavailable)
+}
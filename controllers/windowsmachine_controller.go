@@ -29,8 +29,10 @@ import (
 	"github.com/openshift/windows-machine-config-operator/pkg/instances"
 	"github.com/openshift/windows-machine-config-operator/pkg/metrics"
 	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+	"github.com/openshift/windows-machine-config-operator/pkg/notify"
 	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
 	"github.com/openshift/windows-machine-config-operator/pkg/signer"
+	"github.com/openshift/windows-machine-config-operator/pkg/tracing"
 	"github.com/openshift/windows-machine-config-operator/pkg/windows"
 	"github.com/openshift/windows-machine-config-operator/version"
 )
@@ -60,7 +62,8 @@ type WindowsMachineReconciler struct {
 }
 
 // NewWindowsMachineReconciler returns a pointer to a WindowsMachineReconciler
-func NewWindowsMachineReconciler(mgr manager.Manager, clusterConfig cluster.Config, watchNamespace string) (*WindowsMachineReconciler, error) {
+func NewWindowsMachineReconciler(mgr manager.Manager, clusterConfig cluster.Config, watchNamespace string,
+	opts Options) (*WindowsMachineReconciler, error) {
 	// The client provided by the GetClient() method of the manager is a split client that will always hit the API
 	// server when writing. When reading, the client will either use a cache populated by the informers backing the
 	// controllers, or in certain cases read directly from the API server. It will read from the server both for
@@ -84,10 +87,21 @@ func NewWindowsMachineReconciler(mgr manager.Manager, clusterConfig cluster.Conf
 			log:                  ctrl.Log.WithName("controller").WithName("windowsmachine"),
 			k8sclientset:         clientset,
 			clusterServiceCIDR:   clusterConfig.Network().GetServiceCIDR(),
-			vxlanPort:            clusterConfig.Network().VXLANPort(),
-			recorder:             mgr.GetEventRecorderFor("windowsmachine"),
+			vxlanPort:            vxlanPort(clusterConfig, opts),
+			recorder:             notify.NewRecorder(mgr.GetEventRecorderFor("windowsmachine"), opts.Webhook),
 			watchNamespace:       watchNamespace,
 			prometheusNodeConfig: pc,
+			kubeletConfig:        opts.KubeletConfig,
+			dnsSearchDomains:     opts.DNSSearchDomains,
+			sshSessionLimit:      opts.SSHSessionLimit,
+			sshDialTimeout:       opts.SSHDialTimeout,
+			sshCommandTimeout:    opts.SSHCommandTimeout,
+			hostLocks:            activeHosts,
+			metadataAnnotations:  opts.HostMetadataAnnotations,
+			bastion:              opts.Bastion,
+			proxy:                clusterConfig.Proxy(),
+			ipFamily:             clusterConfig.Network().IPFamily(),
+			drainTimeout:         opts.DrainTimeout,
 		},
 		platform: clusterConfig.Platform(),
 	}, nil
@@ -115,7 +129,7 @@ func (r *WindowsMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		For(&mapi.Machine{}, builder.WithPredicates(machinePredicate)).
 		Watches(&source.Kind{Type: &core.Node{}}, handler.EnqueueRequestsFromMapFunc(r.mapNodeToMachine),
 			builder.WithPredicates(windowsNodePredicate(false))).
-		Complete(r)
+		Complete(tracing.Reconciler("ReconcileWindowsMachine", r))
 }
 
 // mapNodeToMachine maps the given Windows node to its associated Machine
@@ -273,8 +287,8 @@ func (r *WindowsMachineReconciler) Reconcile(ctx context.Context, request ctrl.R
 			// version annotation exists with a valid value, node is fully configured.
 			// configure Prometheus when we have already configured Windows Nodes. This is required to update Endpoints object if
 			// it gets reverted when the operator pod restarts.
-			if err := r.prometheusNodeConfig.Configure(); err != nil {
-				return ctrl.Result{}, errors.Wrap(err, "unable to configure Prometheus")
+			if err := r.configurePrometheus(); err != nil {
+				return ctrl.Result{}, err
 			}
 			return ctrl.Result{}, nil
 		}
@@ -282,8 +296,8 @@ func (r *WindowsMachineReconciler) Reconcile(ctx context.Context, request ctrl.R
 		log.V(1).Info("machine not provisioned", "phase", *machine.Status.Phase)
 		// configure Prometheus when a machine is not in `Running` or `Provisioned` phase. This configuration is
 		// required to update Endpoints object when Windows machines are being deleted.
-		if err := r.prometheusNodeConfig.Configure(); err != nil {
-			return ctrl.Result{}, errors.Wrap(err, "unable to configure Prometheus")
+		if err := r.configurePrometheus(); err != nil {
+			return ctrl.Result{}, err
 		}
 		// Machine is not in provisioned or running state, nothing we should do as of now
 		return ctrl.Result{}, nil
@@ -315,7 +329,13 @@ func (r *WindowsMachineReconciler) Reconcile(ctx context.Context, request ctrl.R
 
 	log.Info("processing")
 	// Make the Machine a Windows Worker node
-	if err := r.addWorkerNode(ipAddress, instanceID, machine.Name); err != nil {
+	if err := r.addWorkerNode(ctx, ipAddress, instanceID, machine.Name); err != nil {
+		// The instance is configured once the operation in progress on it, such as its removal, completes
+		var busyErr *hostBusyError
+		if errors.As(err, &busyErr) {
+			log.Info("deferring configuration, instance is busy", "address", ipAddress)
+			return ctrl.Result{Requeue: true}, nil
+		}
 		var authErr *windows.AuthErr
 		if errors.As(err, &authErr) {
 			// SSH authentication errors with the Machine are non recoverable, stemming from a mismatch with the
@@ -332,8 +352,8 @@ func (r *WindowsMachineReconciler) Reconcile(ctx context.Context, request ctrl.R
 	r.recorder.Eventf(machine, core.EventTypeNormal, "MachineSetup",
 		"Machine %s configured successfully", machine.Name)
 	// configure Prometheus after a Windows machine is configured as a Node.
-	if err := r.prometheusNodeConfig.Configure(); err != nil {
-		return ctrl.Result{}, errors.Wrap(err, "unable to configure Prometheus")
+	if err := r.configurePrometheus(); err != nil {
+		return ctrl.Result{}, err
 	}
 	return ctrl.Result{}, nil
 }
@@ -356,8 +376,15 @@ func (r *WindowsMachineReconciler) deleteMachine(machine *mapi.Machine) error {
 	return nil
 }
 
-// addWorkerNode configures the given Windows VM, adding it as a node object to the cluster
-func (r *WindowsMachineReconciler) addWorkerNode(ipAddress, instanceID, machineName string) error {
+// addWorkerNode configures the given Windows VM, adding it as a node object to the cluster, with the spans of the
+// configuration steps started as children of the span of the given context. A hostBusyError is returned without
+// waiting if another operation is in progress on the VM.
+func (r *WindowsMachineReconciler) addWorkerNode(ctx context.Context, ipAddress, instanceID,
+	machineName string) error {
+	if !r.hostLocks.tryLock(ipAddress) {
+		return &hostBusyError{address: ipAddress}
+	}
+	defer r.hostLocks.unlock(ipAddress)
 	// The name of the Machine must be the same as the hostname of the associated VM. This is currently not true in the
 	// case of vSphere VMs provisioned by MAPI. In case of Linux, ignition was handling it. As we don't have an
 	// equivalent of ignition in Windows, WMCO must correct this by changing the VM's hostname.
@@ -376,7 +403,19 @@ func (r *WindowsMachineReconciler) addWorkerNode(ipAddress, instanceID, machineN
 		username = "Administrator"
 	}
 
-	if err := r.configureInstance(instances.NewInstanceInfo(ipAddress, username, hostname), nil); err != nil {
+	instance := instances.NewInstanceInfo(ipAddress, username, hostname)
+	instance.KubeletConfig = r.kubeletConfig
+	instance.DNSSearchDomains = r.dnsSearchDomains
+	instance.SSHSessionLimit = r.sshSessionLimit
+	instance.SSHDialTimeout = r.sshDialTimeout
+	instance.SSHCommandTimeout = r.sshCommandTimeout
+	instance.MetadataAnnotations = r.metadataAnnotations
+	sshProxy, err := r.proxy.URLFor(ipAddress)
+	if err != nil {
+		return err
+	}
+	instance.SSHProxy = sshProxy
+	if err := r.configureInstance(ctx, instance, nil, nil, r.log.WithValues("address", ipAddress)); err != nil {
 		return errors.Wrapf(err, "unable to configure instance %s", instanceID)
 	}
 
@@ -1,10 +1,12 @@
 package controllers
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
 	mapi "github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 	core "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -63,3 +65,16 @@ func TestIsValidMachine(t *testing.T) {
 	}
 
 }
+
+// TestAddWorkerNodeBusy tests that a Machine VM another operation is in progress on is not configured, without waiting
+// for the operation to complete
+func TestAddWorkerNodeBusy(t *testing.T) {
+	r := WindowsMachineReconciler{instanceReconciler: instanceReconciler{log: logf.Log, hostLocks: newHostLocks()}}
+	require.True(t, r.hostLocks.tryLock("10.0.0.1"))
+
+	err := r.addWorkerNode(context.Background(), "10.0.0.1", "i-0123", "windows-worker")
+	var busyErr *hostBusyError
+	require.True(t, errors.As(err, &busyErr))
+	// The lock is still held by the other operation
+	require.False(t, r.hostLocks.tryLock("10.0.0.1"))
+}
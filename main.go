@@ -6,22 +6,30 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	mapi "github.com/openshift/machine-api-operator/pkg/apis/machine/v1beta1"
 	"github.com/operator-framework/operator-lib/leader"
 	"github.com/spf13/pflag"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/openshift/windows-machine-config-operator/controllers"
 	"github.com/openshift/windows-machine-config-operator/pkg/cluster"
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
 	"github.com/openshift/windows-machine-config-operator/pkg/metrics"
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
 	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig/payload"
+	"github.com/openshift/windows-machine-config-operator/pkg/notify"
+	"github.com/openshift/windows-machine-config-operator/pkg/tracing"
+	"github.com/openshift/windows-machine-config-operator/pkg/windows"
 	"github.com/openshift/windows-machine-config-operator/version"
 	//+kubebuilder:scaffold:imports
 )
@@ -34,6 +42,15 @@ import (
 // by the manager, instead of the "leader" library
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list
 
+const (
+	// defaultAPIQPS is the default maximum number of queries per second sent to the Kubernetes API server
+	defaultAPIQPS = 20
+	// defaultAPIBurst is the default maximum burst of queries sent to the Kubernetes API server
+	defaultAPIBurst = 30
+	// defaultNamespace is the namespace the operator is installed in by default
+	defaultNamespace = "openshift-windows-machine-config-operator"
+)
+
 var (
 	scheme   = runtime.NewScheme()
 	setupLog = ctrl.Log.WithName("setup")
@@ -48,6 +65,129 @@ func init() {
 func main() {
 	var debugLogging bool
 	flag.BoolVar(&debugLogging, "debugLogging", false, "Log debug messages")
+	var shutdownGracePeriod, shutdownGracePeriodCriticalPods time.Duration
+	flag.DurationVar(&shutdownGracePeriod, "shutdownGracePeriod", 0,
+		"Duration Windows nodes delay their shutdown by to gracefully terminate pods. 0 disables graceful shutdown. "+
+			"Has no effect until the kubelet implements graceful shutdown on Windows")
+	flag.DurationVar(&shutdownGracePeriodCriticalPods, "shutdownGracePeriodCriticalPods", 0,
+		"Portion of shutdownGracePeriod reserved for terminating critical pods on Windows nodes")
+	var apiQPS float64
+	flag.Float64Var(&apiQPS, "apiQPS", defaultAPIQPS,
+		"Maximum number of queries per second sent to the Kubernetes API server by the operator")
+	var apiBurst int
+	flag.IntVar(&apiBurst, "apiBurst", defaultAPIBurst,
+		"Maximum burst of queries sent to the Kubernetes API server by the operator, above apiQPS")
+	var sshSessionLimit int
+	flag.IntVar(&sshSessionLimit, "sshSessionLimit", windows.DefaultSSHSessionLimit,
+		"Maximum number of concurrent SSH sessions to a single Windows instance while it is being configured")
+	var sshDialTimeout, sshCommandTimeout time.Duration
+	flag.DurationVar(&sshDialTimeout, "sshDialTimeout", windows.DefaultSSHDialTimeout,
+		"Maximum duration of a single attempt to connect to the SSH server of a Windows instance, including the SSH "+
+			"handshake")
+	flag.DurationVar(&sshCommandTimeout, "sshCommandTimeout", windows.DefaultSSHCommandTimeout,
+		"Maximum duration of a command run on a Windows instance, or of a file transfer to it, after which the "+
+			"configuration of the instance is aborted and retried")
+	var vxlanPort string
+	flag.StringVar(&vxlanPort, "vxlanPort", "",
+		"VXLAN port to configure on Windows nodes, overriding the hybrid overlay VXLAN port of the cluster network")
+	var minWindowsVersion string
+	flag.StringVar(&minWindowsVersion, "minWindowsVersion", controllers.DefaultMinOSVersion,
+		"Minimum version of Windows BYOH instances must be running to be configured. An empty value disables the check")
+	var bastion, bastionUsername, bastionSecret string
+	flag.StringVar(&bastion, "bastion", "",
+		"<address>[:<port>] of the bastion SSH connections to BYOH instances are tunneled through. Instances are "+
+			"connected to directly if empty, unless their entry names a bastion")
+	flag.StringVar(&bastionUsername, "bastionUsername", "",
+		"User to log into the bastion as. Required to tunnel SSH connections through a bastion")
+	flag.StringVar(&bastionSecret, "bastionSecret", "",
+		"Secret holding the private key used to authenticate against the bastion under the private-key.pem key. "+
+			"The private key secret is used if empty")
+	var hostMetadataAnnotations string
+	flag.StringVar(&hostMetadataAnnotations, "hostMetadataAnnotations", "",
+		"JSON list of node annotations sourced from commands run on Windows instances, each with annotation, command "+
+			"and optional template fields, such as [{\"annotation\":\"example.com/serial\",\"command\":"+
+			"\"(Get-CimInstance Win32_BIOS).SerialNumber\"}]")
+	var ignoreLabel string
+	flag.StringVar(&ignoreLabel, "ignoreLabel", controllers.DefaultIgnoreLabel,
+		"Node label which, when set to \"true\", exempts a BYOH node from being configured or removed")
+	var notificationWebhook, notificationReasons string
+	flag.StringVar(&notificationWebhook, "notificationWebhook", "",
+		"URL which notifications of the events emitted by the operator are posted to. Disabled if empty")
+	flag.StringVar(&notificationReasons, "notificationReasons", "",
+		"Comma separated list of the reasons of the events which are notified. All warning events if empty")
+	var drainTimeout time.Duration
+	flag.DurationVar(&drainTimeout, "drainTimeout", controllers.DefaultDrainTimeout,
+		"Maximum duration a BYOH node is drained for before it is removed. 0 waits until the node is drained")
+	var maxUnavailable int
+	flag.IntVar(&maxUnavailable, "maxUnavailable", controllers.DefaultMaxUnavailable,
+		"Maximum number of BYOH nodes which can be unavailable at once while nodes are upgraded")
+	var configurationWorkers int
+	flag.IntVar(&configurationWorkers, "configurationWorkers", controllers.DefaultConfigurationWorkers,
+		"Number of BYOH instances which are configured concurrently")
+	var maxConfigurationBackoff time.Duration
+	flag.DurationVar(&maxConfigurationBackoff, "maxConfigurationBackoff", controllers.DefaultMaxConfigurationBackoff,
+		"Maximum duration a BYOH instance which repeatedly fails to be configured is not retried for")
+	var checkReachability bool
+	flag.BoolVar(&checkReachability, "checkReachability", false,
+		"Probe the SSH port of a BYOH instance before configuring it, reporting unreachable instances early")
+	var resyncInterval time.Duration
+	flag.DurationVar(&resyncInterval, "resyncInterval", controllers.DefaultResyncInterval,
+		"Interval the windows-instances ConfigMap is reconciled at in the absence of events. 0 disables it")
+	var removalGracePeriod time.Duration
+	flag.DurationVar(&removalGracePeriod, "removalGracePeriod", 0,
+		"Duration a BYOH node whose instance is removed from the windows-instances ConfigMap is kept for before it "+
+			"is removed. 0 removes it immediately")
+	var allowDowngrade bool
+	flag.BoolVar(&allowDowngrade, "allowDowngrade", false,
+		"Allow BYOH nodes configured by a newer operator version to be configured again by this version")
+	var instanceConfigMap string
+	flag.StringVar(&instanceConfigMap, "instanceConfigMap", controllers.InstanceConfigMap,
+		"Name of the ConfigMap describing the BYOH instances. Operators watching the same namespace must use distinct "+
+			"names")
+	var restoreConfigMap bool
+	flag.BoolVar(&restoreConfigMap, "restoreConfigMap", false,
+		"Recreate the windows-instances ConfigMap from the existing BYOH nodes if it is deleted")
+	var dryRun bool
+	flag.BoolVar(&dryRun, "dryRun", false,
+		"Report the BYOH instances which would be configured and the BYOH nodes which would be removed, without "+
+			"changing them")
+	var dnsSearchDomains string
+	flag.StringVar(&dnsSearchDomains, "dnsSearchDomains", "",
+		"Comma separated list of DNS search domains set on Windows nodes, in addition to the cluster search domains")
+	var imageGCHighThresholdPercent, imageGCLowThresholdPercent int
+	flag.IntVar(&imageGCHighThresholdPercent, "imageGCHighThresholdPercent", 0,
+		"Percent of disk usage after which image garbage collection is always run on Windows nodes. 0 uses the "+
+			"kubelet default of 85")
+	flag.IntVar(&imageGCLowThresholdPercent, "imageGCLowThresholdPercent", 0,
+		"Percent of disk usage before which image garbage collection is never run on Windows nodes. 0 uses the "+
+			"kubelet default of 80")
+	var strictNodeCount bool
+	flag.BoolVar(&strictNodeCount, "strictNodeCount", false,
+		"Fail BYOH reconciliation when the number of Ready BYOH nodes does not match the configured instances")
+	var validateConfigMap bool
+	flag.BoolVar(&validateConfigMap, "validateConfigMap", false,
+		"Serve the webhook rejecting an invalid windows-instances ConfigMap on admission. Requires the webhook "+
+			"serving certificates, which OLM provisions for the webhook defined in the CSV")
+	var removeUnresolvableHosts bool
+	flag.BoolVar(&removeUnresolvableHosts, "removeUnresolvableHosts", false,
+		"Remove BYOH nodes whose DNS name no longer resolves, instead of rejecting the windows-instances ConfigMap")
+	var tracingEndpoint string
+	flag.StringVar(&tracingEndpoint, "tracingEndpoint", "",
+		"OTLP gRPC endpoint of the collector to export traces of the reconciles to, such as otel-collector:4317. "+
+			"Tracing is disabled if empty")
+	var allowedCIDRs, deniedCIDRs string
+	flag.StringVar(&allowedCIDRs, "allowedCIDRs", "",
+		"Comma separated list of CIDRs the addresses of BYOH instances must be within. All addresses are allowed if "+
+			"empty")
+	flag.StringVar(&deniedCIDRs, "deniedCIDRs", "",
+		"Comma separated list of CIDRs the addresses of BYOH instances cannot be within")
+	var healthProbeBindAddress string
+	flag.StringVar(&healthProbeBindAddress, "healthProbeBindAddress", "",
+		"Address the liveness and readiness probes are served on, such as :8081. The probes are disabled if empty")
+	var readinessFailureThreshold int
+	flag.IntVar(&readinessFailureThreshold, "readinessFailureThreshold", 3,
+		"Number of consecutive failed reconciles of the windows-instances ConfigMap after which the operator is "+
+			"reported as not ready")
 
 	// Add flags registered by imported packages (e.g. glog and
 	// controller-runtime)
@@ -65,12 +205,20 @@ func main() {
 			fmt.Printf("%s version: %q, go version: %q\n", os.Args[0], version.Get(),
 				version.GoVersion)
 			os.Exit(0)
+		case "sample-configmap":
+			// The sample is created in the namespace the operator watches, if known
+			namespace, err := getWatchNamespace()
+			if err != nil {
+				namespace = defaultNamespace
+			}
+			fmt.Print(controllers.SampleInstanceConfigMap(instanceConfigMap, namespace))
+			os.Exit(0)
 		default:
 			fg := strings.Split(os.Args[1], "=")
 			arg := strings.Replace(fg[0], "--", "", -1)
 			if pflag.Lookup(arg) == nil {
 				fmt.Printf("unknown sub-command: %v\n", os.Args[1])
-				fmt.Print("available sub-commands:\n\tversion\n")
+				fmt.Print("available sub-commands:\n\tversion\n\tsample-configmap\n")
 				os.Exit(1)
 			}
 		}
@@ -78,12 +226,172 @@ func main() {
 
 	version.Print()
 
+	controllerOptions := controllers.Options{
+		KubeletConfig: instances.KubeletConfig{
+			ImageGCHighThresholdPercent: int32(imageGCHighThresholdPercent),
+			ImageGCLowThresholdPercent:  int32(imageGCLowThresholdPercent),
+		},
+		StrictNodeCount:         strictNodeCount,
+		RemoveUnresolvableHosts: removeUnresolvableHosts,
+		InstanceConfigMap:       instanceConfigMap,
+		RestoreConfigMap:        restoreConfigMap,
+		DryRun:                  dryRun,
+		IgnoreLabel:             ignoreLabel,
+		AllowDowngrade:          allowDowngrade,
+		DrainTimeout:            drainTimeout,
+		MaxUnavailable:          maxUnavailable,
+		ConfigurationWorkers:    configurationWorkers,
+		CheckReachability:       checkReachability,
+		ResyncInterval:          resyncInterval,
+		RemovalGracePeriod:      removalGracePeriod,
+		MinOSVersion:            minWindowsVersion,
+		MaxConfigurationBackoff: maxConfigurationBackoff,
+		SSHSessionLimit:         sshSessionLimit,
+		SSHDialTimeout:          sshDialTimeout,
+		SSHCommandTimeout:       sshCommandTimeout,
+	}
+	// The shutdown grace periods default to the kubelet default, and are only written to the kubelet configuration
+	// when they are set
+	if shutdownGracePeriod != 0 {
+		controllerOptions.KubeletConfig.ShutdownGracePeriod = &shutdownGracePeriod
+	}
+	if shutdownGracePeriodCriticalPods != 0 {
+		controllerOptions.KubeletConfig.ShutdownGracePeriodCriticalPods = &shutdownGracePeriodCriticalPods
+	}
+	if err := controllerOptions.KubeletConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid kubelet configuration")
+		os.Exit(1)
+	}
+	if apiQPS <= 0 || apiBurst <= 0 {
+		setupLog.Error(fmt.Errorf("apiQPS %v and apiBurst %d must be positive", apiQPS, apiBurst),
+			"invalid API server rate limits")
+		os.Exit(1)
+	}
+	// The name is recorded on the BYOH nodes managed by the operator through a label, which limits its length
+	if errs := append(validation.IsDNS1123Subdomain(instanceConfigMap),
+		validation.IsValidLabelValue(instanceConfigMap)...); len(errs) != 0 {
+		setupLog.Error(fmt.Errorf("%s: %s", instanceConfigMap, strings.Join(errs, ", ")),
+			"invalid instance ConfigMap name")
+		os.Exit(1)
+	}
+	if drainTimeout < 0 {
+		setupLog.Error(fmt.Errorf("%s cannot be negative", drainTimeout), "invalid drain timeout")
+		os.Exit(1)
+	}
+	if maxUnavailable <= 0 {
+		setupLog.Error(fmt.Errorf("%d is not a positive integer", maxUnavailable), "invalid max unavailable")
+		os.Exit(1)
+	}
+	if maxConfigurationBackoff <= 0 {
+		setupLog.Error(fmt.Errorf("%s is not a positive duration", maxConfigurationBackoff),
+			"invalid maximum configuration backoff")
+		os.Exit(1)
+	}
+	if resyncInterval < 0 {
+		setupLog.Error(fmt.Errorf("%s cannot be negative", resyncInterval), "invalid resync interval")
+		os.Exit(1)
+	}
+	if minWindowsVersion != "" {
+		if err := nodeconfig.ValidateOSVersion(minWindowsVersion); err != nil {
+			setupLog.Error(err, "invalid minimum Windows version")
+			os.Exit(1)
+		}
+	}
+	if removalGracePeriod < 0 {
+		setupLog.Error(fmt.Errorf("%s cannot be negative", removalGracePeriod), "invalid removal grace period")
+		os.Exit(1)
+	}
+	if configurationWorkers <= 0 {
+		setupLog.Error(fmt.Errorf("%d is not a positive integer", configurationWorkers),
+			"invalid number of configuration workers")
+		os.Exit(1)
+	}
+	if sshSessionLimit <= 0 {
+		setupLog.Error(fmt.Errorf("%d is not a positive integer", sshSessionLimit), "invalid SSH session limit")
+		os.Exit(1)
+	}
+	if sshDialTimeout <= 0 {
+		setupLog.Error(fmt.Errorf("%s is not a positive duration", sshDialTimeout), "invalid SSH dial timeout")
+		os.Exit(1)
+	}
+	if sshCommandTimeout <= 0 {
+		setupLog.Error(fmt.Errorf("%s is not a positive duration", sshCommandTimeout), "invalid SSH command timeout")
+		os.Exit(1)
+	}
+	if readinessFailureThreshold <= 0 {
+		setupLog.Error(fmt.Errorf("%d is not a positive integer", readinessFailureThreshold),
+			"invalid readiness failure threshold")
+		os.Exit(1)
+	}
+	if dnsSearchDomains != "" {
+		controllerOptions.DNSSearchDomains = strings.Split(dnsSearchDomains, ",")
+		if err := instances.ValidateDNSSearchDomains(controllerOptions.DNSSearchDomains); err != nil {
+			setupLog.Error(err, "invalid DNS search domains")
+			os.Exit(1)
+		}
+	}
+	if allowedCIDRs != "" {
+		networks, err := instances.ParseCIDRs(strings.Split(allowedCIDRs, ","))
+		if err != nil {
+			setupLog.Error(err, "invalid allowed CIDRs")
+			os.Exit(1)
+		}
+		controllerOptions.AllowedCIDRs = networks
+	}
+	if deniedCIDRs != "" {
+		networks, err := instances.ParseCIDRs(strings.Split(deniedCIDRs, ","))
+		if err != nil {
+			setupLog.Error(err, "invalid denied CIDRs")
+			os.Exit(1)
+		}
+		controllerOptions.DeniedCIDRs = networks
+	}
+	if bastion != "" || bastionUsername != "" || bastionSecret != "" {
+		if bastionUsername == "" {
+			setupLog.Error(fmt.Errorf("bastionUsername must be set to use a bastion"), "invalid bastion")
+			os.Exit(1)
+		}
+		controllerOptions.Bastion = &instances.Bastion{Username: bastionUsername, Secret: bastionSecret}
+		if bastion != "" {
+			address, port, err := instances.ParseBastionAddress(bastion)
+			if err != nil {
+				setupLog.Error(err, "invalid bastion")
+				os.Exit(1)
+			}
+			controllerOptions.Bastion.Address, controllerOptions.Bastion.Port = address, port
+		}
+	}
+	if hostMetadataAnnotations != "" {
+		annotations, err := instances.ParseMetadataAnnotations(hostMetadataAnnotations)
+		if err != nil {
+			setupLog.Error(err, "invalid host metadata annotations")
+			os.Exit(1)
+		}
+		controllerOptions.HostMetadataAnnotations = annotations
+	}
+
+	if notificationWebhook != "" {
+		var reasons []string
+		if notificationReasons != "" {
+			reasons = strings.Split(notificationReasons, ",")
+		}
+		webhook, err := notify.NewWebhook(notificationWebhook, reasons)
+		if err != nil {
+			setupLog.Error(err, "invalid notification webhook")
+			os.Exit(1)
+		}
+		controllerOptions.Webhook = webhook
+	}
+
 	// Get a config to talk to the apiserver
 	cfg, err := config.GetConfig()
 	if err != nil {
 		setupLog.Error(err, "failed to get the config for talking to a Kubernetes API server")
 		os.Exit(1)
 	}
+	// The rate limits apply to all the clients created from the config, including the manager's client
+	cfg.QPS = float32(apiQPS)
+	cfg.Burst = apiBurst
 
 	// get cluster configuration
 	clusterConfig, err := cluster.NewConfig(cfg)
@@ -97,6 +405,12 @@ func main() {
 		setupLog.Error(err, "failed to validate required cluster configuration")
 		os.Exit(1)
 	}
+	// validate the VXLAN port before it is configured on any Windows node
+	if controllerOptions.VXLANPort, err = cluster.ResolveVXLANPort(clusterConfig.Network().VXLANPort(),
+		vxlanPort); err != nil {
+		setupLog.Error(err, "invalid VXLAN port, set a valid port through the vxlanPort flag")
+		os.Exit(1)
+	}
 
 	// Checking if required files exist before starting the operator
 	requiredFiles := []string{
@@ -119,8 +433,13 @@ func main() {
 	}
 
 	ctx := context.TODO()
-	// Become the leader before proceeding
-	err = leader.Become(ctx, "windows-machine-config-operator-lock")
+	// Become the leader before proceeding. Operators watching the same namespace with distinct instance ConfigMaps each
+	// hold their own lock.
+	lockName := "windows-machine-config-operator-lock"
+	if instanceConfigMap != controllers.InstanceConfigMap {
+		lockName += "-" + instanceConfigMap
+	}
+	err = leader.Become(ctx, lockName)
 	if err != nil {
 		setupLog.Error(err, "failed to become a leader within current namespace")
 		os.Exit(1)
@@ -132,15 +451,28 @@ func main() {
 	//       as we need to watch Nodes. A MultiNamespacedCache cannot be used at this point as it has issues working
 	//       with cluster scoped resources. Once those issues are resolved, it may be worth switching to using that
 	//       cache type.
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
-		Scheme:             scheme,
-		MetricsBindAddress: fmt.Sprintf("%s:%d", metrics.Host, metrics.Port),
-		Port:               9443,
+	mgr, err := ctrl.NewManager(cfg, ctrl.Options{
+		Scheme:                 scheme,
+		MetricsBindAddress:     fmt.Sprintf("%s:%d", metrics.Host, metrics.Port),
+		HealthProbeBindAddress: healthProbeBindAddress,
+		Port:                   9443,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	// The checks are only served when a probe address is given, as the operator runs on the host network
+	if healthProbeBindAddress != "" {
+		if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+			setupLog.Error(err, "unable to set up the liveness check")
+			os.Exit(1)
+		}
+		if err := mgr.AddReadyzCheck("configmap-reconcile",
+			metrics.ConfigMapReconcileCheck(readinessFailureThreshold)); err != nil {
+			setupLog.Error(err, "unable to set up the readiness check")
+			os.Exit(1)
+		}
+	}
 
 	// Get the watched namespace. This is originally sourced from from the OperatorGroup associated with the CSV.
 	// Because the WMCO CSV only supports the OwnNamespace InstallMode, the watch namespace will always be the namespace
@@ -161,27 +493,39 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Setup all Controllers
-	winMachineReconciler, err := controllers.NewWindowsMachineReconciler(mgr, clusterConfig, watchNamespace)
-	if err != nil {
-		setupLog.Error(err, "unable to create Windows Machine reconciler")
-		os.Exit(1)
-	}
-	if err = winMachineReconciler.SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create Windows Machine controller")
-		os.Exit(1)
+	if controllerOptions.Webhook != nil {
+		if err := mgr.Add(controllerOptions.Webhook); err != nil {
+			setupLog.Error(err, "unable to add notification webhook to the manager")
+			os.Exit(1)
+		}
 	}
 
-	secretReconciler := controllers.NewSecretReconciler(mgr, watchNamespace)
-	if err = secretReconciler.SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create Secret controller")
-		os.Exit(1)
-	}
-	if err := secretReconciler.RemoveInvalidAnnotationsFromLinuxNodes(mgr.GetConfig()); err != nil {
-		setupLog.Error(err, "error removing invalid annotations from Linux nodes")
+	// Setup all Controllers. The nodes of Machines are only managed by the operator using the windows-instances
+	// ConfigMap, so that operators watching the same namespace with distinct ConfigMaps only manage BYOH nodes.
+	if instanceConfigMap == controllers.InstanceConfigMap {
+		winMachineReconciler, err := controllers.NewWindowsMachineReconciler(mgr, clusterConfig, watchNamespace,
+			controllerOptions)
+		if err != nil {
+			setupLog.Error(err, "unable to create Windows Machine reconciler")
+			os.Exit(1)
+		}
+		if err = winMachineReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create Windows Machine controller")
+			os.Exit(1)
+		}
+
+		secretReconciler := controllers.NewSecretReconciler(mgr, watchNamespace)
+		if err = secretReconciler.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create Secret controller")
+			os.Exit(1)
+		}
+		if err := secretReconciler.RemoveInvalidAnnotationsFromLinuxNodes(mgr.GetConfig()); err != nil {
+			setupLog.Error(err, "error removing invalid annotations from Linux nodes")
+		}
 	}
 
-	configMapReconciler, err := controllers.NewConfigMapReconciler(mgr, clusterConfig, watchNamespace)
+	configMapReconciler, err := controllers.NewConfigMapReconciler(mgr, clusterConfig, watchNamespace,
+		controllerOptions)
 	if err != nil {
 		setupLog.Error(err, "unable to create ConfigMap reconciler")
 		os.Exit(1)
@@ -191,6 +535,10 @@ func main() {
 		os.Exit(1)
 	}
 
+	if validateConfigMap {
+		controllers.NewConfigMapValidator(clusterConfig, watchNamespace, controllerOptions).SetupWithManager(mgr)
+	}
+
 	//+kubebuilder:scaffold:builder
 	// The above marker tells kubebuilder that this is where the SetupWithManager function should be inserted when new
 	// controllers are generated by Operator SDK.
@@ -211,8 +559,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	shutdownTracing, err := tracing.Setup(ctx, tracingEndpoint)
+	if err != nil {
+		setupLog.Error(err, "error setting up tracing")
+		os.Exit(1)
+	}
+
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	// Export the spans of the last reconciles before exiting
+	if err := shutdownTracing(context.Background()); err != nil {
+		setupLog.Error(err, "unable to export remaining spans")
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 
 		os.Exit(1)
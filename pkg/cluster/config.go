@@ -31,6 +31,30 @@ type Network interface {
 	Validate() error
 	GetServiceCIDR() string
 	VXLANPort() string
+	// IPFamily returns the IP family of the cluster network
+	IPFamily() IPFamily
+}
+
+// IPFamily is the IP family of the cluster network
+type IPFamily int
+
+const (
+	// IPv4 is an IPv4 single-stack cluster network
+	IPv4 IPFamily = iota
+	// IPv6 is an IPv6 single-stack cluster network
+	IPv6
+	// DualStack is a cluster network with both IPv4 and IPv6 service networks
+	DualStack
+)
+
+// SupportsIPv4 returns true if IPv4 addresses can be used on the cluster network
+func (f IPFamily) SupportsIPv4() bool {
+	return f == IPv4 || f == DualStack
+}
+
+// SupportsIPv6 returns true if IPv6 addresses can be used on the cluster network
+func (f IPFamily) SupportsIPv6() bool {
+	return f == IPv6 || f == DualStack
 }
 
 // Config interface contains methods to expose cluster config related information
@@ -41,6 +65,8 @@ type Config interface {
 	Platform() oconfig.PlatformType
 	// Network returns network configuration for the OpenShift cluster
 	Network() Network
+	// Proxy returns the cluster-wide proxy settings
+	Proxy() Proxy
 }
 
 // networkType holds information for a required network type
@@ -62,6 +88,8 @@ type config struct {
 	// platform indicates the cloud on which OpenShift cluster is running
 	// TODO: Remove this once we figure out how to be provider agnostic
 	platform oconfig.PlatformType
+	// proxy holds the cluster-wide proxy settings
+	proxy Proxy
 }
 
 func (c *config) Platform() oconfig.PlatformType {
@@ -72,6 +100,10 @@ func (c *config) Network() Network {
 	return c.network
 }
 
+func (c *config) Proxy() Proxy {
+	return c.proxy
+}
+
 // NewConfig returns a Config struct pertaining to the cluster configuration
 func NewConfig(restConfig *rest.Config) (Config, error) {
 	// get OpenShift API config client.
@@ -104,11 +136,17 @@ func NewConfig(restConfig *rest.Config) (Config, error) {
 	if len(platformStatus.Type) == 0 {
 		return nil, errors.New("error getting platform type")
 	}
+
+	proxy, err := getProxy(oclient)
+	if err != nil {
+		return nil, err
+	}
 	return &config{
 		oclient:        oclient,
 		operatorClient: operatorClient,
 		network:        network,
 		platform:       platformStatus.Type,
+		proxy:          proxy,
 	}, nil
 }
 
@@ -156,6 +194,8 @@ type clusterNetworkCfg struct {
 	serviceCIDR string
 	// vxlanPort is the port to be used for VXLAN communication
 	vxlanPort string
+	// ipFamily is the IP family of the cluster network
+	ipFamily IPFamily
 }
 
 // ovnKubernetes contains information specific to network type OVNKubernetes
@@ -187,6 +227,9 @@ func networkConfigurationFactory(oclient configclient.Interface, operatorClient
 	if err != nil {
 		return nil, errors.Wrapf(err, "error getting cluster network config")
 	}
+	if clusterNetworkCfg.ipFamily, err = getIPFamily(oclient); err != nil {
+		return nil, errors.Wrap(err, "error getting cluster IP family")
+	}
 	switch network {
 	case ovnKubernetesNetwork:
 		return &ovnKubernetes{
@@ -223,6 +266,11 @@ func (ovn *ovnKubernetes) VXLANPort() string {
 	return ovn.clusterNetworkConfig.vxlanPort
 }
 
+// IPFamily returns the IP family of the cluster network
+func (ovn *ovnKubernetes) IPFamily() IPFamily {
+	return ovn.clusterNetworkConfig.ipFamily
+}
+
 // Validate for OVN Kubernetes checks for network type and hybrid overlay.
 func (ovn *ovnKubernetes) Validate() error {
 	//check if hybrid overlay is enabled for the cluster
@@ -270,6 +318,30 @@ func getServiceNetworkCIDR(oclient configclient.Interface) (string, error) {
 	return serviceCIDR, nil
 }
 
+// getIPFamily returns the IP family of the cluster network, based on the families of the cluster service networks
+func getIPFamily(oclient configclient.Interface) (IPFamily, error) {
+	networkCR, err := oclient.ConfigV1().Networks().Get(context.TODO(), "cluster", meta.GetOptions{})
+	if err != nil {
+		return IPv4, errors.Wrap(err, "error getting cluster network object")
+	}
+	hasIPv4, hasIPv6 := false, false
+	for _, serviceNetwork := range networkCR.Spec.ServiceNetwork {
+		if IsIPv6CIDR(serviceNetwork) {
+			hasIPv6 = true
+		} else {
+			hasIPv4 = true
+		}
+	}
+	switch {
+	case hasIPv4 && hasIPv6:
+		return DualStack, nil
+	case hasIPv6:
+		return IPv6, nil
+	default:
+		return IPv4, nil
+	}
+}
+
 // getVXLANPort gets the VXLAN port to establish tunnel as a string. The return type doesn't matter as we want to pass
 // this argument to a powershell command
 func getVXLANPort(operatorClient operatorv1.OperatorV1Interface) (string, error) {
@@ -288,6 +360,46 @@ func getVXLANPort(operatorClient operatorv1.OperatorV1Interface) (string, error)
 	return "", nil
 }
 
+// reservedVXLANPorts are the ports used by the services configured on Windows nodes, which the VXLAN tunnel cannot use,
+// mapped to the name of the service using them
+var reservedVXLANPorts = map[int]string{
+	22:    "SSH",
+	9182:  "windows_exporter",
+	10250: "kubelet",
+	10256: "kube-proxy health check",
+}
+
+// ValidateVXLANPort returns an error if the given VXLAN port is not a valid port number, or is used by a service
+// configured on Windows nodes. An empty port, which results in the default VXLAN port being used, is valid.
+func ValidateVXLANPort(port string) error {
+	if port == "" {
+		return nil
+	}
+	value, err := strconv.Atoi(port)
+	if err != nil || value < 1 || value > 65535 {
+		return errors.Errorf("VXLAN port %s is not a number between 1 and 65535", port)
+	}
+	if service, reserved := reservedVXLANPorts[value]; reserved {
+		return errors.Errorf("VXLAN port %s is used by %s on Windows nodes", port, service)
+	}
+	return nil
+}
+
+// ResolveVXLANPort returns the VXLAN port to be used on Windows nodes, which is the given override if it is set, and
+// the given VXLAN port of the cluster network otherwise. An error is returned if the resulting port is invalid.
+func ResolveVXLANPort(clusterPort, override string) (string, error) {
+	port := clusterPort
+	source := "cluster network"
+	if override != "" {
+		port = override
+		source = "override"
+	}
+	if err := ValidateVXLANPort(port); err != nil {
+		return "", errors.Wrapf(err, "invalid VXLAN port from %s", source)
+	}
+	return port, nil
+}
+
 // ValidateCIDR uses the parseCIDR from network package to validate the format of the CIDR
 func ValidateCIDR(cidr string) error {
 	_, _, err := net.ParseCIDR(cidr)
@@ -296,3 +408,9 @@ func ValidateCIDR(cidr string) error {
 	}
 	return nil
 }
+
+// IsIPv6CIDR returns true if the given CIDR is a valid IPv6 CIDR
+func IsIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
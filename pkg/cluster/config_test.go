@@ -188,3 +188,104 @@ func TestGetVXLANPort(t *testing.T) {
 		})
 	}
 }
+
+// TestNetworkIPFamily checks if the IP family of the cluster network is derived from the cluster service networks
+func TestNetworkIPFamily(t *testing.T) {
+	tests := []struct {
+		name            string
+		serviceNetworks []string
+		want            IPFamily
+	}{
+		{"ipv4 single-stack", []string{"172.30.0.0/16"}, IPv4},
+		{"ipv6 single-stack", []string{"fd02::/112"}, IPv6},
+		{"dual-stack", []string{"172.30.0.0/16", "fd02::/112"}, DualStack},
+		{"ipv6 primary dual-stack", []string{"fd02::/112", "172.30.0.0/16"}, DualStack},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeConfigClient, fakeOperatorClient := createFakeClients("OVNKubernetes")
+			networkCR, err := fakeConfigClient.ConfigV1().Networks().Get(context.TODO(), "cluster", meta.GetOptions{})
+			require.NoError(t, err)
+			networkCR.Spec.ServiceNetwork = tt.serviceNetworks
+			_, err = fakeConfigClient.ConfigV1().Networks().Update(context.TODO(), networkCR, meta.UpdateOptions{})
+			require.NoError(t, err)
+
+			network, err := networkConfigurationFactory(fakeConfigClient, fakeOperatorClient)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, network.IPFamily())
+		})
+	}
+}
+
+func TestIsIPv6CIDR(t *testing.T) {
+	assert.False(t, IsIPv6CIDR("10.0.0.0/16"))
+	assert.True(t, IsIPv6CIDR("fd02::/112"))
+	assert.False(t, IsIPv6CIDR("fd02::"))
+}
+
+func TestIPFamilySupport(t *testing.T) {
+	assert.True(t, IPv4.SupportsIPv4())
+	assert.False(t, IPv4.SupportsIPv6())
+	assert.False(t, IPv6.SupportsIPv4())
+	assert.True(t, IPv6.SupportsIPv6())
+	assert.True(t, DualStack.SupportsIPv4())
+	assert.True(t, DualStack.SupportsIPv6())
+}
+
+// TestValidateVXLANPort tests that only port numbers which are not used by the services of Windows nodes are valid
+func TestValidateVXLANPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    string
+		wantErr bool
+	}{
+		{"default", "", false},
+		{"custom", "4800", false},
+		{"highest port", "65535", false},
+		{"zero", "0", true},
+		{"out of range", "65536", true},
+		{"negative", "-1", true},
+		{"not a number", "vxlan", true},
+		{"SSH port", "22", true},
+		{"kubelet port", "10250", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateVXLANPort(tt.port)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestResolveVXLANPort tests that the VXLAN port override takes precedence over the port of the cluster network
+func TestResolveVXLANPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		clusterPort string
+		override    string
+		want        string
+		wantErr     bool
+	}{
+		{name: "cluster default", clusterPort: "", want: ""},
+		{name: "cluster port", clusterPort: "4800", want: "4800"},
+		{name: "override", clusterPort: "4800", override: "4900", want: "4900"},
+		{name: "override of reserved cluster port", clusterPort: "9182", override: "4900", want: "4900"},
+		{name: "reserved cluster port", clusterPort: "9182", wantErr: true},
+		{name: "out of range override", clusterPort: "4800", override: "70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveVXLANPort(tt.clusterPort, tt.override)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
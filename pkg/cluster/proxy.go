@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+
+	configclient "github.com/openshift/client-go/config/clientset/versioned"
+	"github.com/pkg/errors"
+	k8sapierrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+//+kubebuilder:rbac:groups=config.openshift.io,resources=proxies,verbs=get
+
+// privateNetworks are the address ranges which are never reached through the proxy, as they are not routable through
+// the public internet
+var privateNetworks = mustParseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8",
+	"169.254.0.0/16", "fc00::/7", "::1/128", "fe80::/10")
+
+// Proxy holds the cluster-wide proxy settings, as set by the status of the cluster Proxy resource
+type Proxy struct {
+	// HTTPProxy is the URL of the proxy for HTTP requests
+	HTTPProxy string
+	// HTTPSProxy is the URL of the proxy for HTTPS requests
+	HTTPSProxy string
+	// NoProxy is a comma separated list of hostnames, domains, IP addresses and CIDRs which are reached directly
+	NoProxy string
+}
+
+// getProxy returns the cluster-wide proxy settings. The settings are empty if the cluster has no Proxy resource.
+func getProxy(oclient configclient.Interface) (Proxy, error) {
+	proxy, err := oclient.ConfigV1().Proxies().Get(context.TODO(), "cluster", meta.GetOptions{})
+	if err != nil {
+		if k8sapierrors.IsNotFound(err) {
+			return Proxy{}, nil
+		}
+		return Proxy{}, errors.Wrap(err, "error getting cluster proxy")
+	}
+	return Proxy{HTTPProxy: proxy.Status.HTTPProxy, HTTPSProxy: proxy.Status.HTTPSProxy,
+		NoProxy: proxy.Status.NoProxy}, nil
+}
+
+// URLFor returns the URL of the proxy that connections to the given host, which is a DNS name or an IP address, should
+// be tunneled through. Connections are tunneled through the HTTPS proxy, falling back to the HTTP proxy if it is not
+// set. nil is returned if the host should be connected to directly, which is the case if no proxy is set, or if the
+// host matches NoProxy or is an IP address within a private range.
+func (p Proxy) URLFor(host string) (*url.URL, error) {
+	proxy := p.HTTPSProxy
+	if proxy == "" {
+		proxy = p.HTTPProxy
+	}
+	if proxy == "" || p.bypasses(host) {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid proxy URL %s", proxy)
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.Errorf("invalid proxy URL %s: missing host", proxy)
+	}
+	return proxyURL, nil
+}
+
+// bypasses returns true if the given host should not be reached through the proxy. The NoProxy entries follow the
+// usual NO_PROXY conventions: "*" matches all hosts, an IP address or CIDR matches the IP addresses it covers, and a
+// domain matches itself and its subdomains, with or without a leading dot.
+func (p Proxy) bypasses(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	if ip != nil {
+		for _, network := range privateNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	} else if host == "localhost" {
+		return true
+	}
+	for _, entry := range strings.Split(p.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		// Ports are not relevant, as the proxy is used for a single port
+		if entryHost, _, err := net.SplitHostPort(entry); err == nil {
+			entry = entryHost
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if entryIP := net.ParseIP(entry); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(strings.TrimSuffix(entry, "."), ".")
+		if ip == nil && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mustParseCIDRs returns the networks described by the given CIDRs, panicking if any of them is invalid
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
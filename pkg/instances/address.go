@@ -0,0 +1,43 @@
+package instances
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// zonePattern matches the name or index of a network interface used as the zone of an IPv6 address
+var zonePattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// SplitZone splits the given address into the address and the zone following it, such as the eth0 interface of the
+// scoped address fe80::1%eth0. The zone is empty if the address does not have one.
+func SplitZone(address string) (string, string) {
+	if i := strings.LastIndexByte(address, '%'); i >= 0 {
+		return address[:i], address[i+1:]
+	}
+	return address, ""
+}
+
+// ParseScopedIP parses the given address as an IP address, which may be followed by a zone naming the network
+// interface of the operator host the address is reached through, such as fe80::1%eth0. The IP address is returned
+// without its zone, and is nil if the address is not an IP address. A zone is only accepted for an IPv6 link-local
+// address, as connections to other addresses do not use the zone.
+func ParseScopedIP(address string) (net.IP, string, error) {
+	host, zone := SplitZone(address)
+	ip := net.ParseIP(host)
+	if host == address {
+		return ip, "", nil
+	}
+	if ip == nil {
+		return nil, "", errors.Errorf("zone %s can only be given for an IP address", zone)
+	}
+	if !zonePattern.MatchString(zone) {
+		return nil, "", errors.Errorf("invalid zone %q, expected the name or index of a network interface", zone)
+	}
+	if ip.To4() != nil || !ip.IsLinkLocalUnicast() {
+		return nil, "", errors.Errorf("zone %s can only be given for an IPv6 link-local address", zone)
+	}
+	return ip, zone, nil
+}
@@ -0,0 +1,74 @@
+package instances
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// defaultBastionPort is the port the SSH server of a bastion listens on if none is given
+const defaultBastionPort = 22
+
+// Bastion describes a jump host SSH connections to instances on a private network are tunneled through
+type Bastion struct {
+	// Address is the DNS name or IP address of the bastion
+	Address string
+	// Port is the port the SSH server of the bastion listens on. A value of 0 results in port 22 being used.
+	Port int
+	// Username is the user to log into the bastion as
+	Username string
+	// Secret is the name of the secret in the operator namespace holding the private key used to authenticate against
+	// the bastion. The private key secret is used if it is empty.
+	Secret string
+	// Signer is created from the private key held by Secret, and is set before connecting to the bastion
+	Signer ssh.Signer
+}
+
+// HostPort returns the address and port the SSH server of the bastion is reached at, as <address>:<port>
+func (b *Bastion) HostPort() string {
+	port := b.Port
+	if port == 0 {
+		port = defaultBastionPort
+	}
+	return net.JoinHostPort(b.Address, strconv.Itoa(port))
+}
+
+// WithAddress returns a copy of the bastion reached at the given <address>[:<port>] instead, using the same credentials
+func (b *Bastion) WithAddress(value string) (*Bastion, error) {
+	address, port, err := ParseBastionAddress(value)
+	if err != nil {
+		return nil, err
+	}
+	bastion := *b
+	bastion.Address, bastion.Port = address, port
+	return &bastion, nil
+}
+
+// ParseBastionAddress returns the address and port given by the <address>[:<port>] value of a bastion. The returned
+// port is 0 if no port is given.
+func ParseBastionAddress(value string) (string, int, error) {
+	address, port := value, 0
+	if host, portValue, err := net.SplitHostPort(value); err == nil {
+		address = host
+		port, err = strconv.Atoi(portValue)
+		if err != nil {
+			return "", 0, errors.Wrapf(err, "invalid bastion port %s", portValue)
+		}
+		if errs := validation.IsValidPortNum(port); len(errs) != 0 {
+			return "", 0, errors.Errorf("invalid bastion port %d: %s", port, strings.Join(errs, ", "))
+		}
+	}
+	if address == "" {
+		return "", 0, errors.New("bastion address cannot be empty")
+	}
+	if net.ParseIP(address) == nil {
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(address)); len(errs) != 0 {
+			return "", 0, errors.Errorf("invalid bastion address %s: %s", address, strings.Join(errs, ", "))
+		}
+	}
+	return address, port, nil
+}
@@ -1,14 +1,374 @@
 package instances
 
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
 // InstanceInfo represents a host that is meant to be joined to the cluster
 type InstanceInfo struct {
 	Address     string
 	Username    string
 	NewHostname string
+	// KubeletConfig holds the kubelet settings that should be applied to the instance
+	KubeletConfig KubeletConfig
+	// DNSSearchDomains are the DNS search domains that should be set on the instance, and are appended to the cluster
+	// search domains for pods running on it
+	DNSSearchDomains []string
+	// ResolvedIPs are the IP addresses the DNS name in Address resolved to when the instance was described, which the
+	// node associated with the instance can be reached at. It is empty if Address is an IP address, or if the DNS name
+	// was not resolved.
+	ResolvedIPs []net.IP
+	// SSHPort is the port the SSH server of the instance listens on. A value of 0 results in the default port 22 being
+	// used.
+	SSHPort int
+	// SSHSessionLimit is the maximum number of concurrent SSH sessions to the instance while it is being configured. A
+	// value of 0 results in the default limit being used.
+	SSHSessionLimit int
+	// SSHDialTimeout is the maximum duration of a single attempt to connect to the SSH server of the instance. A value
+	// of 0 results in the default timeout being used.
+	SSHDialTimeout time.Duration
+	// SSHCommandTimeout is the maximum duration of a command run on the instance, or of a file transfer to it. A value
+	// of 0 results in the default timeout being used.
+	SSHCommandTimeout time.Duration
+	// MinOSVersion is the minimum version of Windows, such as 10.0.17763, the instance must be running to be
+	// configured. The version is not checked if it is empty.
+	MinOSVersion string
+	// MetadataAnnotations are the node annotations whose values are sourced from commands run on the instance. A
+	// command which fails does not prevent the instance from being configured.
+	MetadataAnnotations []MetadataAnnotation
+	// SSHProxy is the URL of the proxy SSH connections to the instance are tunneled through. The instance is connected
+	// to directly if it is nil. If Bastion is set, the proxy is used to reach the bastion instead.
+	SSHProxy *url.URL
+	// Bastion is the jump host SSH connections to the instance are tunneled through. The instance is connected to
+	// directly if it is nil.
+	Bastion *Bastion
+	// BootstrapKubeconfigSecret is the name of the secret in the operator namespace holding the kubeconfig the
+	// instance should bootstrap the kubelet with. The kubeconfig from the worker ignition is used if it is empty.
+	BootstrapKubeconfigSecret string
+	// BootstrapKubeconfig is the content of BootstrapKubeconfigSecret
+	BootstrapKubeconfig []byte
+	// AuthSecret is the name of the secret in the operator namespace holding the password used to authenticate against
+	// the instance, when key based authentication is not possible
+	AuthSecret string
+	// Password is the content of AuthSecret
+	Password string
+	// CredentialSecret is the name of the secret in the operator namespace holding the private key used to
+	// authenticate against the instance. The private key secret shared by all instances is used if it is empty.
+	CredentialSecret string
+	// TopologyLabels are the topology labels that should be applied to the node associated with the instance, keyed
+	// by the label name
+	TopologyLabels map[string]string
+	// Labels are the custom labels that should be applied to the node associated with the instance, keyed by the label
+	// name
+	Labels map[string]string
+	// Taints are the taints that should be applied to the node associated with the instance
+	Taints []core.Taint
+	// ServiceCIDR is the CIDR the CNI configuration of the instance routes through the overlay network and excludes from
+	// outbound NAT, instead of the cluster service CIDR. The cluster service CIDR is used if it is empty.
+	ServiceCIDR string
+	// NATExceptions are the CIDRs excluded from outbound NAT by the CNI configuration of the instance in addition to the
+	// service CIDR, such as a local subnet the instance must be reached from without its traffic being translated
+	NATExceptions []string
 }
 
+// KubeletConfig holds the kubelet settings that WMCO applies on top of the kubelet configuration generated by WMCB.
+// A zero value for any of the fields results in the kubelet default being used. The shutdown grace periods are only
+// applied when they are set, so that a zero grace period can be set to disable graceful node shutdown.
+//
+// As of Kubernetes 1.21, graceful node shutdown is only implemented by the kubelet on Linux, so the shutdown grace
+// periods are written to the kubelet configuration of Windows nodes but have no effect on them.
+type KubeletConfig struct {
+	// ShutdownGracePeriod is the total duration that the node should delay its shutdown by, to allow pods to be
+	// gracefully terminated
+	ShutdownGracePeriod *time.Duration `json:"shutdownGracePeriod,omitempty"`
+	// ShutdownGracePeriodCriticalPods is the portion of ShutdownGracePeriod reserved for terminating critical pods
+	ShutdownGracePeriodCriticalPods *time.Duration `json:"shutdownGracePeriodCriticalPods,omitempty"`
+	// FeatureGates holds additional kubelet feature gates, keyed by the feature gate name
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+	// ImageGCHighThresholdPercent is the percent of disk usage after which image garbage collection is always run
+	ImageGCHighThresholdPercent int32 `json:"imageGCHighThresholdPercent,omitempty"`
+	// ImageGCLowThresholdPercent is the percent of disk usage before which image garbage collection is never run
+	ImageGCLowThresholdPercent int32 `json:"imageGCLowThresholdPercent,omitempty"`
+}
+
+const (
+	// defaultImageGCHighThresholdPercent is the kubelet default for ImageGCHighThresholdPercent
+	defaultImageGCHighThresholdPercent = 85
+	// defaultImageGCLowThresholdPercent is the kubelet default for ImageGCLowThresholdPercent
+	defaultImageGCLowThresholdPercent = 80
+)
+
+// RequiredFeatureGates are the kubelet feature gates set by WMCB, which cannot be changed through FeatureGates
+var RequiredFeatureGates = map[string]bool{
+	"RotateKubeletServerCertificate": true,
+}
+
+// featureGateNameRegex matches valid feature gate names, which are in CamelCase
+var featureGateNameRegex = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+
 // NewInstanceInfo returns a new instanceInfo. newHostname being set means that the instance's hostname should be
 // changed. An empty value is a no-op.
 func NewInstanceInfo(address, username, newHostname string) *InstanceInfo {
 	return &InstanceInfo{Address: address, Username: username, NewHostname: newHostname}
 }
+
+// ConfigHash returns a hash of the instance specific configuration that is applied when the instance is configured.
+// An empty string is returned if the instance has no specific configuration.
+func (i *InstanceInfo) ConfigHash() (string, error) {
+	bastion := ""
+	if i.Bastion != nil {
+		bastion = i.Bastion.HostPort()
+	}
+	if len(i.KubeletConfig.Overrides()) == 0 && len(i.DNSSearchDomains) == 0 && i.SSHPort == 0 && i.AuthSecret == "" &&
+		i.CredentialSecret == "" && bastion == "" && i.ServiceCIDR == "" && len(i.NATExceptions) == 0 {
+		return "", nil
+	}
+	// The kubelet settings are embedded so that the hash of instances without DNS search domains, an SSH port, an
+	// auth secret, a credential secret, a bastion or network overrides is not changed by their addition. The SSH port,
+	// secrets and bastion are included so that the node is annotated with the new values if they change.
+	data, err := json.Marshal(struct {
+		KubeletConfig
+		DNSSearchDomains []string `json:"dnsSearchDomains,omitempty"`
+		SSHPort          int      `json:"sshPort,omitempty"`
+		AuthSecret       string   `json:"authSecret,omitempty"`
+		CredentialSecret string   `json:"credentialSecret,omitempty"`
+		Bastion          string   `json:"bastion,omitempty"`
+		ServiceCIDR      string   `json:"serviceCIDR,omitempty"`
+		NATExceptions    []string `json:"natExceptions,omitempty"`
+	}{i.KubeletConfig, i.DNSSearchDomains, i.SSHPort, i.AuthSecret, i.CredentialSecret, bastion, i.ServiceCIDR,
+		i.NATExceptions})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to marshal instance configuration")
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// invalidUsernameCharacters are the characters which cannot be used in the name of a Windows account
+const invalidUsernameCharacters = `"/[]:;|=,+*?<>`
+
+// ValidateUsername returns an error if the given username is not a valid Windows account name. Domain accounts can be
+// given as <domain>\<user> or <user>@<domain>, and spaces are allowed within the name.
+func ValidateUsername(username string) error {
+	if strings.TrimSpace(username) == "" {
+		return errors.New("username cannot be empty")
+	}
+	for _, r := range username {
+		if unicode.IsControl(r) {
+			return errors.Errorf("username %q cannot contain control characters", username)
+		}
+	}
+	if i := strings.IndexAny(username, invalidUsernameCharacters); i != -1 {
+		return errors.Errorf("username %q cannot contain %q", username, username[i])
+	}
+	user := username
+	if splitUsername := strings.Split(username, `\`); len(splitUsername) > 2 {
+		return errors.Errorf("username %q cannot contain more than one domain separator", username)
+	} else if len(splitUsername) == 2 {
+		if splitUsername[0] == "" || splitUsername[1] == "" {
+			return errors.Errorf("username %q must be formatted as <domain>\\<user>", username)
+		}
+		user = splitUsername[1]
+	}
+	if strings.Trim(user, ". ") == "" {
+		return errors.Errorf("username %q cannot consist only of periods and spaces", username)
+	}
+	return nil
+}
+
+// ValidateDNSSearchDomains returns an error if any of the given DNS search domains is not a valid DNS subdomain
+func ValidateDNSSearchDomains(domains []string) error {
+	for _, domain := range domains {
+		if errs := validation.IsDNS1123Subdomain(domain); len(errs) != 0 {
+			return errors.Errorf("invalid DNS search domain %s: %s", domain, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// ParseCIDRs returns the networks described by the given CIDRs, or an error if any of them is invalid
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid CIDR %s", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// TopologyLabelKeys are the node labels which can be set through TopologyLabels
+var TopologyLabelKeys = []string{core.LabelTopologyZone, core.LabelTopologyRegion}
+
+// ValidateTopologyLabels returns an error if any of the given labels is not a topology label, or has an invalid value
+func ValidateTopologyLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !isTopologyLabelKey(key) {
+			return errors.Errorf("%s is not a topology label, expected one of %s", key,
+				strings.Join(TopologyLabelKeys, ", "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+			return errors.Errorf("invalid value for label %s: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// reservedLabelDomains are the label domains reserved for Kubernetes, which cannot be used by Labels
+var reservedLabelDomains = []string{"kubernetes.io", "k8s.io"}
+
+// ValidateLabels returns an error if any of the given labels has an invalid key or value, or uses a reserved key
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if errs := validation.IsQualifiedName(key); len(errs) != 0 {
+			return errors.Errorf("invalid label %s: %s", key, strings.Join(errs, ", "))
+		}
+		if isTopologyLabelKey(key) {
+			return errors.Errorf("topology label %s must be set through topologyLabels", key)
+		}
+		if isReservedLabelKey(key) {
+			return errors.Errorf("label %s uses a domain reserved for Kubernetes", key)
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) != 0 {
+			return errors.Errorf("invalid value for label %s: %s", key, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// ValidateTaints returns an error if any of the given taints has an invalid key, value or effect, or if multiple taints
+// have the same key and effect
+func ValidateTaints(taints []core.Taint) error {
+	seen := make(map[string]struct{}, len(taints))
+	for _, taint := range taints {
+		if errs := validation.IsQualifiedName(taint.Key); len(errs) != 0 {
+			return errors.Errorf("invalid taint key %s: %s", taint.Key, strings.Join(errs, ", "))
+		}
+		if errs := validation.IsValidLabelValue(taint.Value); len(errs) != 0 {
+			return errors.Errorf("invalid value for taint %s: %s", taint.Key, strings.Join(errs, ", "))
+		}
+		switch taint.Effect {
+		case core.TaintEffectNoSchedule, core.TaintEffectPreferNoSchedule, core.TaintEffectNoExecute:
+		default:
+			return errors.Errorf("invalid effect %q for taint %s, expected one of %s, %s or %s", taint.Effect,
+				taint.Key, core.TaintEffectNoSchedule, core.TaintEffectPreferNoSchedule, core.TaintEffectNoExecute)
+		}
+		id := taint.Key + ":" + string(taint.Effect)
+		if _, present := seen[id]; present {
+			return errors.Errorf("duplicate taint %s", id)
+		}
+		seen[id] = struct{}{}
+	}
+	return nil
+}
+
+// isReservedLabelKey returns true if the prefix of the given label key is one of reservedLabelDomains, or a subdomain
+// of one of them
+func isReservedLabelKey(key string) bool {
+	splitKey := strings.SplitN(key, "/", 2)
+	if len(splitKey) != 2 {
+		return false
+	}
+	for _, domain := range reservedLabelDomains {
+		if splitKey[0] == domain || strings.HasSuffix(splitKey[0], "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTopologyLabelKey returns true if the given label key is one of TopologyLabelKeys
+func isTopologyLabelKey(key string) bool {
+	for _, topologyKey := range TopologyLabelKeys {
+		if key == topologyKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate returns an error if the kubelet settings are not valid
+func (k KubeletConfig) Validate() error {
+	// Unset grace periods are compared using the kubelet default, which disables graceful node shutdown
+	gracePeriod, criticalPodsGracePeriod := durationValue(k.ShutdownGracePeriod),
+		durationValue(k.ShutdownGracePeriodCriticalPods)
+	if gracePeriod < 0 {
+		return errors.Errorf("shutdown grace period %s cannot be negative", gracePeriod)
+	}
+	if criticalPodsGracePeriod < 0 {
+		return errors.Errorf("critical pods shutdown grace period %s cannot be negative", criticalPodsGracePeriod)
+	}
+	if criticalPodsGracePeriod > gracePeriod {
+		return errors.Errorf("critical pods shutdown grace period %s cannot be greater than the shutdown grace "+
+			"period %s", criticalPodsGracePeriod, gracePeriod)
+	}
+	if k.ImageGCHighThresholdPercent < 0 || k.ImageGCHighThresholdPercent > 100 {
+		return errors.Errorf("image GC high threshold %d%% must be between 0 and 100", k.ImageGCHighThresholdPercent)
+	}
+	if k.ImageGCLowThresholdPercent < 0 || k.ImageGCLowThresholdPercent > 100 {
+		return errors.Errorf("image GC low threshold %d%% must be between 0 and 100", k.ImageGCLowThresholdPercent)
+	}
+	// Unset thresholds are compared using the kubelet defaults
+	high, low := k.ImageGCHighThresholdPercent, k.ImageGCLowThresholdPercent
+	if high == 0 {
+		high = defaultImageGCHighThresholdPercent
+	}
+	if low == 0 {
+		low = defaultImageGCLowThresholdPercent
+	}
+	if high <= low {
+		return errors.Errorf("image GC high threshold %d%% must be greater than the low threshold %d%%", high, low)
+	}
+	for name, enabled := range k.FeatureGates {
+		if !featureGateNameRegex.MatchString(name) {
+			return errors.Errorf("invalid feature gate name %s", name)
+		}
+		if required, present := RequiredFeatureGates[name]; present && required != enabled {
+			return errors.Errorf("feature gate %s is required to be set to %t", name, required)
+		}
+	}
+	return nil
+}
+
+// durationValue returns the duration the given pointer refers to, or 0 if it is nil
+func durationValue(d *time.Duration) time.Duration {
+	if d == nil {
+		return 0
+	}
+	return *d
+}
+
+// Overrides returns the kubelet configuration fields that need to be set on the instance, keyed by their name within
+// the KubeletConfiguration object
+func (k KubeletConfig) Overrides() map[string]interface{} {
+	overrides := make(map[string]interface{})
+	if k.ShutdownGracePeriod != nil {
+		overrides["shutdownGracePeriod"] = k.ShutdownGracePeriod.String()
+	}
+	if k.ShutdownGracePeriodCriticalPods != nil {
+		overrides["shutdownGracePeriodCriticalPods"] = k.ShutdownGracePeriodCriticalPods.String()
+	}
+	if len(k.FeatureGates) != 0 {
+		overrides["featureGates"] = k.FeatureGates
+	}
+	if k.ImageGCHighThresholdPercent != 0 {
+		overrides["imageGCHighThresholdPercent"] = k.ImageGCHighThresholdPercent
+	}
+	if k.ImageGCLowThresholdPercent != 0 {
+		overrides["imageGCLowThresholdPercent"] = k.ImageGCLowThresholdPercent
+	}
+	return overrides
+}
@@ -0,0 +1,237 @@
+package instances
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+)
+
+// TestConfigHash tests that instances without instance specific configuration have no configuration hash, and that
+// the hash of an instance only depends on the settings it sets, so that adding a setting does not cause instances
+// which do not use it to be configured again
+func TestConfigHash(t *testing.T) {
+	minute := time.Minute
+	testCases := []struct {
+		name     string
+		instance *InstanceInfo
+		// expectedData is the JSON document the hash is expected to be computed from, empty if no hash is expected
+		expectedData string
+	}{
+		{
+			name: "no overrides",
+			instance: &InstanceInfo{Address: "10.0.0.1", Username: "core", SSHSessionLimit: 5,
+				SSHDialTimeout: time.Second, SSHCommandTimeout: time.Minute, MinOSVersion: "10.0.17763"},
+		},
+		{
+			name:         "kubelet setting",
+			instance:     &InstanceInfo{Username: "core", KubeletConfig: KubeletConfig{ShutdownGracePeriod: &minute}},
+			expectedData: `{"shutdownGracePeriod":60000000000}`,
+		},
+		{
+			name:         "image GC thresholds",
+			instance:     &InstanceInfo{KubeletConfig: KubeletConfig{ImageGCHighThresholdPercent: 90}},
+			expectedData: `{"imageGCHighThresholdPercent":90}`,
+		},
+		{
+			name:         "SSH port",
+			instance:     &InstanceInfo{SSHPort: 2222},
+			expectedData: `{"sshPort":2222}`,
+		},
+		{
+			name:         "bastion",
+			instance:     &InstanceInfo{Bastion: &Bastion{Address: "bastion.example.com", Port: 2222}},
+			expectedData: `{"bastion":"bastion.example.com:2222"}`,
+		},
+		{
+			name:         "service CIDR and NAT exceptions",
+			instance:     &InstanceInfo{ServiceCIDR: "10.96.0.0/12", NATExceptions: []string{"192.168.0.0/24"}},
+			expectedData: `{"serviceCIDR":"10.96.0.0/12","natExceptions":["192.168.0.0/24"]}`,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			hash, err := test.instance.ConfigHash()
+			require.NoError(t, err)
+			if test.expectedData == "" {
+				assert.Empty(t, hash)
+				return
+			}
+			assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte(test.expectedData))), hash)
+		})
+	}
+}
+
+// TestConfigHashZeroGracePeriod tests that explicitly disabling graceful node shutdown is part of the configuration
+// hash, while leaving it unset is not
+func TestConfigHashZeroGracePeriod(t *testing.T) {
+	var zero time.Duration
+	unset, err := (&InstanceInfo{}).ConfigHash()
+	require.NoError(t, err)
+	disabled, err := (&InstanceInfo{KubeletConfig: KubeletConfig{ShutdownGracePeriod: &zero}}).ConfigHash()
+	require.NoError(t, err)
+	assert.Empty(t, unset)
+	assert.NotEmpty(t, disabled)
+}
+
+func TestKubeletConfigValidate(t *testing.T) {
+	minute := time.Minute
+	halfMinute := 30 * time.Second
+	negative := -time.Second
+	testCases := []struct {
+		name        string
+		config      KubeletConfig
+		expectedErr bool
+	}{
+		{name: "empty", config: KubeletConfig{}},
+		{name: "grace periods", config: KubeletConfig{ShutdownGracePeriod: &minute,
+			ShutdownGracePeriodCriticalPods: &halfMinute}},
+		{name: "critical pods grace period equal to grace period", config: KubeletConfig{ShutdownGracePeriod: &minute,
+			ShutdownGracePeriodCriticalPods: &minute}},
+		{name: "critical pods grace period greater than grace period", config: KubeletConfig{
+			ShutdownGracePeriod: &halfMinute, ShutdownGracePeriodCriticalPods: &minute}, expectedErr: true},
+		{name: "critical pods grace period without grace period",
+			config: KubeletConfig{ShutdownGracePeriodCriticalPods: &halfMinute}, expectedErr: true},
+		{name: "negative grace period", config: KubeletConfig{ShutdownGracePeriod: &negative}, expectedErr: true},
+		{name: "high threshold at upper bound", config: KubeletConfig{ImageGCHighThresholdPercent: 100}},
+		{name: "high threshold above upper bound", config: KubeletConfig{ImageGCHighThresholdPercent: 101},
+			expectedErr: true},
+		{name: "negative high threshold", config: KubeletConfig{ImageGCHighThresholdPercent: -1}, expectedErr: true},
+		{name: "low threshold above upper bound", config: KubeletConfig{ImageGCHighThresholdPercent: 100,
+			ImageGCLowThresholdPercent: 101}, expectedErr: true},
+		{name: "negative low threshold", config: KubeletConfig{ImageGCLowThresholdPercent: -1}, expectedErr: true},
+		{name: "high threshold just above default low threshold",
+			config: KubeletConfig{ImageGCHighThresholdPercent: defaultImageGCLowThresholdPercent + 1}},
+		{name: "high threshold equal to default low threshold",
+			config: KubeletConfig{ImageGCHighThresholdPercent: defaultImageGCLowThresholdPercent}, expectedErr: true},
+		{name: "low threshold just below default high threshold",
+			config: KubeletConfig{ImageGCLowThresholdPercent: defaultImageGCHighThresholdPercent - 1}},
+		{name: "low threshold equal to default high threshold",
+			config: KubeletConfig{ImageGCLowThresholdPercent: defaultImageGCHighThresholdPercent}, expectedErr: true},
+		{name: "both thresholds at upper bound", config: KubeletConfig{ImageGCHighThresholdPercent: 100,
+			ImageGCLowThresholdPercent: 100}, expectedErr: true},
+		{name: "both thresholds set", config: KubeletConfig{ImageGCHighThresholdPercent: 100,
+			ImageGCLowThresholdPercent: 99}},
+		{name: "feature gate", config: KubeletConfig{FeatureGates: map[string]bool{"ExpandCSIVolumes": false}}},
+		{name: "invalid feature gate name", config: KubeletConfig{FeatureGates: map[string]bool{"expand-csi": true}},
+			expectedErr: true},
+		{name: "required feature gate disabled",
+			config:      KubeletConfig{FeatureGates: map[string]bool{"RotateKubeletServerCertificate": false}},
+			expectedErr: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	testCases := []struct {
+		username    string
+		expectedErr bool
+	}{
+		{username: "core"},
+		{username: "Windows Admin"},
+		{username: `CORP\core`},
+		{username: "core@corp.example.com"},
+		{username: "core.admin"},
+		{username: "", expectedErr: true},
+		{username: "   ", expectedErr: true},
+		{username: "co\tre", expectedErr: true},
+		{username: "core/admin", expectedErr: true},
+		{username: "core,admin", expectedErr: true},
+		{username: "core=admin", expectedErr: true},
+		{username: `CORP\EU\core`, expectedErr: true},
+		{username: `\core`, expectedErr: true},
+		{username: `CORP\`, expectedErr: true},
+		{username: "...", expectedErr: true},
+		{username: `CORP\. .`, expectedErr: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.username, func(t *testing.T) {
+			err := ValidateUsername(test.username)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	testCases := []struct {
+		name        string
+		labels      map[string]string
+		expectedErr bool
+	}{
+		{name: "none", labels: nil},
+		{name: "prefixed key", labels: map[string]string{"example.com/role": "web"}},
+		{name: "empty value", labels: map[string]string{"role": ""}},
+		{name: "domain ending with a reserved domain name", labels: map[string]string{"notkubernetes.io/role": "web"}},
+		{name: "invalid key", labels: map[string]string{"-role": "web"}, expectedErr: true},
+		{name: "invalid value", labels: map[string]string{"role": "web server"}, expectedErr: true},
+		{name: "value too long", labels: map[string]string{"role": strings.Repeat("a", 64)}, expectedErr: true},
+		{name: "topology label", labels: map[string]string{core.LabelTopologyZone: "us-east-1a"}, expectedErr: true},
+		{name: "reserved domain", labels: map[string]string{"kubernetes.io/role": "web"}, expectedErr: true},
+		{name: "reserved subdomain", labels: map[string]string{"node-role.kubernetes.io/web": ""}, expectedErr: true},
+		{name: "reserved k8s.io subdomain", labels: map[string]string{"x.k8s.io/role": "web"}, expectedErr: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateLabels(test.labels)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidateTaints(t *testing.T) {
+	testCases := []struct {
+		name        string
+		taints      []core.Taint
+		expectedErr bool
+	}{
+		{name: "none", taints: nil},
+		{name: "valid", taints: []core.Taint{{Key: "example.com/dedicated", Value: "gpu",
+			Effect: core.TaintEffectNoSchedule}}},
+		{name: "without value", taints: []core.Taint{{Key: "dedicated", Effect: core.TaintEffectNoExecute}}},
+		{name: "same key with different effects", taints: []core.Taint{
+			{Key: "dedicated", Value: "gpu", Effect: core.TaintEffectNoSchedule},
+			{Key: "dedicated", Value: "gpu", Effect: core.TaintEffectPreferNoSchedule}}},
+		{name: "same key and effect", taints: []core.Taint{
+			{Key: "dedicated", Value: "gpu", Effect: core.TaintEffectNoSchedule},
+			{Key: "dedicated", Value: "cpu", Effect: core.TaintEffectNoSchedule}}, expectedErr: true},
+		{name: "missing effect", taints: []core.Taint{{Key: "dedicated", Value: "gpu"}}, expectedErr: true},
+		{name: "invalid effect", taints: []core.Taint{{Key: "dedicated", Effect: "NoEvict"}}, expectedErr: true},
+		{name: "invalid key", taints: []core.Taint{{Key: "dedicated/", Effect: core.TaintEffectNoSchedule}},
+			expectedErr: true},
+		{name: "empty key", taints: []core.Taint{{Effect: core.TaintEffectNoSchedule}}, expectedErr: true},
+		{name: "invalid value", taints: []core.Taint{{Key: "dedicated", Value: "gpu;cpu",
+			Effect: core.TaintEffectNoSchedule}}, expectedErr: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			err := ValidateTaints(test.taints)
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package instances
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// MetadataAnnotation describes a node annotation whose value is sourced from the output of a command run on the
+// instance, such as its serial number or asset tag
+type MetadataAnnotation struct {
+	// Annotation is the key of the node annotation
+	Annotation string `json:"annotation"`
+	// Command is the PowerShell command run on the instance
+	Command string `json:"command"`
+	// Template renders the annotation value from the output of the command, available as {{.Output}} with surrounding
+	// whitespace removed. The output is used as is if it is empty.
+	Template string `json:"template,omitempty"`
+	// template is the parsed Template
+	template *template.Template
+}
+
+// metadataTemplateData is the data the template of a MetadataAnnotation is rendered with
+type metadataTemplateData struct {
+	// Output is the output of the command, with surrounding whitespace removed
+	Output string
+}
+
+// ParseMetadataAnnotations returns the MetadataAnnotations described by the given JSON list, returning an error if
+// any of them is invalid. An empty string describes no annotations.
+func ParseMetadataAnnotations(value string) ([]MetadataAnnotation, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	var annotations []MetadataAnnotation
+	if err := json.Unmarshal([]byte(value), &annotations); err != nil {
+		return nil, errors.Wrap(err, "expected a JSON list of objects with annotation, command and template fields")
+	}
+	seen := make(map[string]struct{}, len(annotations))
+	for i := range annotations {
+		annotation := &annotations[i]
+		if errs := validation.IsQualifiedName(annotation.Annotation); len(errs) != 0 {
+			return nil, errors.Errorf("invalid annotation %q: %s", annotation.Annotation, strings.Join(errs, ", "))
+		}
+		if _, present := seen[annotation.Annotation]; present {
+			return nil, errors.Errorf("duplicate annotation %s", annotation.Annotation)
+		}
+		seen[annotation.Annotation] = struct{}{}
+		if strings.TrimSpace(annotation.Command) == "" {
+			return nil, errors.Errorf("missing command for annotation %s", annotation.Annotation)
+		}
+		if annotation.Template == "" {
+			continue
+		}
+		var err error
+		annotation.template, err = template.New(annotation.Annotation).Option("missingkey=error").
+			Parse(annotation.Template)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid template for annotation %s", annotation.Annotation)
+		}
+	}
+	return annotations, nil
+}
+
+// Value returns the annotation value rendered from the given output of the command
+func (m *MetadataAnnotation) Value(output string) (string, error) {
+	output = strings.TrimSpace(output)
+	if m.template == nil {
+		return output, nil
+	}
+	var value bytes.Buffer
+	if err := m.template.Execute(&value, metadataTemplateData{Output: output}); err != nil {
+		return "", errors.Wrapf(err, "unable to render template for annotation %s", m.Annotation)
+	}
+	return value.String(), nil
+}
@@ -0,0 +1,230 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	core "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+)
+
+var (
+	// byohNodes is the number of BYOH nodes currently managed by the operator
+	byohNodes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wmco_byoh_nodes_total",
+		Help: "Number of BYOH Windows nodes managed by the operator",
+	})
+	// byohInstancesDesired is the number of instances specified in the windows-instances ConfigMap
+	byohInstancesDesired = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wmco_byoh_instances_desired",
+		Help: "Number of BYOH Windows instances specified in the windows-instances ConfigMap",
+	})
+	// byohNodesReady is the number of nodes of the instances specified in the windows-instances ConfigMap which are
+	// configured and Ready
+	byohNodesReady = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wmco_byoh_nodes_ready",
+		Help: "Number of BYOH Windows nodes which are configured and Ready",
+	})
+	// byohNodesPending is the number of instances specified in the windows-instances ConfigMap which do not have a
+	// configured and Ready node yet
+	byohNodesPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wmco_byoh_nodes_pending",
+		Help: "Number of BYOH Windows instances which do not have a configured and Ready node yet",
+	})
+	// byohNodesDeconfigured is the number of BYOH nodes which were removed as their instance is no longer specified in
+	// the windows-instances ConfigMap
+	byohNodesDeconfigured = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "wmco_byoh_nodes_deconfigured_total",
+		Help: "Number of BYOH Windows nodes removed as their instance is no longer specified in the windows-instances " +
+			"ConfigMap",
+	})
+	// configMapReconcileSeconds is the duration of the reconciles of the windows-instances ConfigMap, by result. The
+	// buckets range from under a second, for reconciles with nothing to do, to 20 minutes, as configuring instances
+	// can be slow.
+	configMapReconcileSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wmco_configmap_reconcile_seconds",
+		Help:    "Duration of the reconciles of the windows-instances ConfigMap in seconds",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1200},
+	}, []string{"result"})
+	// configMapLastSuccess is the time of the last reconcile of the windows-instances ConfigMap which succeeded, so
+	// that alerts can be raised when the ConfigMap has not been reconciled successfully for too long
+	configMapLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wmco_configmap_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful reconcile of the windows-instances ConfigMap",
+	})
+	// configMapLastError is the time of the last reconcile of the windows-instances ConfigMap which failed
+	configMapLastError = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "wmco_configmap_last_error_timestamp_seconds",
+		Help: "Unix time of the last failed reconcile of the windows-instances ConfigMap",
+	})
+	// configMapObservedGeneration is the resourceVersion of each ConfigMap describing instances as of the last
+	// reconcile which processed all of its hosts. ConfigMaps do not have a generation, and their resourceVersion
+	// includes the instance states reported on them, so that the value matches the live ConfigMap once its latest edit
+	// has been processed.
+	configMapObservedGeneration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "wmco_configmap_observed_generation",
+		Help: "resourceVersion of the windows-instances ConfigMaps as of the last reconcile which processed all hosts",
+	}, []string{"configmap"})
+	// instanceConfigFailures is the number of failed attempts to configure each instance, by address. The cardinality
+	// of the metric scales with the number of distinct instance addresses.
+	instanceConfigFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmco_instance_config_failures_total",
+		Help: "Number of failed attempts to configure BYOH Windows instances, by instance address",
+	}, []string{"address"})
+	// failedAddresses holds the addresses instanceConfigFailures currently reports, so that the addresses no longer
+	// specified in the windows-instances ConfigMap can be pruned
+	failedAddresses = make(map[string]struct{})
+	// failedAddressesLock synchronizes access to failedAddresses, as instances are configured concurrently
+	failedAddressesLock sync.Mutex
+	// configMapReconcileFailures is the number of consecutive reconciles of the windows-instances ConfigMap which
+	// failed, reset by a successful reconcile
+	configMapReconcileFailures int
+	// configMapReconcileFailuresLock synchronizes access to configMapReconcileFailures, as it is read by the readiness
+	// probe while the ConfigMap is reconciled
+	configMapReconcileFailuresLock sync.Mutex
+)
+
+func init() {
+	// The operator metrics are served by the controller-runtime metrics server
+	crmetrics.Registry.MustRegister(byohNodes, byohInstancesDesired, byohNodesReady, byohNodesPending,
+		byohNodesDeconfigured, configMapReconcileSeconds, configMapLastSuccess, configMapLastError,
+		configMapObservedGeneration, instanceConfigFailures)
+}
+
+// SetBYOHNodes sets the number of BYOH nodes currently managed by the operator
+func SetBYOHNodes(count int) {
+	byohNodes.Set(float64(count))
+}
+
+// SetBYOHInstancesDesired sets the number of instances specified in the windows-instances ConfigMap
+func SetBYOHInstancesDesired(count int) {
+	byohInstancesDesired.Set(float64(count))
+}
+
+// IncBYOHNodesDeconfigured increments the number of BYOH nodes which were removed as their instance is no longer
+// specified in the windows-instances ConfigMap
+func IncBYOHNodesDeconfigured() {
+	byohNodesDeconfigured.Inc()
+}
+
+// SetBYOHNodeProgress sets the number of the given nodes, which are associated with the given number of instances
+// specified in the windows-instances ConfigMap, which are configured and Ready, and the number of those instances which
+// do not have such a node yet
+func SetBYOHNodeProgress(nodes []core.Node, desired int) {
+	ready, pending := byohNodeProgress(nodes, desired)
+	byohNodesReady.Set(float64(ready))
+	byohNodesPending.Set(float64(pending))
+}
+
+// byohNodeProgress returns the number of the given nodes which are configured and Ready, and the number of the given
+// number of instances which do not have such a node
+func byohNodeProgress(nodes []core.Node, desired int) (int, int) {
+	ready := 0
+	for _, node := range nodes {
+		if _, configured := node.Annotations[nodeconfig.VersionAnnotation]; configured && isNodeReady(&node) {
+			ready++
+		}
+	}
+	pending := desired - ready
+	if pending < 0 {
+		pending = 0
+	}
+	return ready, pending
+}
+
+// isNodeReady returns true if the given node has a Ready condition of True
+func isNodeReady(node *core.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == core.NodeReady {
+			return condition.Status == core.ConditionTrue
+		}
+	}
+	return false
+}
+
+// ObserveConfigMapReconcile records the duration of a reconcile of the windows-instances ConfigMap, which has just
+// ended, under a result of "error" if the given error is not nil, and "success" otherwise. The time of the last
+// reconcile with the same result is set to the current time.
+func ObserveConfigMapReconcile(duration time.Duration, err error) {
+	observeConfigMapReconcile(duration, err, time.Now())
+}
+
+// observeConfigMapReconcile records a reconcile of the windows-instances ConfigMap which ended at the given time
+func observeConfigMapReconcile(duration time.Duration, err error, end time.Time) {
+	result := "success"
+	last := configMapLastSuccess
+	if err != nil {
+		result = "error"
+		last = configMapLastError
+	}
+	configMapReconcileSeconds.WithLabelValues(result).Observe(duration.Seconds())
+	last.Set(float64(end.UnixNano()) / float64(time.Second))
+
+	configMapReconcileFailuresLock.Lock()
+	defer configMapReconcileFailuresLock.Unlock()
+	if err != nil {
+		configMapReconcileFailures++
+	} else {
+		configMapReconcileFailures = 0
+	}
+}
+
+// ConfigMapReconcileCheck returns a readiness check which fails while the last given number of reconciles of the
+// windows-instances ConfigMap have all failed, and passes again once a reconcile succeeds
+func ConfigMapReconcileCheck(threshold int) healthz.Checker {
+	return func(_ *http.Request) error {
+		configMapReconcileFailuresLock.Lock()
+		defer configMapReconcileFailuresLock.Unlock()
+		if configMapReconcileFailures >= threshold {
+			return fmt.Errorf("the last %d reconciles of the windows-instances ConfigMap failed",
+				configMapReconcileFailures)
+		}
+		return nil
+	}
+}
+
+// SetConfigMapObservedGeneration sets the observed generation of the given ConfigMaps, which have just been reconciled,
+// to their resourceVersion. ConfigMaps other than the given ones are no longer reported, and ConfigMaps with a
+// resourceVersion which is not a number are not reported.
+func SetConfigMapObservedGeneration(configMaps []*core.ConfigMap) {
+	configMapObservedGeneration.Reset()
+	for _, configMap := range configMaps {
+		resourceVersion, err := strconv.ParseUint(configMap.GetResourceVersion(), 10, 64)
+		if err != nil {
+			continue
+		}
+		configMapObservedGeneration.WithLabelValues(configMap.GetName()).Set(float64(resourceVersion))
+	}
+}
+
+// IncInstanceConfigFailures increments the number of failed attempts to configure the instance with the given address
+func IncInstanceConfigFailures(address string) {
+	failedAddressesLock.Lock()
+	defer failedAddressesLock.Unlock()
+	failedAddresses[address] = struct{}{}
+	instanceConfigFailures.WithLabelValues(address).Inc()
+}
+
+// PruneInstanceConfigFailures stops reporting the failed configuration attempts of all addresses other than the given
+// ones, so that instances removed from the windows-instances ConfigMap are no longer reported
+func PruneInstanceConfigFailures(addresses []string) {
+	current := make(map[string]struct{}, len(addresses))
+	for _, address := range addresses {
+		current[address] = struct{}{}
+	}
+	failedAddressesLock.Lock()
+	defer failedAddressesLock.Unlock()
+	for address := range failedAddresses {
+		if _, present := current[address]; !present {
+			instanceConfigFailures.DeleteLabelValues(address)
+			delete(failedAddresses, address)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig"
+)
+
+// gaugeValue returns the current value of the given gauge
+func gaugeValue(t *testing.T, gauge prometheus.Gauge) float64 {
+	metric := &dto.Metric{}
+	require.NoError(t, gauge.Write(metric))
+	return metric.GetGauge().GetValue()
+}
+
+// TestObserveConfigMapReconcile tests that the time of the last successful and failed reconciles are only set by
+// reconciles with the matching result
+func TestObserveConfigMapReconcile(t *testing.T) {
+	configMapLastSuccess.Set(0)
+	configMapLastError.Set(0)
+	start := time.Unix(1600000000, 0)
+
+	// A reconcile with nothing to do is successful
+	observeConfigMapReconcile(time.Millisecond, nil, start)
+	assert.Equal(t, float64(1600000000), gaugeValue(t, configMapLastSuccess))
+	assert.Equal(t, float64(0), gaugeValue(t, configMapLastError))
+
+	observeConfigMapReconcile(time.Second, errors.New("failed"), start.Add(time.Minute))
+	assert.Equal(t, float64(1600000000), gaugeValue(t, configMapLastSuccess))
+	assert.Equal(t, float64(1600000060), gaugeValue(t, configMapLastError))
+
+	observeConfigMapReconcile(time.Second, nil, start.Add(90*time.Second))
+	assert.Equal(t, float64(1600000090), gaugeValue(t, configMapLastSuccess))
+	assert.Equal(t, float64(1600000060), gaugeValue(t, configMapLastError))
+}
+
+// TestConfigMapReconcileCheck tests that the readiness check only fails once the threshold of consecutive failed
+// reconciles is reached, and passes again after a successful reconcile
+func TestConfigMapReconcileCheck(t *testing.T) {
+	check := ConfigMapReconcileCheck(3)
+	start := time.Unix(1600000000, 0)
+	observeConfigMapReconcile(time.Second, nil, start)
+	assert.NoError(t, check(nil))
+
+	// Failures below the threshold do not affect readiness
+	observeConfigMapReconcile(time.Second, errors.New("failed"), start.Add(time.Minute))
+	observeConfigMapReconcile(time.Second, errors.New("failed"), start.Add(2*time.Minute))
+	assert.NoError(t, check(nil))
+
+	observeConfigMapReconcile(time.Second, errors.New("failed"), start.Add(3*time.Minute))
+	err := check(nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "the last 3 reconciles")
+	// A stricter check is not affected by a looser one
+	assert.Error(t, ConfigMapReconcileCheck(1)(nil))
+	assert.NoError(t, ConfigMapReconcileCheck(4)(nil))
+
+	// A single success makes the operator ready again, and failures are counted from scratch
+	observeConfigMapReconcile(time.Second, nil, start.Add(4*time.Minute))
+	assert.NoError(t, check(nil))
+	observeConfigMapReconcile(time.Second, errors.New("failed"), start.Add(5*time.Minute))
+	assert.NoError(t, check(nil))
+}
+
+// TestSetConfigMapObservedGeneration tests that the observed generation of a ConfigMap follows its resourceVersion as
+// its data is changed, and that ConfigMaps which are no longer reconciled are no longer reported
+func TestSetConfigMapObservedGeneration(t *testing.T) {
+	instances := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "windows-instances", ResourceVersion: "1042"},
+		Data: map[string]string{"10.0.0.1": "username=core"}}
+	extra := &core.ConfigMap{ObjectMeta: meta.ObjectMeta{Name: "extra-instances", ResourceVersion: "977"}}
+	SetConfigMapObservedGeneration([]*core.ConfigMap{instances, extra})
+	assert.Equal(t, float64(1042), gaugeValue(t, configMapObservedGeneration.WithLabelValues("windows-instances")))
+	assert.Equal(t, float64(977), gaugeValue(t, configMapObservedGeneration.WithLabelValues("extra-instances")))
+
+	// Editing the data of the ConfigMap results in a new resourceVersion, which is reported once it is reconciled
+	instances.Data["10.0.0.2"] = "username=core"
+	instances.ResourceVersion = "1057"
+	SetConfigMapObservedGeneration([]*core.ConfigMap{instances})
+	assert.Equal(t, float64(1057), gaugeValue(t, configMapObservedGeneration.WithLabelValues("windows-instances")))
+	assert.False(t, configMapObservedGeneration.DeleteLabelValues("extra-instances"))
+
+	// A resourceVersion which is not a number is not reported
+	instances.ResourceVersion = "opaque"
+	SetConfigMapObservedGeneration([]*core.ConfigMap{instances})
+	assert.False(t, configMapObservedGeneration.DeleteLabelValues("windows-instances"))
+}
+
+// TestSetBYOHNodeProgress tests that only configured and Ready nodes are counted as ready, and that instances without
+// such a node are counted as pending
+func TestSetBYOHNodeProgress(t *testing.T) {
+	newNode := func(configured bool, ready core.ConditionStatus) core.Node {
+		node := core.Node{ObjectMeta: meta.ObjectMeta{Annotations: map[string]string{}}}
+		if configured {
+			node.Annotations[nodeconfig.VersionAnnotation] = "3.1.0+def5678"
+		}
+		if ready != "" {
+			node.Status.Conditions = []core.NodeCondition{{Type: core.NodeReady, Status: ready}}
+		}
+		return node
+	}
+
+	testCases := []struct {
+		name            string
+		nodes           []core.Node
+		desired         int
+		expectedReady   int
+		expectedPending int
+	}{
+		{
+			name:            "no nodes yet",
+			nodes:           nil,
+			desired:         3,
+			expectedReady:   0,
+			expectedPending: 3,
+		},
+		{
+			name:            "all nodes configured and ready",
+			nodes:           []core.Node{newNode(true, core.ConditionTrue), newNode(true, core.ConditionTrue)},
+			desired:         2,
+			expectedReady:   2,
+			expectedPending: 0,
+		},
+		{
+			name: "unconfigured and not ready nodes are pending",
+			nodes: []core.Node{newNode(true, core.ConditionTrue), newNode(false, core.ConditionTrue),
+				newNode(true, core.ConditionFalse), newNode(true, "")},
+			desired:         5,
+			expectedReady:   1,
+			expectedPending: 4,
+		},
+		{
+			name:            "pending is never negative",
+			nodes:           []core.Node{newNode(true, core.ConditionTrue), newNode(true, core.ConditionTrue)},
+			desired:         1,
+			expectedReady:   2,
+			expectedPending: 0,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			SetBYOHNodeProgress(test.nodes, test.desired)
+			assert.Equal(t, float64(test.expectedReady), gaugeValue(t, byohNodesReady))
+			assert.Equal(t, float64(test.expectedPending), gaugeValue(t, byohNodesPending))
+		})
+	}
+}
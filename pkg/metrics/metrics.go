@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 
 	"github.com/pkg/errors"
 	monclient "github.com/prometheus-operator/prometheus-operator/pkg/client/versioned/typed/monitoring/v1"
@@ -107,24 +108,27 @@ func NewConfig(mgr manager.Manager, cfg *rest.Config, namespace string) (*Config
 	}, nil
 }
 
-// syncMetricsEndpoint updates the endpoint object with the new list of IP addresses from the Windows nodes and the
-// metrics port.
-func (pc *PrometheusNodeConfig) syncMetricsEndpoint(nodeEndpointAdressess []v1.EndpointAddress) error {
-	// Update EndpointSubset field with list of Windows Nodes endpoint addresses and required metrics port information
-	// We need to patch the entire endpoint subset field, since addresses and ports both fields are deleted when there
-	// are no Windows nodes.
-	var subsets []v1.EndpointSubset
-	if nodeEndpointAdressess != nil {
-		subsets = []v1.EndpointSubset{{
-			Addresses: nodeEndpointAdressess,
-			Ports: []v1.EndpointPort{{
-				Name:     PortName,
-				Port:     Port,
-				Protocol: v1.ProtocolTCP,
-			}},
-		}}
+// metricsSubsets returns the endpoint subsets exposing the metrics port on the given list of endpoint addresses of the
+// Windows nodes. There are no subsets when there are no Windows nodes.
+func metricsSubsets(nodeEndpointAdressess []v1.EndpointAddress) []v1.EndpointSubset {
+	if nodeEndpointAdressess == nil {
+		return nil
 	}
+	return []v1.EndpointSubset{{
+		Addresses: nodeEndpointAdressess,
+		Ports: []v1.EndpointPort{{
+			Name:     PortName,
+			Port:     Port,
+			Protocol: v1.ProtocolTCP,
+		}},
+	}}
+}
 
+// syncMetricsEndpoint updates the endpoint object with the given subsets, holding the IP addresses of the Windows nodes
+// and the metrics port.
+func (pc *PrometheusNodeConfig) syncMetricsEndpoint(subsets []v1.EndpointSubset) error {
+	// We need to patch the entire endpoint subset field, since addresses and ports both fields are deleted when there
+	// are no Windows nodes.
 	patchData := []patchEndpoint{{
 		Op:    "replace",
 		Path:  "/subsets",
@@ -141,45 +145,50 @@ func (pc *PrometheusNodeConfig) syncMetricsEndpoint(nodeEndpointAdressess []v1.E
 	return errors.Wrap(err, "unable to sync metrics endpoints")
 }
 
-// Configure patches the endpoint object to reflect the current list Windows nodes.
-func (pc *PrometheusNodeConfig) Configure() error {
+// Configure patches the endpoint object to reflect the current list of Ready Windows nodes, so that nodes which are
+// still being configured are not scraped. The endpoint object is only patched if it differs from the current list, in
+// which case true is returned.
+func (pc *PrometheusNodeConfig) Configure() (bool, error) {
 	// Check if metrics are enabled in current cluster
 	if !metricsEnabled {
 		log.Info("install the prometheus-operator to enable Prometheus configuration")
-		return nil
+		return false, nil
 	}
 	// get list of Windows nodes that are in Ready phase
 	nodes, err := pc.k8sclientset.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{LabelSelector: nodeconfig.WindowsOSLabel,
 		FieldSelector: "spec.unschedulable=false"})
 	if err != nil {
-		return errors.Wrap(err, "could not get Windows nodes")
+		return false, errors.Wrap(err, "could not get Windows nodes")
 	}
 
 	// get Metrics Endpoints object
 	endpoints, err := pc.k8sclientset.CoreV1().Endpoints(pc.namespace).Get(context.TODO(),
 		WindowsMetricsResource, metav1.GetOptions{})
 	if err != nil {
-		return errors.Wrapf(err, "could not get metrics endpoints %v", WindowsMetricsResource)
+		return false, errors.Wrapf(err, "could not get metrics endpoints %v", WindowsMetricsResource)
 	}
 
-	if !isEndpointsValid(nodes, endpoints) {
-		// check if we can get list of endpoint addresses
-		windowsIPList := getNodeEndpointAddresses(nodes)
-		// sync metrics endpoints object with the current list of addresses
-		if err := pc.syncMetricsEndpoint(windowsIPList); err != nil {
-			return errors.Wrap(err, "error updating endpoints object with list of endpoint addresses")
-		}
+	subsets := metricsSubsets(getNodeEndpointAddresses(nodes))
+	if isEndpointsValid(subsets, endpoints) {
+		return false, nil
 	}
-	log.Info("Prometheus configured", "endpoints", WindowsMetricsResource, "port", Port, "name", PortName)
-	return nil
+	// sync metrics endpoints object with the current list of addresses
+	if err := pc.syncMetricsEndpoint(subsets); err != nil {
+		return false, errors.Wrap(err, "error updating endpoints object with list of endpoint addresses")
+	}
+	return true, nil
 }
 
-// getNodeEndpointAddresses returns a list of endpoint addresses according to the given list of Windows nodes
+// getNodeEndpointAddresses returns a list of endpoint addresses according to the given list of Windows nodes. Nodes
+// whose Ready condition is not True are left out.
 func getNodeEndpointAddresses(nodes *v1.NodeList) []v1.EndpointAddress {
 	// an empty list to store node IP addresses
 	var nodeIPAddress []v1.EndpointAddress
 	// loops through nodes
 	for _, node := range nodes.Items {
+		if !isNodeReady(&node) {
+			continue
+		}
 		for _, address := range node.Status.Addresses {
 			if address.Type == "InternalIP" && address.Address != "" {
 				// add IP address address to the endpoint address list
@@ -199,29 +208,40 @@ func getNodeEndpointAddresses(nodes *v1.NodeList) []v1.EndpointAddress {
 	return nodeIPAddress
 }
 
-// isEndpointsValid returns true if Endpoints object has entries for all the Windows nodes in the cluster.
-// It returns false when any one of the Windows nodes is not present in the subset.
-func isEndpointsValid(nodes *v1.NodeList, endpoints *v1.Endpoints) bool {
-	// check if number of entries in endpoints object match number of Ready Windows nodes
-	if len(endpoints.Subsets) == 0 || len(nodes.Items) != len(endpoints.Subsets[0].Addresses) {
+// isEndpointsValid returns true if the Endpoints object has the given subsets. The addresses of a subset are compared
+// by IP address and node, regardless of their order.
+func isEndpointsValid(subsets []v1.EndpointSubset, endpoints *v1.Endpoints) bool {
+	if len(subsets) != len(endpoints.Subsets) {
 		return false
 	}
-
-	for _, node := range nodes.Items {
-		nodeFound := false
-		for _, address := range endpoints.Subsets[0].Addresses {
-			if address.TargetRef.Name == node.Name {
-				nodeFound = true
-				break
-			}
-		}
-		if !nodeFound {
+	for i, subset := range subsets {
+		current := endpoints.Subsets[i]
+		if !reflect.DeepEqual(subset.Ports, current.Ports) || len(subset.Addresses) != len(current.Addresses) ||
+			len(current.NotReadyAddresses) != 0 {
 			return false
 		}
+		currentAddresses := make(map[string]struct{}, len(current.Addresses))
+		for _, address := range current.Addresses {
+			currentAddresses[endpointAddressKey(address)] = struct{}{}
+		}
+		for _, address := range subset.Addresses {
+			if _, present := currentAddresses[endpointAddressKey(address)]; !present {
+				return false
+			}
+		}
 	}
 	return true
 }
 
+// endpointAddressKey returns a key identifying the given endpoint address by its IP address and the node it targets
+func endpointAddressKey(address v1.EndpointAddress) string {
+	node := ""
+	if address.TargetRef != nil {
+		node = address.TargetRef.Name
+	}
+	return address.IP + "/" + node
+}
+
 // Configure takes care of all the required configuration steps
 // for Prometheus monitoring like validating monitoring label
 // and creating metrics Endpoints object.
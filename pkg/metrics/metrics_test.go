@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newNode returns a node with the given name, internal IP address and Ready condition status
+func newNode(name, address string, ready v1.ConditionStatus) v1.Node {
+	return v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: v1.NodeStatus{
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: address}},
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: ready}},
+		},
+	}
+}
+
+// TestGetNodeEndpointAddresses tests that only Ready nodes are included in the metrics endpoints
+func TestGetNodeEndpointAddresses(t *testing.T) {
+	nodes := &v1.NodeList{Items: []v1.Node{
+		newNode("ready", "10.0.0.1", v1.ConditionTrue),
+		newNode("not-ready", "10.0.0.2", v1.ConditionFalse),
+		newNode("unknown", "10.0.0.3", v1.ConditionUnknown),
+		newNode("ready-2", "10.0.0.4", v1.ConditionTrue),
+		{ObjectMeta: metav1.ObjectMeta{Name: "no-condition"},
+			Status: v1.NodeStatus{Addresses: []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.5"}}}},
+	}}
+	var included []string
+	for _, address := range getNodeEndpointAddresses(nodes) {
+		included = append(included, address.TargetRef.Name+"="+address.IP)
+	}
+	assert.Equal(t, []string{"ready=10.0.0.1", "ready-2=10.0.0.4"}, included)
+
+	// There are no subsets while none of the nodes are Ready
+	assert.Nil(t, metricsSubsets(getNodeEndpointAddresses(&v1.NodeList{Items: nodes.Items[1:3]})))
+}
+
+// TestIsEndpointsValid tests that the metrics endpoints are only considered out of date when they differ from the
+// current list of Windows nodes
+func TestIsEndpointsValid(t *testing.T) {
+	nodes := &v1.NodeList{Items: []v1.Node{
+		newNode("node-1", "10.0.0.1", v1.ConditionTrue),
+		newNode("node-2", "10.0.0.2", v1.ConditionTrue),
+	}}
+	subsets := metricsSubsets(getNodeEndpointAddresses(nodes))
+	reordered := metricsSubsets(getNodeEndpointAddresses(&v1.NodeList{Items: []v1.Node{nodes.Items[1],
+		nodes.Items[0]}}))
+	changedIP := metricsSubsets(getNodeEndpointAddresses(nodes))
+	changedIP[0].Addresses[0].IP = "10.0.0.3"
+	changedPort := metricsSubsets(getNodeEndpointAddresses(nodes))
+	changedPort[0].Ports[0].Port = 9100
+
+	testCases := []struct {
+		name     string
+		subsets  []v1.EndpointSubset
+		current  []v1.EndpointSubset
+		expected bool
+	}{
+		{
+			name:     "no change",
+			subsets:  subsets,
+			current:  subsets,
+			expected: true,
+		},
+		{
+			name:     "addresses in a different order",
+			subsets:  subsets,
+			current:  reordered,
+			expected: true,
+		},
+		{
+			name:     "no Windows nodes and no subsets",
+			subsets:  metricsSubsets(getNodeEndpointAddresses(&v1.NodeList{})),
+			current:  nil,
+			expected: true,
+		},
+		{
+			name:     "node added",
+			subsets:  subsets,
+			current:  metricsSubsets(getNodeEndpointAddresses(&v1.NodeList{Items: nodes.Items[:1]})),
+			expected: false,
+		},
+		{
+			name:     "all nodes removed",
+			subsets:  nil,
+			current:  subsets,
+			expected: false,
+		},
+		{
+			name:     "node IP address changed",
+			subsets:  subsets,
+			current:  changedIP,
+			expected: false,
+		},
+		{
+			name:     "port changed",
+			subsets:  subsets,
+			current:  changedPort,
+			expected: false,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, isEndpointsValid(test.subsets, &v1.Endpoints{Subsets: test.current}))
+		})
+	}
+}
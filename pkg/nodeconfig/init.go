@@ -1,6 +1,8 @@
 package nodeconfig
 
 import (
+	"sync"
+
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
@@ -15,10 +17,12 @@ type cache struct {
 	// workerIgnitionEndpoint is the Machine Config Server(MCS) endpoint from which we can download the
 	// the OpenShift worker ignition file.
 	workerIgnitionEndPoint string
+	// lock guards workerIgnitionEndPoint, as instances can be configured concurrently
+	lock sync.Mutex
 }
 
 // cache has the information related to nodeConfig that should not be changed.
-var nodeConfigCache = cache{}
+var nodeConfigCache = &cache{}
 
 // init populates the cache that we need for nodeConfig
 func init() {
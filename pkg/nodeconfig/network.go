@@ -75,8 +75,9 @@ func (nw *network) cleanupTempConfig(configFile string) error {
 }
 
 // populateCniConfig populates the CNI config template with necessary information and
-// creates a new file in temp directory to store the modified template
-func (nw *network) populateCniConfig(serviceCIDR string, templatePath string) (string, error) {
+// creates a new file in temp directory to store the modified template. The given NAT exceptions are excluded from
+// outbound NAT along with the service CIDR.
+func (nw *network) populateCniConfig(serviceCIDR string, natExceptions []string, templatePath string) (string, error) {
 	if nw.hostSubnet == "" {
 		return "", errors.New("can't populate CNI config with empty hostSubnet")
 	}
@@ -91,7 +92,7 @@ func (nw *network) populateCniConfig(serviceCIDR string, templatePath string) (s
 		return "", errors.Wrap(err, "error converting CNI template into cniCfg struct")
 	}
 
-	if err = populateCfgPolicies(&cniCfg.Policies, serviceCIDR); err != nil {
+	if err = populateCfgPolicies(&cniCfg.Policies, serviceCIDR, natExceptions); err != nil {
 		return "", errors.Wrap(err, "error populating config policies in cniConf struct")
 	}
 
@@ -123,12 +124,14 @@ func (nw *network) populateCniConfig(serviceCIDR string, templatePath string) (s
 	return cniConfigPath.Name(), nil
 }
 
-// populateCfgPolicies populates the policies in cniConf struct with serviceCIDR information
-func populateCfgPolicies(cniCfgPolicies *policies, serviceCIDR string) error {
+// populateCfgPolicies populates the policies in cniConf struct with serviceCIDR information, and adds the given NAT
+// exceptions to the exception list of the outbound NAT policy
+func populateCfgPolicies(cniCfgPolicies *policies, serviceCIDR string, natExceptions []string) error {
 	if len(*cniCfgPolicies) < 2 || len((*cniCfgPolicies)[0].Value.ExceptionList) == 0 || (*cniCfgPolicies)[1].Value.DestinationPrefix == "" {
 		return errors.Errorf("invalid policy fields in cniConf struct")
 	}
 	(*cniCfgPolicies)[0].Value.ExceptionList[0] = serviceCIDR
+	(*cniCfgPolicies)[0].Value.ExceptionList = append((*cniCfgPolicies)[0].Value.ExceptionList, natExceptions...)
 	(*cniCfgPolicies)[1].Value.DestinationPrefix = serviceCIDR
 	return nil
 }
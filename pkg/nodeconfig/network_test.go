@@ -29,7 +29,7 @@ var tests = []struct {
 func TestPopulateCfgPoliciesError(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := populateCfgPolicies(tt.policies, tt.serviceCIDR)
+			err := populateCfgPolicies(tt.policies, tt.serviceCIDR, nil)
 			if tt.errorMessage == "" {
 				require.Nil(t, err, "Successful check for invalid CNI config template")
 			} else {
@@ -46,12 +46,21 @@ func TestPopulateCfgPoliciesError(t *testing.T) {
 func TestPopulateCfgPoliciesValues(t *testing.T) {
 	policies := mockValidPolicies()
 	serviceCIDR := "10.128.0.0/14"
-	_ = populateCfgPolicies(policies, serviceCIDR)
+	_ = populateCfgPolicies(policies, serviceCIDR, nil)
 	if (*policies)[0].Value.ExceptionList[0] != serviceCIDR || (*policies)[1].Value.DestinationPrefix != serviceCIDR {
 		t.Errorf("error populating policies in CNI config")
 	}
 }
 
+// TestPopulateCfgPoliciesNATExceptions tests that NAT exceptions are added to the exception list of the outbound NAT
+// policy, after the service CIDR
+func TestPopulateCfgPoliciesNATExceptions(t *testing.T) {
+	policies := mockValidPolicies()
+	require.NoError(t, populateCfgPolicies(policies, "172.30.0.0/16", []string{"10.10.0.0/16", "192.168.1.0/24"}))
+	assert.Equal(t, []string{"172.30.0.0/16", "10.10.0.0/16", "192.168.1.0/24"}, (*policies)[0].Value.ExceptionList)
+	assert.Equal(t, "172.30.0.0/16", (*policies)[1].Value.DestinationPrefix)
+}
+
 // mockValidPolicies is a helper function to create a set of valid CNI config policies
 // for testing populateCfgPolicies()
 func mockValidPolicies() *policies {
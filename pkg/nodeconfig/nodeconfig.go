@@ -4,7 +4,9 @@ import (
 	"context"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -24,6 +26,7 @@ import (
 	"github.com/openshift/windows-machine-config-operator/pkg/instances"
 	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig/payload"
 	"github.com/openshift/windows-machine-config-operator/pkg/retry"
+	"github.com/openshift/windows-machine-config-operator/pkg/tracing"
 	"github.com/openshift/windows-machine-config-operator/pkg/windows"
 	"github.com/openshift/windows-machine-config-operator/version"
 )
@@ -41,8 +44,25 @@ const (
 	VersionAnnotation = "windowsmachineconfig.openshift.io/version"
 	// PubKeyHashAnnotation corresponds to the public key present on the VM
 	PubKeyHashAnnotation = "windowsmachineconfig.openshift.io/pub-key-hash"
+	// ConfigHashAnnotation is a hash of the instance specific configuration that was applied to the VM
+	ConfigHashAnnotation = "windowsmachineconfig.openshift.io/config-hash"
+	// OSVersionLabel is a node label that contains the version of Windows the instance is running
+	OSVersionLabel = "windowsmachineconfig.openshift.io/os-version"
 )
 
+// UnsupportedOSVersionError is returned when the version of Windows an instance is running is older than the minimum
+// supported version. The instance cannot be configured until it is upgraded or replaced.
+type UnsupportedOSVersionError struct {
+	// version is the version of Windows the instance is running
+	version string
+	// minimum is the minimum supported version of Windows
+	minimum string
+}
+
+func (e *UnsupportedOSVersionError) Error() string {
+	return fmt.Sprintf("Windows version %s is older than the minimum supported version %s", e.version, e.minimum)
+}
+
 // nodeConfig holds the information to make the given VM a kubernetes node. As of now, it holds the information
 // related to kubeclient and the windowsVM.
 type nodeConfig struct {
@@ -56,11 +76,27 @@ type nodeConfig struct {
 	network *network
 	// publicKeyHash is the hash of the public key present on the VM
 	publicKeyHash string
+	// configHash is the hash of the instance specific configuration applied to the VM
+	configHash string
 	// clusterServiceCIDR holds the service CIDR for cluster
 	clusterServiceCIDR string
-	log                logr.Logger
+	// natExceptions are the CIDRs excluded from outbound NAT on the VM in addition to clusterServiceCIDR
+	natExceptions []string
+	log           logr.Logger
 	// additionalAnnotations are extra annotations that should be applied to configured nodes
 	additionalAnnotations map[string]string
+	// additionalLabels are extra labels that should be applied to configured nodes
+	additionalLabels map[string]string
+	// taints are the taints that should be applied to configured nodes
+	taints []core.Taint
+	// minOSVersion is the minimum version of Windows the VM must be running. The version is not checked if it is empty.
+	minOSVersion string
+	// osVersion is the version of Windows the VM is running, which is set once it is checked
+	osVersion string
+	// metadataAnnotations are the annotations whose values are sourced from commands run on the VM
+	metadataAnnotations []instances.MetadataAnnotation
+	// hostMetadata holds the values of the metadataAnnotations which were collected from the VM
+	hostMetadata map[string]string
 }
 
 // discoverKubeAPIServerEndpoint discovers the kubernetes api server endpoint
@@ -86,40 +122,80 @@ func discoverKubeAPIServerEndpoint() (string, error) {
 	return host.Status.APIServerInternalURL, nil
 }
 
+// getWorkerIgnitionEndpoint returns the cached worker ignition endpoint, computing it if it is not cached yet
+func (c *cache) getWorkerIgnitionEndpoint() (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.workerIgnitionEndPoint != "" {
+		return c.workerIgnitionEndPoint, nil
+	}
+	// We couldn't find it in cache. Let's compute it now.
+	kubeAPIServerEndpoint, err := discoverKubeAPIServerEndpoint()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find kube api server endpoint")
+	}
+	clusterAddress, err := getClusterAddr(kubeAPIServerEndpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "error getting cluster address")
+	}
+	c.workerIgnitionEndPoint = "https://" + clusterAddress + ":22623/config/worker"
+	return c.workerIgnitionEndPoint, nil
+}
+
 // NewNodeConfig creates a new instance of nodeConfig to be used by the caller.
 // hostName having a value will result in the VM's hostname being changed to the given value.
 func NewNodeConfig(clientset *kubernetes.Clientset, clusterServiceCIDR, vxlanPort string,
-	instance *instances.InstanceInfo, signer ssh.Signer, additionalAnnotations map[string]string) (*nodeConfig, error) {
-	var err error
-	if nodeConfigCache.workerIgnitionEndPoint == "" {
-		var kubeAPIServerEndpoint string
-		// We couldn't find it in cache. Let's compute it now.
-		kubeAPIServerEndpoint, err = discoverKubeAPIServerEndpoint()
-		if err != nil {
-			return nil, errors.Wrap(err, "unable to find kube api server endpoint")
-		}
-		clusterAddress, err := getClusterAddr(kubeAPIServerEndpoint)
-		if err != nil {
-			return nil, errors.Wrap(err, "error getting cluster address")
-		}
-		workerIgnitionEndpoint := "https://" + clusterAddress + ":22623/config/worker"
-		nodeConfigCache.workerIgnitionEndPoint = workerIgnitionEndpoint
+	instance *instances.InstanceInfo, signer ssh.Signer, additionalAnnotations,
+	additionalLabels map[string]string) (*nodeConfig, error) {
+	workerIgnitionEndpoint, err := nodeConfigCache.getWorkerIgnitionEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	// The instance can override the cluster service CIDR, such as when it conflicts with a subnet local to the instance
+	if instance.ServiceCIDR != "" {
+		clusterServiceCIDR = instance.ServiceCIDR
 	}
 	if err = cluster.ValidateCIDR(clusterServiceCIDR); err != nil {
 		return nil, errors.Wrap(err, "error receiving valid CIDR value for "+
 			"creating new node config")
 	}
+	for _, cidr := range instance.NATExceptions {
+		if err = cluster.ValidateCIDR(cidr); err != nil {
+			return nil, errors.Wrap(err, "invalid NAT exception")
+		}
+	}
+
+	if err = instance.KubeletConfig.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid kubelet configuration")
+	}
+	if err = instances.ValidateDNSSearchDomains(instance.DNSSearchDomains); err != nil {
+		return nil, err
+	}
+	if err = instances.ValidateTaints(instance.Taints); err != nil {
+		return nil, err
+	}
+	configHash, err := instance.ConfigHash()
+	if err != nil {
+		return nil, err
+	}
 
 	log := ctrl.Log.WithName(fmt.Sprintf("nodeconfig %s", instance.Address))
-	win, err := windows.New(nodeConfigCache.workerIgnitionEndPoint, vxlanPort,
+	win, err := windows.New(workerIgnitionEndpoint, vxlanPort,
 		instance, signer)
 	if err != nil {
 		return nil, errors.Wrap(err, "error instantiating Windows instance from VM")
 	}
 
+	// Instances authenticated against using only a password have no public key
+	publicKeyHash := ""
+	if signer != nil {
+		publicKeyHash = CreatePubKeyHashAnnotation(signer.PublicKey())
+	}
 	return &nodeConfig{k8sclientset: clientset, Windows: win, network: newNetwork(log),
-		clusterServiceCIDR: clusterServiceCIDR, publicKeyHash: CreatePubKeyHashAnnotation(signer.PublicKey()),
-		log: log, additionalAnnotations: additionalAnnotations}, nil
+		clusterServiceCIDR: clusterServiceCIDR, publicKeyHash: publicKeyHash,
+		configHash: configHash, log: log, additionalAnnotations: additionalAnnotations,
+		additionalLabels: additionalLabels, taints: instance.Taints, minOSVersion: instance.MinOSVersion,
+		metadataAnnotations: instance.MetadataAnnotations, natExceptions: instance.NATExceptions}, nil
 }
 
 // getClusterAddr gets the cluster address associated with given kubernetes APIServerEndpoint.
@@ -142,8 +218,14 @@ func getClusterAddr(kubeAPIServerEndpoint string) (string, error) {
 	return hostName, nil
 }
 
-// Configure configures the Windows VM to make it a Windows worker node
-func (nc *nodeConfig) Configure() error {
+// Configure configures the Windows VM to make it a Windows worker node. The spans of the configuration steps are
+// started as children of the span of the given context.
+func (nc *nodeConfig) Configure(ctx context.Context) error {
+	// Check the version of Windows before anything is changed, so that an unsupported VM is left as it is
+	if err := nc.checkOSVersion(); err != nil {
+		return err
+	}
+	nc.collectHostMetadata()
 	drainHelper := &drain.Helper{Ctx: context.TODO(), Client: nc.k8sclientset}
 	// If we find a node  it implies that we are reconfiguring and we should cordon the node
 	if err := nc.setNode(true); err == nil {
@@ -154,7 +236,7 @@ func (nc *nodeConfig) Configure() error {
 	}
 
 	// Perform the basic kubelet configuration using WMCB
-	if err := nc.Windows.Configure(); err != nil {
+	if err := nc.Windows.Configure(ctx); err != nil {
 		return errors.Wrap(err, "configuring the Windows VM failed")
 	}
 
@@ -173,29 +255,40 @@ func (nc *nodeConfig) Configure() error {
 		// Ensure we are annotating the node as soon as the Node object is created, so that we can identify which
 		// controller should be watching it
 		nc.addAdditionalAnnotations()
+		nc.addAdditionalLabels()
+		nc.addTaints()
 		nc.addPubKeyHashAnnotation()
 		node, err := nc.k8sclientset.CoreV1().Nodes().Update(context.TODO(), nc.node, meta.UpdateOptions{})
 		if err != nil {
-			return errors.Wrapf(err, "error updating public key hash and additional annotations on node %s",
-				nc.node.GetName())
+			return errors.Wrapf(err, "error updating public key hash, additional annotations, labels and taints on "+
+				"node %s", nc.node.GetName())
 		}
 		nc.node = node
 
 		// Now that basic kubelet configuration is complete, configure networking in the node
-		if err := nc.configureNetwork(); err != nil {
+		_, span := tracing.StartSpan(ctx, "ConfigureNetwork", tracing.Address(nc.Address()))
+		err = nc.configureNetwork()
+		tracing.EndSpan(span, err)
+		if err != nil {
 			return errors.Wrap(err, "configuring node network failed")
 		}
 
-		// Now that the node has been fully configured, add the version annotation to signify that the node
-		// was successfully configured by this version of WMCO
-		// populate node object in nodeConfig once more
-		if err := nc.setNode(false); err != nil {
-			return errors.Wrap(err, "error getting node object")
+		// Now that the node has been fully configured, wait for it to become functional before adding the version
+		// annotation to signify that the node was successfully configured by this version of WMCO. This also
+		// populates the node object in nodeConfig once more.
+		_, span = tracing.StartSpan(ctx, "WaitForNodeReady", tracing.Address(nc.Address()))
+		err = nc.waitForNodeReady()
+		tracing.EndSpan(span, err)
+		if err != nil {
+			return err
 		}
 
 		// Version annotation is the indicator that the node was fully configured by this version of WMCO, so it should
-		// be added at the end of the process.
-		nc.addVersionAnnotation()
+		// be added at the end of the process. The config hash annotation is added alongside it, as it indicates that
+		// the node was fully configured with the given instance specific configuration.
+		if err := nc.addCompletionAnnotations(); err != nil {
+			return err
+		}
 		node, err = nc.k8sclientset.CoreV1().Nodes().Update(context.TODO(), nc.node, meta.UpdateOptions{})
 		if err != nil {
 			return errors.Wrapf(err, "error updating version annotation on node %s", nc.node.GetName())
@@ -219,6 +312,72 @@ func (nc *nodeConfig) Configure() error {
 	return err
 }
 
+// checkOSVersion sets nc.osVersion to the version of Windows the VM is running, returning an
+// UnsupportedOSVersionError if it is older than nc.minOSVersion
+func (nc *nodeConfig) checkOSVersion() error {
+	osVersion, err := nc.Windows.GetOSVersion()
+	if err != nil {
+		return err
+	}
+	current, err := parseOSVersion(osVersion)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse operating system version")
+	}
+	nc.osVersion = osVersion
+	if nc.minOSVersion == "" {
+		return nil
+	}
+	minimum, err := parseOSVersion(nc.minOSVersion)
+	if err != nil {
+		return errors.Wrap(err, "invalid minimum operating system version")
+	}
+	if compareOSVersions(current, minimum) < 0 {
+		return &UnsupportedOSVersionError{version: osVersion, minimum: nc.minOSVersion}
+	}
+	return nil
+}
+
+// ValidateOSVersion returns an error if the given string is not a Windows version, made of dot separated numbers,
+// such as 10.0.17763
+func ValidateOSVersion(osVersion string) error {
+	_, err := parseOSVersion(osVersion)
+	return err
+}
+
+// parseOSVersion returns the numbers making up the given Windows version
+func parseOSVersion(osVersion string) ([]int, error) {
+	if osVersion == "" {
+		return nil, errors.New("version cannot be empty")
+	}
+	var parts []int
+	for _, field := range strings.Split(osVersion, ".") {
+		part, err := strconv.Atoi(field)
+		if err != nil || part < 0 {
+			return nil, errors.Errorf("invalid version %q, expected dot separated numbers", osVersion)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// compareOSVersions returns a negative number if version a is older than version b, a positive number if it is newer,
+// and 0 if they are the same. Missing trailing parts are treated as 0, so 10.0 is the same as 10.0.0.
+func compareOSVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
+
 // configureNetwork configures k8s networking in the node
 // we are assuming that the WindowsVM and node objects are valid
 func (nc *nodeConfig) configureNetwork() error {
@@ -255,27 +414,155 @@ func (nc *nodeConfig) configureNetwork() error {
 	return nil
 }
 
+// addCompletionAnnotations adds the annotations signifying that nc.node has been fully configured. An error is returned
+// without modifying the node if it is not functional, as the version annotation must only be present on such nodes.
+func (nc *nodeConfig) addCompletionAnnotations() error {
+	if err := checkNodeReady(nc.node); err != nil {
+		return errors.Wrapf(err, "node %s cannot be marked as configured", nc.node.GetName())
+	}
+	nc.addConfigHashAnnotation()
+	nc.addVersionAnnotation()
+	return nil
+}
+
+// waitForNodeReady waits for nc.node to be Ready with its network configured, updating nc.node with the latest state
+func (nc *nodeConfig) waitForNodeReady() error {
+	var readyErr error
+	err := wait.PollImmediate(retry.Interval, retry.Timeout, func() (bool, error) {
+		node, err := nc.k8sclientset.CoreV1().Nodes().Get(context.TODO(), nc.node.GetName(), meta.GetOptions{})
+		if err != nil {
+			nc.log.V(1).Error(err, "unable to get node", "node", nc.node.GetName())
+			return false, nil
+		}
+		nc.node = node
+		readyErr = checkNodeReady(node)
+		return readyErr == nil, nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "error waiting for node %s to be ready: %v", nc.node.GetName(), readyErr)
+	}
+	return nil
+}
+
+// checkNodeReady returns an error describing why the given node is not functional, if that is the case. A node is
+// functional if it is Ready, and its network has been configured by the hybrid overlay and is available.
+func checkNodeReady(node *core.Node) error {
+	if _, present := node.Annotations[HybridOverlayMac]; !present {
+		return errors.Errorf("missing %s annotation", HybridOverlayMac)
+	}
+	ready := false
+	for _, condition := range node.Status.Conditions {
+		switch condition.Type {
+		case core.NodeReady:
+			ready = condition.Status == core.ConditionTrue
+		case core.NodeNetworkUnavailable:
+			if condition.Status == core.ConditionTrue {
+				return errors.Errorf("network unavailable: %s", condition.Message)
+			}
+		}
+	}
+	if !ready {
+		return errors.New("not Ready")
+	}
+	return nil
+}
+
 // addVersionAnnotation adds the version annotation to nc.node
 func (nc *nodeConfig) addVersionAnnotation() {
 	nc.node.Annotations[VersionAnnotation] = version.Get()
 }
 
+// addConfigHashAnnotation adds the config hash annotation to nc.node, removing it if the instance has no specific
+// configuration
+func (nc *nodeConfig) addConfigHashAnnotation() {
+	if nc.configHash == "" {
+		delete(nc.node.Annotations, ConfigHashAnnotation)
+		return
+	}
+	nc.node.Annotations[ConfigHashAnnotation] = nc.configHash
+}
+
 // addPubKeyHashAnnotation adds the public key annotation to nc.node
 func (nc *nodeConfig) addPubKeyHashAnnotation() {
 	nc.node.Annotations[PubKeyHashAnnotation] = nc.publicKeyHash
 }
 
-// addAdditionalAnnotations merges nc.additionalAnnotations into the annotations on nc.node. If the annotation
-// already existed, its value will be overwritten.
+// addAdditionalAnnotations merges nc.additionalAnnotations and nc.hostMetadata into the annotations on nc.node. If the
+// annotation already existed, its value will be overwritten.
 func (nc *nodeConfig) addAdditionalAnnotations() {
-	if nc.additionalAnnotations == nil {
+	if nc.additionalAnnotations == nil && nc.hostMetadata == nil {
 		return
 	}
+	if nc.node.Annotations == nil {
+		nc.node.Annotations = make(map[string]string)
+	}
+	for key, value := range nc.hostMetadata {
+		nc.node.Annotations[key] = value
+	}
 	for key, value := range nc.additionalAnnotations {
 		nc.node.Annotations[key] = value
 	}
 }
 
+// collectHostMetadata sets nc.hostMetadata to the values of nc.metadataAnnotations, rendered from the output of their
+// commands on the VM. Annotations whose command fails or whose value cannot be rendered are logged and skipped, as
+// metadata is informational and must not prevent the VM from being configured.
+func (nc *nodeConfig) collectHostMetadata() {
+	if len(nc.metadataAnnotations) == 0 {
+		return
+	}
+	nc.hostMetadata = make(map[string]string, len(nc.metadataAnnotations))
+	for i := range nc.metadataAnnotations {
+		annotation := &nc.metadataAnnotations[i]
+		out, err := nc.Windows.Run(annotation.Command, true)
+		if err != nil {
+			nc.log.Info("unable to collect host metadata", "annotation", annotation.Annotation, "error", err)
+			continue
+		}
+		value, err := annotation.Value(out)
+		if err != nil {
+			nc.log.Info("unable to collect host metadata", "annotation", annotation.Annotation, "error", err)
+			continue
+		}
+		nc.hostMetadata[annotation.Annotation] = value
+	}
+}
+
+// addAdditionalLabels merges nc.additionalLabels into the labels on nc.node, along with the OS version label if the
+// version of Windows the VM is running is known. If the label already existed, its value will be overwritten.
+func (nc *nodeConfig) addAdditionalLabels() {
+	if nc.additionalLabels == nil && nc.osVersion == "" {
+		return
+	}
+	if nc.node.Labels == nil {
+		nc.node.Labels = make(map[string]string)
+	}
+	for key, value := range nc.additionalLabels {
+		nc.node.Labels[key] = value
+	}
+	if nc.osVersion != "" {
+		nc.node.Labels[OSVersionLabel] = nc.osVersion
+	}
+}
+
+// addTaints merges nc.taints into the taints on nc.node. If a taint with the same key and effect already existed, its
+// value will be overwritten.
+func (nc *nodeConfig) addTaints() {
+	for _, taint := range nc.taints {
+		found := false
+		for i := range nc.node.Spec.Taints {
+			if nc.node.Spec.Taints[i].Key == taint.Key && nc.node.Spec.Taints[i].Effect == taint.Effect {
+				nc.node.Spec.Taints[i].Value = taint.Value
+				found = true
+				break
+			}
+		}
+		if !found {
+			nc.node.Spec.Taints = append(nc.node.Spec.Taints, taint)
+		}
+	}
+}
+
 // setNode finds the Node associated with the VM that has been configured, and sets the node field of the
 // nodeConfig object. If quickCheck is set, the function does a quicker check for the node which is useful in the node
 // reconfiguration case.
@@ -296,10 +583,11 @@ func (nc *nodeConfig) setNode(quickCheck bool) error {
 		if len(nodes.Items) == 0 {
 			return false, nil
 		}
-		// get the node with IP address used to configure it
+		// get the node with IP address used to configure it, node addresses do not have the zone of a scoped address
+		address, _ := instances.SplitZone(nc.Address())
 		for _, node := range nodes.Items {
 			for _, nodeAddress := range node.Status.Addresses {
-				if nc.Address() == nodeAddress.Address {
+				if address == nodeAddress.Address {
 					nc.node = &node
 					return true, nil
 				}
@@ -344,7 +632,8 @@ func (nc *nodeConfig) configureCNI() error {
 		return errors.Wrap(err, "error populating host subnet in node network")
 	}
 	// populate the CNI config file with the host subnet and the service network CIDR
-	configFile, err := nc.network.populateCniConfig(nc.clusterServiceCIDR, payload.CNIConfigTemplatePath)
+	configFile, err := nc.network.populateCniConfig(nc.clusterServiceCIDR, nc.natExceptions,
+		payload.CNIConfigTemplatePath)
 	if err != nil {
 		return errors.Wrapf(err, "error populating CNI config file %s", configFile)
 	}
@@ -359,21 +648,43 @@ func (nc *nodeConfig) configureCNI() error {
 	return nil
 }
 
-// Deconfigure removes the node from the cluster, reverting changes made by the Configure function
-func (nc *nodeConfig) Deconfigure() error {
+// Drain cordons the node and evicts its pods, respecting PodDisruptionBudgets and the termination grace period of the
+// pods. Draining is stopped once the given context is done.
+func (nc *nodeConfig) Drain(ctx context.Context) error {
 	// Set nc.node to the existing node
 	if err := nc.setNode(true); err != nil {
 		return err
 	}
-
-	// Cordon and drain the Node before we interact with the instance
-	drainHelper := &drain.Helper{Ctx: context.TODO(), Client: nc.k8sclientset}
+	drainHelper := &drain.Helper{
+		Ctx:    ctx,
+		Client: nc.k8sclientset,
+		// Use the termination grace period of each pod
+		GracePeriodSeconds: -1,
+		// DaemonSet pods are recreated on the node regardless, and are removed along with it
+		IgnoreAllDaemonSets: true,
+		DeleteEmptyDirData:  true,
+		Out:                 io.Discard,
+		ErrOut:              io.Discard,
+	}
+	if deadline, present := ctx.Deadline(); present {
+		drainHelper.Timeout = time.Until(deadline)
+	}
 	if err := drain.RunCordonOrUncordon(drainHelper, nc.node, true); err != nil {
 		return errors.Wrapf(err, "unable to cordon node %s", nc.node.GetName())
 	}
 	if err := drain.RunNodeDrain(drainHelper, nc.node.GetName()); err != nil {
 		return errors.Wrapf(err, "unable to drain node %s", nc.node.GetName())
 	}
+	return nil
+}
+
+// Deconfigure removes the node from the cluster, reverting changes made by the Configure function. The node should be
+// drained beforehand using Drain, any pods remaining on it are removed along with the node.
+func (nc *nodeConfig) Deconfigure() error {
+	// Set nc.node to the existing node
+	if err := nc.setNode(true); err != nil {
+		return err
+	}
 
 	// Revert the changes we've made to the instance by removing services and deleting all installed files
 	if err := nc.Windows.Deconfigure(); err != nil {
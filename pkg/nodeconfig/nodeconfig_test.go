@@ -3,7 +3,16 @@ package nodeconfig
 import (
 	"testing"
 
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
+	"github.com/openshift/windows-machine-config-operator/pkg/windows"
+	"github.com/openshift/windows-machine-config-operator/version"
 )
 
 // Test_getClusterAddr tests the getClusterAddr function
@@ -49,3 +58,208 @@ func Test_getClusterAddr(t *testing.T) {
 		})
 	}
 }
+
+// TestAddCompletionAnnotations tests that the annotations marking a node as configured are only added to functional
+// nodes
+func TestAddCompletionAnnotations(t *testing.T) {
+	readyCondition := core.NodeCondition{Type: core.NodeReady, Status: core.ConditionTrue}
+	notReadyCondition := core.NodeCondition{Type: core.NodeReady, Status: core.ConditionFalse}
+	networkUnavailableCondition := core.NodeCondition{Type: core.NodeNetworkUnavailable, Status: core.ConditionTrue}
+	networkAvailableCondition := core.NodeCondition{Type: core.NodeNetworkUnavailable, Status: core.ConditionFalse}
+
+	testCases := []struct {
+		name        string
+		annotations map[string]string
+		conditions  []core.NodeCondition
+		expectedErr bool
+	}{
+		{
+			name:        "ready node with network configured",
+			annotations: map[string]string{HybridOverlayMac: "00:00:00:00:00:00"},
+			conditions:  []core.NodeCondition{readyCondition, networkAvailableCondition},
+			expectedErr: false,
+		},
+		{
+			name:        "ready node without network configured",
+			annotations: map[string]string{},
+			conditions:  []core.NodeCondition{readyCondition},
+			expectedErr: true,
+		},
+		{
+			name:        "ready node with network unavailable",
+			annotations: map[string]string{HybridOverlayMac: "00:00:00:00:00:00"},
+			conditions:  []core.NodeCondition{readyCondition, networkUnavailableCondition},
+			expectedErr: true,
+		},
+		{
+			name:        "not ready node",
+			annotations: map[string]string{HybridOverlayMac: "00:00:00:00:00:00"},
+			conditions:  []core.NodeCondition{notReadyCondition},
+			expectedErr: true,
+		},
+		{
+			name:        "node without conditions",
+			annotations: map[string]string{HybridOverlayMac: "00:00:00:00:00:00"},
+			conditions:  nil,
+			expectedErr: true,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			nc := &nodeConfig{configHash: "hash", node: &core.Node{
+				ObjectMeta: meta.ObjectMeta{Annotations: test.annotations},
+				Status:     core.NodeStatus{Conditions: test.conditions},
+			}}
+			err := nc.addCompletionAnnotations()
+			if test.expectedErr {
+				require.Error(t, err)
+				assert.NotContains(t, nc.node.Annotations, VersionAnnotation)
+				assert.NotContains(t, nc.node.Annotations, ConfigHashAnnotation)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, version.Get(), nc.node.Annotations[VersionAnnotation])
+			assert.Equal(t, "hash", nc.node.Annotations[ConfigHashAnnotation])
+		})
+	}
+}
+
+// TestAddTaints tests that the taints of an instance are merged into the taints of its node
+func TestAddTaints(t *testing.T) {
+	existing := core.Taint{Key: "example.com/maintenance", Effect: core.TaintEffectNoExecute}
+	nc := &nodeConfig{
+		node: &core.Node{Spec: core.NodeSpec{Taints: []core.Taint{existing,
+			{Key: "dedicated", Value: "old", Effect: core.TaintEffectNoSchedule}}}},
+		taints: []core.Taint{{Key: "dedicated", Value: "winapp", Effect: core.TaintEffectNoSchedule},
+			{Key: "dedicated", Value: "winapp", Effect: core.TaintEffectPreferNoSchedule}},
+	}
+	nc.addTaints()
+	assert.Equal(t, []core.Taint{existing, {Key: "dedicated", Value: "winapp", Effect: core.TaintEffectNoSchedule},
+		{Key: "dedicated", Value: "winapp", Effect: core.TaintEffectPreferNoSchedule}}, nc.node.Spec.Taints)
+}
+
+// osVersionWindows is a Windows VM which only reports the version of Windows it is running
+type osVersionWindows struct {
+	windows.Windows
+	version string
+	err     error
+}
+
+func (w *osVersionWindows) GetOSVersion() (string, error) {
+	return w.version, w.err
+}
+
+// TestCheckOSVersion tests that only VMs running at least the minimum version of Windows are configured, and that the
+// version is labeled on their node
+func TestCheckOSVersion(t *testing.T) {
+	testCases := []struct {
+		name        string
+		version     string
+		err         error
+		minimum     string
+		unsupported bool
+		expectedErr bool
+	}{
+		{name: "Windows Server 2019", version: "10.0.17763", minimum: "10.0.17763"},
+		{name: "Windows Server 2022", version: "10.0.20348", minimum: "10.0.17763"},
+		{name: "Windows Server 2016", version: "10.0.14393", minimum: "10.0.17763", unsupported: true},
+		{name: "older major version", version: "6.3.9600", minimum: "10.0.17763", unsupported: true},
+		{name: "shorter minimum", version: "10.0.14393", minimum: "10.0"},
+		{name: "check disabled", version: "10.0.14393", minimum: ""},
+		{name: "unparsable version", version: "Windows Server 2019", minimum: "10.0.17763", expectedErr: true},
+		{name: "failure to get version", err: errors.New("connection lost"), minimum: "10.0.17763",
+			expectedErr: true},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			nc := &nodeConfig{Windows: &osVersionWindows{version: test.version, err: test.err},
+				minOSVersion: test.minimum}
+			err := nc.checkOSVersion()
+			var osErr *UnsupportedOSVersionError
+			assert.Equal(t, test.unsupported, errors.As(err, &osErr))
+			if test.expectedErr || test.unsupported {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			nc.node = &core.Node{}
+			nc.addAdditionalLabels()
+			assert.Equal(t, test.version, nc.node.Labels[OSVersionLabel])
+		})
+	}
+}
+
+// metadataWindows is a Windows VM which returns canned output for the commands run on it
+type metadataWindows struct {
+	windows.Windows
+	// output maps the commands which succeed to their output. All other commands fail.
+	output map[string]string
+}
+
+func (w *metadataWindows) Run(cmd string, _ bool) (string, error) {
+	out, present := w.output[cmd]
+	if !present {
+		return "", errors.Errorf("command %s failed", cmd)
+	}
+	return out, nil
+}
+
+// TestCollectHostMetadata tests that node annotations are sourced from the output of commands run on the VM, and that
+// failing commands are skipped without failing the configuration
+func TestCollectHostMetadata(t *testing.T) {
+	annotations, err := instances.ParseMetadataAnnotations(`[
+		{"annotation": "example.com/serial", "command": "(Get-CimInstance Win32_BIOS).SerialNumber"},
+		{"annotation": "example.com/asset", "command": "Get-AssetTag", "template": "asset-{{.Output}}"},
+		{"annotation": "example.com/rack", "command": "Get-Rack"},
+		{"annotation": "example.com/missing", "command": "Get-Missing", "template": "{{.Missing}}"}]`)
+	require.NoError(t, err)
+	nc := &nodeConfig{log: logr.Discard(), metadataAnnotations: annotations,
+		additionalAnnotations: map[string]string{"example.com/asset": "overridden"},
+		Windows: &metadataWindows{output: map[string]string{
+			"(Get-CimInstance Win32_BIOS).SerialNumber": "  VMware-42 \r\n",
+			"Get-AssetTag": "1234",
+			"Get-Missing":  "value",
+		}}}
+	nc.collectHostMetadata()
+	assert.Equal(t, map[string]string{"example.com/serial": "VMware-42", "example.com/asset": "asset-1234"},
+		nc.hostMetadata)
+
+	// Annotations given by the controller take precedence over host metadata
+	nc.node = &core.Node{}
+	nc.addAdditionalAnnotations()
+	assert.Equal(t, map[string]string{"example.com/serial": "VMware-42", "example.com/asset": "overridden"},
+		nc.node.Annotations)
+}
+
+// TestParseMetadataAnnotations tests that invalid host metadata annotations are rejected
+func TestParseMetadataAnnotations(t *testing.T) {
+	testCases := []struct {
+		name        string
+		value       string
+		expectedErr bool
+	}{
+		{name: "empty", value: ""},
+		{name: "valid", value: `[{"annotation": "example.com/serial", "command": "Get-Serial"}]`},
+		{name: "invalid JSON", value: `example.com/serial=Get-Serial`, expectedErr: true},
+		{name: "invalid annotation", value: `[{"annotation": "-serial", "command": "Get-Serial"}]`, expectedErr: true},
+		{name: "missing command", value: `[{"annotation": "example.com/serial"}]`, expectedErr: true},
+		{
+			name: "duplicate annotation",
+			value: `[{"annotation": "example.com/serial", "command": "Get-Serial"},
+				{"annotation": "example.com/serial", "command": "Get-Other"}]`,
+			expectedErr: true,
+		},
+		{
+			name:        "invalid template",
+			value:       `[{"annotation": "example.com/serial", "command": "Get-Serial", "template": "{{.Output"}]`,
+			expectedErr: true,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := instances.ParseMetadataAnnotations(test.value)
+			assert.Equal(t, test.expectedErr, err != nil, "unexpected error: %v", err)
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// queueSize is the number of notifications which can be waiting to be sent. Notifications are dropped once the
+	// queue is full, so that a slow endpoint does not block reconciles.
+	queueSize = 100
+	// attempts is the number of times sending a notification is attempted
+	attempts = 3
+	// defaultRetryInterval is the wait time before the first retry of a failed notification. It is doubled on each
+	// retry.
+	defaultRetryInterval = time.Second
+	// requestTimeout is the timeout of a single attempt to send a notification
+	requestTimeout = 10 * time.Second
+)
+
+// Notification is the body of the request sent to the webhook for each notified event
+type Notification struct {
+	// Type is the type of the event, either Normal or Warning
+	Type string `json:"type"`
+	// Reason is the reason of the event, for example InstanceSetupFailure
+	Reason string `json:"reason"`
+	// Message is the human readable message of the event
+	Message string `json:"message"`
+	// Object is the object the event is about
+	Object ObjectReference `json:"object"`
+	// Timestamp is the time at which the event occurred
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ObjectReference identifies the object an event is about
+type ObjectReference struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// Webhook sends notifications of events to an external endpoint. Notifications are queued and sent in the background
+// once the Webhook is started.
+type Webhook struct {
+	url    string
+	client *http.Client
+	// reasons is the set of event reasons which are notified. All warning events are notified if it is empty.
+	reasons map[string]struct{}
+	queue   chan Notification
+	// retryInterval is the wait time before the first retry of a failed notification
+	retryInterval time.Duration
+	log           logr.Logger
+}
+
+// NewWebhook returns a Webhook sending notifications to the given URL for events with the given reasons. All warning
+// events are notified if no reasons are given.
+func NewWebhook(webhookURL string, reasons []string) (*Webhook, error) {
+	parsedURL, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid webhook URL %s", webhookURL)
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, errors.Errorf("webhook URL %s must use http or https", webhookURL)
+	}
+	w := &Webhook{
+		url:           webhookURL,
+		client:        &http.Client{Timeout: requestTimeout},
+		reasons:       make(map[string]struct{}),
+		queue:         make(chan Notification, queueSize),
+		retryInterval: defaultRetryInterval,
+		log:           ctrl.Log.WithName("notify"),
+	}
+	for _, reason := range reasons {
+		w.reasons[reason] = struct{}{}
+	}
+	return w, nil
+}
+
+// Start sends the queued notifications until the given context is done. It implements the manager.Runnable interface.
+func (w *Webhook) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case notification := <-w.queue:
+			if err := w.send(ctx, notification); err != nil {
+				w.log.Error(err, "unable to send notification", "reason", notification.Reason)
+			}
+		}
+	}
+}
+
+// notifies returns true if events of the given type and reason are notified
+func (w *Webhook) notifies(eventType, reason string) bool {
+	if len(w.reasons) == 0 {
+		return eventType == core.EventTypeWarning
+	}
+	_, present := w.reasons[reason]
+	return present
+}
+
+// enqueue queues the given notification to be sent, dropping it if the queue is full
+func (w *Webhook) enqueue(notification Notification) {
+	select {
+	case w.queue <- notification:
+	default:
+		w.log.Info("notification queue is full, dropping notification", "reason", notification.Reason)
+	}
+}
+
+// send posts the given notification to the webhook, retrying on failure
+func (w *Webhook) send(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal notification")
+	}
+	interval := w.retryInterval
+	for attempt := 1; ; attempt++ {
+		err = w.post(ctx, body)
+		if err == nil || attempt == attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+	}
+}
+
+// post makes a single request to the webhook with the given body
+func (w *Webhook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "unable to create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+// recorder is an EventRecorder which also queues a notification for each notified event
+type recorder struct {
+	record.EventRecorder
+	webhook *Webhook
+}
+
+// NewRecorder returns an EventRecorder which records events using the given recorder, and notifies the given webhook
+// of them. The given recorder is returned as is if webhook is nil.
+func NewRecorder(eventRecorder record.EventRecorder, webhook *Webhook) record.EventRecorder {
+	if webhook == nil {
+		return eventRecorder
+	}
+	return &recorder{EventRecorder: eventRecorder, webhook: webhook}
+}
+
+func (r *recorder) Event(object runtime.Object, eventtype, reason, message string) {
+	r.EventRecorder.Event(object, eventtype, reason, message)
+	r.notify(object, eventtype, reason, message)
+}
+
+func (r *recorder) Eventf(object runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.EventRecorder.Eventf(object, eventtype, reason, messageFmt, args...)
+	r.notify(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+func (r *recorder) AnnotatedEventf(object runtime.Object, annotations map[string]string, eventtype, reason,
+	messageFmt string, args ...interface{}) {
+	r.EventRecorder.AnnotatedEventf(object, annotations, eventtype, reason, messageFmt, args...)
+	r.notify(object, eventtype, reason, fmt.Sprintf(messageFmt, args...))
+}
+
+// notify queues a notification of the given event if events of its type and reason are notified
+func (r *recorder) notify(object runtime.Object, eventtype, reason, message string) {
+	if !r.webhook.notifies(eventtype, reason) {
+		return
+	}
+	r.webhook.enqueue(Notification{
+		Type:      eventtype,
+		Reason:    reason,
+		Message:   message,
+		Object:    objectReference(object),
+		Timestamp: time.Now(),
+	})
+}
+
+// objectReference returns a reference to the given object
+func objectReference(object runtime.Object) ObjectReference {
+	// The kind is not set on objects retrieved using typed clients, so fall back to the name of the type
+	ref := ObjectReference{Kind: object.GetObjectKind().GroupVersionKind().Kind}
+	if ref.Kind == "" {
+		ref.Kind = reflect.Indirect(reflect.ValueOf(object)).Type().Name()
+	}
+	if accessor, err := meta.Accessor(object); err == nil {
+		ref.Namespace = accessor.GetNamespace()
+		ref.Name = accessor.GetName()
+	}
+	return ref
+}
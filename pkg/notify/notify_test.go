@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestNewWebhook(t *testing.T) {
+	_, err := NewWebhook("https://example.com/hook", nil)
+	assert.NoError(t, err)
+	_, err = NewWebhook("ftp://example.com/hook", nil)
+	assert.Error(t, err)
+	_, err = NewWebhook("://example.com", nil)
+	assert.Error(t, err)
+}
+
+func TestNotifies(t *testing.T) {
+	w, err := NewWebhook("https://example.com/hook", nil)
+	require.NoError(t, err)
+	assert.True(t, w.notifies(core.EventTypeWarning, "InstanceSetupFailure"))
+	assert.False(t, w.notifies(core.EventTypeNormal, "MachineSetup"))
+
+	w, err = NewWebhook("https://example.com/hook", []string{"MachineSetup"})
+	require.NoError(t, err)
+	assert.False(t, w.notifies(core.EventTypeWarning, "InstanceSetupFailure"))
+	assert.True(t, w.notifies(core.EventTypeNormal, "MachineSetup"))
+}
+
+// TestRecorder tests that events are recorded, and that notified events are queued without blocking once the queue is
+// full
+func TestRecorder(t *testing.T) {
+	w, err := NewWebhook("https://example.com/hook", nil)
+	require.NoError(t, err)
+	fakeRecorder := record.NewFakeRecorder(queueSize + 2)
+	r := NewRecorder(fakeRecorder, w)
+	node := &core.Node{ObjectMeta: meta.ObjectMeta{Name: "node"}}
+
+	r.Eventf(node, core.EventTypeNormal, "KeyRotated", "rotated the key of node %s", "node")
+	assert.Len(t, w.queue, 0)
+	for i := 0; i <= queueSize; i++ {
+		r.Eventf(node, core.EventTypeWarning, "InstanceSetupFailure", "unable to configure %s", "node")
+	}
+	assert.Len(t, fakeRecorder.Events, queueSize+2)
+	require.Len(t, w.queue, queueSize)
+
+	notification := <-w.queue
+	assert.Equal(t, core.EventTypeWarning, notification.Type)
+	assert.Equal(t, "InstanceSetupFailure", notification.Reason)
+	assert.Equal(t, "unable to configure node", notification.Message)
+	assert.Equal(t, ObjectReference{Kind: "Node", Name: "node"}, notification.Object)
+}
+
+func TestNewRecorderWithoutWebhook(t *testing.T) {
+	fakeRecorder := record.NewFakeRecorder(1)
+	assert.Equal(t, fakeRecorder, NewRecorder(fakeRecorder, nil))
+}
+
+// TestSend tests that notifications are posted to the webhook, and retried on failure
+func TestSend(t *testing.T) {
+	var received []Notification
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if failures > 0 {
+			failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var notification Notification
+		require.NoError(t, json.NewDecoder(req.Body).Decode(&notification))
+		received = append(received, notification)
+	}))
+	defer server.Close()
+
+	w, err := NewWebhook(server.URL, nil)
+	require.NoError(t, err)
+	w.retryInterval = time.Millisecond
+	require.NoError(t, w.send(context.Background(), Notification{Type: core.EventTypeWarning,
+		Reason: "NodeCountMismatch", Object: ObjectReference{Kind: "ConfigMap", Name: "windows-instances"}}))
+	require.Len(t, received, 1)
+	assert.Equal(t, "NodeCountMismatch", received[0].Reason)
+
+	failures = attempts
+	assert.Error(t, w.send(context.Background(), Notification{Reason: "NodeCountMismatch"}))
+}
@@ -2,12 +2,15 @@ package secrets
 
 import (
 	"context"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeTypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/clientcmd"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -20,20 +23,65 @@ const (
 	PrivateKeySecret = "cloud-private-key"
 	// PrivateKeySecretKey is the key within the private key secret which holds the private key
 	PrivateKeySecretKey = "private-key.pem"
+	// PrivateKeyPassphraseKey is the optional key within the private key secret which holds the passphrase the private
+	// key is encrypted with
+	PrivateKeyPassphraseKey = "passphrase"
+	// PrivateKeyRotationSecret is the name of the secret provided by the user holding the private key that the BYOH
+	// instances should be rotated to. It uses the same data key as the private key secret.
+	PrivateKeyRotationSecret = "cloud-private-key-rotation"
+	// BootstrapKubeconfigSecretKey is the key within a bootstrap kubeconfig secret provided by the user which holds the
+	// kubeconfig
+	BootstrapKubeconfigSecretKey = "kubeconfig"
+	// AuthSecretPasswordKey is the key within an auth secret provided by the user which holds the password of an
+	// instance
+	AuthSecretPasswordKey = "password"
 )
 
-// GetPrivateKey fetches the specified secret and extracts the private key data
-func GetPrivateKey(secret kubeTypes.NamespacedName, c client.Client) ([]byte, error) {
+// GetPrivateKey fetches the specified secret and extracts the private key data, along with the passphrase the private
+// key is encrypted with, which is nil if the secret does not hold one. The error returned if the secret does not hold
+// the private key under PrivateKeySecretKey names the keys it holds instead, as the private key is commonly added under
+// a different key, such as id_rsa.
+func GetPrivateKey(secret kubeTypes.NamespacedName, c client.Client) ([]byte, []byte, error) {
 	privateKeySecret := &core.Secret{}
 	if err := c.Get(context.TODO(), secret, privateKeySecret); err != nil {
 		// Error reading the object - requeue the request.
-		return []byte{}, err
+		return []byte{}, nil, err
 	}
 	privateKey, ok := privateKeySecret.Data[PrivateKeySecretKey]
 	if !ok {
-		return []byte{}, errors.New("cloud-private-key missing 'private-key.pem' secret")
+		return []byte{}, nil, missingKeyError(secret.Name, PrivateKeySecretKey, privateKeySecret.Data)
 	}
-	return privateKey, nil
+	return privateKey, privateKeySecret.Data[PrivateKeyPassphraseKey], nil
+}
+
+// GetBootstrapKubeconfig fetches the specified secret and extracts the bootstrap kubeconfig data, ensuring that it is a
+// valid kubeconfig
+func GetBootstrapKubeconfig(secret kubeTypes.NamespacedName, c client.Client) ([]byte, error) {
+	kubeconfigSecret := &core.Secret{}
+	if err := c.Get(context.TODO(), secret, kubeconfigSecret); err != nil {
+		return nil, err
+	}
+	kubeconfig, ok := kubeconfigSecret.Data[BootstrapKubeconfigSecretKey]
+	if !ok {
+		return nil, errors.Errorf("%s missing '%s' secret", secret.Name, BootstrapKubeconfigSecretKey)
+	}
+	if _, err := clientcmd.Load(kubeconfig); err != nil {
+		return nil, errors.Wrapf(err, "%s contains an invalid kubeconfig", secret.Name)
+	}
+	return kubeconfig, nil
+}
+
+// GetPassword fetches the specified auth secret and extracts the password data
+func GetPassword(secret kubeTypes.NamespacedName, c client.Client) (string, error) {
+	authSecret := &core.Secret{}
+	if err := c.Get(context.TODO(), secret, authSecret); err != nil {
+		return "", err
+	}
+	password, ok := authSecret.Data[AuthSecretPasswordKey]
+	if !ok || len(password) == 0 {
+		return "", errors.Errorf("%s missing '%s' secret", secret.Name, AuthSecretPasswordKey)
+	}
+	return string(password), nil
 }
 
 // GenerateUserData generates the desired value of userdata secret.
@@ -80,3 +128,17 @@ func GenerateUserData(publicKey ssh.PublicKey) (*core.Secret, error) {
 
 	return userDataSecret, nil
 }
+
+// missingKeyError returns an error reporting that the secret with the given name, holding the given data, is missing
+// the expected key
+func missingKeyError(name, expected string, data map[string][]byte) error {
+	if len(data) == 0 {
+		return errors.Errorf("secret %s has no data, expected the '%s' key", name, expected)
+	}
+	found := make([]string, 0, len(data))
+	for key := range data {
+		found = append(found, key)
+	}
+	sort.Strings(found)
+	return errors.Errorf("secret %s is missing the '%s' key, found keys: %s", name, expected, strings.Join(found, ", "))
+}
@@ -1,6 +1,13 @@
 package signer
 
 import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	kubeTypes "k8s.io/apimachinery/pkg/types"
@@ -9,15 +16,63 @@ import (
 	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
 )
 
-// Create creates a signer using the private key data
+// Create creates a signer using the private key data. RSA, ECDSA and Ed25519 keys are supported. An encrypted private
+// key is decrypted with the passphrase held by the secret.
 func Create(secret kubeTypes.NamespacedName, c client.Client) (ssh.Signer, error) {
-	privateKey, err := secrets.GetPrivateKey(secret, c)
+	privateKey, passphrase, err := secrets.GetPrivateKey(secret, c)
 	if err != nil {
 		return nil, err
 	}
-	signer, err := ssh.ParsePrivateKey(privateKey)
+	return fromPrivateKey(privateKey, passphrase)
+}
+
+// fromPrivateKey returns a signer using the given PEM encoded private key, which must be an RSA, ECDSA or Ed25519 key.
+// If the private key is encrypted, it is decrypted with the given passphrase.
+func fromPrivateKey(privateKey, passphrase []byte) (ssh.Signer, error) {
+	key, err := ssh.ParseRawPrivateKey(privateKey)
+	var passphraseErr *ssh.PassphraseMissingError
+	if errors.As(err, &passphraseErr) {
+		if len(passphrase) == 0 {
+			return nil, errors.Errorf("private key is encrypted, but no passphrase is set under the %s key",
+				secrets.PrivateKeyPassphraseKey)
+		}
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase(privateKey, passphrase)
+		if err == x509.IncorrectPasswordError {
+			return nil, errors.New("incorrect passphrase for encrypted private key")
+		}
+	}
 	if err != nil {
+		// The PEM block type is the only indication of the key type available if the key cannot be parsed
+		if block, _ := pem.Decode(privateKey); block != nil {
+			return nil, errors.Wrapf(err, "unable to parse private key of PEM type %q", block.Type)
+		}
 		return nil, errors.Wrap(err, "unable to parse private key")
 	}
+	keyType := keyTypeName(key)
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey, *ed25519.PrivateKey:
+	default:
+		return nil, errors.Errorf("unsupported %s private key, expected an RSA, ECDSA or Ed25519 key", keyType)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create signer from %s private key", keyType)
+	}
 	return signer, nil
 }
+
+// keyTypeName returns the name of the algorithm of the given private key
+func keyTypeName(key interface{}) string {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "RSA"
+	case *ecdsa.PrivateKey:
+		return "ECDSA"
+	case ed25519.PrivateKey, *ed25519.PrivateKey:
+		return "Ed25519"
+	case *dsa.PrivateKey:
+		return "DSA"
+	default:
+		return "unknown"
+	}
+}
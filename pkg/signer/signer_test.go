@@ -0,0 +1,163 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	core "k8s.io/api/core/v1"
+	kubeTypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/secrets"
+)
+
+// TestFromPrivateKey tests that signers are created from RSA, ECDSA and Ed25519 keys, either unencrypted or encrypted
+// with the given passphrase, and that invalid keys are rejected with an error naming the key type
+func TestFromPrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecdsaBytes, err := x509.MarshalECPrivateKey(ecdsaKey)
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ed25519Bytes, err := x509.MarshalPKCS8PrivateKey(ed25519Key)
+	require.NoError(t, err)
+	rsaPKCS8Bytes, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	require.NoError(t, err)
+	encryptedBlock, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey),
+		[]byte("secret"), x509.PEMCipherAES256)
+	require.NoError(t, err)
+	encryptedKey := pem.EncodeToMemory(encryptedBlock)
+
+	tests := []struct {
+		name            string
+		privateKey      []byte
+		passphrase      []byte
+		expectedKeyType string
+		expectedErr     string
+	}{
+		{
+			name:            "RSA",
+			privateKey:      pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}),
+			expectedKeyType: ssh.KeyAlgoRSA,
+		},
+		{
+			name:            "RSA PKCS8",
+			privateKey:      pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rsaPKCS8Bytes}),
+			expectedKeyType: ssh.KeyAlgoRSA,
+		},
+		{
+			name:            "ECDSA",
+			privateKey:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecdsaBytes}),
+			expectedKeyType: ssh.KeyAlgoECDSA256,
+		},
+		{
+			name:            "Ed25519",
+			privateKey:      pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ed25519Bytes}),
+			expectedKeyType: ssh.KeyAlgoED25519,
+		},
+		{
+			name:            "passphrase of unencrypted key is ignored",
+			privateKey:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecdsaBytes}),
+			passphrase:      []byte("secret"),
+			expectedKeyType: ssh.KeyAlgoECDSA256,
+		},
+		{
+			name:            "encrypted RSA",
+			privateKey:      encryptedKey,
+			passphrase:      []byte("secret"),
+			expectedKeyType: ssh.KeyAlgoRSA,
+		},
+		{
+			name:        "encrypted RSA without passphrase",
+			privateKey:  encryptedKey,
+			expectedErr: "private key is encrypted, but no passphrase is set under the passphrase key",
+		},
+		{
+			name:        "encrypted RSA with incorrect passphrase",
+			privateKey:  encryptedKey,
+			passphrase:  []byte("incorrect"),
+			expectedErr: "incorrect passphrase for encrypted private key",
+		},
+		{
+			name:        "malformed ECDSA",
+			privateKey:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("invalid")}),
+			expectedErr: `PEM type "EC PRIVATE KEY"`,
+		},
+		{
+			name:        "unsupported PEM type",
+			privateKey:  pem.EncodeToMemory(&pem.Block{Type: "UNKNOWN PRIVATE KEY", Bytes: []byte("invalid")}),
+			expectedErr: `PEM type "UNKNOWN PRIVATE KEY"`,
+		},
+		{
+			name:        "not PEM encoded",
+			privateKey:  []byte("invalid"),
+			expectedErr: "unable to parse private key",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signer, err := fromPrivateKey(test.privateKey, test.passphrase)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedKeyType, signer.PublicKey().Type())
+		})
+	}
+}
+
+// secretClient is a client which serves a single secret. All other requests are unimplemented.
+type secretClient struct {
+	client.Client
+	secret *core.Secret
+}
+
+func (c *secretClient) Get(_ context.Context, _ client.ObjectKey, obj client.Object) error {
+	c.secret.DeepCopyInto(obj.(*core.Secret))
+	return nil
+}
+
+// TestCreateMissingKey tests that a private key secret holding the private key under an unexpected key is rejected with
+// an error naming the expected key and the keys which were found
+func TestCreateMissingKey(t *testing.T) {
+	name := kubeTypes.NamespacedName{Namespace: "openshift-windows-machine-config-operator",
+		Name: secrets.PrivateKeySecret}
+	tests := []struct {
+		name        string
+		data        map[string][]byte
+		expectedErr string
+	}{
+		{
+			name: "wrong key",
+			data: map[string][]byte{"id_rsa": []byte("key"), "id_rsa.pub": []byte("public key")},
+			expectedErr: "secret cloud-private-key is missing the 'private-key.pem' key, found keys: id_rsa, " +
+				"id_rsa.pub",
+		},
+		{
+			name:        "no data",
+			expectedErr: "secret cloud-private-key has no data, expected the 'private-key.pem' key",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Create(name, &secretClient{secret: &core.Secret{Data: test.data}})
+			require.Error(t, err)
+			assert.Equal(t, test.expectedErr, err.Error())
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/openshift/windows-machine-config-operator/version"
+)
+
+const (
+	// tracerName is the name of the tracer creating the spans of the operator
+	tracerName = "github.com/openshift/windows-machine-config-operator"
+	// serviceName is the service the spans of the operator are reported under
+	serviceName = "windows-machine-config-operator"
+)
+
+// Setup configures the spans of the operator to be exported over OTLP, through a plaintext gRPC connection to the
+// collector listening on the given endpoint, such as otel-collector:4317. Tracing is disabled if the endpoint is
+// empty, in which case spans are not recorded. The returned function flushes the spans which have not been exported
+// yet, and stops the export.
+func Setup(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to export traces to %s", endpoint)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(version.Get()))))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span with the given name and attributes, as a child of the span of the given context if it has
+// one, returning a context holding the new span
+func StartSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan ends the given span, marking it as failed with the given error if it is not nil
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Address returns a span attribute holding the address of the instance an operation is performed on
+func Address(address string) attribute.KeyValue {
+	return attribute.String("wmco.instance.address", address)
+}
+
+// reconciler records a span for each reconcile of the reconciler it wraps, which the spans started while reconciling
+// are children of
+type reconciler struct {
+	reconcile.Reconciler
+	// name is the name of the spans
+	name string
+}
+
+// Reconciler returns a reconciler recording a span with the given name for each reconcile of the given reconciler
+func Reconciler(name string, r reconcile.Reconciler) reconcile.Reconciler {
+	return &reconciler{Reconciler: r, name: name}
+}
+
+// Reconcile reconciles the given request with the wrapped reconciler, within a span
+func (r *reconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	ctx, span := StartSpan(ctx, r.name, attribute.String("k8s.namespace.name", req.Namespace),
+		attribute.String("k8s.object.name", req.Name))
+	result, err := r.Reconciler.Reconcile(ctx, req)
+	EndSpan(span, err)
+	return result, err
+}
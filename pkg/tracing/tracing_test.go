@@ -0,0 +1,72 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// reconcileFunc is a reconciler starting a span for a single operation, which fails with the given error
+type reconcileFunc struct {
+	err error
+}
+
+func (f reconcileFunc) Reconcile(ctx context.Context, _ reconcile.Request) (reconcile.Result, error) {
+	_, span := StartSpan(ctx, "ConfigureInstance", Address("10.0.0.1"))
+	EndSpan(span, f.err)
+	return reconcile.Result{}, f.err
+}
+
+func TestReconciler(t *testing.T) {
+	testCases := []struct {
+		name           string
+		err            error
+		expectedStatus codes.Code
+	}{
+		{
+			name:           "successful reconcile",
+			expectedStatus: codes.Unset,
+		},
+		{
+			name:           "failed reconcile",
+			err:            fmt.Errorf("unable to connect"),
+			expectedStatus: codes.Error,
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			previous := otel.GetTracerProvider()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+			defer otel.SetTracerProvider(previous)
+
+			_, err := Reconciler("ReconcileConfigMap", reconcileFunc{err: test.err}).Reconcile(context.Background(),
+				reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "wmco", Name: "windows-instances"}})
+			assert.Equal(t, test.err, err)
+
+			spans := recorder.Ended()
+			require.Len(t, spans, 2)
+			child, root := spans[0], spans[1]
+			assert.Equal(t, "ConfigureInstance", child.Name())
+			assert.Equal(t, "ReconcileConfigMap", root.Name())
+			assert.Equal(t, root.SpanContext().SpanID(), child.Parent().SpanID())
+			assert.Equal(t, test.expectedStatus, root.Status().Code)
+			assert.Equal(t, test.expectedStatus, child.Status().Code)
+		})
+	}
+}
+
+func TestSetupDisabled(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "")
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+}
@@ -3,8 +3,11 @@ package windows
 import (
 	"fmt"
 	"io"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,11 +17,22 @@ import (
 	"golang.org/x/crypto/ssh"
 	"k8s.io/apimachinery/pkg/util/wait"
 
+	"github.com/openshift/windows-machine-config-operator/pkg/instances"
 	"github.com/openshift/windows-machine-config-operator/pkg/retry"
 )
 
-// sshPort is the default SSH port
-const sshPort = "22"
+// DefaultSSHPort is the default SSH port
+const DefaultSSHPort = 22
+
+// DefaultSSHSessionLimit is the default maximum number of concurrent SSH sessions to a single VM
+const DefaultSSHSessionLimit = 2
+
+// DefaultSSHDialTimeout is the default maximum duration of a single attempt to connect to the SSH server of a VM,
+// including the SSH handshake
+const DefaultSSHDialTimeout = 30 * time.Second
+
+// DefaultSSHCommandTimeout is the default maximum duration of a command run on a VM, or of a file transfer to it
+const DefaultSSHCommandTimeout = 5 * time.Minute
 
 // AuthErr occurs when our authentication into the VM is rejected
 type AuthErr struct {
@@ -34,6 +48,35 @@ func newAuthErr(err error) *AuthErr {
 	return &AuthErr{err: err.Error()}
 }
 
+// TimeoutErr occurs when the VM does not accept an SSH connection within retry.Timeout. Unlike an AuthErr, it is
+// expected to be transient, for example while the VM is still booting.
+type TimeoutErr struct {
+	err string
+}
+
+func (e *TimeoutErr) Error() string {
+	return fmt.Sprintf("SSH connection timed out: %s", e.err)
+}
+
+// newTimeoutErr returns a new TimeoutErr, holding the last error encountered connecting to the VM
+func newTimeoutErr(err error) *TimeoutErr {
+	if err == nil {
+		return &TimeoutErr{err: fmt.Sprintf("no connection within %s", retry.Timeout)}
+	}
+	return &TimeoutErr{err: err.Error()}
+}
+
+// CommandTimeoutErr occurs when a command run on the VM, or a file transfer to it, does not complete within the command
+// timeout. The SSH session is closed, and the operation on the VM is aborted.
+type CommandTimeoutErr struct {
+	operation string
+	timeout   time.Duration
+}
+
+func (e *CommandTimeoutErr) Error() string {
+	return fmt.Sprintf("%s did not complete within %s", e.operation, e.timeout)
+}
+
 type connectivity interface {
 	// run executes the given command on the remote system
 	run(cmd string) (string, error)
@@ -49,20 +92,61 @@ type sshConnectivity struct {
 	username string
 	// ipAddress is the VM's IP address
 	ipAddress string
+	// port is the port the SSH server of the VM listens on
+	port int
 	// signer is used for authenticating against the VM
 	signer ssh.Signer
+	// password is used for authenticating against the VM if it is set, when key based authentication fails
+	password string
 	// sshClient is the client used to access the Windows VM via ssh
 	sshClient *ssh.Client
-	log       logr.Logger
+	// proxy is the URL of the proxy the SSH connection is tunneled through, the VM is connected to directly if it is
+	// nil. If bastion is set, the proxy is used to reach the bastion instead.
+	proxy *url.URL
+	// bastion is the jump host the SSH connection is tunneled through, the VM is connected to directly if it is nil
+	bastion *instances.Bastion
+	// sessions limits the number of concurrent SSH sessions to the VM, each session holding a slot while in use
+	sessions chan struct{}
+	// dialTimeout bounds each attempt to connect to the SSH server of the VM, or of the bastion
+	dialTimeout time.Duration
+	// commandTimeout bounds each command run on the VM and each file transfer to it
+	commandTimeout time.Duration
+	log            logr.Logger
 }
 
-// newSshConnectivity returns an instance of sshConnectivity
-func newSshConnectivity(username, ipAddress string, signer ssh.Signer, logger logr.Logger) (connectivity, error) {
+// newSshConnectivity returns an instance of sshConnectivity. port is the port the SSH server of the VM listens on, with
+// DefaultSSHPort being used if it is 0. At least one of signer and password must be given, with key based
+// authentication being attempted first if both are. sessionLimit is the maximum number of concurrent SSH sessions to
+// the VM, with DefaultSSHSessionLimit being used if it is not positive. dialTimeout and commandTimeout bound each
+// connection attempt and each command, with DefaultSSHDialTimeout and DefaultSSHCommandTimeout being used if they are
+// not positive. The SSH connection is tunneled through the given bastion and proxy, unless they are nil.
+func newSshConnectivity(username, ipAddress string, port int, signer ssh.Signer, password string, sessionLimit int,
+	dialTimeout, commandTimeout time.Duration, proxy *url.URL, bastion *instances.Bastion,
+	logger logr.Logger) (connectivity, error) {
+	if port == 0 {
+		port = DefaultSSHPort
+	}
+	if sessionLimit <= 0 {
+		sessionLimit = DefaultSSHSessionLimit
+	}
+	if dialTimeout <= 0 {
+		dialTimeout = DefaultSSHDialTimeout
+	}
+	if commandTimeout <= 0 {
+		commandTimeout = DefaultSSHCommandTimeout
+	}
 	c := &sshConnectivity{
-		username:  username,
-		ipAddress: ipAddress,
-		signer:    signer,
-		log:       logger,
+		username:       username,
+		ipAddress:      ipAddress,
+		port:           port,
+		signer:         signer,
+		password:       password,
+		sessions:       make(chan struct{}, sessionLimit),
+		dialTimeout:    dialTimeout,
+		commandTimeout: commandTimeout,
+		proxy:          proxy,
+		bastion:        bastion,
+		log:            logger,
 	}
 	if err := c.init(); err != nil {
 		return nil, errors.Wrap(err, "error instantiating SSH client")
@@ -70,34 +154,44 @@ func newSshConnectivity(username, ipAddress string, signer ssh.Signer, logger lo
 	return c, nil
 }
 
-// init initialises the key based SSH client
+// init initialises the SSH client, using key based authentication, password authentication, or both
 func (c *sshConnectivity) init() error {
-	if c.username == "" || c.ipAddress == "" || c.signer == nil {
-		return fmt.Errorf("incomplete sshConnectivity information: %v", c)
+	if c.username == "" || c.ipAddress == "" || (c.signer == nil && c.password == "") {
+		// The struct is not printed, as it holds the password
+		return fmt.Errorf("incomplete sshConnectivity information for user %q at %q", c.username, c.ipAddress)
 	}
 
+	var authMethods []ssh.AuthMethod
+	if c.signer != nil {
+		authMethods = append(authMethods, ssh.PublicKeys(c.signer))
+	}
+	if c.password != "" {
+		authMethods = append(authMethods, ssh.Password(c.password))
+	}
 	config := &ssh.ClientConfig{
-		User: c.username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(c.signer),
-		},
+		User:            c.username,
+		Auth:            authMethods,
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
-	var err error
 	var sshClient *ssh.Client
+	// dialErr is the error of the last attempt to connect to the VM
+	var dialErr error
 	// Retry if we are unable to create a client as the VM could still be executing the steps in its user data
-	err = wait.PollImmediate(time.Minute, retry.Timeout, func() (bool, error) {
-		sshClient, err = ssh.Dial("tcp", c.ipAddress+":"+sshPort, config)
-		if err == nil {
+	err := wait.PollImmediate(time.Minute, retry.Timeout, func() (bool, error) {
+		sshClient, dialErr = c.dial(config)
+		if dialErr == nil {
 			return true, nil
 		}
-		c.log.V(1).Info("SSH dial", "IP Address", c.ipAddress, "error", err)
-		if strings.Contains(err.Error(), "unable to authenticate") {
+		c.log.V(1).Info("SSH dial", "IP Address", c.ipAddress, "error", dialErr)
+		if strings.Contains(dialErr.Error(), "unable to authenticate") {
 			// Authentication failure is a special case that must be handled differently
-			return false, newAuthErr(err)
+			return false, newAuthErr(dialErr)
 		}
 		return false, nil
 	})
+	if err == wait.ErrWaitTimeout {
+		err = newTimeoutErr(dialErr)
+	}
 	if err != nil {
 		return errors.Wrapf(err, "unable to connect to Windows VM %s", c.ipAddress)
 	}
@@ -105,11 +199,85 @@ func (c *sshConnectivity) init() error {
 	return nil
 }
 
+// dial connects to the SSH server of the VM, tunneling the connection through the bastion if one is set, and through
+// the proxy if one is set
+func (c *sshConnectivity) dial(config *ssh.ClientConfig) (*ssh.Client, error) {
+	address := net.JoinHostPort(c.ipAddress, strconv.Itoa(c.port))
+	if c.bastion == nil {
+		return dialSSH(address, c.proxy, config, c.dialTimeout)
+	}
+	if c.bastion.Signer == nil {
+		return nil, errors.Errorf("no credentials to authenticate against bastion %s", c.bastion.HostPort())
+	}
+	bastionClient, err := dialSSH(c.bastion.HostPort(), c.proxy, &ssh.ClientConfig{
+		User:            c.bastion.Username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(c.bastion.Signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, c.dialTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to connect to bastion %s", c.bastion.HostPort())
+	}
+	conn, err := bastionClient.Dial("tcp", address)
+	if err != nil {
+		bastionClient.Close()
+		return nil, errors.Wrapf(err, "unable to reach %s through bastion %s", address, c.bastion.HostPort())
+	}
+	client, err := newClient(conn, address, config, c.dialTimeout)
+	if err != nil {
+		bastionClient.Close()
+		return nil, err
+	}
+	// The connection to the bastion is only needed for as long as the connection to the VM is open
+	go func() {
+		client.Wait()
+		bastionClient.Close()
+	}()
+	return client, nil
+}
+
+// dialSSH connects to the SSH server at the given address, tunneling the connection through the given proxy unless it
+// is nil. Connecting to the server and the SSH handshake must complete within the given timeout.
+func dialSSH(address string, proxy *url.URL, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if proxy == nil {
+		conn, err = net.DialTimeout("tcp", address, timeout)
+	} else {
+		conn, err = dialThroughProxy(proxy, address, proxyConnectTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, address, config, timeout)
+}
+
+// newClient returns an SSH client using the given connection to the SSH server at the given address. The connection is
+// closed if the SSH handshake fails, or does not complete within the given timeout.
+func newClient(conn net.Conn, address string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The deadline only applies to the handshake, commands are bounded by the command timeout instead
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		sshConn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
 // run instantiates a new SSH session and runs the command on the VM and returns the combined stdout and stderr output
 func (c *sshConnectivity) run(cmd string) (string, error) {
 	if c.sshClient == nil {
 		return "", errors.New("run cannot be called with nil SSH client")
 	}
+	c.acquireSession()
+	defer c.releaseSession()
 
 	session, err := c.sshClient.NewSession()
 	if err != nil {
@@ -123,29 +291,75 @@ func (c *sshConnectivity) run(cmd string) (string, error) {
 		}
 	}()
 
-	out, err := session.CombinedOutput(cmd)
+	// The output is only read once the command has completed, as it is written to after a timeout
+	var out []byte
+	err = c.withTimeout("command", func() error {
+		var runErr error
+		out, runErr = session.CombinedOutput(cmd)
+		return runErr
+	}, func() { session.Close() })
+	var timeoutErr *CommandTimeoutErr
+	if errors.As(err, &timeoutErr) {
+		return "", err
+	}
 	if err != nil {
 		return string(out), err
 	}
 	return string(out), nil
 }
 
+// withTimeout runs the given operation, and calls abort to interrupt it if it does not complete within the command
+// timeout, in which case a CommandTimeoutErr is returned without waiting for the operation to return
+func (c *sshConnectivity) withTimeout(operation string, run func() error, abort func()) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- run()
+	}()
+	timer := time.NewTimer(c.commandTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		c.log.Info("aborting SSH operation", "operation", operation, "timeout", c.commandTimeout)
+		abort()
+		return &CommandTimeoutErr{operation: operation, timeout: c.commandTimeout}
+	}
+}
+
 // transfer uses FTP to copy the file from the local disk to the remote VM directory, creating the directory if needed
 func (c *sshConnectivity) transfer(filePath, remoteDir string) error {
 	if c.sshClient == nil {
 		return errors.New("transfer cannot be called with nil SSH client")
 	}
+	c.acquireSession()
+	defer c.releaseSession()
 
 	ftp, err := sftp.NewClient(c.sshClient)
 	if err != nil {
 		return err
 	}
+	// The FTP connection is closed to abort the transfer if it times out
+	aborted := false
 	defer func() {
+		if aborted {
+			return
+		}
 		if err := ftp.Close(); err != nil {
 			c.log.Error(err, "error closing FTP connection")
 		}
 	}()
+	return c.withTimeout("transfer of "+filePath, func() error {
+		return c.copyFile(ftp, filePath, remoteDir)
+	}, func() {
+		aborted = true
+		ftp.Close()
+	})
+}
 
+// copyFile copies the file from the local disk to the remote VM directory over the given FTP connection, creating the
+// directory if needed
+func (c *sshConnectivity) copyFile(ftp *sftp.Client, filePath, remoteDir string) error {
 	f, err := os.Open(filePath)
 	if err != nil {
 		return errors.Wrapf(err, "error opening %s file to be transferred", filePath)
@@ -177,3 +391,13 @@ func (c *sshConnectivity) transfer(filePath, remoteDir string) error {
 	}
 	return nil
 }
+
+// acquireSession blocks until the number of concurrent SSH sessions to the VM is below the limit, and takes a slot
+func (c *sshConnectivity) acquireSession() {
+	c.sessions <- struct{}{}
+}
+
+// releaseSession frees the slot taken by acquireSession
+func (c *sshConnectivity) releaseSession() {
+	<-c.sessions
+}
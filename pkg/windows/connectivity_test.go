@@ -0,0 +1,190 @@
+package windows
+
+import (
+	"crypto/ed25519"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// startSSHServer starts an SSH server accepting any client, which passes the command of each exec request to the given
+// handler along with the channel of the session, and returns the address of the server
+func startSSHServer(t *testing.T, handle func(channel ssh.Channel, command string)) string {
+	_, key, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	hostKey, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for newChannel := range channels {
+					channel, channelRequests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go func() {
+						for req := range channelRequests {
+							if req.Type != "exec" {
+								req.Reply(false, nil)
+								continue
+							}
+							req.Reply(true, nil)
+							var payload struct{ Command string }
+							if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+								go handle(channel, payload.Command)
+							}
+						}
+					}()
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// TestDialTimeout tests that connecting to a server which never completes the SSH handshake is aborted at the dial
+// timeout
+func TestDialTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	// Connections are accepted, but nothing is ever sent on them
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	_, err = dialSSH(listener.Addr().String(), nil, &ssh.ClientConfig{User: "core",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey()}, 200*time.Millisecond)
+	require.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+// TestCommandTimeout tests that a command which hangs is aborted at the command timeout, closing its session, while
+// commands completing in time return their output
+func TestCommandTimeout(t *testing.T) {
+	// aborted is closed once the session of the hanging command is closed by the client
+	aborted := make(chan struct{})
+	address := startSSHServer(t, func(channel ssh.Channel, command string) {
+		if command == "hang" {
+			io.Copy(ioutil.Discard, channel)
+			close(aborted)
+			return
+		}
+		channel.Write([]byte("winhost"))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		channel.Close()
+	})
+	client, err := dialSSH(address, nil, &ssh.ClientConfig{User: "core",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey()}, time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+	c := &sshConnectivity{sshClient: client, sessions: make(chan struct{}, DefaultSSHSessionLimit),
+		commandTimeout: 200 * time.Millisecond, log: logr.Discard()}
+
+	out, err := c.run("hostname")
+	require.NoError(t, err)
+	assert.Equal(t, "winhost", out)
+
+	start := time.Now()
+	_, err = c.run("hang")
+	require.Error(t, err)
+	var timeoutErr *CommandTimeoutErr
+	require.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, "command did not complete within 200ms", err.Error())
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session of the command was not closed")
+	}
+
+	// The connection is still usable, and the session slot of the aborted command has been released
+	for i := 0; i < DefaultSSHSessionLimit+1; i++ {
+		out, err = c.run("hostname")
+		require.NoError(t, err)
+		assert.Equal(t, "winhost", out)
+	}
+}
+
+// TestSessionLimit tests that no more than the session limit of SSH sessions to a VM are in use at once, while
+// commands beyond the limit wait for a session instead of failing
+func TestSessionLimit(t *testing.T) {
+	const sessionLimit = 3
+	// active and peak count the commands in progress on the server, and the most which were in progress at once
+	var active, peak int32
+	address := startSSHServer(t, func(channel ssh.Channel, command string) {
+		current := atomic.AddInt32(&active, 1)
+		for {
+			highest := atomic.LoadInt32(&peak)
+			if current <= highest || atomic.CompareAndSwapInt32(&peak, highest, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		channel.Write([]byte(command))
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+		channel.Close()
+	})
+	client, err := dialSSH(address, nil, &ssh.ClientConfig{User: "core",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey()}, time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+	c := &sshConnectivity{sshClient: client, sessions: make(chan struct{}, sessionLimit),
+		commandTimeout: 5 * time.Second, log: logr.Discard()}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*sessionLimit)
+	for i := 0; i < 4*sessionLimit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			out, err := c.run("hostname")
+			if err == nil && out != "hostname" {
+				err = errors.Errorf("unexpected output %q", out)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.LessOrEqual(t, atomic.LoadInt32(&peak), int32(sessionLimit))
+	// The commands are run concurrently up to the limit
+	assert.Greater(t, atomic.LoadInt32(&peak), int32(1))
+	assert.Empty(t, c.sessions)
+}
@@ -1,20 +1,27 @@
 package windows
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/yaml"
 	ctrl "sigs.k8s.io/controller-runtime"
 
 	"github.com/openshift/windows-machine-config-operator/pkg/instances"
 	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig/payload"
 	"github.com/openshift/windows-machine-config-operator/pkg/retry"
+	"github.com/openshift/windows-machine-config-operator/pkg/tracing"
 )
 
 const (
@@ -44,6 +51,15 @@ const (
 	kubeProxyPath = k8sDir + "kube-proxy.exe"
 	// hybridOverlayPath is the location of the hybrid-overlay-node exe
 	hybridOverlayPath = k8sDir + "hybrid-overlay-node.exe"
+	// kubeletConfigFile is the name of the kubelet configuration file generated by WMCB
+	kubeletConfigFile = "kubelet.conf"
+	// kubeletConfigPath is the location of the kubelet configuration file
+	kubeletConfigPath = k8sDir + kubeletConfigFile
+	// bootstrapKubeconfigFile is the name of the file the bootstrap kubeconfig of the instance is copied to
+	bootstrapKubeconfigFile = "bootstrap-kubeconfig"
+	// ignitionKubeconfigPath is the path of the kubeconfig file within the worker ignition, which WMCB bootstraps the
+	// kubelet with
+	ignitionKubeconfigPath = "/etc/kubernetes/kubeconfig"
 
 	// hybridOverlayServiceName is the name of the hybrid-overlay-node Windows service
 	hybridOverlayServiceName = "hybrid-overlay-node"
@@ -69,6 +85,8 @@ const (
 	remotePowerShellCmdPrefix = "powershell.exe -NonInteractive -ExecutionPolicy Bypass "
 	// serviceQueryCmd is the Windows command used to query a service
 	serviceQueryCmd = "sc.exe qc "
+	// authorizedKeysPath is the location of the file holding the authorized SSH keys for administrator users
+	authorizedKeysPath = "$env:ProgramData\\ssh\\administrators_authorized_keys"
 	// serviceNotFound is part of the error message returned when a service does not exist. 1060 is an error code
 	// representing ERROR_SERVICE_DOES_NOT_EXIST
 	// referenced: https://docs.microsoft.com/en-us/windows/win32/debug/system-error-codes--1000-1299-
@@ -78,6 +96,8 @@ const (
 var (
 	// filesToTransfer is a map of what files should be copied to the Windows VM and where they should be copied to
 	filesToTransfer map[*payload.FileInfo]string
+	// filesToTransferLock synchronizes the population of filesToTransfer, as instances can be configured concurrently
+	filesToTransferLock sync.Mutex
 	// RequiredServices is a list of Windows services installed by WMCO
 	// The order of this slice matters due to service dependencies. If a service depends on another service, the
 	// dependent service should be placed before the service it depends on.
@@ -99,6 +119,8 @@ var (
 
 // getFilesToTransfer returns the properly populated filesToTransfer map
 func getFilesToTransfer() (map[*payload.FileInfo]string, error) {
+	filesToTransferLock.Lock()
+	defer filesToTransferLock.Unlock()
 	if filesToTransfer != nil {
 		return filesToTransfer, nil
 	}
@@ -144,8 +166,9 @@ type Windows interface {
 	Run(string, bool) (string, error)
 	// Reinitialize re-initializes the Windows VM's SSH client
 	Reinitialize() error
-	// Configure prepares the Windows VM for the bootstrapper and then runs it
-	Configure() error
+	// Configure prepares the Windows VM for the bootstrapper and then runs it. The spans of the configuration steps are
+	// started as children of the span of the given context.
+	Configure(context.Context) error
 	// ConfigureCNI ensures that the CNI configuration in done on the node
 	ConfigureCNI(string) error
 	// ConfigureHybridOverlay ensures that the hybrid overlay is running on the node
@@ -158,6 +181,12 @@ type Windows interface {
 	EnsureRequiredServicesStopped() error
 	// Deconfigure removes all files and services created as part of the configuration process
 	Deconfigure() error
+	// AuthorizeKey ensures the given public key is an authorized SSH key on the Windows VM
+	AuthorizeKey(ssh.PublicKey) error
+	// UnauthorizeKey ensures the given public key is not an authorized SSH key on the Windows VM
+	UnauthorizeKey(ssh.PublicKey) error
+	// GetOSVersion returns the version of the operating system of the Windows VM, for example 10.0.17763
+	GetOSVersion() (string, error)
 }
 
 // windows implements the Windows interface
@@ -175,7 +204,16 @@ type windows struct {
 	vxlanPort string
 	// if hostName is set, the hostname of the VM will be set to its value when the VM is being configured.
 	hostName string
-	log      logr.Logger
+	// kubeletConfig holds the kubelet settings to be applied on top of the configuration generated by WMCB
+	kubeletConfig instances.KubeletConfig
+	// dnsSearchDomains are the DNS search domains to be set on the VM
+	dnsSearchDomains []string
+	// bootstrapKubeconfig is the kubeconfig to bootstrap the kubelet with, instead of the one in the worker ignition
+	bootstrapKubeconfig []byte
+	// sessionLimit is the maximum number of concurrent SSH sessions to the VM, which bounds the number of files
+	// transferred at a time. DefaultSSHSessionLimit is used if it is not positive.
+	sessionLimit int
+	log          logr.Logger
 }
 
 // New returns a new Windows instance constructed from the given WindowsVM
@@ -186,7 +224,9 @@ func New(workerIgnitionEndpoint, vxlanPort string, instance *instances.InstanceI
 
 	log := ctrl.Log.WithName(fmt.Sprintf("VM %s", instance.Address))
 	log.V(1).Info("initializing SSH connection", "user", instance.Username)
-	conn, err := newSshConnectivity(instance.Username, instance.Address, signer, log)
+	conn, err := newSshConnectivity(instance.Username, instance.Address, instance.SSHPort, signer, instance.Password,
+		instance.SSHSessionLimit, instance.SSHDialTimeout, instance.SSHCommandTimeout, instance.SSHProxy,
+		instance.Bastion, log)
 	if err != nil {
 		return nil, errors.Wrapf(err, "unable to setup VM %s sshConnectivity", instance.Address)
 	}
@@ -197,6 +237,10 @@ func New(workerIgnitionEndpoint, vxlanPort string, instance *instances.InstanceI
 			workerIgnitionEndpoint: workerIgnitionEndpoint,
 			vxlanPort:              vxlanPort,
 			hostName:               instance.NewHostname,
+			kubeletConfig:          instance.KubeletConfig,
+			dnsSearchDomains:       instance.DNSSearchDomains,
+			bootstrapKubeconfig:    instance.BootstrapKubeconfig,
+			sessionLimit:           instance.SSHSessionLimit,
 			log:                    log,
 		},
 		nil
@@ -261,7 +305,7 @@ func (vm *windows) Run(cmd string, psCmd bool) (string, error) {
 
 func (vm *windows) Reinitialize() error {
 	if err := vm.interact.init(); err != nil {
-		return fmt.Errorf("failed to reinitialize ssh client: %v", err)
+		return errors.Wrap(err, "failed to reinitialize ssh client")
 	}
 	return nil
 }
@@ -311,7 +355,7 @@ func (vm *windows) Deconfigure() error {
 	return nil
 }
 
-func (vm *windows) Configure() error {
+func (vm *windows) Configure(ctx context.Context) error {
 	vm.log.Info("configuring")
 	if err := vm.EnsureRequiredServicesStopped(); err != nil {
 		return errors.Wrap(err, "unable to stop required services")
@@ -322,17 +366,39 @@ func (vm *windows) Configure() error {
 			return err
 		}
 	}
-	if err := vm.createDirectories(); err != nil {
-		return errors.Wrap(err, "error creating directories on Windows VM")
-	}
-	if err := vm.transferFiles(); err != nil {
-		return errors.Wrap(err, "error transferring files to Windows VM")
+	if err := vm.transferPayload(ctx); err != nil {
+		return err
 	}
 	if err := vm.ConfigureWindowsExporter(); err != nil {
 		return errors.Wrapf(err, "error configuring Windows exporter")
 	}
+	if err := vm.configureDNSSearchDomains(); err != nil {
+		return err
+	}
 
-	return vm.runBootstrapper()
+	return vm.bootstrapKubelet(ctx)
+}
+
+// transferPayload creates the directories used by the configuration on the Windows VM, and transfers the payload files
+// to it, within a span started as a child of the span of the given context
+func (vm *windows) transferPayload(ctx context.Context) (err error) {
+	_, span := tracing.StartSpan(ctx, "TransferFiles", tracing.Address(vm.address))
+	defer func() { tracing.EndSpan(span, err) }()
+	if err := vm.createDirectories(); err != nil {
+		return errors.Wrap(err, "error creating directories on Windows VM")
+	}
+	return errors.Wrap(vm.transferFiles(), "error transferring files to Windows VM")
+}
+
+// bootstrapKubelet runs the bootstrapper and configures the kubelet it installed, within a span started as a child of
+// the span of the given context
+func (vm *windows) bootstrapKubelet(ctx context.Context) (err error) {
+	_, span := tracing.StartSpan(ctx, "ConfigureKubelet", tracing.Address(vm.address))
+	defer func() { tracing.EndSpan(span, err) }()
+	if err := vm.runBootstrapper(); err != nil {
+		return err
+	}
+	return vm.configureKubelet()
 }
 
 // ConfigureWindowsExporter starts Windows metrics exporter service, only if the file is present on the VM
@@ -441,6 +507,34 @@ func (vm *windows) ConfigureKubeProxy(nodeName, hostSubnet string) error {
 	return nil
 }
 
+func (vm *windows) AuthorizeKey(key ssh.PublicKey) error {
+	authorizedKey := authorizedKeyEntry(key)
+	cmd := "\"if (-not (Select-String -Path " + authorizedKeysPath + " -SimpleMatch '" + authorizedKey + "' -Quiet)) " +
+		"{ Add-Content -Path " + authorizedKeysPath + " -Value '" + authorizedKey + "' -Encoding ascii }\""
+	if _, err := vm.Run(cmd, true); err != nil {
+		return errors.Wrap(err, "unable to add authorized key")
+	}
+	return nil
+}
+
+func (vm *windows) UnauthorizeKey(key ssh.PublicKey) error {
+	authorizedKey := authorizedKeyEntry(key)
+	cmd := "\"$keys = @(Get-Content -Path " + authorizedKeysPath + " | Where-Object { -not $_.StartsWith('" +
+		authorizedKey + "') }); Set-Content -Path " + authorizedKeysPath + " -Value $keys -Encoding ascii\""
+	if _, err := vm.Run(cmd, true); err != nil {
+		return errors.Wrap(err, "unable to remove authorized key")
+	}
+	return nil
+}
+
+func (vm *windows) GetOSVersion() (string, error) {
+	out, err := vm.Run("\"(Get-CimInstance Win32_OperatingSystem).Version\"", true)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to get operating system version")
+	}
+	return strings.TrimSpace(out), nil
+}
+
 // Interface helper methods
 
 // ensureHostName ensures hostname of the Windows VM matches the expected name
@@ -457,6 +551,21 @@ func (vm *windows) ensureHostName() error {
 	return nil
 }
 
+// configureDNSSearchDomains sets the DNS suffix search list of the Windows VM to the configured DNS search domains. The
+// kubelet appends this list to the cluster search domains in the DNS configuration of pods. The existing list is left
+// untouched if no search domains are configured.
+func (vm *windows) configureDNSSearchDomains() error {
+	if len(vm.dnsSearchDomains) == 0 {
+		return nil
+	}
+	cmd := "Set-DnsClientGlobalSetting -SuffixSearchList @('" + strings.Join(vm.dnsSearchDomains, "','") + "')"
+	if out, err := vm.Run(cmd, true); err != nil {
+		return errors.Wrapf(err, "unable to set DNS search domains, with output %s", out)
+	}
+	vm.log.Info("configured DNS search domains", "domains", vm.dnsSearchDomains)
+	return nil
+}
+
 // isHostNameChangeNeeded tells if we need to update the host name of the Windows VM
 func (vm *windows) isHostNameChangeNeeded() (bool, error) {
 	out, err := vm.Run("hostname", true)
@@ -508,12 +617,57 @@ func (vm *windows) transferFiles() error {
 	if err != nil {
 		return errors.Wrapf(err, "error getting list of files to transfer")
 	}
-	for src, dest := range filesToTransfer {
-		if err := vm.EnsureFile(src, dest); err != nil {
-			return errors.Wrapf(err, "error copying %s to %s ", src.Path, dest)
+	return vm.ensureFiles(filesToTransfer)
+}
+
+// ensureFiles copies the given files to the VM in parallel, keyed by the remote directory each is copied to, with as
+// many files transferred at a time as the VM allows concurrent SSH sessions. Once a transfer fails, the files which
+// are not being transferred yet are skipped, and the error of the first failed transfer is returned.
+func (vm *windows) ensureFiles(files map[*payload.FileInfo]string) error {
+	workers := vm.sessionLimit
+	if workers <= 0 {
+		workers = DefaultSSHSessionLimit
+	}
+	type transfer struct {
+		src  *payload.FileInfo
+		dest string
+	}
+	transfers := make(chan transfer)
+	// failed is closed once a transfer fails, firstErr holding its error
+	failed := make(chan struct{})
+	var firstErr error
+	var failOnce sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range transfers {
+				select {
+				case <-failed:
+					continue
+				default:
+				}
+				if err := vm.EnsureFile(t.src, t.dest); err != nil {
+					failOnce.Do(func() {
+						firstErr = errors.Wrapf(err, "error copying %s to %s ", t.src.Path, t.dest)
+						close(failed)
+					})
+				}
+			}
+		}()
+	}
+queue:
+	for src, dest := range files {
+		select {
+		case transfers <- transfer{src: src, dest: dest}:
+		case <-failed:
+			break queue
 		}
 	}
-	return nil
+	close(transfers)
+	wg.Wait()
+	return firstErr
 }
 
 // runBootstrapper copies the bootstrapper and runs the code on the remote Windows VM
@@ -533,6 +687,64 @@ func (vm *windows) runBootstrapper() error {
 	return nil
 }
 
+// configureKubelet applies the kubelet settings managed by WMCO on top of the kubelet configuration file generated by
+// WMCB, and restarts the kubelet so that they take effect. This is a no-op if there are no settings to apply.
+func (vm *windows) configureKubelet() error {
+	overrides := vm.kubeletConfig.Overrides()
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	out, err := vm.Run("Get-Content -Raw "+kubeletConfigPath, true)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read %s", kubeletConfigPath)
+	}
+	// The kubelet accepts both YAML and JSON configuration files, so the updated configuration is written as JSON
+	kubeletConfigJSON, err := yaml.ToJSON([]byte(out))
+	if err != nil {
+		return errors.Wrapf(err, "unable to parse %s", kubeletConfigPath)
+	}
+	kubeletConfig := make(map[string]interface{})
+	if err := json.Unmarshal(kubeletConfigJSON, &kubeletConfig); err != nil {
+		return errors.Wrapf(err, "unable to parse %s", kubeletConfigPath)
+	}
+	for field, value := range overrides {
+		gates, isFeatureGates := value.(map[string]bool)
+		if !isFeatureGates {
+			kubeletConfig[field] = value
+			continue
+		}
+		// Feature gates are added to the ones already present, so that the gates set by WMCB are kept
+		existingGates, ok := kubeletConfig[field].(map[string]interface{})
+		if !ok {
+			existingGates = make(map[string]interface{})
+		}
+		for name, enabled := range gates {
+			existingGates[name] = enabled
+		}
+		kubeletConfig[field] = existingGates
+	}
+	kubeletConfigData, err := json.Marshal(kubeletConfig)
+	if err != nil {
+		return errors.Wrap(err, "unable to marshal kubelet configuration")
+	}
+
+	if err := vm.transferData(kubeletConfigData, kubeletConfigFile, k8sDir); err != nil {
+		return errors.Wrap(err, "unable to transfer kubelet configuration")
+	}
+
+	// Restart the kubelet to pick up the updated configuration
+	kubeletService := &service{name: kubeletServiceName}
+	if err := vm.ensureServiceNotRunning(kubeletService); err != nil {
+		return errors.Wrapf(err, "unable to stop %s Windows service", kubeletServiceName)
+	}
+	if err := vm.startService(kubeletService); err != nil {
+		return errors.Wrapf(err, "unable to start %s Windows service", kubeletServiceName)
+	}
+	vm.log.Info("configured kubelet", "settings", overrides)
+	return nil
+}
+
 // initializeTestBootstrapperFiles initializes the files required for initialize-kubelet
 func (vm *windows) initializeBootstrapperFiles() error {
 	// Ignition v2.3.0 maps to Ignition config spec v3.1.0.
@@ -544,6 +756,52 @@ func (vm *windows) initializeBootstrapperFiles() error {
 	if err != nil {
 		return errors.Wrap(err, "unable to download worker.ign")
 	}
+	if len(vm.bootstrapKubeconfig) != 0 {
+		return vm.setBootstrapKubeconfig()
+	}
+	return nil
+}
+
+// setBootstrapKubeconfig replaces the kubeconfig within the downloaded worker ignition with the bootstrap kubeconfig
+// of the instance, so that WMCB bootstraps the kubelet with it
+func (vm *windows) setBootstrapKubeconfig() error {
+	if err := vm.transferData(vm.bootstrapKubeconfig, bootstrapKubeconfigFile, winTemp); err != nil {
+		return errors.Wrap(err, "unable to transfer bootstrap kubeconfig")
+	}
+	kubeconfigPath := winTemp + bootstrapKubeconfigFile
+	ignitionPath := winTemp + "worker.ign"
+	cmd := "\"$ign = Get-Content -Raw " + ignitionPath + " | ConvertFrom-Json; " +
+		"$file = $ign.storage.files | Where-Object { $_.path -eq '" + ignitionKubeconfigPath + "' }; " +
+		"if (-not $file) { exit 1 }; " +
+		"$file.contents.source = 'data:;base64,' + [Convert]::ToBase64String([IO.File]::ReadAllBytes('" +
+		kubeconfigPath + "')); " +
+		"$ign | ConvertTo-Json -Depth 100 -Compress | Set-Content -Path " + ignitionPath + " -Encoding ascii; " +
+		"Remove-Item " + kubeconfigPath + "\""
+	if out, err := vm.Run(cmd, true); err != nil {
+		return errors.Wrapf(err, "unable to set bootstrap kubeconfig in worker ignition, with output %s", out)
+	}
+	return nil
+}
+
+// transferData writes the given data to a local temp file with the given name, and copies it to the given directory
+// on the VM
+func (vm *windows) transferData(data []byte, fileName, remoteDir string) error {
+	tmpDir, err := ioutil.TempDir("", "wmco")
+	if err != nil {
+		return errors.Wrap(err, "error creating local temp directory")
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpDir); err != nil {
+			vm.log.Error(err, "error deleting local temp directory", "dir", tmpDir)
+		}
+	}()
+	tmpPath := filepath.Join(tmpDir, fileName)
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrapf(err, "error writing %s", tmpPath)
+	}
+	if err := vm.interact.transfer(tmpPath, remoteDir); err != nil {
+		return errors.Wrapf(err, "unable to transfer %s to %s", fileName, remoteDir)
+	}
 	return nil
 }
 
@@ -781,6 +1039,11 @@ func (vm *windows) newFileInfo(path string) (*payload.FileInfo, error) {
 
 // Generic helper methods
 
+// authorizedKeyEntry returns the given public key in the format used by the authorized keys file
+func authorizedKeyEntry(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
 // mkdirCmd returns the Windows command to create a directory if it does not exists
 func mkdirCmd(dirName string) string {
 	return "if not exist " + dirName + " mkdir " + dirName
@@ -0,0 +1,87 @@
+package windows
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openshift/windows-machine-config-operator/pkg/nodeconfig/payload"
+)
+
+// transferRecorder is a connectivity on which no file exists, which records the files transferred through it. The
+// transfer of the file named failing fails immediately, while the other transfers take some time.
+type transferRecorder struct {
+	failing string
+	lock    sync.Mutex
+	// failed is set once the transfer of the failing file has failed
+	failed bool
+	// active and peak count the transfers in progress, and the most which were in progress at once
+	active, peak int
+	// started are the files whose transfer was started, and startedAfterFailure the ones started after failed is set
+	started, startedAfterFailure []string
+}
+
+func (c *transferRecorder) run(string) (string, error) {
+	return "False", nil
+}
+
+func (c *transferRecorder) transfer(filePath, _ string) error {
+	c.lock.Lock()
+	c.started = append(c.started, filePath)
+	if c.failed {
+		c.startedAfterFailure = append(c.startedAfterFailure, filePath)
+	}
+	if filePath == c.failing {
+		c.failed = true
+		c.lock.Unlock()
+		return errors.New("connection lost")
+	}
+	c.active++
+	if c.active > c.peak {
+		c.peak = c.active
+	}
+	c.lock.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+	c.lock.Lock()
+	c.active--
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *transferRecorder) init() error {
+	return nil
+}
+
+// TestEnsureFiles tests that files are transferred in parallel up to the session limit, and that once a transfer
+// fails no further transfer is started and the error of the failed transfer is returned
+func TestEnsureFiles(t *testing.T) {
+	const sessionLimit = 2
+	files := make(map[*payload.FileInfo]string)
+	for i := 0; i < 10; i++ {
+		files[&payload.FileInfo{Path: fmt.Sprintf("/payload/file-%d", i)}] = k8sDir
+	}
+
+	c := &transferRecorder{}
+	vm := &windows{interact: c, sessionLimit: sessionLimit, log: logr.Discard()}
+	require.NoError(t, vm.ensureFiles(files))
+	assert.Len(t, c.started, len(files))
+	assert.Equal(t, sessionLimit, c.peak)
+
+	c = &transferRecorder{failing: "/payload/file-3"}
+	vm = &windows{interact: c, sessionLimit: sessionLimit, log: logr.Discard()}
+	err := vm.ensureFiles(files)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "error copying /payload/file-3 to "+k8sDir), err.Error())
+	assert.Contains(t, err.Error(), "connection lost")
+	assert.Contains(t, c.started, "/payload/file-3")
+	assert.Empty(t, c.startedAfterFailure)
+	assert.LessOrEqual(t, c.peak, sessionLimit)
+}